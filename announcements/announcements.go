@@ -0,0 +1,130 @@
+package announcements
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/streams"
+	"github.com/PonyFest/music-control/tts"
+)
+
+// maxTextLength keeps announcements to something a person would want to listen to.
+const maxTextLength = 2000
+
+// defaultTTL is how long an announcement can sit in a queue before it's too stale to bother playing.
+const defaultTTL = time.Hour
+
+// Store keeps synthesized audio somewhere players can fetch it; songs.MusicHandler is one.
+type Store interface {
+	StoreInterstitial(audio []byte, contentType, title string, ttl time.Duration) (string, error)
+}
+
+// Queue is where announcements get played; streams.Handler is one.
+type Queue interface {
+	QueueFirst(stream, trackId string) error
+	RequestSkip(stream string) error
+}
+
+// Handler turns text into speech and puts it at the front of streams' queues.
+type Handler struct {
+	redis *redis.Client
+	tts   tts.Synthesizer
+	store Store
+	queue Queue
+}
+
+func New(redis *redis.Client, synthesizer tts.Synthesizer, store Store, queue Queue) *Handler {
+	return &Handler{
+		redis: redis,
+		tts:   synthesizer,
+		store: store,
+		queue: queue,
+	}
+}
+
+// ServeHTTP takes a POST with `text` to announce, `streams` as a comma separated list of streams to announce it on
+// (every stream we know of if empty), optionally `ttl` (how long it's worth playing for, as a Go duration), and
+// optionally `interrupt`, which skips whatever's playing instead of waiting for it to end.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "announcements can only be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	text := strings.TrimSpace(r.FormValue("text"))
+	if text == "" {
+		http.Error(w, "there's no text to announce", http.StatusBadRequest)
+		return
+	}
+	if len(text) > maxTextLength {
+		http.Error(w, fmt.Sprintf("announcements can be at most %d bytes", maxTextLength), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultTTL
+	if t := r.FormValue("ttl"); t != "" {
+		var err error
+		if ttl, err = time.ParseDuration(t); err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl %q", t), http.StatusBadRequest)
+			return
+		}
+	}
+	interrupt := false
+	if i := r.FormValue("interrupt"); i != "" {
+		var err error
+		if interrupt, err = strconv.ParseBool(i); err != nil {
+			http.Error(w, fmt.Sprintf("invalid interrupt flag %q", i), http.StatusBadRequest)
+			return
+		}
+	}
+	var targets []string
+	for _, stream := range strings.Split(r.FormValue("streams"), ",") {
+		if stream = strings.TrimSpace(stream); stream != "" {
+			targets = append(targets, stream)
+		}
+	}
+	if len(targets) == 0 {
+		var err error
+		if targets, err = h.redis.SMembers(streams.StreamsKey).Result(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to list streams: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	audio, contentType, err := h.tts.Synthesize(text)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("speech synthesis failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	trackId, err := h.store.StoreInterstitial(audio, contentType, text, ttl)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("storing the announcement failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// One stream failing shouldn't stop everyone else hearing it.
+	queued := []string{}
+	failed := map[string]string{}
+	for _, stream := range targets {
+		if err := h.queue.QueueFirst(stream, trackId); err != nil {
+			failed[stream] = err.Error()
+			continue
+		}
+		queued = append(queued, stream)
+		if interrupt {
+			if err := h.queue.RequestSkip(stream); err != nil {
+				log.Printf("Failed to interrupt %q for an announcement: %v.\n", stream, err)
+			}
+		}
+	}
+	log.Printf("Queued announcement %s on %d streams\n", trackId, len(queued))
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "trackId": trackId, "streams": queued, "failed": failed}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,44 @@
+// Package apierror is how the API reports errors that clients might want to act on: a standard HTTP status, with a
+// JSON body carrying a machine-readable code alongside the usual human-readable message:
+//
+//	{"status": "error", "code": "unknown_track", "error": "no such track \"abc\""}
+//
+// Each code always comes with the same status, so clients can go by either. Codes are only ever added; one that
+// has been documented here keeps its meaning.
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type Code string
+
+const (
+	// NoEligibleTracks (503) means a stream has nothing it's allowed to play: up next is empty, and no track in its
+	// pool or playlist passes its filters. It'll go away once there's music, so it's worth trying again later.
+	NoEligibleTracks Code = "no_eligible_tracks"
+	// UnknownTrack (404) means a request named a track that doesn't exist, whether in the path or a parameter.
+	UnknownTrack Code = "unknown_track"
+)
+
+var statuses = map[Code]int{
+	NoEligibleTracks: http.StatusServiceUnavailable,
+	UnknownTrack:     http.StatusNotFound,
+}
+
+// Status is the HTTP status that goes with code.
+func Status(code Code) int {
+	if status, ok := statuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Write responds with the error code, and message for people.
+func Write(w http.ResponseWriter, code Code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(Status(code))
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "code": code, "error": message})
+}
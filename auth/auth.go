@@ -1,29 +1,141 @@
 package auth
 
 import (
+	"context"
 	"crypto/subtle"
 	"net/http"
+	"strings"
+	"sync"
 )
 
+// RoleAdmin can do anything. Every other role is a name we made up for a more limited password, which only gets to
+// watch events.
+const RoleAdmin = "admin"
+
+// Credential is a password, and who you are if you know it.
+type Credential struct {
+	Password string
+	Role     string
+}
+
+type roleKey struct{}
+
+// Keyring is a set of credentials that can be changed while requests are being checked against it, so passwords
+// can be changed without a restart.
+type Keyring struct {
+	mu          sync.RWMutex
+	credentials []Credential
+}
+
+func NewKeyring(credentials ...Credential) *Keyring {
+	return &Keyring{credentials: credentials}
+}
+
+// Set replaces everything in the keyring.
+func (k *Keyring) Set(credentials ...Credential) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.credentials = credentials
+}
+
+func (k *Keyring) get() []Credential {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.credentials
+}
+
 type authedHandler struct {
-	password string
-	realm    string
-	handler  http.Handler
+	keyring *Keyring
+	realm   string
+	handler http.Handler
+	// open is whether an empty keyring lets everyone in, as though there were no authentication at all.
+	open bool
 }
 
 func (ah *authedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("password")), []byte(ah.password)) != 1 {
+	credentials := ah.keyring.get()
+	if len(credentials) == 0 && ah.open {
+		ah.handler.ServeHTTP(w, r)
+		return
+	}
+	provided := []byte(r.URL.Query().Get("password"))
+	role := ""
+	// Check all of them, so how long this takes doesn't say which one matched.
+	for _, c := range credentials {
+		if subtle.ConstantTimeCompare(provided, []byte(c.Password)) == 1 && role == "" {
+			role = c.Role
+		}
+	}
+	if role == "" {
 		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 		return
 	}
 
-	ah.handler.ServeHTTP(w, r)
+	ah.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, role)))
 }
 
 func Basic(handler http.Handler, password, realm string) http.Handler {
+	return AnyOf(handler, realm, password)
+}
+
+// AnyOf is like Basic, but accepts any of several passwords.
+func AnyOf(handler http.Handler, realm string, passwords ...string) http.Handler {
+	credentials := make([]Credential, len(passwords))
+	for i, password := range passwords {
+		credentials[i] = Credential{Password: password, Role: RoleAdmin}
+	}
+	return WithRoles(handler, realm, credentials...)
+}
+
+// WithRoles is like AnyOf, but each password can stand for a different role, which handlers can find with RoleOf.
+func WithRoles(handler http.Handler, realm string, credentials ...Credential) http.Handler {
+	return &authedHandler{
+		keyring: NewKeyring(credentials...),
+		realm:   realm,
+		handler: handler,
+	}
+}
+
+// WithKeyring is like WithRoles, but checks whatever is in keyring at the time. An empty keyring lets everyone in,
+// so a password can be added (or taken away) later.
+func WithKeyring(handler http.Handler, realm string, keyring *Keyring) http.Handler {
 	return &authedHandler{
-		password: password,
-		realm:    realm,
-		handler:  handler,
+		keyring: keyring,
+		realm:   realm,
+		handler: handler,
+		open:    true,
 	}
 }
+
+// As returns r as if it had been made by role, for requests we make ourselves on someone else's behalf.
+func As(r *http.Request, role string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), roleKey{}, role))
+}
+
+// RoleOf says who made a request. Requests that never went through any authentication are admins, since that's
+// what they could already do.
+func RoleOf(r *http.Request) string {
+	if role, ok := r.Context().Value(roleKey{}).(string); ok {
+		return role
+	}
+	return RoleAdmin
+}
+
+// AdminOnly turns away anyone who isn't an admin, except on the given paths (and anything under them).
+func AdminOnly(handler http.Handler, except ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RoleOf(r) != RoleAdmin {
+			allowed := false
+			for _, path := range except {
+				if r.URL.Path == path || strings.HasPrefix(r.URL.Path, path+"/") {
+					allowed = true
+				}
+			}
+			if !allowed {
+				http.Error(w, "Forbidden.", http.StatusForbidden)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
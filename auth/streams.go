@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"net/http"
+	"path"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// StreamACL says which streams each operator can control, so someone running the acoustic stage can't skip tracks
+// on the main stage by mistake. Streams can be given as patterns, like "acoustic-*". Admins control everything,
+// and a nil StreamACL doesn't restrict anyone.
+type StreamACL struct {
+	mu      sync.RWMutex
+	streams map[string][]string
+}
+
+func NewStreamACL(streams map[string][]string) *StreamACL {
+	return &StreamACL{streams: streams}
+}
+
+// Set replaces every operator's streams.
+func (a *StreamACL) Set(streams map[string][]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.streams = streams
+}
+
+// CanControl says whether role may change anything about stream.
+func (a *StreamACL) CanControl(role, stream string) bool {
+	if a == nil || role == RoleAdmin {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, pattern := range a.streams[role] {
+		if matched, _ := path.Match(pattern, stream); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap is middleware for a router with {stream} in its routes, which turns away anyone who can't control the stream
+// unless looking says they're only looking. Routes without a stream affect every stream, so only admins get to
+// change anything through them.
+func (a *StreamACL) Wrap(handler http.Handler, looking func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a == nil || looking(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		role := RoleOf(r)
+		stream, ok := mux.Vars(r)["stream"]
+		if (ok && !a.CanControl(role, stream)) || (!ok && role != RoleAdmin) {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,124 @@
+// Package breaker stops us hammering Redis while it's down, and tells clients to come back later rather than
+// failing every request in its own special way.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// ErrOpen is what Redis commands fail with while the breaker is open.
+var ErrOpen = errors.New("redis is unavailable")
+
+// Breaker opens after enough Redis commands in a row fail to reach Redis, and stays open for the cooldown, during
+// which commands fail immediately with ErrOpen. After that, commands are let through again, and the first one to
+// succeed closes it. Commands that reach Redis and get an error back (including redis.Nil) count as successes: Redis
+// is clearly there. Reads that fail are retried by RetryReads first, so a failure here is one that survived those
+// retries.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+
+	cacheMu sync.Mutex
+	cache   map[string]*cachedResponse
+}
+
+func New(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		cache:     map[string]*cachedResponse{},
+	}
+}
+
+// Open says whether we're currently refusing to talk to Redis, and if so, for how much longer.
+func (b *Breaker) Open() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	remaining := time.Until(b.openUntil)
+	return remaining > 0, remaining
+}
+
+func (b *Breaker) record(err error) {
+	if err == ErrOpen {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !unreachable(err) {
+		if b.failures >= b.threshold {
+			log.Println("Redis is back; closing the circuit breaker.")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Printf("Redis has failed %d times in a row (last: %v); opening the circuit breaker.\n", b.failures, err)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// unreachable says whether an error means we couldn't talk to Redis, as opposed to Redis telling us no.
+func unreachable(err error) bool {
+	if err == nil || err == redis.Nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// Errors from Redis itself are things like "ERR ..." and "WRONGTYPE ..."; the client's own start with "redis: ".
+	s := err.Error()
+	return strings.HasPrefix(s, "redis: ") || strings.HasPrefix(s, "LOADING ")
+}
+
+// Hook returns a Redis client hook that feeds the breaker and fails fast while it's open.
+func (b *Breaker) Hook() redis.Hook {
+	return hook{b}
+}
+
+type hook struct {
+	b *Breaker
+}
+
+func (h hook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if open, _ := h.b.Open(); open {
+		return ctx, ErrOpen
+	}
+	return ctx, nil
+}
+
+func (h hook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.b.record(cmd.Err())
+	return nil
+}
+
+func (h hook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if open, _ := h.b.Open(); open {
+		return ctx, ErrOpen
+	}
+	return ctx, nil
+}
+
+func (h hook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	// If we couldn't reach Redis, every command will say so; if we could, the first one's as good as any.
+	if len(cmds) > 0 {
+		h.b.record(cmds[0].Err())
+	}
+	return nil
+}
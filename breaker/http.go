@@ -0,0 +1,120 @@
+package breaker
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/PonyFest/music-control/auth"
+)
+
+// We remember the last good response to GETs so we can keep showing dashboards something while Redis is away.
+const maxCachedBody = 1 << 20
+const maxCachedResponses = 1000
+
+// cachedHeaders are the headers we replay from a cached response. They're the only ones that describe the response
+// itself: anything else, like Content-Encoding or CORS headers, was set by middleware for whoever asked first.
+var cachedHeaders = []string{"Content-Type", "ETag", "Last-Modified"}
+
+type cachedResponse struct {
+	header http.Header
+	body   []byte
+}
+
+// recorder passes everything through to the real ResponseWriter while keeping a copy for the cache, until it turns
+// out not to be worth caching.
+type recorder struct {
+	http.ResponseWriter
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	cacheable bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		h := r.Header()
+		r.header = http.Header{}
+		for _, k := range cachedHeaders {
+			for _, v := range h.Values(k) {
+				r.header.Add(k, v)
+			}
+		}
+		// Event streams never end, and some responses go stale by design, or change things so they can't be repeated.
+		if status != http.StatusOK || strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") || strings.Contains(h.Get("Cache-Control"), "no-store") {
+			r.cacheable = false
+		}
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.cacheable {
+		if r.body.Len()+len(b) > maxCachedBody {
+			r.cacheable = false
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Wrap answers for handler while the breaker is open: GETs get the last good response we saw, marked as stale, and
+// everything else gets a 503 saying when to try again. It has to go inside authentication, or it'll happily show
+// cached responses to anyone.
+func (b *Breaker) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Different roles can see different things.
+		key := auth.RoleOf(r) + " " + r.URL.RequestURI()
+		if open, remaining := b.Open(); open {
+			if r.Method == http.MethodGet {
+				b.cacheMu.Lock()
+				cached := b.cache[key]
+				b.cacheMu.Unlock()
+				if cached != nil {
+					for k, v := range cached.header {
+						w.Header()[k] = append([]string(nil), v...)
+					}
+					w.Header().Set("Warning", `110 - "Response is Stale"`)
+					_, _ = w.Write(cached.body)
+					return
+				}
+			}
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(remaining.Seconds()))))
+			http.Error(w, "the music controller can't reach its database right now; try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != http.MethodGet {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		rec := &recorder{ResponseWriter: w, cacheable: true}
+		handler.ServeHTTP(rec, r)
+		if !rec.cacheable || rec.status == 0 {
+			return
+		}
+		b.cacheMu.Lock()
+		defer b.cacheMu.Unlock()
+		if _, ok := b.cache[key]; !ok && len(b.cache) >= maxCachedResponses {
+			// Map iteration order is random enough to pick something to forget.
+			for k := range b.cache {
+				delete(b.cache, k)
+				break
+			}
+		}
+		b.cache[key] = &cachedResponse{header: rec.header, body: rec.body.Bytes()}
+	})
+}
@@ -0,0 +1,57 @@
+package breaker
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWrapReplaysOnlyResponseHeaders(t *testing.T) {
+	b := New(1, time.Minute)
+	handler := b.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/next" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"1"`)
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/tracks", http.StatusOK},
+		{"/next", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		// Middleware outside the breaker sets headers of its own for whoever asked first.
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+	}
+	b.record(io.EOF)
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("replayed Content-Encoding %q", got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+				t.Errorf("replayed Access-Control-Allow-Origin %q", got)
+			}
+			if got := w.Header().Get("ETag"); got != `"1"` {
+				t.Errorf("got ETag %q, want %q", got, `"1"`)
+			}
+		})
+	}
+}
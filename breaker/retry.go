@@ -0,0 +1,85 @@
+package breaker
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// readOnly are the commands it's safe to send again when we can't tell whether the first attempt reached Redis.
+// Anything that writes isn't: a retried LPOP loses a track, and a retried RPUSH or XADD duplicates one.
+var readOnly = map[string]bool{
+	"exists":           true,
+	"get":              true,
+	"getrange":         true,
+	"hexists":          true,
+	"hget":             true,
+	"hgetall":          true,
+	"hkeys":            true,
+	"hlen":             true,
+	"hmget":            true,
+	"hscan":            true,
+	"hvals":            true,
+	"keys":             true,
+	"lindex":           true,
+	"llen":             true,
+	"lrange":           true,
+	"mget":             true,
+	"ping":             true,
+	"pttl":             true,
+	"scan":             true,
+	"scard":            true,
+	"sismember":        true,
+	"smembers":         true,
+	"srandmember":      true,
+	"sscan":            true,
+	"strlen":           true,
+	"ttl":              true,
+	"type":             true,
+	"xlen":             true,
+	"xrange":           true,
+	"xrevrange":        true,
+	"zcard":            true,
+	"zcount":           true,
+	"zrange":           true,
+	"zrangebyscore":    true,
+	"zrank":            true,
+	"zrevrange":        true,
+	"zrevrangebyscore": true,
+	"zrevrank":         true,
+	"zscan":            true,
+	"zscore":           true,
+}
+
+// RetryReads returns a Redis client hook that sends read-only commands that failed to reach Redis again through
+// reads, which should be a client for the same server that's allowed to retry. The client the hook is added to
+// shouldn't retry anything itself, and should have the hook added before the breaker's, so the breaker only hears
+// about failures that survived the retries. Pipelines aren't retried, since they usually write.
+func RetryReads(reads *redis.Client) redis.Hook {
+	return retryHook{reads}
+}
+
+type retryHook struct {
+	reads *redis.Client
+}
+
+func (h retryHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h retryHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if unreachable(cmd.Err()) && readOnly[strings.ToLower(cmd.Name())] {
+		// This replaces the command's result, error and all.
+		_ = h.reads.ProcessContext(ctx, cmd)
+	}
+	return nil
+}
+
+func (h retryHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h retryHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
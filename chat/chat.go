@@ -0,0 +1,269 @@
+// Package chat lets stream operators talk to each other ("taking over stream 2") and see who else is around,
+// over the same event stream the control UI already listens to.
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/auth"
+	"github.com/PonyFest/music-control/events"
+)
+
+// Channel is the event channel messages and presence go out on. It isn't one of the stream event channels, so
+// only admins (and viewers explicitly given it) can listen.
+const Channel = "ops"
+
+// HistoryKey is a list of JSON-encoded messages, newest first, capped at maxHistory.
+const HistoryKey = "ops-chat"
+
+// PresenceKey is a sorted set of operator names, scored by when we last heard from them, and PresenceStatusKey is
+// a hash of operator name to what they say they're doing.
+const PresenceKey = "ops-presence"
+const PresenceStatusKey = "ops-presence-status"
+
+const maxHistory = 500
+const maxTextLength = 2000
+const maxNameLength = 100
+
+// presenceTimeout is how long an operator counts as present after their last heartbeat. The UI should send one
+// every 30 seconds or so.
+const presenceTimeout = 90 * time.Second
+
+// Message is something an operator said.
+type Message struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name"`
+	Text string    `json:"text"`
+	Sent time.Time `json:"sent"`
+}
+
+// Operator is someone with the control UI open.
+type Operator struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status,omitempty"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type Handler struct {
+	mux           *mux.Router
+	redis         *redis.Client
+	channelPrefix string
+}
+
+// New creates the operator chat API. Events are published on channelPrefix plus Channel.
+func New(redis *redis.Client, channelPrefix string) *Handler {
+	h := &Handler{
+		mux:           mux.NewRouter(),
+		redis:         redis,
+		channelPrefix: channelPrefix,
+	}
+	h.mux.HandleFunc("/", h.handleChat).Methods(http.MethodGet, http.MethodPost)
+	h.mux.HandleFunc("/presence", h.handlePresence).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// name is who's talking: `name` if they gave one, or their role otherwise.
+func name(r *http.Request) (string, error) {
+	n := strings.TrimSpace(r.FormValue("name"))
+	if n == "" {
+		return auth.RoleOf(r), nil
+	}
+	if len(n) > maxNameLength {
+		return "", fmt.Errorf("name must be at most %d characters", maxNameLength)
+	}
+	return n, nil
+}
+
+func (h *Handler) publish(event string, values map[string]interface{}, snapshot bool) {
+	values["event"] = event
+	j, err := json.Marshal(values)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v.\n", event, err)
+		return
+	}
+	channel := h.channelPrefix + Channel
+	if err := events.Publish(h.redis, channel, j); err != nil {
+		log.Printf("Failed to publish %s event: %v.\n", event, err)
+	}
+	if snapshot {
+		if err := events.SetSnapshot(h.redis, channel, event, j); err != nil {
+			log.Printf("Failed to snapshot %s event: %v.\n", event, err)
+		}
+	}
+}
+
+// handleChat lists recent messages (the latest `limit`, 100 by default, oldest first) with who's around on GET,
+// and says `text` on POST.
+func (h *Handler) handleChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		h.handleSay(w, r)
+		return
+	}
+	limit := 100
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxHistory {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxHistory), http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := h.redis.LRange(HistoryKey, 0, int64(limit-1)).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch messages: %v", err), http.StatusInternalServerError)
+		return
+	}
+	messages := make([]Message, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		var m Message
+		if err := json.Unmarshal([]byte(entries[i]), &m); err != nil {
+			log.Printf("Skipping corrupt chat message %q: %v.\n", entries[i], err)
+			continue
+		}
+		messages = append(messages, m)
+	}
+	present, err := h.present()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "messages": messages, "present": present}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) handleSay(w http.ResponseWriter, r *http.Request) {
+	text := strings.TrimSpace(r.FormValue("text"))
+	if text == "" {
+		http.Error(w, "there's nothing to say", http.StatusBadRequest)
+		return
+	}
+	if len(text) > maxTextLength {
+		http.Error(w, fmt.Sprintf("messages can be at most %d bytes", maxTextLength), http.StatusBadRequest)
+		return
+	}
+	n, err := name(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m := Message{ID: uuid.New().String(), Name: n, Text: text, Sent: time.Now().Truncate(time.Millisecond)}
+	j, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	p := h.redis.TxPipeline()
+	p.LPush(HistoryKey, j)
+	p.LTrim(HistoryKey, 0, maxHistory-1)
+	// Saying something counts as being here.
+	p.ZAdd(PresenceKey, &redis.Z{Score: float64(time.Now().Unix()), Member: n})
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to save message: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.publish("chatMessage", map[string]interface{}{"message": m}, false)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "message": m}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// present lists the operators we've heard from recently, forgetting anyone we haven't.
+func (h *Handler) present() ([]Operator, error) {
+	cutoff := time.Now().Add(-presenceTimeout).Unix()
+	gone, err := h.redis.ZRangeByScore(PresenceKey, &redis.ZRangeBy{Min: "-inf", Max: "(" + strconv.FormatInt(cutoff, 10)}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list operators: %v", err)
+	}
+	if len(gone) > 0 {
+		members := make([]interface{}, len(gone))
+		for i, g := range gone {
+			members[i] = g
+		}
+		p := h.redis.TxPipeline()
+		p.ZRem(PresenceKey, members...)
+		p.HDel(PresenceStatusKey, gone...)
+		if _, err := p.Exec(); err != nil {
+			log.Printf("Failed to forget absent operators: %v.\n", err)
+		}
+	}
+	entries, err := h.redis.ZRangeWithScores(PresenceKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list operators: %v", err)
+	}
+	statuses, err := h.redis.HGetAll(PresenceStatusKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch operator statuses: %v", err)
+	}
+	result := make([]Operator, 0, len(entries))
+	for _, e := range entries {
+		n := e.Member.(string)
+		result = append(result, Operator{Name: n, Status: statuses[n], LastSeen: time.Unix(int64(e.Score), 0)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// handlePresence lists who's around on GET. POST is a heartbeat, optionally with a `status` saying what the
+// operator is up to (an empty one clears it); DELETE says they've gone. Everyone watching hears about changes.
+func (h *Handler) handlePresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		n, err := name(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := strings.TrimSpace(r.FormValue("status"))
+		if len(status) > maxTextLength {
+			http.Error(w, fmt.Sprintf("status can be at most %d bytes", maxTextLength), http.StatusBadRequest)
+			return
+		}
+		p := h.redis.TxPipeline()
+		if r.Method == http.MethodDelete {
+			p.ZRem(PresenceKey, n)
+			p.HDel(PresenceStatusKey, n)
+		} else {
+			p.ZAdd(PresenceKey, &redis.Z{Score: float64(time.Now().Unix()), Member: n})
+			if status == "" {
+				p.HDel(PresenceStatusKey, n)
+			} else {
+				p.HSet(PresenceStatusKey, n, status)
+			}
+		}
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to update presence: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	present, err := h.present()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodGet {
+		h.publish("presence", map[string]interface{}{"present": present}, true)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "present": present}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
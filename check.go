@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+
+	"github.com/PonyFest/music-control/breaker"
+	"github.com/PonyFest/music-control/songs"
+	"github.com/PonyFest/music-control/trackurl"
+)
+
+// checkTimeout is how long we give anything we're checking to answer.
+const checkTimeout = 10 * time.Second
+
+// checker runs checks one after another, printing how each went.
+type checker struct {
+	failed bool
+}
+
+func (k *checker) check(name string, f func() error) bool {
+	if err := f(); err != nil {
+		fmt.Printf("FAIL %s: %v\n", name, err)
+		k.failed = true
+		return false
+	}
+	fmt.Printf("ok   %s\n", name)
+	return true
+}
+
+// runChecks tries out everything we'll need once we're running, so a deploy with a bad config or missing
+// permissions fails before it takes over rather than at the first upload. It says whether everything passed.
+// The config itself has already been validated by the time we get here.
+func runChecks(c config) bool {
+	k := &checker{}
+	fmt.Println("ok   config")
+
+	b := breaker.New(c.BreakerThreshold, c.BreakerCooldown)
+	if c.Dev && c.RedisURL == "" {
+		k.check("redis-server", func() error {
+			_, err := exec.LookPath("redis-server")
+			return err
+		})
+	} else {
+		k.check("redis", func() error {
+			client, err := getRedisClient(c, b)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			return client.Ping().Err()
+		})
+		for _, t := range c.Tenants {
+			t := t
+			k.check(fmt.Sprintf("redis for tenant %s (db %d)", t.Name, t.DB), func() error {
+				client, err := getRedisClientForDB(c, t.DB, b)
+				if err != nil {
+					return err
+				}
+				defer client.Close()
+				return client.Ping().Err()
+			})
+		}
+	}
+
+	if c.Dev {
+		k.check("dev directory", func() error {
+			store, err := getStorage(c, nil)
+			if err != nil {
+				return err
+			}
+			key := "check-" + uuid.New().String()
+			if err := store.Put(context.Background(), key, bytes.NewReader([]byte("music-control configuration check\n")), "text/plain"); err != nil {
+				return err
+			}
+			return store.Delete(context.Background(), []string{key})
+		})
+	} else {
+		var s3Client *s3.S3
+		if k.check("s3 session", func() error {
+			var err error
+			s3Client, err = getS3Client()
+			return err
+		}) {
+			checkBucket(k, c, s3Client)
+		}
+	}
+
+	k.check("spool directory", func() error {
+		if err := os.MkdirAll(c.SpoolDir, 0700); err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile(c.SpoolDir, "check-")
+		if err != nil {
+			return err
+		}
+		_ = f.Close()
+		return os.Remove(f.Name())
+	})
+	if c.FFmpeg != "" {
+		k.check("hls ffmpeg", func() error {
+			_, err := exec.LookPath(c.FFmpeg)
+			return err
+		})
+	}
+	if len(c.Mixers) > 0 {
+		k.check("mixer ffmpeg", func() error {
+			_, err := exec.LookPath(c.MixerFFmpeg)
+			return err
+		})
+	}
+
+	if k.failed {
+		fmt.Println("Some checks failed.")
+	} else {
+		fmt.Println("Everything looks good.")
+	}
+	return !k.failed
+}
+
+// checkBucket makes sure we can do everything to the bucket we'll need to, using a scratch object where new
+// uploads would go, and that the object then shows up under the music root.
+func checkBucket(k *checker, c config, s3Client *s3.S3) {
+	body := []byte("music-control configuration check\n")
+	key := songs.KeyFor(c.KeyLayout, "check-"+uuid.New().String(), "text/plain")
+	if !k.check(fmt.Sprintf("s3 put %s", key), func() error {
+		_, err := s3Client.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(c.S3Bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(body),
+			ACL:         aws.String("public-read"),
+			ContentType: aws.String("text/plain"),
+		})
+		return err
+	}) {
+		return
+	}
+	k.check(fmt.Sprintf("s3 get %s", key), func() error {
+		output, err := s3Client.GetObject(&s3.GetObjectInput{Bucket: aws.String(c.S3Bucket), Key: aws.String(key)})
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+		got, err := ioutil.ReadAll(output.Body)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, body) {
+			return fmt.Errorf("got back something other than what we put there")
+		}
+		return nil
+	})
+	k.check("music root", func() error {
+		urls, err := trackurl.New(c.MusicRoot, c.URLSigning)
+		if err != nil {
+			return err
+		}
+		u := urls.URL(key)
+		client := http.Client{Timeout: checkTimeout}
+		resp, err := client.Get(u)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fetching %s got %s", u, resp.Status)
+		}
+		got, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, body) {
+			return fmt.Errorf("%s isn't what we put in the bucket; is --music-root pointing somewhere else?", u)
+		}
+		return nil
+	})
+	k.check(fmt.Sprintf("s3 delete %s", key), func() error {
+		_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(c.S3Bucket), Key: aws.String(key)})
+		return err
+	})
+}
@@ -0,0 +1,194 @@
+// Package cms keeps the now playing on the PonyFest website up to date, by posting each stream's now playing and
+// what's coming up to the website's CMS whenever they change.
+package cms
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/streams"
+)
+
+// claimFormat makes sure only one server posts each version of a stream's now playing.
+const claimFormat = "cms-claim-%s-%s"
+
+// settle is how long we wait after a change for any others that come with it, like a track change and the queue
+// moving up, so the CMS hears about them in one go.
+const settle = 2 * time.Second
+
+// maxAttempts is how many times we try posting before giving up, doubling the wait each time from a second. A newer
+// change to the stream gives up on the old one straight away.
+const maxAttempts = 5
+
+// changes are the events that change what the website shows.
+var changes = map[string]bool{
+	"update":          true,
+	"stateUpdated":    true,
+	"updateUpNext":    true,
+	"metadataUpdated": true,
+	"settingsUpdated": true,
+	"panic":           true,
+	"panicEnded":      true,
+}
+
+// Source is where now playing comes from; streams.Handler is one.
+type Source interface {
+	NowPlaying(stream string) (streams.NowPlaying, error)
+}
+
+// Publisher posts now playing to the CMS. Each post is a streams.NowPlaying as JSON, with an `updated` time.
+type Publisher struct {
+	redis         *redis.Client
+	source        Source
+	channelPrefix string
+	url           string
+	token         string
+	client        *http.Client
+
+	mu          sync.Mutex
+	timers      map[string]*time.Timer
+	generations map[string]int
+}
+
+// New creates a publisher that posts to url with token as its bearer token, hearing about changes on the channels
+// that start with channelPrefix. Call Run to actually post anything.
+func New(redis *redis.Client, source Source, channelPrefix, url, token string) *Publisher {
+	return &Publisher{
+		redis:         redis,
+		source:        source,
+		channelPrefix: channelPrefix,
+		url:           url,
+		token:         token,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		timers:        map[string]*time.Timer{},
+		generations:   map[string]int{},
+	}
+}
+
+// Run posts every stream's now playing once, so the website catches up with anything it missed while we were away,
+// and then again whenever it changes, forever.
+func (p *Publisher) Run() {
+	channelPrefix := p.channelPrefix + "events-"
+	pubsub := p.redis.PSubscribe(channelPrefix + "*")
+	defer pubsub.Close()
+	if all, err := p.redis.SMembers(streams.StreamsKey).Result(); err != nil {
+		log.Printf("Failed to list streams for the CMS: %v.\n", err)
+	} else {
+		for _, stream := range all {
+			p.changed(stream)
+		}
+	}
+	for message := range pubsub.Channel() {
+		var event struct {
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil || !changes[event.Event] {
+			continue
+		}
+		p.changed(strings.TrimPrefix(message.Channel, channelPrefix))
+	}
+}
+
+// changed posts the stream's now playing once things have settled.
+func (p *Publisher) changed(stream string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.generations[stream]++
+	generation := p.generations[stream]
+	if timer, ok := p.timers[stream]; ok {
+		timer.Stop()
+	}
+	p.timers[stream] = time.AfterFunc(settle, func() {
+		p.publish(stream, generation)
+	})
+}
+
+// current says whether generation is still the latest change to stream.
+func (p *Publisher) current(stream string, generation int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.generations[stream] == generation
+}
+
+// publish posts the stream's now playing, unless it's a version that's been posted already. Every server sees the
+// same changes, so whichever claims a version first is the one that posts it.
+func (p *Publisher) publish(stream string, generation int) {
+	np, err := p.source.NowPlaying(stream)
+	if err != nil {
+		log.Printf("Failed to work out now playing on %q for the CMS: %v.\n", stream, err)
+		return
+	}
+	if !p.redis.SetNX(fmt.Sprintf(claimFormat, stream, version(np)), 1, time.Minute).Val() {
+		return
+	}
+	body, err := json.Marshal(struct {
+		streams.NowPlaying
+		Updated time.Time `json:"updated"`
+	}{np, time.Now().UTC()})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	backoff := time.Second
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = p.post(body); err == nil {
+			return
+		}
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if !p.current(stream, generation) {
+			return
+		}
+	}
+	log.Printf("Giving up posting now playing on %q to the CMS after %d attempts: %v.\n", stream, maxAttempts, err)
+}
+
+// version identifies what the website shows for a stream. Start times move about a little with every position
+// update, so they're left out.
+func version(np streams.NowPlaying) string {
+	var cues []streams.Cue
+	if np.Track != nil {
+		cues = append(cues, *np.Track)
+	}
+	cues = append(cues, np.Next...)
+	for i := range cues {
+		cues[i].Start, cues[i].StartClock, cues[i].Offset = time.Time{}, "", ""
+	}
+	np.Track, np.Next = nil, cues
+	j, _ := json.Marshal(np)
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *Publisher) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PonyFest-Music-Control")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package compression
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type compressedHandler struct {
+	handler http.Handler
+}
+
+// compressWriter decides whether to compress when the response headers are written, because only then do we know
+// what the content type is. Event streams are left alone, because compressors buffer and would stall them.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding   string
+	compressor io.WriteCloser
+	decided    bool
+}
+
+func (cw *compressWriter) decide(status int) {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+	h := cw.Header()
+	if status == http.StatusNoContent || status == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		return
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	h.Set("Content-Encoding", cw.encoding)
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+	switch cw.encoding {
+	case "gzip":
+		cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+	case "deflate":
+		// this can only fail for invalid compression levels.
+		cw.compressor, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+	}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	cw.decide(status)
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.decide(http.StatusOK)
+	}
+	if cw.compressor == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.compressor.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if f, ok := cw.compressor.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) close() {
+	if cw.compressor != nil {
+		_ = cw.compressor.Close()
+	}
+}
+
+func (ch *compressedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	encoding := negotiate(r.Header.Get("Accept-Encoding"))
+	if encoding == "" || r.Method == http.MethodHead {
+		ch.handler.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+	defer cw.close()
+	ch.handler.ServeHTTP(cw, r)
+}
+
+// negotiate picks gzip if the client will take it, deflate otherwise, or nothing at all.
+func negotiate(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					ok = false
+				}
+			}
+		}
+		accepted[name] = ok
+	}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if ok, present := accepted[encoding]; (present && ok) || (!present && accepted["*"]) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// Wrap compresses responses for clients that ask for it.
+func Wrap(handler http.Handler) http.Handler {
+	return &compressedHandler{
+		handler: handler,
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/PonyFest/music-control/auth"
+)
+
+// contributor is a password that can only upload tracks, which wait for an admin to approve them before they're
+// played.
+type contributor struct {
+	Name     string
+	Password string
+}
+
+type contributorList []contributor
+
+func (c *contributorList) String() string {
+	names := make([]string, len(*c))
+	for i, contributor := range *c {
+		names[i] = contributor.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (c *contributorList) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("contributors look like name:password, not %q", redactPassword(value))
+	}
+	if parts[0] == auth.RoleAdmin {
+		return fmt.Errorf("%q can't be used as a contributor name", parts[0])
+	}
+	for _, existing := range *c {
+		if existing.Name == parts[0] {
+			return fmt.Errorf("contributor %q is defined twice", parts[0])
+		}
+	}
+	*c = append(*c, contributor{Name: parts[0], Password: parts[1]})
+	return nil
+}
+
+func (c contributorList) has(role string) bool {
+	for _, contributor := range c {
+		if contributor.Name == role {
+			return true
+		}
+	}
+	return false
+}
+
+// allowUploads lets whoever contributors currently returns upload tracks through to handler, and sends every other
+// request to otherwise.
+func allowUploads(contributors func() contributorList, handler, otherwise http.Handler, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == path && contributors().has(auth.RoleOf(r)) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		otherwise.ServeHTTP(w, r)
+	})
+}
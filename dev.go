@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// devMusicPath is where --dev serves the music it stores.
+const devMusicPath = "/dev-music/"
+
+// devMusicRoot is the music root for --dev, which is ourselves. Browsers can't fetch from 0.0.0.0, so we use
+// localhost for that.
+func devMusicRoot(bind string) (string, error) {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return "", fmt.Errorf("invalid --bind %q: %v", bind, err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + devMusicPath, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// startEmbeddedRedis starts a redis inside this process for --embedded, returning its URL. It keeps everything in
+// memory, so nothing survives a restart, and nothing else can share it.
+func startEmbeddedRedis() (string, error) {
+	m, err := miniredis.Run()
+	if err != nil {
+		return "", fmt.Errorf("starting embedded redis failed: %v", err)
+	}
+	url := fmt.Sprintf("redis://%s/0", m.Addr())
+	log.Printf("Started embedded redis at %s; nothing will survive a restart.\n", url)
+	return url, nil
+}
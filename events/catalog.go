@@ -0,0 +1,120 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/PonyFest/music-control/auth"
+)
+
+// EventType is one kind of event that turns up on a channel, with an example of what it looks like.
+type EventType struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Example     json.RawMessage `json:"example"`
+}
+
+// ChannelInfo describes a channel, or a family of them, that clients can subscribe to.
+type ChannelInfo struct {
+	Channel     string      `json:"channel"`
+	Pattern     bool        `json:"pattern"`
+	Description string      `json:"description"`
+	Events      []EventType `json:"events"`
+}
+
+// connectionEvents turn up on every connection, whatever it's subscribed to.
+var connectionEvents = []EventType{
+	{"session", "The first event on every connection, with the token to resume it", json.RawMessage(`{"event":"session","session":"0b5d8f52-7c1a-4a55-9a0e-3f3f6c1c2f4e","resumed":false}`)},
+	{"heartbeat", "Sent every so often, with the server's time and the eventId of the last logged event on each channel", json.RawMessage(`{"event":"heartbeat","serverTime":1700000000000,"lastEventIds":{"events-main":"1700000000000-0"}}`)},
+	{"resync", "Events were lost, so the state should be fetched again", json.RawMessage(`{"event":"resync"}`)},
+}
+
+// Catalog is every channel we publish on. It's written by hand, so anything publishing a new kind of event should
+// add it here too.
+var Catalog = []ChannelInfo{
+	{
+		Channel:     "events",
+		Description: "Changes to the track pool, and alerts that concern more than one stream",
+		Events: append([]EventType{
+			{"poolTrackAdded", "A track joined the pool", json.RawMessage(`{"event":"poolTrackAdded","track":{"trackId":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11","trackUrl":"https://example.com/5f0c8a8e.mp3","title":"Winter Wrap Up","artist":"Ponyville"}}`)},
+			{"trackSubmitted", "A contributor uploaded a track, which is waiting for review", json.RawMessage(`{"event":"trackSubmitted","track":{"trackId":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11","trackUrl":"https://example.com/5f0c8a8e.mp3","title":"Winter Wrap Up","artist":"Ponyville"}}`)},
+			{"submittedTrackUpdated", "Someone commented on a track that's waiting for review", json.RawMessage(`{"event":"submittedTrackUpdated","track":{"trackId":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11","title":"Winter Wrap Up","artist":"Ponyville","commentCount":"1"}}`)},
+			{"poolTrackUpdated", "A track's metadata, audio, rating, license or comments changed", json.RawMessage(`{"event":"poolTrackUpdated","track":{"trackId":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11","title":"Winter Wrap Up","artist":"Ponyville"}}`)},
+			{"trackQuarantined", "A track was pulled from rotation", json.RawMessage(`{"event":"trackQuarantined","trackId":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11"}`)},
+			{"trackReleased", "A track came out of quarantine", json.RawMessage(`{"event":"trackReleased","trackId":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11"}`)},
+			{"panic", "Some streams were stopped in a hurry", json.RawMessage(`{"event":"panic","priority":"high","streams":["main","lobby"]}`)},
+			{"panicEnded", "Streams stopped by a panic were resumed", json.RawMessage(`{"event":"panicEnded","priority":"high","streams":["main","lobby"]}`)},
+			{"streamStalled", "A stream stopped reporting progress, and was asked to skip", json.RawMessage(`{"event":"streamStalled","stream":"main","currentTrack":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11","stalledFor":95}`)},
+		}, connectionEvents...),
+	},
+	{
+		Channel:     "events-<stream>",
+		Pattern:     true,
+		Description: "Everything that happens to one stream; subscribe to events-* for every stream at once",
+		Events: append([]EventType{
+			{"update", "A single field of the stream's state changed", json.RawMessage(`{"event":"update","stream":"main","key":"playing","value":"true"}`)},
+			{"stateUpdated", "Several fields of the stream's state changed at once", json.RawMessage(`{"event":"stateUpdated","stream":"main","changes":{"currentTrack":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11","playing":"true"}}`)},
+			{"updateUpNext", "The queue of requested tracks changed", json.RawMessage(`{"event":"updateUpNext","stream":"main","upNext":["5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11"],"entries":[{"trackId":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11"}]}`)},
+			{"updatePending", "The random picks lined up after the queue changed", json.RawMessage(`{"event":"updatePending","stream":"main","pending":["5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11"]}`)},
+			{"requestSkip", "The player should skip the current track", json.RawMessage(`{"event":"requestSkip","stream":"main"}`)},
+			{"progress", "The player reported how far through the current track it is", json.RawMessage(`{"event":"progress","stream":"main","trackId":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11","position":42.5,"duration":180,"playing":true,"at":1700000000000}`)},
+			{"trackEndingSoon", "The current track is about to end, with the next one if prefetching is on", json.RawMessage(`{"event":"trackEndingSoon","stream":"main","trackId":"5f0c8a8e-2d6b-4b8e-9a57-1f0c6c8d2e11","remaining":10}`)},
+			{"settingsUpdated", "The stream's settings changed", json.RawMessage(`{"event":"settingsUpdated","stream":"main","settings":{"autoplay":true}}`)},
+			{"metadataUpdated", "The stream's display name, description, notes or colour changed", json.RawMessage(`{"event":"metadataUpdated","stream":"main","metadata":{"displayName":"Main Stage"}}`)},
+			{"profileChanged", "The stream switched to another profile", json.RawMessage(`{"event":"profileChanged","stream":"main","profile":"chill"}`)},
+			{"recentCleared", "The stream forgot what it has played recently", json.RawMessage(`{"event":"recentCleared","stream":"main"}`)},
+			{"quietHoursStarted", "The stream's quiet hours began", json.RawMessage(`{"event":"quietHoursStarted","stream":"main","quietHours":"23:00-07:00","timezone":"America/New_York"}`)},
+			{"quietHoursEnded", "The stream's quiet hours ended", json.RawMessage(`{"event":"quietHoursEnded","stream":"main","quietHours":"23:00-07:00","timezone":"America/New_York"}`)},
+			{"scheduledActionRun", "A scheduled action came due, and how it went", json.RawMessage(`{"event":"scheduledActionRun","stream":"main","id":"9a7e1c3e-5b8d-4f0a-8c2e-6d1f3b4a5c6d","key":"playing","value":"false","ok":true}`)},
+			{"streamLocked", "Only admins can change the stream now", json.RawMessage(`{"event":"streamLocked","stream":"main"}`)},
+			{"streamUnlocked", "The stream can be changed by operators again", json.RawMessage(`{"event":"streamUnlocked","stream":"main"}`)},
+			{"panic", "The stream was stopped in a hurry", json.RawMessage(`{"event":"panic","priority":"high","streams":["main"]}`)},
+			{"panicEnded", "The stream was resumed after a panic", json.RawMessage(`{"event":"panicEnded","priority":"high","streams":["main"]}`)},
+		}, connectionEvents...),
+	},
+	{
+		Channel:     "ops",
+		Description: "The operators' chat",
+		Events: append([]EventType{
+			{"chatMessage", "Someone said something", json.RawMessage(`{"event":"chatMessage","message":{"id":"1700000000000-0","name":"admin","text":"Five minutes to the parade","sent":"2024-01-20T18:55:00Z"}}`)},
+			{"presence", "Who is in the chat", json.RawMessage(`{"event":"presence","present":[{"name":"admin","status":"on stage","lastSeen":"2024-01-20T18:55:00Z"}]}`)},
+		}, connectionEvents...),
+	},
+}
+
+// canSubscribe says whether role can subscribe to anything c covers.
+func (h *Handler) canSubscribe(role string, c ChannelInfo) bool {
+	if !c.Pattern {
+		return h.allowed(role, c.Channel)
+	}
+	if role == auth.RoleAdmin {
+		return true
+	}
+	h.accessMu.RLock()
+	defer h.accessMu.RUnlock()
+	prefix := strings.TrimSuffix(c.Channel, "<stream>")
+	for _, pattern := range h.access[role] {
+		if strings.HasPrefix(pattern, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeChannels lists the event channels the caller can subscribe to, with what turns up on each. Upload jobs don't
+// have a channel of their own; their results turn up on the global one.
+func (h *Handler) ServeChannels(w http.ResponseWriter, r *http.Request) {
+	role := auth.RoleOf(r)
+	channels := []ChannelInfo{}
+	for _, c := range Catalog {
+		if h.canSubscribe(role, c) {
+			channels = append(channels, c)
+		}
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "channels": channels}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
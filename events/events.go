@@ -1,29 +1,187 @@
 package events
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+
+	"github.com/PonyFest/music-control/auth"
 )
 
 type Handler struct {
-	redis *redis.Client
+	redis         *redis.Client
+	channelPrefix string
+	registry      *Registry
+	hub           *Hub
+
+	accessMu sync.RWMutex
+	access   map[string][]string
 }
 
-func New(redis *redis.Client) *Handler {
+// New creates an event stream handler. Clients only get to see channels starting with channelPrefix, and don't need
+// to know it's there. Admins can subscribe to any event channel; other roles can only subscribe to the channels
+// (or patterns) access lists for them. Connections are recorded in registry, if there is one, and events come
+// through hub.
+func New(redis *redis.Client, channelPrefix string, access map[string][]string, registry *Registry, hub *Hub) *Handler {
 	return &Handler{
-		redis: redis,
+		redis:         redis,
+		channelPrefix: channelPrefix,
+		access:        access,
+		registry:      registry,
+		hub:           hub,
+	}
+}
+
+// ValidChannel says whether a requested channel is one of ours: either the global events channel, or a stream's
+// events channel, or the pattern covering every stream, or the operators' chat. We don't allow any other patterns,
+// so clients can't use them to reach channels that aren't for them.
+func ValidChannel(channel string) bool {
+	if channel == "events" || channel == "events-*" || channel == "ops" {
+		return true
+	}
+	return strings.HasPrefix(channel, "events-") && len(channel) > len("events-") && !strings.ContainsAny(channel, `*?[]\`)
+}
+
+// SetAccess replaces the access lists, for new subscriptions. Anyone already subscribed stays subscribed.
+func (h *Handler) SetAccess(access map[string][]string) {
+	h.accessMu.Lock()
+	defer h.accessMu.Unlock()
+	h.access = access
+}
+
+// allowed says whether role may subscribe to channel, which must already be valid.
+func (h *Handler) allowed(role, channel string) bool {
+	if role == auth.RoleAdmin {
+		return true
+	}
+	h.accessMu.RLock()
+	defer h.accessMu.RUnlock()
+	for _, pattern := range h.access[role] {
+		if pattern == channel {
+			return true
+		}
+		// A role allowed events-* can still ask for a single stream.
+		if matched, _ := path.Match(pattern, channel); matched && !strings.Contains(channel, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// eventName pulls the event type out of a payload, if it has one.
+func eventName(payload string) string {
+	var event struct {
+		Event string `json:"event"`
+	}
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		return ""
+	}
+	// Anything that would break the SSE framing doesn't get to be a name.
+	if strings.ContainsAny(event.Event, "\r\n") {
+		return ""
+	}
+	return event.Event
+}
+
+// format frames an event for SSE, with an ID if it has one.
+func (h *Handler) format(payload string, named bool, id string) string {
+	output := fmt.Sprintf("data: %s\n\n", payload)
+	if id != "" {
+		output = fmt.Sprintf("id: %s\n", id) + output
+	}
+	if named {
+		if name := eventName(payload); name != "" {
+			output = fmt.Sprintf("event: %s\n", name) + output
+		}
 	}
+	return output
 }
 
+// ServeHTTP streams events from the channels in `channels`, starting with the latest snapshot of each. With
+// `named=true`, each message also gets an `event:` line with its type, so EventSource clients can addEventListener
+// per type. That's opt-in, because onmessage doesn't see named events. Every so often there's a heartbeat event with
+// the server's time and the eventId of the last logged event on each channel; events after the snapshot have SSE
+// IDs of the form channel:number, counting up from one on each channel. A resync event means we lost redis for a while, and
+// clients should fetch the state again; so does one after we drop events for a client that can't keep up.
+//
+// The first event is a session event with a token. Connecting again with `session=<token>` within the hour picks up
+// where the last connection left off, with the same channels, replaying anything logged that it missed instead of
+// sending a snapshot.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	channels := strings.Split(r.FormValue("channels"), ",")
-	pubsub := h.redis.PSubscribe(channels...)
-	defer pubsub.Close()
+	role := auth.RoleOf(r)
+	var resumed *session
+	if token := r.FormValue("session"); token != "" {
+		var err error
+		if resumed, err = h.loadSession(token); err != nil {
+			http.Error(w, fmt.Sprintf("failed to look up session: %v", err), http.StatusInternalServerError)
+			return
+		}
+		// Someone else's session might be subscribed to things we aren't allowed to see.
+		if resumed != nil && resumed.role != role {
+			resumed = nil
+		}
+		if resumed == nil && r.FormValue("channels") == "" {
+			http.Error(w, fmt.Sprintf("session %q has expired", token), http.StatusNotFound)
+			return
+		}
+	}
+	s := resumed
+	if s == nil {
+		named, _ := strconv.ParseBool(r.FormValue("named"))
+		s = &session{
+			token:    uuid.New().String(),
+			role:     role,
+			channels: strings.Split(r.FormValue("channels"), ","),
+			named:    named,
+		}
+	}
+	named := s.named
+	channels := make([]string, len(s.channels))
+	for i, channel := range s.channels {
+		if !ValidChannel(channel) {
+			http.Error(w, fmt.Sprintf("%q isn't an event channel", channel), http.StatusBadRequest)
+			return
+		}
+		if !h.allowed(role, channel) {
+			http.Error(w, fmt.Sprintf("you can't subscribe to %q", channel), http.StatusForbidden)
+			return
+		}
+		channels[i] = h.channelPrefix + channel
+	}
+	if resumed == nil {
+		// Anything after this is news to a new subscriber, even if it comes before the snapshot.
+		var err error
+		if s.lastEventID, err = h.latestLogID(); err != nil {
+			log.Printf("Failed to find the latest event: %v.\n", err)
+		}
+	}
+	subscription := h.hub.subscribe(channels)
+	defer h.hub.unsubscribe(subscription)
+
+	// Players can say who they are with clientId, which makes the connection list a lot more useful.
+	ctx, disconnect := context.WithCancel(r.Context())
+	defer disconnect()
+	connection := &Connection{
+		ClientID:   r.FormValue("clientId"),
+		Prefix:     h.channelPrefix,
+		Role:       role,
+		Channels:   s.channels,
+		RemoteAddr: r.RemoteAddr,
+		Connected:  time.Now(),
+		disconnect: disconnect,
+	}
+	h.registry.add(connection)
+	defer h.registry.remove(connection)
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -31,23 +189,69 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Accel-Buffering", "no")
 
 	_, _ = w.Write([]byte(": hello\n\n"))
+	j, _ := json.Marshal(map[string]interface{}{"event": "session", "session": s.token, "resumed": resumed != nil})
+	_, _ = w.Write([]byte(h.format(string(j), named, "")))
+	ids := newEventIDs(h.channelPrefix)
+	// We're already subscribed, so anything published while we catch up might arrive twice, but never out of order.
+	// Logged events say where they are in the log, so we skip those we've already sent.
+	var replayed []hubEvent
+	caughtUp := false
+	if resumed != nil {
+		var err error
+		if replayed, caughtUp, err = h.replay(channels, s.lastEventID); err != nil {
+			log.Printf("Failed to replay events: %v.\n", err)
+		}
+	}
+	if caughtUp {
+		for _, event := range replayed {
+			id := TaggedID(event.payload)
+			_, _ = w.Write([]byte(h.format(event.payload, named, ids.next(event.channel, id))))
+			s.sent(id)
+		}
+	} else if resumed != nil {
+		// We can't tell it what it missed, so it'll have to start over.
+		_, _ = w.Write([]byte(h.format(resyncEvent, named, "") + h.snapshotSince(s, channels, named)))
+	} else {
+		// Catch the new subscriber up on how things are right now.
+		_, _ = w.Write([]byte(h.snapshotOutput(channels, named)))
+	}
 	w.(http.Flusher).Flush()
+	s.save(h.redis)
+	defer s.save(h.redis)
 
-	const pingTime = 45 * time.Second
-	pingChannel := time.After(pingTime)
+	heartbeatChannel := time.After(heartbeatTime)
 	for {
-		output := ""
+		output, sentID := "", ""
 		select {
-		case message := <-pubsub.Channel():
-			output = fmt.Sprintf("data: %s\n\n", message.Payload)
-		case <-pingChannel:
-			pingChannel = time.After(pingTime)
-			output = ": ping\n\n"
+		case event := <-subscription.events:
+			if event.resync {
+				output = h.format(resyncEvent, named, "") + h.snapshotSince(s, channels, named)
+			} else {
+				id := TaggedID(event.payload)
+				if id != "" && !logIDAfter(id, s.lastEventID) {
+					continue
+				}
+				output, sentID = h.format(event.payload, named, ids.next(event.channel, id)), id
+			}
+			// Once we've caught up on whatever we managed to queue, we can catch up on what we didn't.
+			if len(subscription.events) == 0 && subscription.missed() {
+				output += h.format(resyncEvent, named, "") + h.snapshotSince(s, channels, named)
+			}
+		case <-subscription.done:
+			log.Printf("Disconnecting %s, which can't keep up with its events.\n", r.RemoteAddr)
+			return
+		case <-heartbeatChannel:
+			heartbeatChannel = time.After(heartbeatTime)
+			output = ids.heartbeat(named)
+			s.save(h.redis)
+		case <-ctx.Done():
+			return
 		}
 
 		_, err := w.Write([]byte(output))
 		if err == nil {
 			w.(http.Flusher).Flush()
+			s.sent(sentID)
 		} else {
 			log.Printf("write failed, dropping connection: %v", err)
 			break
@@ -0,0 +1,64 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// heartbeatTime is how often subscribers get a heartbeat, which also keeps proxies from deciding the connection is
+// idle.
+const heartbeatTime = 45 * time.Second
+
+// heartbeat is sent to subscribers every so often. ServerTime lets clients see how far their clock (or the
+// connection) is behind ours, and LastEventIDs is the log ID (the eventId it was published with) of the last logged
+// event sent on each channel, so a client that hasn't seen that one knows it missed something and should fetch the
+// state again rather than trust its own. Log IDs are the same on every connection and every server.
+type heartbeat struct {
+	Event        string            `json:"event"`
+	ServerTime   int64             `json:"serverTime"`
+	LastEventIDs map[string]string `json:"lastEventIds"`
+}
+
+// eventIDs numbers the events sent on each channel of a connection, starting from one after the snapshot. The
+// numbers only mean anything within a connection; a client that reconnects gets the snapshot again anyway. It also
+// keeps the log ID of the last logged event on each channel, for heartbeats.
+type eventIDs struct {
+	prefix string
+	last   map[string]int64
+	logged map[string]string
+}
+
+func newEventIDs(prefix string) *eventIDs {
+	return &eventIDs{prefix: prefix, last: map[string]int64{}, logged: map[string]string{}}
+}
+
+// next assigns an ID to an event that arrived on the (prefixed) channel with the given log ID, if it was logged,
+// returning the SSE ID for it.
+func (e *eventIDs) next(channel, logID string) string {
+	channel = strings.TrimPrefix(channel, e.prefix)
+	e.last[channel]++
+	if logID != "" {
+		e.logged[channel] = logID
+	}
+	return fmt.Sprintf("%s:%d", channel, e.last[channel])
+}
+
+// heartbeat frames a heartbeat event. It's always named, so named clients don't have to listen for it.
+func (e *eventIDs) heartbeat(named bool) string {
+	j, err := json.Marshal(heartbeat{
+		Event:        "heartbeat",
+		ServerTime:   time.Now().UnixNano() / int64(time.Millisecond),
+		LastEventIDs: e.logged,
+	})
+	if err != nil {
+		// Better a bare keepalive than nothing.
+		return ": ping\n\n"
+	}
+	output := fmt.Sprintf("data: %s\n\n", j)
+	if named {
+		output = "event: heartbeat\n" + output
+	}
+	return output
+}
@@ -0,0 +1,202 @@
+package events
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// SlowClientPolicy is what the hub does with a subscriber whose queue is full because it isn't reading its events
+// fast enough.
+type SlowClientPolicy string
+
+const (
+	// DropEvents drops events the subscriber has no room for, then tells it to resync once it catches up.
+	DropEvents SlowClientPolicy = "drop"
+	// Disconnect disconnects the subscriber. EventSource reconnects by itself, and gets a fresh snapshot.
+	Disconnect SlowClientPolicy = "disconnect"
+)
+
+// ParseSlowClientPolicy checks that s is a SlowClientPolicy.
+func ParseSlowClientPolicy(s string) (SlowClientPolicy, error) {
+	switch policy := SlowClientPolicy(s); policy {
+	case DropEvents, Disconnect:
+		return policy, nil
+	}
+	return "", fmt.Errorf("slow clients must be dropped or disconnected, not %q", s)
+}
+
+// DefaultQueueSize is how many events a subscriber can fall behind by, unless HubOptions says otherwise.
+const DefaultQueueSize = 256
+
+type HubOptions struct {
+	// QueueSize is how many events each subscriber can fall behind by before SlowClients kicks in.
+	QueueSize int
+	// SlowClients is what happens to subscribers that fall further behind than that.
+	SlowClients SlowClientPolicy
+}
+
+// droppedEvents and slowDisconnects count what we've done to slow subscribers, across every hub.
+var droppedEvents, slowDisconnects int64
+
+// DroppedEvents is how many events slow subscribers have missed.
+func DroppedEvents() int64 {
+	return atomic.LoadInt64(&droppedEvents)
+}
+
+// SlowClientDisconnects is how many subscribers have been disconnected for being too slow.
+func SlowClientDisconnects() int64 {
+	return atomic.LoadInt64(&slowDisconnects)
+}
+
+// Hub fans events out to subscribers in this process, with one redis subscription per channel or pattern however
+// many people are listening to it. Each subscriber has its own queue, so one that's slow to read (or stuck behind a
+// bad connection) only holds itself up.
+type Hub struct {
+	redis   *redis.Client
+	options HubOptions
+
+	mu       sync.Mutex
+	patterns map[string]*patternSubscription
+}
+
+type patternSubscription struct {
+	pubsub      *redis.PubSub
+	subscribers map[*subscriber]struct{}
+}
+
+// hubEvent is something for a subscriber: either a message, or word that it might have missed some.
+type hubEvent struct {
+	channel, payload string
+	resync           bool
+}
+
+type subscriber struct {
+	patterns []string
+	events   chan hubEvent
+	// done is closed if the hub gives up on the subscriber.
+	done chan struct{}
+
+	mu      sync.Mutex
+	dropped bool
+	closed  bool
+}
+
+// NewHub creates a hub subscribing with redisClient. Pub/sub doesn't care which database a client uses, so one hub
+// can serve every tenant, as their channels are prefixed.
+func NewHub(redisClient *redis.Client, options HubOptions) *Hub {
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.SlowClients == "" {
+		options.SlowClients = DropEvents
+	}
+	return &Hub{
+		redis:    redisClient,
+		options:  options,
+		patterns: map[string]*patternSubscription{},
+	}
+}
+
+// subscribe adds a subscriber to the given (already prefixed) channels and patterns, subscribing to any nobody else
+// is listening to yet.
+func (h *Hub) subscribe(patterns []string) *subscriber {
+	s := &subscriber{
+		patterns: patterns,
+		events:   make(chan hubEvent, h.options.QueueSize),
+		done:     make(chan struct{}),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, pattern := range patterns {
+		ps, ok := h.patterns[pattern]
+		if !ok {
+			ps = &patternSubscription{
+				pubsub:      h.redis.PSubscribe(pattern),
+				subscribers: map[*subscriber]struct{}{},
+			}
+			h.patterns[pattern] = ps
+			go h.run(pattern, ps)
+		}
+		ps.subscribers[s] = struct{}{}
+	}
+	return s
+}
+
+// unsubscribe removes a subscriber, dropping redis subscriptions nobody is listening to any more.
+func (h *Hub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, pattern := range s.patterns {
+		ps, ok := h.patterns[pattern]
+		if !ok {
+			continue
+		}
+		delete(ps.subscribers, s)
+		if len(ps.subscribers) == 0 {
+			delete(h.patterns, pattern)
+			if err := ps.pubsub.Close(); err != nil {
+				log.Printf("Failed to unsubscribe from %q: %v.\n", pattern, err)
+			}
+		}
+	}
+}
+
+// run passes on everything published on pattern until its subscription is closed.
+func (h *Hub) run(pattern string, ps *patternSubscription) {
+	// The pubsub quietly reconnects if it loses redis, but anything published meanwhile is gone, so when it
+	// resubscribes we tell everyone to resync.
+	watcher := newSubscriptionWatcher()
+	for message := range ps.pubsub.ChannelWithSubscriptions(h.options.QueueSize) {
+		switch message := message.(type) {
+		case *redis.Message:
+			h.broadcast(ps, hubEvent{channel: message.Channel, payload: message.Payload})
+		case *redis.Subscription:
+			if watcher.restarted(message) {
+				log.Printf("Resubscribed to %q after losing redis.\n", pattern)
+				h.broadcast(ps, hubEvent{resync: true})
+			}
+		}
+	}
+}
+
+// broadcast queues an event for everyone subscribed to ps, without waiting for any of them.
+func (h *Hub) broadcast(ps *patternSubscription, event hubEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range ps.subscribers {
+		select {
+		case s.events <- event:
+		default:
+			h.tooSlow(s)
+		}
+	}
+}
+
+// tooSlow deals with a subscriber that has no room for another event.
+func (h *Hub) tooSlow(s *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h.options.SlowClients == Disconnect {
+		if !s.closed {
+			s.closed = true
+			close(s.done)
+			atomic.AddInt64(&slowDisconnects, 1)
+		}
+		return
+	}
+	s.dropped = true
+	atomic.AddInt64(&droppedEvents, 1)
+}
+
+// missed says whether the subscriber has had events dropped since it last asked.
+func (s *subscriber) missed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := s.dropped
+	s.dropped = false
+	return dropped
+}
@@ -0,0 +1,130 @@
+package events
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// LogKey is a redis stream of recent events, with their channel and payload, so subscribers that drop off for a
+// moment can be sent what they missed instead of starting over. Tenants have their own databases, so they have
+// their own logs.
+const LogKey = "event-log"
+
+// logLength is roughly how many events we keep in the log. That's a few hours at a con, which is far longer than
+// any reconnection should take.
+const logLength = 10000
+
+// publishScript logs an event and publishes it, tagged with its ID in the log, so subscribers know where they're
+// up to. Both happen at once, so the log is always in the order subscribers see events.
+// KEYS: the log. ARGV: channel, payload, log length.
+var publishScript = redis.NewScript(`
+local id = redis.call("XADD", KEYS[1], "MAXLEN", "~", ARGV[3], "*", "channel", ARGV[1], "payload", ARGV[2])
+local payload = ARGV[2]
+if string.sub(payload, 1, 2) == "{}" then
+	payload = '{"eventId":"' .. id .. '"}'
+elseif string.sub(payload, 1, 1) == "{" then
+	payload = '{"eventId":"' .. id .. '",' .. string.sub(payload, 2)
+end
+redis.call("PUBLISH", ARGV[1], payload)
+return id
+`)
+
+// Publish publishes an event, a JSON object, on channel, and keeps it in the log for anyone who misses it. Events
+// that are only interesting for a moment, like playback progress, aren't worth logging, and can just be published.
+func Publish(c redis.Cmdable, channel string, payload []byte) error {
+	return publishScript.Run(c, []string{LogKey}, channel, payload, logLength).Err()
+}
+
+// tagEvent adds a logged event's ID to its payload, just as publishing it did.
+func tagEvent(id, payload string) string {
+	if strings.HasPrefix(payload, "{}") {
+		return fmt.Sprintf(`{"eventId":"%s"}`, id)
+	}
+	if strings.HasPrefix(payload, "{") {
+		return fmt.Sprintf(`{"eventId":"%s",`, id) + payload[1:]
+	}
+	return payload
+}
+
+// TaggedID is the log ID a published payload was tagged with, if it was logged. Tags always come first, so there's
+// no need to parse the whole thing.
+func TaggedID(payload string) string {
+	const tag = `{"eventId":"`
+	if !strings.HasPrefix(payload, tag) {
+		return ""
+	}
+	end := strings.IndexByte(payload[len(tag):], '"')
+	if end < 0 {
+		return ""
+	}
+	return payload[len(tag) : len(tag)+end]
+}
+
+// logIDAfter says whether log ID a comes after b. An empty ID comes before everything.
+func logIDAfter(a, b string) bool {
+	if b == "" {
+		return a != ""
+	}
+	parse := func(id string) (ms, seq uint64) {
+		parts := strings.SplitN(id, "-", 2)
+		ms, _ = strconv.ParseUint(parts[0], 10, 64)
+		if len(parts) == 2 {
+			seq, _ = strconv.ParseUint(parts[1], 10, 64)
+		}
+		return
+	}
+	aMs, aSeq := parse(a)
+	bMs, bSeq := parse(b)
+	return aMs > bMs || (aMs == bMs && aSeq > bSeq)
+}
+
+// maxReplay is the most events we'll replay to a subscriber. Anyone further behind than that might as well start
+// again.
+const maxReplay = 1000
+
+// emptyLogID stands in for the last event ID when there was nothing in the log, so everything in it is new.
+const emptyLogID = "0-0"
+
+// latestLogID is the ID of the latest event in the log.
+func (h *Handler) latestLogID() (string, error) {
+	messages, err := h.redis.XRevRangeN(LogKey, "+", "-", 1).Result()
+	if err != nil || len(messages) == 0 {
+		return emptyLogID, err
+	}
+	return messages[0].ID, nil
+}
+
+// replay fetches the events on the given (already prefixed) channels and patterns since the log ID since, tagged
+// with their IDs. It returns false if the log doesn't go back that far, or there's too much to replay.
+func (h *Handler) replay(channels []string, since string) ([]hubEvent, bool, error) {
+	// Exclusive ranges need redis 6.2, so we fetch since too, which also tells us it hasn't been trimmed.
+	messages, err := h.redis.XRangeN(LogKey, since, "+", maxReplay+1).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	if since != emptyLogID {
+		if len(messages) == 0 || messages[0].ID != since {
+			return nil, false, nil
+		}
+		messages = messages[1:]
+	}
+	if len(messages) > maxReplay {
+		return nil, false, nil
+	}
+	var events []hubEvent
+	for _, message := range messages {
+		channel, _ := message.Values["channel"].(string)
+		payload, _ := message.Values["payload"].(string)
+		for _, pattern := range channels {
+			if matched, _ := path.Match(pattern, channel); matched {
+				events = append(events, hubEvent{channel: channel, payload: tagEvent(message.ID, payload)})
+				break
+			}
+		}
+	}
+	return events, true, nil
+}
@@ -0,0 +1,100 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Connection is an event stream someone has open on this server.
+type Connection struct {
+	ID         string    `json:"id"`
+	ClientID   string    `json:"clientId,omitempty"`
+	Prefix     string    `json:"prefix,omitempty"`
+	Role       string    `json:"role"`
+	Channels   []string  `json:"channels"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Connected  time.Time `json:"connected"`
+
+	disconnect func()
+}
+
+// Registry keeps track of the event streams open on this server, so admins can see who's listening and kick them.
+// It's only this server: with several behind a load balancer, each has its own.
+type Registry struct {
+	mu          sync.Mutex
+	connections map[string]*Connection
+}
+
+func NewRegistry() *Registry {
+	return &Registry{connections: map[string]*Connection{}}
+}
+
+func (reg *Registry) add(c *Connection) {
+	if reg == nil {
+		return
+	}
+	c.ID = uuid.New().String()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.connections[c.ID] = c
+}
+
+func (reg *Registry) remove(c *Connection) {
+	if reg == nil {
+		return
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.connections, c.ID)
+}
+
+// List returns the open connections, oldest first.
+func (reg *Registry) List() []Connection {
+	reg.mu.Lock()
+	result := make([]Connection, 0, len(reg.connections))
+	for _, c := range reg.connections {
+		result = append(result, *c)
+	}
+	reg.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Connected.Before(result[j].Connected) })
+	return result
+}
+
+// Disconnect closes a connection, returning false if there wasn't one with that ID.
+func (reg *Registry) Disconnect(id string) bool {
+	reg.mu.Lock()
+	c, ok := reg.connections[id]
+	reg.mu.Unlock()
+	if ok {
+		c.disconnect()
+	}
+	return ok
+}
+
+// ServeHTTP lists connections (GET), or closes the one whose ID is at the end of the path (DELETE). It expects to be
+// mounted with its prefix stripped.
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "connections": reg.List()}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		id := strings.TrimPrefix(r.URL.Path, "/")
+		if !reg.Disconnect(id) {
+			http.Error(w, fmt.Sprintf("no connection %q on this server", id), http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
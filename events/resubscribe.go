@@ -0,0 +1,45 @@
+package events
+
+import (
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// subscriptionRestarts counts how many times subscribers have had to resubscribe after losing their connection to
+// redis, across every connection since we started.
+var subscriptionRestarts int64
+
+// SubscriptionRestarts is how many times subscribers have resubscribed after losing their connection to redis.
+func SubscriptionRestarts() int64 {
+	return atomic.LoadInt64(&subscriptionRestarts)
+}
+
+// resyncEvent tells a subscriber that it might have missed events, either because we lost our subscription for a
+// while or because it couldn't keep up, and should fetch the state again. A fresh snapshot follows it.
+const resyncEvent = `{"event":"resync"}`
+
+// subscriptionWatcher notices when redis confirms a subscription we already had, which means the pubsub lost its
+// connection and resubscribed, dropping anything published in between.
+type subscriptionWatcher struct {
+	confirmed map[string]bool
+}
+
+func newSubscriptionWatcher() *subscriptionWatcher {
+	return &subscriptionWatcher{confirmed: map[string]bool{}}
+}
+
+// restarted says whether a subscription confirmation is for a new connection. Redis confirms each channel in turn,
+// so only the first confirmation after a reconnection counts.
+func (s *subscriptionWatcher) restarted(subscription *redis.Subscription) bool {
+	if subscription.Kind != "subscribe" && subscription.Kind != "psubscribe" {
+		return false
+	}
+	if !s.confirmed[subscription.Channel] {
+		s.confirmed[subscription.Channel] = true
+		return false
+	}
+	s.confirmed = map[string]bool{subscription.Channel: true}
+	atomic.AddInt64(&subscriptionRestarts, 1)
+	return true
+}
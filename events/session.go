@@ -0,0 +1,64 @@
+package events
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// sessionFormat is a hash, per session token, of what a subscriber was subscribed to and the last logged event it
+// was sent, so it can pick up where it left off if it reconnects with the token.
+const sessionFormat = "event-session-%s"
+
+// sessionTTL is how long a session outlives its connection.
+const sessionTTL = time.Hour
+
+// session is a subscription that can be resumed.
+type session struct {
+	token       string
+	role        string
+	channels    []string
+	named       bool
+	lastEventID string
+}
+
+// loadSession fetches the session for token, or nil if it's expired (or never existed).
+func (h *Handler) loadSession(token string) (*session, error) {
+	fields, err := h.redis.HGetAll(fmt.Sprintf(sessionFormat, token)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	named, _ := strconv.ParseBool(fields["named"])
+	return &session{
+		token:       token,
+		role:        fields["role"],
+		channels:    strings.Split(fields["channels"], ","),
+		named:       named,
+		lastEventID: fields["lastEventId"],
+	}, nil
+}
+
+// save stores the session, giving it another sessionTTL to be resumed in.
+func (s *session) save(c redis.Cmdable) {
+	key := fmt.Sprintf(sessionFormat, s.token)
+	p := c.TxPipeline()
+	p.HSet(key, "role", s.role, "channels", strings.Join(s.channels, ","), "named", s.named, "lastEventId", s.lastEventID)
+	p.Expire(key, sessionTTL)
+	if _, err := p.Exec(); err != nil {
+		log.Printf("Failed to save event session: %v.\n", err)
+	}
+}
+
+// sent notes that the session has been sent the logged event with ID id.
+func (s *session) sent(id string) {
+	if logIDAfter(id, s.lastEventID) {
+		s.lastEventID = id
+	}
+}
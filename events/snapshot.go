@@ -0,0 +1,85 @@
+package events
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// snapshotFormat is a hash, per channel, of event type to the latest event of that type, which new subscribers get
+// straight away instead of waiting for the next one.
+const snapshotFormat = "snapshot-%s"
+
+// snapshotTTL is how long a channel's snapshot outlives its last update. Anything older than this is probably
+// misleading.
+const snapshotTTL = 10 * time.Minute
+
+// SetSnapshot records payload, which was just published on channel, as the latest event of its type for new
+// subscribers. Only events that describe the current state of things belong in snapshots.
+func SetSnapshot(c redis.Cmdable, channel, event string, payload []byte) error {
+	key := fmt.Sprintf(snapshotFormat, channel)
+	p := c.Pipeline()
+	p.HSet(key, event, payload)
+	p.Expire(key, snapshotTTL)
+	_, err := p.Exec()
+	return err
+}
+
+// snapshotOutput is the latest events for the given (already prefixed) channels and patterns, framed for SSE.
+func (h *Handler) snapshotOutput(channels []string, named bool) string {
+	snapshot, err := h.snapshot(channels)
+	if err != nil {
+		log.Printf("Failed to fetch event snapshot: %v.\n", err)
+		return ""
+	}
+	var b strings.Builder
+	for _, payload := range snapshot {
+		b.WriteString(h.format(payload, named, ""))
+	}
+	return b.String()
+}
+
+// snapshotSince is the snapshot for a session starting over, which won't need anything from before it replayed if
+// it resumes. We're already subscribed, so the snapshot can only be newer than the latest event we find.
+func (h *Handler) snapshotSince(s *session, channels []string, named bool) string {
+	id, err := h.latestLogID()
+	if err != nil {
+		log.Printf("Failed to find the latest event: %v.\n", err)
+	} else {
+		s.lastEventID = id
+	}
+	return h.snapshotOutput(channels, named)
+}
+
+// snapshot is the latest events for the given (already prefixed) channels and patterns.
+func (h *Handler) snapshot(channels []string) ([]string, error) {
+	var keys []string
+	for _, channel := range channels {
+		if !strings.Contains(channel, "*") {
+			keys = append(keys, fmt.Sprintf(snapshotFormat, channel))
+			continue
+		}
+		// This is a scan of the whole database, but people don't connect all that often.
+		iter := h.redis.Scan(0, fmt.Sprintf(snapshotFormat, channel), 100).Iterator()
+		for iter.Next() {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	var payloads []string
+	for _, key := range keys {
+		events, err := h.redis.HGetAll(key).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, payload := range events {
+			payloads = append(payloads, payload)
+		}
+	}
+	return payloads, nil
+}
@@ -1,11 +1,15 @@
 module github.com/PonyFest/music-control
 
-go 1.14
+go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.16.1
 	github.com/aws/aws-sdk-go v1.30.23
 	github.com/dhowden/tag v0.0.0-20200412032933-5d76b8eaae27
 	github.com/go-redis/redis/v7 v7.2.0
-	github.com/google/uuid v1.1.1
+	github.com/google/uuid v1.1.2
 	github.com/gorilla/mux v1.7.4
+	golang.org/x/text v0.3.7
+	google.golang.org/grpc v1.41.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,145 @@
+package idempotency
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/auth"
+)
+
+const keyFormat = "idempotency-%s-%s-%s-%s"
+const pendingMarker = "pending"
+
+// pendingTTL is how long a request can hold its key before a retry may run it again. It's short, so that a request
+// that never finished, because the handler panicked or we died, doesn't turn away its retries for a whole window.
+const pendingTTL = time.Minute
+
+type cachedResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	ETag        string `json:"etag,omitempty"`
+	Body        []byte `json:"body"`
+}
+
+type idempotentHandler struct {
+	redis   *redis.Client
+	window  time.Duration
+	handler http.Handler
+}
+
+// recorder passes everything through to the real ResponseWriter while keeping a copy for the cache.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (ih *idempotentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" || (r.Method != http.MethodPut && r.Method != http.MethodPatch && r.Method != http.MethodDelete && r.Method != http.MethodPost) {
+		ih.handler.ServeHTTP(w, r)
+		return
+	}
+	// Keys are scoped to who used them and the request they were used with, so reusing one on a different endpoint
+	// just does the thing rather than replaying something unrelated, and nobody gets to see someone else's response.
+	key := fmt.Sprintf(keyFormat, auth.RoleOf(r), r.Method, r.URL.Path, idempotencyKey)
+	claimed, err := ih.redis.SetNX(key, pendingMarker, pendingTTL).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("checking idempotency key failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		ih.replay(w, key)
+		return
+	}
+
+	// Unless we get as far as storing the response, let whoever tries next have a go, even if the handler panics.
+	stored := false
+	defer func() {
+		if !stored {
+			ih.redis.Del(key)
+		}
+	}()
+	rec := &recorder{ResponseWriter: w}
+	ih.handler.ServeHTTP(rec, r)
+
+	// Server errors are probably worth retrying for real, so forget we ever saw them.
+	if rec.status >= 500 {
+		return
+	}
+	j, err := json.Marshal(cachedResponse{
+		Status:      rec.status,
+		ContentType: w.Header().Get("Content-Type"),
+		ETag:        w.Header().Get("ETag"),
+		Body:        rec.body.Bytes(),
+	})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	if err := ih.redis.Set(key, j, ih.window).Err(); err != nil {
+		log.Printf("Failed to store idempotent response: %v.\n", err)
+		return
+	}
+	stored = true
+}
+
+func (ih *idempotentHandler) replay(w http.ResponseWriter, key string) {
+	stored, err := ih.redis.Get(key).Result()
+	if err == redis.Nil {
+		http.Error(w, "idempotency key expired mid-request, please retry", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("looking up idempotency key failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if stored == pendingMarker {
+		http.Error(w, "a request with this idempotency key is still in progress", http.StatusConflict)
+		return
+	}
+	var response cachedResponse
+	if err := json.Unmarshal([]byte(stored), &response); err != nil {
+		http.Error(w, fmt.Sprintf("decoding stored response failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if response.ContentType != "" {
+		w.Header().Set("Content-Type", response.ContentType)
+	}
+	if response.ETag != "" {
+		w.Header().Set("ETag", response.ETag)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(response.Status)
+	_, _ = w.Write(response.Body)
+}
+
+// Wrap makes PUT, PATCH, DELETE and POST requests carrying an Idempotency-Key header happen at most once per window,
+// replaying the original response to any retries.
+func Wrap(handler http.Handler, redis *redis.Client, window time.Duration) http.Handler {
+	return &idempotentHandler{
+		redis:   redis,
+		window:  window,
+		handler: handler,
+	}
+}
@@ -0,0 +1,70 @@
+package idempotency
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/auth"
+)
+
+func TestWrap(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer c.Close()
+	calls, panicked := 0, false
+	handler := Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/panic" && !panicked {
+			panicked = true
+			panic("oops")
+		}
+		w.Header().Set("ETag", `"3"`)
+		_, _ = w.Write([]byte(auth.RoleOf(r)))
+	}), c, time.Hour)
+	send := func(path, role string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.Header.Set("Idempotency-Key", "key")
+		w := httptest.NewRecorder()
+		func() {
+			defer func() { _ = recover() }()
+			handler.ServeHTTP(w, auth.As(r, role))
+		}()
+		return w
+	}
+	tests := []struct {
+		name      string
+		path      string
+		role      string
+		wantBody  string
+		wantCalls int
+	}{
+		{"first", "/", "alice", "alice", 1},
+		{"replayed", "/", "alice", "alice", 1},
+		{"someone else", "/", "bob", "bob", 2},
+		{"panicked", "/panic", "alice", "", 3},
+		{"retried after a panic", "/panic", "alice", "alice", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.path, tt.role)
+			if got := w.Body.String(); got != tt.wantBody {
+				t.Errorf("got body %q, want %q", got, tt.wantBody)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.wantCalls)
+			}
+			if got := w.Header().Get("ETag"); tt.wantBody != "" && got != `"3"` {
+				t.Errorf("got ETag %q, want %q", got, `"3"`)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package maintenance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Key holds whether we're in maintenance mode, so that every server agrees.
+const Key = "maintenance"
+
+// Mode is a global switch that stops anyone changing anything, while leaving players able to keep playing.
+type Mode struct {
+	redis  *redis.Client
+	forced bool
+}
+
+// New creates a maintenance switch. If forced is set we're in maintenance mode no matter what redis says, which is
+// useful when redis itself is what's being worked on.
+func New(redis *redis.Client, forced bool) *Mode {
+	return &Mode{
+		redis:  redis,
+		forced: forced,
+	}
+}
+
+func (m *Mode) Enabled() bool {
+	if m.forced {
+		return true
+	}
+	enabled, _ := m.redis.Get(Key).Int()
+	return enabled != 0
+}
+
+// Wrap rejects anything that isn't a read while maintenance mode is on. Fetching the next track counts as a read,
+// since players need it to keep going.
+func (m *Mode) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions && m.Enabled() {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "the music controller is in maintenance mode; try again later", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP lets admins look at and flip the switch.
+func (m *Mode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid enabled flag %q", r.FormValue("enabled")), http.StatusBadRequest)
+			return
+		}
+		value := 0
+		if enabled {
+			value = 1
+		}
+		if err := m.redis.Set(Key, value, 0).Err(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to change maintenance mode: %v", err), http.StatusInternalServerError)
+			return
+		}
+		fallthrough
+	case http.MethodGet:
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "maintenance": m.Enabled(), "forced": m.forced}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"fmt"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// autoplaySettings copies autoplay into the settings of streams from before there were settings. Their state has
+// said whether they autoplay all along, and players still read it from there, but their settings say they don't,
+// so the first settings change quietly turns autoplay off.
+func autoplaySettings(c *redis.Client, dryRun bool) (int, error) {
+	streams, err := c.SMembers("streams").Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list streams: %v", err)
+	}
+	changed := 0
+	for _, stream := range streams {
+		settingsKey := fmt.Sprintf("settings-%s", stream)
+		if c.HExists(settingsKey, "autoplay").Val() {
+			continue
+		}
+		autoplay, err := c.HGet(fmt.Sprintf("state-%s", stream), "autoplay").Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return changed, fmt.Errorf("failed to fetch %q's state: %v", stream, err)
+		}
+		changed++
+		if dryRun {
+			continue
+		}
+		// Only if nothing has stored settings in the meantime.
+		if err := c.HSetNX(settingsKey, "autoplay", autoplay).Err(); err != nil {
+			return changed, fmt.Errorf("failed to update %q's settings: %v", stream, err)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,130 @@
+// Package migrations upgrades what's in redis from one layout to the next when we start, so improvements to the data
+// model can ship between events without anyone fixing things up by hand.
+package migrations
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// VersionKey holds the version of the newest migration that has been applied.
+const VersionKey = "schema-version"
+
+// lockKey stops two servers starting at once from both migrating. It expires in case whoever holds it dies.
+const lockKey = "schema-migration-lock"
+const lockTTL = 10 * time.Minute
+
+// lockPoll is how often we check whether someone else has finished migrating.
+const lockPoll = time.Second
+
+// Migration is one step from a layout to the next. Run makes the change, or with dryRun only works out what it
+// would change, returning how many keys that is. Migrations run before we serve anything, but a server that died
+// halfway through one will run it again, so they should be safe to repeat.
+type Migration struct {
+	Version     int
+	Description string
+	Run         func(c *redis.Client, dryRun bool) (int, error)
+}
+
+// All is every migration, in the order they run. New ones go at the end with the next version; once one has
+// shipped, it shouldn't change, since some databases will already have it. Migrations refer to keys by their
+// layout at the time, rather than borrowing constants that might change later.
+var All = []Migration{
+	{1, "copy autoplay from stream states into their settings", autoplaySettings},
+}
+
+// Latest is the version every database ends up at.
+func Latest() int {
+	if len(All) == 0 {
+		return 0
+	}
+	return All[len(All)-1].Version
+}
+
+// Version is the version of the data in c. Databases that have never been migrated are at version 0.
+func Version(c *redis.Client) (int, error) {
+	version, err := c.Get(VersionKey).Int()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to fetch the schema version: %v", err)
+	}
+	return version, nil
+}
+
+// Pending is the migrations that haven't been applied to c yet.
+func Pending(c *redis.Client) ([]Migration, error) {
+	version, err := Version(c)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range All {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Run brings c up to date, logging each migration as it goes, with name saying which database it is. With dryRun,
+// it only logs what each migration would change, and nothing is written. Data from a newer version than we know
+// about is left alone, since it was presumably migrated by a newer server that's being rolled back.
+func Run(c *redis.Client, name string, dryRun bool) error {
+	if !dryRun {
+		unlock, err := lock(c)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	version, err := Version(c)
+	if err != nil {
+		return err
+	}
+	if version > Latest() {
+		log.Printf("The %s data is at schema version %d, but we only know about version %d; carrying on regardless.\n", name, version, Latest())
+		return nil
+	}
+	pending, err := Pending(c)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		changed, err := m.Run(c, dryRun)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		if dryRun {
+			log.Printf("Migration %d would %s in the %s data, changing %d keys.\n", m.Version, m.Description, name, changed)
+			continue
+		}
+		if err := c.Set(VersionKey, m.Version, 0).Err(); err != nil {
+			return fmt.Errorf("failed to record schema version %d: %v", m.Version, err)
+		}
+		log.Printf("Migration %d: %s in the %s data, changing %d keys.\n", m.Version, m.Description, name, changed)
+	}
+	return nil
+}
+
+// lock waits until we're the only one migrating c, returning how to let someone else have a go.
+func lock(c *redis.Client) (func(), error) {
+	waiting := false
+	for {
+		acquired, err := c.SetNX(lockKey, time.Now().Unix(), lockTTL).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to take the migration lock: %v", err)
+		}
+		if acquired {
+			return func() { c.Del(lockKey) }, nil
+		}
+		if !waiting {
+			log.Println("Waiting for another server to finish migrating.")
+			waiting = true
+		}
+		time.Sleep(lockPoll)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PonyFest/music-control/mixer"
+)
+
+type mountList []mixer.Mount
+
+func (m *mountList) String() string {
+	streams := make([]string, len(*m))
+	for i, mount := range *m {
+		streams[i] = mount.Stream
+	}
+	return strings.Join(streams, ",")
+}
+
+func (m *mountList) Set(value string) error {
+	mount, err := mixer.ParseMount(value)
+	if err != nil {
+		return err
+	}
+	for _, existing := range *m {
+		if existing.Stream == mount.Stream {
+			return fmt.Errorf("stream %q is mixed twice", mount.Stream)
+		}
+	}
+	*m = append(*m, mount)
+	return nil
+}
@@ -0,0 +1,90 @@
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/secrets"
+)
+
+// eventChannels are the pub/sub patterns carrying everything clients see over SSE, for every tenant.
+var eventChannels = []string{"events", "events-*", "*:events", "*:events-*"}
+
+const keepAlive = time.Minute
+
+// Bridge republishes controller events to an MQTT broker, so things that already speak MQTT don't have to speak SSE.
+// A channel like events-main ends up on <topic prefix>events-main, and a tenant's ponyfest:events-main on
+// <topic prefix>ponyfest/events-main. Events are fire-and-forget: anything published while the broker is unreachable
+// is lost.
+type Bridge struct {
+	redis       *redis.Client
+	broker      *url.URL
+	topicPrefix string
+	clientID    string
+}
+
+func New(redis *redis.Client, broker, topicPrefix string) (*Bridge, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT broker URL %s: %v", secrets.RedactURLString(broker), secrets.URLError(err))
+	}
+	if topicPrefix != "" && !strings.HasSuffix(topicPrefix, "/") {
+		topicPrefix += "/"
+	}
+	hostname, _ := os.Hostname()
+	return &Bridge{
+		redis:       redis,
+		broker:      u,
+		topicPrefix: topicPrefix,
+		clientID:    fmt.Sprintf("music-control-%s-%d", hostname, os.Getpid()),
+	}, nil
+}
+
+// Run forwards events forever, reconnecting to the broker whenever it goes away.
+func (b *Bridge) Run() {
+	pubsub := b.redis.PSubscribe(eventChannels...)
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+
+	backoff := time.Second
+	for {
+		c, err := dial(b.broker, b.clientID, keepAlive)
+		if err != nil {
+			log.Printf("Failed to connect to MQTT broker %s: %v.\n", b.broker.Host, err)
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		log.Printf("Connected to MQTT broker %s.\n", b.broker.Host)
+		backoff = time.Second
+		err = b.forward(c, messages)
+		log.Printf("Lost connection to MQTT broker %s: %v.\n", b.broker.Host, err)
+		c.close()
+	}
+}
+
+func (b *Bridge) forward(c *client, messages <-chan *redis.Message) error {
+	ping := time.NewTicker(keepAlive / 2)
+	defer ping.Stop()
+	for {
+		select {
+		case message := <-messages:
+			topic := b.topicPrefix + strings.ReplaceAll(message.Channel, ":", "/")
+			if err := c.publish(topic, []byte(message.Payload)); err != nil {
+				return err
+			}
+		case <-ping.C:
+			if err := c.ping(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/PonyFest/music-control/auth"
+)
+
+// operator is a password that can run some streams, and look at (but not change) the rest.
+type operator struct {
+	Name     string
+	Password string
+	Streams  []string
+}
+
+type operatorList []operator
+
+func (o *operatorList) String() string {
+	names := make([]string, len(*o))
+	for i, operator := range *o {
+		names[i] = operator.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (o *operatorList) Set(value string) error {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return fmt.Errorf("operators look like name:password:stream[,stream...], not %q", redactPassword(value))
+	}
+	if parts[0] == auth.RoleAdmin {
+		return fmt.Errorf("%q can't be used as an operator name", parts[0])
+	}
+	for _, existing := range *o {
+		if existing.Name == parts[0] {
+			return fmt.Errorf("operator %q is defined twice", parts[0])
+		}
+	}
+	streams := strings.Split(parts[2], ",")
+	for _, stream := range streams {
+		if _, err := path.Match(stream, ""); err != nil || stream == "" {
+			return fmt.Errorf("operator %q: %q isn't a stream or pattern", parts[0], stream)
+		}
+	}
+	*o = append(*o, operator{Name: parts[0], Password: parts[1], Streams: streams})
+	return nil
+}
+
+func (o operatorList) has(role string) bool {
+	for _, operator := range o {
+		if operator.Name == role {
+			return true
+		}
+	}
+	return false
+}
+
+// streams is which streams each operator controls, for an auth.StreamACL.
+func (o operatorList) streams() map[string][]string {
+	streams := make(map[string][]string, len(o))
+	for _, operator := range o {
+		streams[operator.Name] = operator.Streams
+	}
+	return streams
+}
+
+// eventAccess is which event channels each role that isn't an admin can watch. Operators see everything that
+// happens on every stream, as well as the operators' chat.
+func eventAccess(c config) map[string][]string {
+	access := c.Viewers.access()
+	for _, operator := range c.Operators {
+		access[operator.Name] = []string{"events", "events-*", "ops"}
+	}
+	return access
+}
+
+// allowOperators lets whoever operators currently returns through to handler for the parts of the API they need to
+// run streams: the streams themselves (which check which ones they can control), the operators' chat, and looking
+// at the library. Every other request goes to otherwise.
+func allowOperators(operators func() operatorList, handler, otherwise http.Handler, base string) http.Handler {
+	under := func(r *http.Request, prefix string) bool {
+		return r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if operators().has(auth.RoleOf(r)) {
+			if under(r, base+"/streams") || under(r, base+"/ops/chat") || (r.Method == http.MethodGet && (under(r, base+"/tracks") || under(r, base+"/artists"))) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		otherwise.ServeHTTP(w, r)
+	})
+}
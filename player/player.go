@@ -0,0 +1,293 @@
+// Package player serves the core player operations over gRPC, for headless players that would rather have typed
+// messages than parse SSE. Each call is made against the HTTP API in-process, so authentication, stream ACLs, locks
+// and everything else behave exactly as they do over HTTP.
+package player
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/PonyFest/music-control/proto"
+)
+
+type server struct {
+	pb.UnimplementedPlayerServer
+	api http.Handler
+}
+
+// New creates a gRPC server that serves the Player service by calling api, which should be the whole HTTP API.
+func New(api http.Handler) *grpc.Server {
+	s := grpc.NewServer()
+	pb.RegisterPlayerServer(s, &server{api: api})
+	return s
+}
+
+// request builds the HTTP request a call stands for. Credentials and the tenant come from the call's metadata.
+func request(ctx context.Context, method, path string, query, form url.Values) (*http.Request, error) {
+	base := "/api"
+	md, _ := metadata.FromIncomingContext(ctx)
+	if tenant := md.Get("tenant"); len(tenant) > 0 {
+		base = "/api/events/" + url.PathEscape(tenant[0])
+	}
+	u := &url.URL{Path: base + path, RawQuery: query.Encode()}
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if authorization := md.Get("authorization"); len(authorization) > 0 {
+		r.Header.Set("Authorization", authorization[0])
+	}
+	r.RemoteAddr = "grpc"
+	return r, nil
+}
+
+// call makes a request against the API, and turns anything but a success into an error with the matching code.
+func (s *server) call(r *http.Request) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	s.api.ServeHTTP(w, r)
+	if w.Code >= 200 && w.Code < 300 {
+		return w, nil
+	}
+	return nil, status.Error(code(w.Code), errorMessage(w.Body.Bytes()))
+}
+
+// code is the gRPC code closest to an HTTP status.
+func code(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusPreconditionFailed, http.StatusPreconditionRequired, http.StatusLocked:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// errorMessage pulls the message out of an error response, whether it's JSON from apierror or plain text.
+func errorMessage(body []byte) string {
+	var apiError struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &apiError); err == nil && apiError.Error != "" {
+		return apiError.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
+func (s *server) NextTrack(ctx context.Context, req *pb.NextTrackRequest) (*pb.Track, error) {
+	query := url.Values{}
+	if req.DryRun {
+		query.Set("dryRun", "true")
+	}
+	if req.Quality != "" {
+		query.Set("quality", req.Quality)
+	}
+	r, err := request(ctx, http.MethodGet, "/streams/"+url.PathEscape(req.Stream)+"/next", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.call(r)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Track map[string]string `json:"track"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		return nil, status.Errorf(codes.Internal, "couldn't decode the next track: %v", err)
+	}
+	return track(response.Track), nil
+}
+
+// track turns the HTTP API's idea of a track into a message.
+func track(fields map[string]string) *pb.Track {
+	t := &pb.Track{Fields: map[string]string{}}
+	for k, v := range fields {
+		switch k {
+		case "trackId":
+			t.TrackId = v
+		case "trackUrl":
+			t.TrackUrl = v
+		case "title":
+			t.Title = v
+		case "artist":
+			t.Artist = v
+		case "duration":
+			t.Duration, _ = strconv.ParseFloat(v, 64)
+		default:
+			t.Fields[k] = v
+		}
+	}
+	return t
+}
+
+func (s *server) ReportState(ctx context.Context, req *pb.ReportStateRequest) (*pb.ReportStateResponse, error) {
+	form := url.Values{}
+	if req.CurrentTrack != nil {
+		form.Set("currentTrack", *req.CurrentTrack)
+	}
+	if req.Duration != nil {
+		form.Set("duration", strconv.FormatFloat(*req.Duration, 'f', -1, 64))
+	}
+	if req.Position != nil {
+		form.Set("position", strconv.FormatFloat(*req.Position, 'f', -1, 64))
+	}
+	if req.Playing != nil {
+		form.Set("playing", strconv.FormatBool(*req.Playing))
+	}
+	if req.Skip != nil && *req.Skip {
+		form.Set("skip", "true")
+	}
+	r, err := request(ctx, http.MethodPatch, "/streams/"+url.PathEscape(req.Stream)+"/state", nil, form)
+	if err != nil {
+		return nil, err
+	}
+	// Players that don't say which revision they saw get the last word, as they always have.
+	r.Header.Set("If-Match", "*")
+	if req.IfMatch != nil {
+		r.Header.Set("If-Match", fmt.Sprintf(`"%d"`, *req.IfMatch))
+	}
+	w, err := s.call(r)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		State struct {
+			Revision string `json:"revision"`
+		} `json:"state"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		return nil, status.Errorf(codes.Internal, "couldn't decode the new state: %v", err)
+	}
+	revision, _ := strconv.ParseInt(response.State.Revision, 10, 64)
+	return &pb.ReportStateResponse{Revision: revision}, nil
+}
+
+func (s *server) Subscribe(req *pb.SubscribeRequest, stream pb.Player_SubscribeServer) error {
+	query := url.Values{"channels": {strings.Join(req.Channels, ",")}}
+	if req.Session != "" {
+		query.Set("session", req.Session)
+	}
+	r, err := request(stream.Context(), http.MethodGet, "/events", query, nil)
+	if err != nil {
+		return err
+	}
+	w := &eventWriter{header: http.Header{}, stream: stream}
+	s.api.ServeHTTP(w, r)
+	if w.err != nil {
+		return w.err
+	}
+	if w.code != 0 && w.code != http.StatusOK {
+		return status.Error(code(w.code), errorMessage(w.buffer.Bytes()))
+	}
+	return nil
+}
+
+// eventWriter is a ResponseWriter that turns the SSE the events handler writes into messages, one per event.
+// Anything that isn't an event, like a comment, is left out.
+type eventWriter struct {
+	header http.Header
+	code   int
+	buffer bytes.Buffer
+	stream pb.Player_SubscribeServer
+	err    error
+}
+
+func (w *eventWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *eventWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buffer.Write(p)
+	if w.code != http.StatusOK {
+		// It's an error message, which Subscribe will pass on once the handler's done.
+		return len(p), nil
+	}
+	for {
+		frame, rest, found := cut(w.buffer.String(), "\n\n")
+		if !found {
+			break
+		}
+		w.buffer.Reset()
+		w.buffer.WriteString(rest)
+		if err := w.send(frame); err != nil {
+			w.err = err
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush does nothing, since every whole event has already been sent by the time Write returns.
+func (w *eventWriter) Flush() {}
+
+// send sends one SSE frame as a message, if it's an event.
+func (w *eventWriter) send(frame string) error {
+	event := &pb.Event{}
+	var data []string
+	for _, line := range strings.Split(frame, "\n") {
+		field, value, _ := cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			event.Id = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	if data == nil {
+		return nil
+	}
+	event.Json = strings.Join(data, "\n")
+	return w.stream.Send(event)
+}
+
+// cut is strings.Cut, which we don't have yet.
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,168 @@
+package playlists
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/songs"
+	"github.com/PonyFest/music-control/trackurl"
+)
+
+// bundleTrack is a track in a bundle's manifest: its metadata, and where its audio is in the bundle.
+type bundleTrack struct {
+	TrackID  string            `json:"trackId"`
+	File     string            `json:"file"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// bundleManifest describes what's in a bundle, as manifest.json.
+type bundleManifest struct {
+	Playlist string        `json:"playlist"`
+	Created  time.Time     `json:"created"`
+	Tracks   []bundleTrack `json:"tracks"`
+	// Missing is the tracks whose audio we couldn't fetch, which aren't in the bundle.
+	Missing []string `json:"missing"`
+}
+
+// handleBundle packages a playlist's audio into a zip, along with a manifest.json of its metadata and a
+// playlist.m3u8 that plays it all, so a laptop can carry on without us (or the internet). The zip streams straight
+// back, or with `stage=true`, goes in storage under bundles/, and we say where.
+func (h *Handler) handleBundle(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["playlist"]
+	if !namePattern.MatchString(name) {
+		http.Error(w, fmt.Sprintf("no such playlist %q", name), http.StatusNotFound)
+		return
+	}
+	stage, _ := strconv.ParseBool(r.FormValue("stage"))
+	trackIds, err := h.redis.SMembers(fmt.Sprintf(songs.PlaylistFormat, name)).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch playlist: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(trackIds) == 0 {
+		http.Error(w, fmt.Sprintf("no such playlist %q", name), http.StatusNotFound)
+		return
+	}
+	tracks, err := h.tracks.GetMany(trackIds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("looking up track data failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// Sets don't have an order, so we make one up that's easy to find things in.
+	sort.Slice(trackIds, func(i, j int) bool {
+		a, b := tracks[trackIds[i]], tracks[trackIds[j]]
+		if a["artist"] != b["artist"] {
+			return a["artist"] < b["artist"]
+		}
+		return a["title"] < b["title"]
+	})
+
+	if !stage {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+		// It's too late to say so once we've started, so the most we can do is stop.
+		if err := h.writeBundle(r.Context(), w, name, trackIds, tracks); err != nil {
+			log.Printf("Failed to stream bundle of %q: %v.\n", name, err)
+		}
+		return
+	}
+
+	f, err := ioutil.TempFile("", "bundle-*.zip")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("creating temp file failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := h.writeBundle(r.Context(), f, name, trackIds, tracks); err != nil {
+		http.Error(w, fmt.Sprintf("building bundle failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, fmt.Sprintf("building bundle failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	key := fmt.Sprintf("bundles/%s-%s.zip", name, time.Now().UTC().Format("20060102-150405"))
+	if err := h.storage.Put(r.Context(), key, f, "application/zip"); err != nil {
+		http.Error(w, fmt.Sprintf("storing bundle failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Staged a bundle of %q at %s.\n", name, key)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "key": key, "url": h.urls.URL(key)}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// writeBundle writes the zip for handleBundle. Tracks we can't fetch are left out, and listed as missing in the
+// manifest, rather than losing the whole bundle over them.
+func (h *Handler) writeBundle(ctx context.Context, out io.Writer, name string, trackIds []string, tracks map[string]map[string]string) error {
+	zw := zip.NewWriter(out)
+	manifest := bundleManifest{Playlist: name, Created: time.Now().UTC(), Tracks: []bundleTrack{}, Missing: []string{}}
+	m3u := []string{"#EXTM3U"}
+	for i, trackId := range trackIds {
+		track := tracks[trackId]
+		key := track[trackurl.KeyField]
+		if key == "" {
+			key = trackId
+		}
+		file := fmt.Sprintf("audio/%03d-%s.%s", i+1, trackId, songs.Extension(track[songs.ContentTypeKey]))
+		if err := h.addToBundle(ctx, zw, file, key); err != nil {
+			log.Printf("Leaving %s out of the bundle of %q: %v.\n", trackId, name, err)
+			manifest.Missing = append(manifest.Missing, trackId)
+			continue
+		}
+		manifest.Tracks = append(manifest.Tracks, bundleTrack{TrackID: trackId, File: file, Metadata: track})
+		duration := -1
+		if d, err := strconv.ParseFloat(track[songs.DurationKey], 64); err == nil {
+			duration = int(d)
+		}
+		m3u = append(m3u, fmt.Sprintf("#EXTINF:%d,%s - %s", duration, track["artist"], track["title"]), file)
+	}
+
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(mw)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+	pw, err := zw.Create("playlist.m3u8")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(pw, strings.Join(m3u, "\n")+"\n"); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// addToBundle copies the object at key into the zip as file. Audio is already compressed, so it's stored as is.
+func (h *Handler) addToBundle(ctx context.Context, zw *zip.Writer, file, key string) error {
+	body, err := h.storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: file, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, body)
+	return err
+}
@@ -0,0 +1,143 @@
+package playlists
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// How alike titles and artists need to be, from 0 to 1, for an entry to match a track.
+const minTitleSimilarity = 0.8
+const minArtistSimilarity = 0.5
+
+// bracketed catches the "(Radio Edit)" and "[feat. Somepony]" that one tool includes and the next doesn't.
+var bracketed = regexp.MustCompile(`\([^)]*\)|\[[^\]]*\]`)
+
+// normalise boils a title or artist down to lowercase words, so punctuation and spacing don't stop things matching.
+func normalise(s string) string {
+	s = strings.ToLower(bracketed.ReplaceAllString(s, " "))
+	s = strings.ReplaceAll(s, "&", " and ")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// similarity says how alike two normalised strings are, from 0 to 1: whichever is kinder of how many words they
+// share and how few edits it takes to turn one into the other.
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	if a == "" || b == "" {
+		return 0
+	}
+	wordsA, wordsB := strings.Fields(a), strings.Fields(b)
+	seen := map[string]bool{}
+	for _, w := range wordsA {
+		seen[w] = true
+	}
+	shared := 0
+	for _, w := range wordsB {
+		if seen[w] {
+			shared++
+			delete(seen, w)
+		}
+	}
+	words := 2 * float64(shared) / float64(len(wordsA)+len(wordsB))
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	edits := 1 - float64(levenshtein(ra, rb))/float64(longest)
+	if words > edits {
+		return words
+	}
+	return edits
+}
+
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minOf(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minOf(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// artistSimilarity is similarity for artists, which also counts one credit naming the other among several artists,
+// since exports disagree on whether collaborators go in the artist field.
+func artistSimilarity(a, b string) float64 {
+	best := similarity(normalise(a), normalise(b))
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' || r == '&' || r == '/' })
+	}
+	for _, x := range split(a) {
+		for _, y := range split(b) {
+			if s := similarity(normalise(x), normalise(y)); s > best {
+				best = s
+			}
+		}
+	}
+	return best
+}
+
+// candidate is a library track, with its title already normalised.
+type candidate struct {
+	trackId string
+	title   string
+	artist  string
+}
+
+// match finds the library track most like an entry, or "" if none is close enough. Entries without an artist can
+// only go by title.
+func match(entry Entry, library []candidate) string {
+	title := normalise(entry.Title)
+	if title == "" {
+		return ""
+	}
+	best, bestScore := "", 0.0
+	for _, c := range library {
+		score := similarity(title, c.title)
+		if score < minTitleSimilarity {
+			continue
+		}
+		if entry.Artist != "" && c.artist != "" {
+			artist := artistSimilarity(entry.Artist, c.artist)
+			if artist < minArtistSimilarity {
+				continue
+			}
+			// Titles get more say, since artists are the part exports mangle the most.
+			score = (2*score + artist) / 3
+		}
+		if score > bestScore {
+			best, bestScore = c.trackId, score
+		}
+	}
+	return best
+}
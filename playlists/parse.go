@@ -0,0 +1,149 @@
+package playlists
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Entry is a track as some other tool described it, which we then have to find in our library.
+type Entry struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist,omitempty"`
+}
+
+// splitArtistTitle splits "Artist - Title", which is what most tools write when they only have one field to work
+// with. Without a separator, it's all title.
+func splitArtistTitle(s string) Entry {
+	s = strings.TrimSpace(s)
+	if parts := strings.SplitN(s, " - ", 2); len(parts) == 2 {
+		return Entry{Artist: strings.TrimSpace(parts[0]), Title: strings.TrimSpace(parts[1])}
+	}
+	return Entry{Title: s}
+}
+
+// parseM3U reads an M3U or M3U8 playlist. Entries with an #EXTINF line get their name from that; anything else only
+// has its file name to go on.
+func parseM3U(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	name := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			if parts := strings.SplitN(line, ",", 2); len(parts) == 2 {
+				name = parts[1]
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			if name == "" {
+				// Windows tools write backslashes, which path doesn't know about.
+				name = path.Base(strings.ReplaceAll(line, `\`, "/"))
+				name = strings.TrimSuffix(name, path.Ext(name))
+			}
+			entries = append(entries, splitArtistTitle(name))
+			name = ""
+		}
+	}
+	return entries, scanner.Err()
+}
+
+type xspfPlaylist struct {
+	Tracks []struct {
+		Title    string `xml:"title"`
+		Creator  string `xml:"creator"`
+		Location string `xml:"location"`
+	} `xml:"trackList>track"`
+}
+
+// parseXSPF reads an XSPF playlist. Tracks without a title fall back to their location's file name.
+func parseXSPF(r io.Reader) ([]Entry, error) {
+	var playlist xspfPlaylist
+	if err := xml.NewDecoder(r).Decode(&playlist); err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(playlist.Tracks))
+	for _, t := range playlist.Tracks {
+		if t.Title != "" {
+			entries = append(entries, Entry{Title: strings.TrimSpace(t.Title), Artist: strings.TrimSpace(t.Creator)})
+			continue
+		}
+		name := path.Base(t.Location)
+		entries = append(entries, splitArtistTitle(strings.TrimSuffix(name, path.Ext(name))))
+	}
+	return entries, nil
+}
+
+// csvTitleColumns and csvArtistColumns are the headings we recognise, lowercased. Streaming service exports call
+// them all sorts of things.
+var csvTitleColumns = []string{"title", "track name", "track", "name", "song"}
+var csvArtistColumns = []string{"artist", "artist name(s)", "artist name", "artists", "creator"}
+
+// parseCSV reads a CSV with a heading row, which needs at least a title column.
+func parseCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the heading row: %v", err)
+	}
+	column := func(names []string) int {
+		for _, name := range names {
+			for i, h := range header {
+				if strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))) == name {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+	titleColumn, artistColumn := column(csvTitleColumns), column(csvArtistColumns)
+	if titleColumn < 0 {
+		return nil, fmt.Errorf("no title column; expected one of %s", strings.Join(csvTitleColumns, ", "))
+	}
+	var entries []Entry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if titleColumn >= len(record) || strings.TrimSpace(record[titleColumn]) == "" {
+			continue
+		}
+		entry := Entry{Title: strings.TrimSpace(record[titleColumn])}
+		if artistColumn >= 0 && artistColumn < len(record) {
+			entry.Artist = strings.TrimSpace(record[artistColumn])
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// parse reads a playlist in the given format, or works it out if format is empty: XSPF is XML, and M3U is anything
+// else, since plenty of M3Us don't bother with a #EXTM3U header.
+func parse(format string, body []byte) ([]Entry, error) {
+	if format == "" {
+		format = "m3u"
+		if bytes.HasPrefix(bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\ufeff"))), []byte("<")) {
+			format = "xspf"
+		}
+	}
+	switch format {
+	case "m3u", "m3u8":
+		return parseM3U(bytes.NewReader(body))
+	case "xspf":
+		return parseXSPF(bytes.NewReader(body))
+	case "csv":
+		return parseCSV(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unknown playlist format %q", format)
+	}
+}
@@ -0,0 +1,152 @@
+// Package playlists manages named playlists, which streams can restrict their random picks to.
+package playlists
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/songs"
+	"github.com/PonyFest/music-control/storage"
+	"github.com/PonyFest/music-control/trackcache"
+	"github.com/PonyFest/music-control/trackurl"
+)
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,50}$`)
+
+type Handler struct {
+	mux     *mux.Router
+	redis   *redis.Client
+	tracks  *trackcache.Cache
+	storage storage.Storage
+	urls    *trackurl.Builder
+}
+
+func New(redis *redis.Client, tracks *trackcache.Cache, store storage.Storage, urls *trackurl.Builder) *Handler {
+	h := &Handler{
+		mux:     mux.NewRouter(),
+		redis:   redis,
+		tracks:  tracks,
+		storage: store,
+		urls:    urls,
+	}
+	h.mux.HandleFunc("/import", h.handleImport).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{playlist}/bundle", h.handleBundle).Methods(http.MethodGet)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// formatOf works out what format an import is in from `format`, or failing that its content type. Empty means we
+// should guess from the contents.
+func formatOf(r *http.Request) string {
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		return format
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return "csv"
+	case "application/xspf+xml":
+		return "xspf"
+	case "audio/x-mpegurl", "audio/mpegurl", "application/vnd.apple.mpegurl", "application/x-mpegurl":
+		return "m3u"
+	}
+	return ""
+}
+
+// library fetches every track in the pool, ready to match against.
+func (h *Handler) library() ([]candidate, error) {
+	trackIds, err := h.redis.SMembers(songs.TrackPoolKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list track IDs: %v", err)
+	}
+	tracks, err := h.tracks.GetMany(trackIds)
+	if err != nil {
+		return nil, fmt.Errorf("looking up track data failed: %v", err)
+	}
+	library := make([]candidate, 0, len(tracks))
+	for trackId, track := range tracks {
+		library = append(library, candidate{trackId: trackId, title: normalise(track["title"]), artist: track["artist"]})
+	}
+	return library, nil
+}
+
+// handleImport creates the playlist `name` from an M3U, M3U8, XSPF or CSV file in the body, matching its entries to
+// library tracks by title and artist. An existing playlist by that name is only replaced with `replace=true`.
+// Entries that don't match anything are reported back rather than failing the import, unless none of them match.
+func (h *Handler) handleImport(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !namePattern.MatchString(name) {
+		http.Error(w, fmt.Sprintf("playlist names are up to 50 letters, numbers, dashes and underscores, not %q", name), http.StatusBadRequest)
+		return
+	}
+	replace, _ := strconv.ParseBool(r.URL.Query().Get("replace"))
+	key := fmt.Sprintf(songs.PlaylistFormat, name)
+	if !replace && h.redis.Exists(key).Val() > 0 {
+		http.Error(w, fmt.Sprintf("playlist %q already exists", name), http.StatusConflict)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't read playlist: %v", err), http.StatusBadRequest)
+		return
+	}
+	entries, err := parse(formatOf(r), body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't parse playlist: %v", err), http.StatusBadRequest)
+		return
+	}
+	library, err := h.library()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type matched struct {
+		Entry
+		TrackID string `json:"trackId"`
+	}
+	matches := []matched{}
+	unmatched := []Entry{}
+	var trackIds []interface{}
+	for _, entry := range entries {
+		if trackId := match(entry, library); trackId != "" {
+			matches = append(matches, matched{Entry: entry, TrackID: trackId})
+			trackIds = append(trackIds, trackId)
+		} else {
+			unmatched = append(unmatched, entry)
+		}
+	}
+	if len(trackIds) == 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "error": "nothing in the playlist matched the library", "unmatched": unmatched})
+		return
+	}
+	p := h.redis.TxPipeline()
+	p.Del(key)
+	p.SAdd(key, trackIds...)
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store playlist: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Imported playlist %q: %d entries matched, %d didn't.\n", name, len(matches), len(unmatched))
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "playlist": name, "matched": matches, "unmatched": unmatched}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
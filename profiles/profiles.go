@@ -0,0 +1,181 @@
+// Package profiles manages named moods for streams to play in, like "lobby" or "rave", which decide what random
+// picks favour and how tracks blend together.
+package profiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// Key is a hash of profile name to its JSON-encoded definition.
+const Key = "profiles"
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,50}$`)
+
+// Profile is a mood for a stream.
+type Profile struct {
+	Name string `json:"name"`
+	// Weights are how likely random picks with each tag are, relative to each other. If there are any, tracks
+	// without one of these tags are never randomly picked; tracks with several go by the heaviest.
+	Weights map[string]float64 `json:"weights"`
+	// Exclude are tags that are never randomly picked, whatever else they're tagged with.
+	Exclude []string `json:"exclude"`
+	// Crossfade, if set, becomes the stream's crossfade when it switches to this profile.
+	Crossfade *float64 `json:"crossfade,omitempty"`
+}
+
+// normalise checks that a profile makes sense, and tidies up its tags.
+func (p *Profile) normalise() error {
+	if !namePattern.MatchString(p.Name) {
+		return fmt.Errorf("profile names are up to 50 letters, numbers, dashes and underscores, not %q", p.Name)
+	}
+	weights := make(map[string]float64, len(p.Weights))
+	for tag, weight := range p.Weights {
+		tag, err := songs.NormaliseTag(tag)
+		if err != nil {
+			return err
+		}
+		if weight <= 0 || weight > 1000 {
+			return fmt.Errorf("weight for %q must be more than 0 and at most 1000", tag)
+		}
+		weights[tag] = weight
+	}
+	p.Weights = weights
+	exclude := make([]string, 0, len(p.Exclude))
+	for _, tag := range p.Exclude {
+		tag, err := songs.NormaliseTag(tag)
+		if err != nil {
+			return err
+		}
+		if _, ok := weights[tag]; ok {
+			return fmt.Errorf("%q can't be both weighted and excluded", tag)
+		}
+		exclude = append(exclude, tag)
+	}
+	sort.Strings(exclude)
+	p.Exclude = exclude
+	if p.Crossfade != nil && (*p.Crossfade < 0 || *p.Crossfade > 30) {
+		return fmt.Errorf("crossfade must be a number of seconds between 0 and 30")
+	}
+	return nil
+}
+
+// Get fetches a profile, returning redis.Nil if there isn't one by that name.
+func Get(c redis.Cmdable, name string) (*Profile, error) {
+	entry, err := c.HGet(Key, name).Result()
+	if err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err := json.Unmarshal([]byte(entry), &p); err != nil {
+		return nil, fmt.Errorf("corrupt profile %q: %v", entry, err)
+	}
+	return &p, nil
+}
+
+type Handler struct {
+	mux   *mux.Router
+	redis *redis.Client
+}
+
+// New creates the profile management API. Switching streams between them is up to the streams API.
+func New(redis *redis.Client) *Handler {
+	h := &Handler{
+		mux:   mux.NewRouter(),
+		redis: redis,
+	}
+	h.mux.HandleFunc("/", h.handleProfiles).Methods(http.MethodGet)
+	h.mux.HandleFunc("/{name}", h.handleProfile).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	entries, err := h.redis.HGetAll(Key).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list profiles: %v", err), http.StatusInternalServerError)
+		return
+	}
+	result := make([]Profile, 0, len(entries))
+	for _, entry := range entries {
+		var p Profile
+		if err := json.Unmarshal([]byte(entry), &p); err != nil {
+			http.Error(w, fmt.Sprintf("corrupt profile %q: %v", entry, err), http.StatusInternalServerError)
+			return
+		}
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.ToLower(result[i].Name) < strings.ToLower(result[j].Name)
+	})
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "profiles": result}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleProfile fetches, replaces (PUT, with the profile as JSON) or deletes a profile. Streams that are using a
+// profile pick up changes to it on their next pick; deleting it leaves them playing without one.
+func (h *Handler) handleProfile(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	switch r.Method {
+	case http.MethodGet:
+		p, err := Get(h.redis, name)
+		if err == redis.Nil {
+			http.Error(w, fmt.Sprintf("no such profile %q", name), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("failed to fetch profile: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "profile": p}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodPut:
+		var p Profile
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, fmt.Sprintf("couldn't parse profile: %v", err), http.StatusBadRequest)
+			return
+		}
+		p.Name = name
+		if err := p.normalise(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		j, err := json.Marshal(p)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := h.redis.HSet(Key, name, j).Err(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to store profile: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "profile": p}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if err := h.redis.HDel(Key, name).Err(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to delete profile: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+	}
+}
@@ -0,0 +1,207 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// PlayerClient is the client API for Player service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PlayerClient interface {
+	// NextTrack is GET /api/streams/{stream}/next.
+	NextTrack(ctx context.Context, in *NextTrackRequest, opts ...grpc.CallOption) (*Track, error)
+	// ReportState is PATCH /api/streams/{stream}/state. Only the fields that are set are changed.
+	ReportState(ctx context.Context, in *ReportStateRequest, opts ...grpc.CallOption) (*ReportStateResponse, error)
+	// Subscribe is GET /api/events, with each message being one event's JSON.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Player_SubscribeClient, error)
+}
+
+type playerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPlayerClient(cc grpc.ClientConnInterface) PlayerClient {
+	return &playerClient{cc}
+}
+
+func (c *playerClient) NextTrack(ctx context.Context, in *NextTrackRequest, opts ...grpc.CallOption) (*Track, error) {
+	out := new(Track)
+	err := c.cc.Invoke(ctx, "/musiccontrol.Player/NextTrack", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *playerClient) ReportState(ctx context.Context, in *ReportStateRequest, opts ...grpc.CallOption) (*ReportStateResponse, error) {
+	out := new(ReportStateResponse)
+	err := c.cc.Invoke(ctx, "/musiccontrol.Player/ReportState", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *playerClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Player_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Player_ServiceDesc.Streams[0], "/musiccontrol.Player/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &playerSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Player_SubscribeClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type playerSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *playerSubscribeClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PlayerServer is the server API for Player service.
+// All implementations must embed UnimplementedPlayerServer
+// for forward compatibility
+type PlayerServer interface {
+	// NextTrack is GET /api/streams/{stream}/next.
+	NextTrack(context.Context, *NextTrackRequest) (*Track, error)
+	// ReportState is PATCH /api/streams/{stream}/state. Only the fields that are set are changed.
+	ReportState(context.Context, *ReportStateRequest) (*ReportStateResponse, error)
+	// Subscribe is GET /api/events, with each message being one event's JSON.
+	Subscribe(*SubscribeRequest, Player_SubscribeServer) error
+	mustEmbedUnimplementedPlayerServer()
+}
+
+// UnimplementedPlayerServer must be embedded to have forward compatible implementations.
+type UnimplementedPlayerServer struct {
+}
+
+func (UnimplementedPlayerServer) NextTrack(context.Context, *NextTrackRequest) (*Track, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method NextTrack not implemented")
+}
+func (UnimplementedPlayerServer) ReportState(context.Context, *ReportStateRequest) (*ReportStateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReportState not implemented")
+}
+func (UnimplementedPlayerServer) Subscribe(*SubscribeRequest, Player_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedPlayerServer) mustEmbedUnimplementedPlayerServer() {}
+
+// UnsafePlayerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PlayerServer will
+// result in compilation errors.
+type UnsafePlayerServer interface {
+	mustEmbedUnimplementedPlayerServer()
+}
+
+func RegisterPlayerServer(s grpc.ServiceRegistrar, srv PlayerServer) {
+	s.RegisterService(&Player_ServiceDesc, srv)
+}
+
+func _Player_NextTrack_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NextTrackRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PlayerServer).NextTrack(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/musiccontrol.Player/NextTrack",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PlayerServer).NextTrack(ctx, req.(*NextTrackRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Player_ReportState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReportStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PlayerServer).ReportState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/musiccontrol.Player/ReportState",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PlayerServer).ReportState(ctx, req.(*ReportStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Player_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PlayerServer).Subscribe(m, &playerSubscribeServer{stream})
+}
+
+type Player_SubscribeServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type playerSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *playerSubscribeServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Player_ServiceDesc is the grpc.ServiceDesc for Player service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Player_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "musiccontrol.Player",
+	HandlerType: (*PlayerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "NextTrack",
+			Handler:    _Player_NextTrack_Handler,
+		},
+		{
+			MethodName: "ReportState",
+			Handler:    _Player_ReportState_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Player_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/player.proto",
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/PonyFest/music-control/auth"
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/songs"
+	"github.com/PonyFest/music-control/trackurl"
+)
+
+// reloadableFlags are the flags a reload can change. Changing anything else needs a restart, which kicks every
+// player off its event stream for a moment, so we say so rather than half applying it.
+var reloadableFlags = map[string]bool{
+	"config":             true,
+	"password":           true,
+	"password-file":      true,
+	"password-secret":    true,
+	"viewer":             true,
+	"contributor":        true,
+	"operator":           true,
+	"tenant":             true,
+	"max-upload-bytes":   true,
+	"daily-upload-quota": true,
+	"url-signing":        true,
+	"url-signing-key":    true,
+	"url-signing-key-id": true,
+	"url-signing-ttl":    true,
+}
+
+// configFileArg finds --config in args, which we need before we can parse the rest.
+func configFileArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// readConfigFile reads a file of flags, one per line. Blank lines and lines starting with # are ignored.
+func readConfigFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %v", err)
+	}
+	defer f.Close()
+	var args []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args = append(args, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %v", err)
+	}
+	return args, nil
+}
+
+// redactPassword hides the password in a name:password[:...] flag value, for error messages.
+func redactPassword(value string) string {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) > 1 && parts[1] != "" {
+		parts[1] = "xxxxx"
+	}
+	return strings.Join(parts, ":")
+}
+
+// credentials are everyone who can log in to the main event.
+func credentials(c config) []auth.Credential {
+	if c.Password == "" {
+		return nil
+	}
+	credentials := []auth.Credential{{Password: c.Password, Role: auth.RoleAdmin}}
+	for _, v := range c.Viewers {
+		credentials = append(credentials, auth.Credential{Password: v.Password, Role: v.Name})
+	}
+	for _, contributor := range c.Contributors {
+		credentials = append(credentials, auth.Credential{Password: contributor.Password, Role: contributor.Name})
+	}
+	for _, operator := range c.Operators {
+		credentials = append(credentials, auth.Credential{Password: operator.Password, Role: operator.Name})
+	}
+	return credentials
+}
+
+// tenantCredentials are everyone who can log in to a tenant: global admins, and the tenant's own admins.
+func tenantCredentials(c config, t tenant) []auth.Credential {
+	var credentials []auth.Credential
+	for _, password := range nonEmpty(c.Password, t.Password) {
+		credentials = append(credentials, auth.Credential{Password: password, Role: auth.RoleAdmin})
+	}
+	return credentials
+}
+
+// sameTenants says whether two tenant lists have the same tenants in the same databases, whatever their passwords.
+func sameTenants(a, b tenantList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	dbs := map[string]int{}
+	for _, t := range a {
+		dbs[t.Name] = t.DB
+	}
+	for _, t := range b {
+		if db, ok := dbs[t.Name]; !ok || db != t.DB {
+			return false
+		}
+	}
+	return true
+}
+
+// reloader applies what it can of a changed configuration to everything that's already running.
+type reloader struct {
+	args []string
+
+	mu      sync.Mutex
+	current config
+	keyring *auth.Keyring
+	acl     *auth.StreamACL
+	tenants map[string]*auth.Keyring
+	urls    *trackurl.Builder
+	music   []*songs.MusicHandler
+	events  []*events.Handler
+}
+
+func newReloader(c config, args []string) *reloader {
+	rl := &reloader{
+		args:    args,
+		current: c,
+		keyring: auth.NewKeyring(credentials(c)...),
+		acl:     auth.NewStreamACL(c.Operators.streams()),
+		tenants: map[string]*auth.Keyring{},
+	}
+	for _, t := range c.Tenants {
+		rl.tenants[t.Name] = auth.NewKeyring(tenantCredentials(c, t)...)
+	}
+	return rl
+}
+
+// addMusic has reloads change m's upload limits. Reloads can already be happening while we're still setting up.
+func (rl *reloader) addMusic(m *songs.MusicHandler) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.music = append(rl.music, m)
+}
+
+// addEvents has reloads change who can subscribe to e's channels.
+func (rl *reloader) addEvents(e *events.Handler) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.events = append(rl.events, e)
+}
+
+// contributors are the current contributors.
+func (rl *reloader) contributors() contributorList {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.current.Contributors
+}
+
+// operators are the current operators.
+func (rl *reloader) operators() operatorList {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.current.Operators
+}
+
+// Run reloads whenever we get a SIGHUP.
+func (rl *reloader) Run() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if _, err := rl.reload(); err != nil {
+			log.Printf("Failed to reload config: %v.\n", err)
+		}
+	}
+}
+
+// reload reads the config again and applies the parts that can change while we're running. It returns the flags
+// that changed but need a restart to take effect. If the new config is no good, nothing changes.
+func (rl *reloader) reload() ([]string, error) {
+	c, err := parseConfig(rl.args, flag.ContinueOnError)
+	if err != nil {
+		return nil, err
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	var restart []string
+	for name, value := range c.flags {
+		if !reloadableFlags[name] && rl.current.flags[name] != value {
+			restart = append(restart, name)
+		}
+	}
+	// Tenants can change their passwords, but not come or go.
+	if !sameTenants(rl.current.Tenants, c.Tenants) {
+		restart = append(restart, "tenant")
+	}
+	sort.Strings(restart)
+
+	if err := rl.urls.Update(c.URLSigning); err != nil {
+		return nil, err
+	}
+	rl.keyring.Set(credentials(c)...)
+	rl.acl.Set(c.Operators.streams())
+	for _, t := range c.Tenants {
+		if keyring, ok := rl.tenants[t.Name]; ok {
+			keyring.Set(tenantCredentials(c, t)...)
+		}
+	}
+	for _, m := range rl.music {
+		m.SetUploadLimits(c.MaxUploadBytes, c.DailyUploadQuota)
+	}
+	for _, e := range rl.events {
+		e.SetAccess(eventAccess(c))
+	}
+	// Anything that needs a restart stays as it was, so the next reload can still tell it's different.
+	for _, name := range restart {
+		c.flags[name] = rl.current.flags[name]
+	}
+	c.Tenants = rl.current.Tenants
+	rl.current = c
+	if len(restart) > 0 {
+		log.Printf("Reloaded config, but %s won't change until we restart.\n", strings.Join(restart, ", "))
+	} else {
+		log.Println("Reloaded config.")
+	}
+	return restart, nil
+}
+
+// ServeHTTP reloads the config on request, as an alternative to SIGHUP for wherever signals are awkward.
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	restart, err := rl.reload()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reloading config failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "needsRestart": restart}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,128 @@
+// Package screening checks uploads against something that knows about problem tracks, like a content ID service,
+// before we put them on air.
+package screening
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// Pass means the track is fine.
+	Pass = "pass"
+	// Flag means someone should have a look at the track before it's played.
+	Flag = "flag"
+	// Reject means the track mustn't be stored at all.
+	Reject = "reject"
+)
+
+// Track is what we tell a screener about the track alongside its audio.
+type Track struct {
+	ID          string `json:"trackId"`
+	Title       string `json:"title"`
+	Artist      string `json:"artist"`
+	ContentType string `json:"contentType"`
+}
+
+// Verdict is what a screener thinks of a track, and why.
+type Verdict struct {
+	Result string `json:"verdict"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Screener decides whether a track can be played.
+type Screener interface {
+	Screen(audio io.Reader, track Track) (Verdict, error)
+}
+
+// New sets up a screener from a spec. "command:<command line>" runs the command with the audio on stdin and the
+// track's details in MUSIC_TRACK_ID, MUSIC_TITLE, MUSIC_ARTIST and MUSIC_CONTENT_TYPE; an http(s) URL gets the audio
+// POSTed to it, with the details in the query string. Either way, the answer is a JSON verdict like
+// {"verdict": "flag", "reason": "matches a known claimed track"}.
+func New(spec string) (Screener, error) {
+	switch {
+	case strings.HasPrefix(spec, "command:"):
+		args := strings.Fields(strings.TrimPrefix(spec, "command:"))
+		if len(args) == 0 {
+			return nil, fmt.Errorf("no screening command given")
+		}
+		return &command{args: args}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpBackend{url: spec, client: &http.Client{Timeout: 5 * time.Minute}}, nil
+	default:
+		return nil, fmt.Errorf("unknown screening backend %q (want command:... or an http(s) URL)", spec)
+	}
+}
+
+// parseVerdict reads a screener's answer, which has to be one of ours.
+func parseVerdict(data []byte) (Verdict, error) {
+	var v Verdict
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("couldn't parse verdict %q: %v", strings.TrimSpace(string(data)), err)
+	}
+	switch v.Result {
+	case Pass, Flag, Reject:
+		return v, nil
+	default:
+		return v, fmt.Errorf("unknown verdict %q", v.Result)
+	}
+}
+
+type command struct {
+	args []string
+}
+
+func (c *command) Screen(audio io.Reader, track Track) (Verdict, error) {
+	cmd := exec.Command(c.args[0], c.args[1:]...)
+	cmd.Stdin = audio
+	cmd.Env = append(os.Environ(),
+		"MUSIC_TRACK_ID="+track.ID,
+		"MUSIC_TITLE="+track.Title,
+		"MUSIC_ARTIST="+track.Artist,
+		"MUSIC_CONTENT_TYPE="+track.ContentType,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Verdict{}, fmt.Errorf("%s failed: %v: %s", c.args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return parseVerdict(stdout.Bytes())
+}
+
+type httpBackend struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpBackend) Screen(audio io.Reader, track Track) (Verdict, error) {
+	query := url.Values{"trackId": {track.ID}, "title": {track.Title}, "artist": {track.Artist}}
+	u := h.url
+	if strings.Contains(u, "?") {
+		u += "&" + query.Encode()
+	} else {
+		u += "?" + query.Encode()
+	}
+	resp, err := h.client.Post(u, track.ContentType, audio)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("screening request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Verdict{}, fmt.Errorf("reading screening response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Verdict{}, fmt.Errorf("screening backend said %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return parseVerdict(body)
+}
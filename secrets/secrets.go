@@ -0,0 +1,100 @@
+// Package secrets loads passwords and keys from wherever they're kept, so they needn't be on the command line, and
+// keeps them out of logs and error messages.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// Load fetches the secret ref refers to, which is either file:<path> or aws-secretsmanager:<secret name or ARN>.
+// AWS Secrets Manager uses the same credentials and region as S3.
+func Load(ref string) (string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		return "", fmt.Errorf("secrets look like file:<path> or aws-secretsmanager:<name>, not %q", ref)
+	}
+	switch parts[0] {
+	case "file":
+		return LoadFile(parts[1])
+	case "aws-secretsmanager":
+		return loadAWS(parts[1])
+	default:
+		return "", fmt.Errorf("unknown secret store %q", parts[0])
+	}
+}
+
+// LoadFile reads a secret from a file. Editors like to end files with a newline, which isn't part of the secret.
+func LoadFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %v", err)
+	}
+	secret := strings.TrimRight(string(b), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+func loadAWS(name string) (string, error) {
+	s, err := session.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("creating an AWS session failed: %v", err)
+	}
+	output, err := secretsmanager.New(s).GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch secret %q: %v", name, err)
+	}
+	if output.SecretString == nil || *output.SecretString == "" {
+		return "", fmt.Errorf("secret %q has no text value", name)
+	}
+	return *output.SecretString, nil
+}
+
+// sensitiveParams are query parameters that carry credentials, or things just as good as them.
+var sensitiveParams = []string{"password", "session", "token", "key", "signature", "Signature", "X-Amz-Signature", "X-Amz-Credential"}
+
+// RedactURL describes u for logs, without any password in it or credentials in its query.
+func RedactURL(u *url.URL) string {
+	redacted := *u
+	if query := u.Query(); len(query) > 0 {
+		changed := false
+		for _, param := range sensitiveParams {
+			if _, ok := query[param]; ok {
+				query.Set(param, "xxxxx")
+				changed = true
+			}
+		}
+		if changed {
+			redacted.RawQuery = query.Encode()
+		}
+	}
+	return redacted.Redacted()
+}
+
+// RedactURLString is RedactURL for a URL we haven't parsed yet. If it doesn't parse, we can't tell which part is
+// the secret, so none of it goes in the logs.
+func RedactURLString(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "(unparseable URL)"
+	}
+	return RedactURL(u)
+}
+
+// URLError is err without the URL that url.Parse helpfully includes in its errors.
+func URLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,226 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// ArtistsKey is a hash holding the artists directory, as JSON in "artists", and the library version it was built
+// from in "version". It's rebuilt whenever someone asks for it after the library has changed.
+const ArtistsKey = "artists-directory"
+
+// Artist is everyone credited on a track, whether as its artist or as featured, however they were spelled.
+type Artist struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// TrackCount is how many tracks they're on, and FeaturedCount how many of those only feature them.
+	TrackCount    int      `json:"trackCount"`
+	FeaturedCount int      `json:"featuredCount"`
+	TrackIDs      []string `json:"trackIds"`
+}
+
+// ArtistID is the ID of the artist directory entry an artist goes under, so that different spellings and spacings
+// of the same name end up in one place.
+func ArtistID(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(normaliseText(name)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			dash = false
+			b.WriteRune(r)
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// splitArtists splits a normalised artist or features field into the artists in it.
+func splitArtists(s string) []string {
+	var artists []string
+	for _, artist := range strings.Split(s, artistSeparator) {
+		if artist = strings.TrimSpace(artist); artist != "" {
+			artists = append(artists, artist)
+		}
+	}
+	return artists
+}
+
+// Credited is everyone credited on a track: its artists, then anyone it features.
+func Credited(track map[string]string) []string {
+	return append(splitArtists(track["artist"]), splitArtists(track[FeaturesKey])...)
+}
+
+// buildArtists works out the artists directory from the tracks, sorted by ID. Each artist goes by whichever
+// spelling most of their tracks use.
+func buildArtists(tracks map[string]map[string]string) []*Artist {
+	artists := map[string]*Artist{}
+	spellings := map[string]map[string]int{}
+	add := func(trackId, name string, featured bool, seen map[string]bool) {
+		id := ArtistID(name)
+		if id == "" || seen[id] {
+			return
+		}
+		seen[id] = true
+		artist, ok := artists[id]
+		if !ok {
+			artist = &Artist{ID: id}
+			artists[id] = artist
+			spellings[id] = map[string]int{}
+		}
+		artist.TrackCount++
+		if featured {
+			artist.FeaturedCount++
+		}
+		artist.TrackIDs = append(artist.TrackIDs, trackId)
+		spellings[id][name]++
+	}
+	for trackId, track := range tracks {
+		seen := map[string]bool{}
+		for _, name := range splitArtists(track["artist"]) {
+			add(trackId, name, false, seen)
+		}
+		for _, name := range splitArtists(track[FeaturesKey]) {
+			add(trackId, name, true, seen)
+		}
+	}
+	result := make([]*Artist, 0, len(artists))
+	for id, artist := range artists {
+		best := 0
+		for name, count := range spellings[id] {
+			if count > best || (count == best && name < artist.Name) {
+				artist.Name, best = name, count
+			}
+		}
+		sort.Slice(artist.TrackIDs, func(i, j int) bool {
+			a, b := tracks[artist.TrackIDs[i]], tracks[artist.TrackIDs[j]]
+			if a["title"] != b["title"] {
+				return strings.ToLower(a["title"]) < strings.ToLower(b["title"])
+			}
+			return artist.TrackIDs[i] < artist.TrackIDs[j]
+		})
+		result = append(result, artist)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// artists returns the artists directory, rebuilding it if the library has changed since it was last built.
+func (m *MusicHandler) artists(version int64) ([]*Artist, error) {
+	stored, err := m.redis.HMGet(ArtistsKey, "version", "artists").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the artists directory: %v", err)
+	}
+	if v, ok := stored[0].(string); ok && v == fmt.Sprint(version) {
+		if j, ok := stored[1].(string); ok {
+			var artists []*Artist
+			if err := json.Unmarshal([]byte(j), &artists); err == nil {
+				return artists, nil
+			}
+		}
+	}
+
+	trackIds, err := m.redis.SMembers(TrackPoolKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list track IDs: %v", err)
+	}
+	tracks, err := m.tracks.GetMany(trackIds)
+	if err != nil {
+		return nil, fmt.Errorf("looking up track data failed: %v", err)
+	}
+	artists := buildArtists(tracks)
+	j, err := json.Marshal(artists)
+	if err != nil {
+		return nil, fmt.Errorf("encoding JSON failed: %v", err)
+	}
+	// If the library changed while we were at it, this is already out of date, but the version says so.
+	if err := m.redis.HSet(ArtistsKey, "version", version, "artists", j).Err(); err != nil {
+		return nil, fmt.Errorf("failed to store the artists directory: %v", err)
+	}
+	return artists, nil
+}
+
+// ArtistsHandler serves the artists directory: everyone credited in the library, with how many tracks they're on.
+// GET / lists them, and GET /{artist} has the artist's tracks in full.
+func (m *MusicHandler) ArtistsHandler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		m.withContext(req.Context()).handleArtists(w, req)
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/{artist}", func(w http.ResponseWriter, req *http.Request) {
+		m.withContext(req.Context()).handleArtist(w, req)
+	}).Methods(http.MethodGet)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "" {
+			req.URL.Path = "/"
+		}
+		r.ServeHTTP(w, req)
+	})
+}
+
+func (m *MusicHandler) handleArtists(w http.ResponseWriter, r *http.Request) {
+	// Like the track listing, this only changes when the library does.
+	version, modified := m.libraryVersion()
+	etag := fmt.Sprintf(`"%d"`, version)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	artists, err := m.artists(version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "artists": artists}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (m *MusicHandler) handleArtist(w http.ResponseWriter, r *http.Request) {
+	id := ArtistID(mux.Vars(r)["artist"])
+	version, _ := m.libraryVersion()
+	artists, err := m.artists(version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	i := sort.Search(len(artists), func(i int) bool { return artists[i].ID >= id })
+	if i == len(artists) || artists[i].ID != id {
+		http.Error(w, fmt.Sprintf("no such artist %q", mux.Vars(r)["artist"]), http.StatusNotFound)
+		return
+	}
+	artist := artists[i]
+	tracks, err := m.tracks.GetMany(artist.TrackIDs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Looking up track data failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	list := make([]map[string]string, 0, len(artist.TrackIDs))
+	for _, trackId := range artist.TrackIDs {
+		track, ok := tracks[trackId]
+		if !ok {
+			continue
+		}
+		track["trackId"] = trackId
+		track["trackUrl"] = m.urls.TrackURL(trackId, track)
+		list = append(list, track)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "artist": artist, "tracks": list}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
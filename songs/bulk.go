@@ -0,0 +1,267 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/events"
+)
+
+type trackEdit struct {
+	TrackID string            `json:"trackId"`
+	Fields  map[string]string `json:"fields"`
+}
+
+type editResult struct {
+	TrackID string `json:"trackId"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ParseStartAt parses an offset to start a track at, either in seconds or as minutes:seconds.
+func ParseStartAt(s string) (float64, error) {
+	seconds := strings.TrimSpace(s)
+	minutes := 0
+	if i := strings.Index(seconds, ":"); i >= 0 {
+		var err error
+		if minutes, err = strconv.Atoi(seconds[:i]); err != nil || minutes < 0 {
+			return 0, fmt.Errorf("startAt must be seconds or minutes:seconds, not %q", s)
+		}
+		seconds = seconds[i+1:]
+	}
+	n, err := strconv.ParseFloat(seconds, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) || (minutes > 0 && n >= 60) {
+		return 0, fmt.Errorf("startAt must be seconds or minutes:seconds, not %q", s)
+	}
+	return float64(minutes*60) + n, nil
+}
+
+// ParseDuration reads a track's duration in seconds, which has to be a finite number above zero. Anything else
+// throws out every ETA after it.
+func ParseDuration(s string) (float64, error) {
+	d, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || d <= 0 || math.IsInf(d, 0) || math.IsNaN(d) {
+		return 0, fmt.Errorf("duration must be a positive number of seconds, not %q", s)
+	}
+	return d, nil
+}
+
+// normaliseEdit checks that an edit only touches fields people are allowed to edit, and tidies up their values.
+// An empty value removes the field.
+func normaliseEdit(fields map[string]string) (map[string]string, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields to edit")
+	}
+	result := make(map[string]string, len(fields))
+	for k, v := range fields {
+		switch k {
+		case "title", "artist", LicenseSourceKey, LicenseTypeKey:
+		case FeaturesKey:
+			v = joinArtists(normaliseText(v))
+		case AlbumKey:
+			v = normaliseText(v)
+		case TrackNumberKey:
+			if v != "" {
+				if n, err := strconv.Atoi(v); err != nil || n < 1 {
+					return nil, fmt.Errorf("track number must be a positive integer, not %q", v)
+				}
+			}
+		case DurationKey:
+			if v != "" {
+				d, err := ParseDuration(v)
+				if err != nil {
+					return nil, err
+				}
+				v = strconv.FormatFloat(d, 'f', -1, 64)
+			}
+		case StartAtKey:
+			if v != "" {
+				startAt, err := ParseStartAt(v)
+				if err != nil {
+					return nil, err
+				}
+				v = strconv.FormatFloat(startAt, 'f', -1, 64)
+			}
+		case TagsKey:
+			var err error
+			if v, err = normaliseTags(v); err != nil {
+				return nil, err
+			}
+		case GainKey:
+			if v != "" {
+				if gain, err := strconv.ParseFloat(v, 64); err != nil || gain < -30 || gain > 30 {
+					return nil, fmt.Errorf("gain must be a number of dB between -30 and 30, not %q", v)
+				}
+			}
+		case BPMKey:
+			if v != "" {
+				if bpm, err := strconv.ParseFloat(v, 64); err != nil || bpm < 20 || bpm > 300 {
+					return nil, fmt.Errorf("bpm must be a number between 20 and 300, not %q", v)
+				}
+			}
+		case "explicit":
+			if v != "" {
+				explicit, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid explicit flag %q", v)
+				}
+				v = ""
+				if explicit {
+					v = "true"
+				}
+			}
+		case AllowedUntilKey:
+			if v != "" {
+				t, err := ParseAllowedUntil(v)
+				if err != nil {
+					return nil, err
+				}
+				v = t.UTC().Format(time.RFC3339)
+			}
+		default:
+			return nil, fmt.Errorf("%q can't be edited", k)
+		}
+		result[k] = v
+	}
+	normaliseMetadata(result)
+	return result, nil
+}
+
+// applyEdit queues up an already normalised edit, keeping the sets that mirror track fields in sync.
+func applyEdit(c redis.Cmdable, trackId string, fields map[string]string) {
+	license := map[string]string{}
+	for k, v := range fields {
+		switch k {
+		case LicenseSourceKey, LicenseTypeKey, AllowedUntilKey:
+			license[k] = v
+			continue
+		case TagsKey:
+			setTags(c, trackId, v)
+			continue
+		case "explicit":
+			if v == "" {
+				c.SRem(ExplicitTracksKey, trackId)
+			} else {
+				c.SAdd(ExplicitTracksKey, trackId)
+			}
+		}
+		if v == "" {
+			c.HDel(trackId, k)
+		} else {
+			c.HSet(trackId, k, v)
+		}
+	}
+	if len(license) > 0 {
+		setLicense(c, trackId, license)
+	}
+}
+
+// bulkEdit applies a list of metadata edits in one transaction. Edits that don't make sense are skipped and reported
+// in the per-item results; the rest all succeed or fail together.
+func (m *MusicHandler) bulkEdit(w http.ResponseWriter, r *http.Request) {
+	var edits []trackEdit
+	if err := json.NewDecoder(r.Body).Decode(&edits); err != nil {
+		http.Error(w, fmt.Sprintf("couldn't parse edits: %v", err), http.StatusBadRequest)
+		return
+	}
+	results, valid, err := m.checkEdits(edits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := m.commitEdits(valid); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Applied %d of %d metadata edits.\n", len(valid), len(edits))
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "results": results}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// checkEdits works out which edits can be applied, returning a result for every edit and the normalised versions of
+// the ones that are fine.
+func (m *MusicHandler) checkEdits(edits []trackEdit) ([]editResult, []trackEdit, error) {
+	p := m.redis.Pipeline()
+	exists := make([]*redis.BoolCmd, len(edits))
+	for i, edit := range edits {
+		exists[i] = p.SIsMember(TrackPoolKey, edit.TrackID)
+	}
+	if _, err := p.Exec(); err != nil {
+		return nil, nil, fmt.Errorf("failed to look up tracks: %v", err)
+	}
+	results := make([]editResult, len(edits))
+	var valid []trackEdit
+	for i, edit := range edits {
+		results[i] = editResult{TrackID: edit.TrackID, Status: "ok"}
+		if !exists[i].Val() {
+			results[i].Status = "error"
+			results[i].Error = "no such track"
+			continue
+		}
+		fields, err := normaliseEdit(edit.Fields)
+		if err != nil {
+			results[i].Status = "error"
+			results[i].Error = err.Error()
+			continue
+		}
+		valid = append(valid, trackEdit{TrackID: edit.TrackID, Fields: fields})
+	}
+	return results, valid, nil
+}
+
+// commitEdits applies normalised edits in a single transaction and tells everyone about them.
+func (m *MusicHandler) commitEdits(edits []trackEdit) error {
+	if len(edits) == 0 {
+		return nil
+	}
+	tx := m.redis.TxPipeline()
+	trackIds := make([]string, len(edits))
+	for i, edit := range edits {
+		applyEdit(tx, edit.TrackID, edit.Fields)
+		trackIds[i] = edit.TrackID
+	}
+	if err := BumpLibraryVersion(tx, trackIds...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(); err != nil {
+		return fmt.Errorf("failed to store edits: %v", err)
+	}
+	for _, trackId := range trackIds {
+		m.tracks.Invalidate(trackId)
+	}
+	m.publishTracksUpdated(trackIds)
+	return nil
+}
+
+func (m *MusicHandler) publishTracksUpdated(trackIds []string) {
+	tracks, err := m.tracks.GetMany(trackIds)
+	if err != nil {
+		log.Printf("Failed to look up updated tracks: %v.\n", err)
+		return
+	}
+	for trackId, track := range tracks {
+		track["trackId"] = trackId
+		track["trackUrl"] = m.urls.TrackURL(trackId, track)
+		j, err := json.Marshal(map[string]interface{}{
+			"event": "poolTrackUpdated",
+			"track": track,
+		})
+		if err != nil {
+			log.Printf("Failed to encode JSON, somehow: %v.\n", err)
+			continue
+		}
+		if err := events.Publish(m.redis, m.options.ChannelPrefix+EventsKey, j); err != nil {
+			log.Printf("Failed to publish track updated event: %v.\n", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// handleChanges is what changed in the library since version `since`, for players that keep their own copy: tracks
+// `added` to the pool and `updated` since then (with everything listTracks would say about them), and the IDs of
+// those `removed` from it. Apply them and remember `version` for next time. If we can't say what changed since then,
+// `resync` is true, and the whole listing has to be fetched again.
+func (m *MusicHandler) handleChanges(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	if err != nil || since < 0 {
+		http.Error(w, fmt.Sprintf("since must be a library version, not %q", r.FormValue("since")), http.StatusBadRequest)
+		return
+	}
+	// All at once, so the changes are exactly those up to the version we say.
+	p := m.redis.TxPipeline()
+	versionCmd := p.Get(LibraryVersionKey)
+	changesSinceCmd := p.Get(LibraryChangesSinceKey)
+	changedCmd := p.ZRangeByScore(LibraryChangesKey, &redis.ZRangeBy{Min: fmt.Sprintf("(%d", since), Max: "+inf"})
+	addedCmd := p.ZRangeByScore(LibraryAdditionsKey, &redis.ZRangeBy{Min: fmt.Sprintf("(%d", since), Max: "+inf"})
+	if _, err := p.Exec(); err != nil && err != redis.Nil {
+		http.Error(w, fmt.Sprintf("failed to fetch library changes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// A library that has never changed doesn't have a version, and has nothing to tell us anyway.
+	version, _ := versionCmd.Int64()
+	changesSince, err := changesSinceCmd.Int64()
+	if err != nil {
+		changesSince = version
+	}
+	if since > version || since < changesSince {
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "version": version, "resync": true}); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	changed := changedCmd.Val()
+	added := map[string]bool{}
+	for _, trackId := range addedCmd.Val() {
+		added[trackId] = true
+	}
+	p = m.redis.Pipeline()
+	inPool := make([]*redis.BoolCmd, len(changed))
+	for i, trackId := range changed {
+		inPool[i] = p.SIsMember(TrackPoolKey, trackId)
+	}
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to check the track pool: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var present []string
+	removed := []string{}
+	for i, trackId := range changed {
+		if inPool[i].Val() {
+			present = append(present, trackId)
+		} else {
+			removed = append(removed, trackId)
+		}
+	}
+	tracks, err := m.tracks.GetMany(present)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Looking up track data failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	addedTracks := map[string]map[string]string{}
+	updatedTracks := map[string]map[string]string{}
+	for trackId, track := range tracks {
+		track["trackId"] = trackId
+		track["trackUrl"] = m.urls.TrackURL(trackId, track)
+		if added[trackId] {
+			addedTracks[trackId] = track
+		} else {
+			updatedTracks[trackId] = track
+		}
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "ok",
+		"version": version,
+		"since":   since,
+		"resync":  false,
+		"added":   addedTracks,
+		"updated": updatedTracks,
+		"removed": removed,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,191 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/apierror"
+	"github.com/PonyFest/music-control/events"
+)
+
+// CommentsFormat is the key for a hash of a track's comments, as JSON, by ID.
+const CommentsFormat = "comments-%s"
+
+// CommentCountKey and LatestCommentKey are the fields in a track hash holding how many comments it has and the
+// text of the newest, so listings can show them without fetching every track's comments.
+const CommentCountKey = "commentCount"
+const LatestCommentKey = "latestComment"
+
+// maxCommentLength is the longest a comment can be, in bytes.
+const maxCommentLength = 4000
+
+// Comment is something an operator wants everyone else to know about a track.
+type Comment struct {
+	ID      string    `json:"id"`
+	Author  string    `json:"author"`
+	Text    string    `json:"text"`
+	Created time.Time `json:"created"`
+}
+
+// commentScript adds or removes a comment, then works out the track's comment count and latest comment again.
+// Creation times are whole seconds, so they compare properly as strings.
+// KEYS: track hash, comments hash. ARGV: comment ID, comment JSON (empty to remove it).
+var commentScript = redis.NewScript(`
+if ARGV[2] == "" then
+	if redis.call("HDEL", KEYS[2], ARGV[1]) == 0 then
+		return false
+	end
+else
+	redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+end
+local comments = redis.call("HVALS", KEYS[2])
+if #comments == 0 then
+	redis.call("HDEL", KEYS[1], "commentCount", "latestComment")
+	return true
+end
+local latest = nil
+for _, v in ipairs(comments) do
+	local comment = cjson.decode(v)
+	if latest == nil or comment.created >= latest.created then
+		latest = comment
+	end
+end
+redis.call("HSET", KEYS[1], "commentCount", #comments, "latestComment", latest.text)
+return true
+`)
+
+// handleComments lists a track's comments, oldest first (GET), or adds one with `text`, from `author` if given or
+// else the caller's role (POST). Tracks still waiting for review can have comments too, which is how reviewers talk
+// about them.
+func (m *MusicHandler) handleComments(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	if !m.redis.SIsMember(TrackPoolKey, trackId).Val() && !m.redis.SIsMember(PendingTracksKey, trackId).Val() {
+		apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+		return
+	}
+	if r.Method == http.MethodGet {
+		comments, err := m.comments(trackId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "comments": comments}); err != nil {
+			http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	author := r.FormValue("author")
+	if author == "" {
+		var err error
+		if author, err = rater(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if len(author) > 100 {
+		http.Error(w, "author must be at most 100 characters", http.StatusBadRequest)
+		return
+	}
+	text := strings.TrimSpace(r.FormValue("text"))
+	if text == "" || len(text) > maxCommentLength {
+		http.Error(w, fmt.Sprintf("text must be between 1 and %d characters", maxCommentLength), http.StatusBadRequest)
+		return
+	}
+	comment := Comment{ID: uuid.New().String(), Author: author, Text: text, Created: time.Now().UTC().Truncate(time.Second)}
+	j, err := json.Marshal(comment)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := m.changeComments(trackId, comment.ID, string(j)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "comment": comment}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleComment deletes a comment.
+func (m *MusicHandler) handleComment(w http.ResponseWriter, r *http.Request) {
+	trackId, commentId := mux.Vars(r)["track"], mux.Vars(r)["comment"]
+	if !m.redis.HExists(fmt.Sprintf(CommentsFormat, trackId), commentId).Val() {
+		http.Error(w, fmt.Sprintf("no such comment %q", commentId), http.StatusNotFound)
+		return
+	}
+	if err := m.changeComments(trackId, commentId, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+// comments fetches a track's comments, oldest first.
+func (m *MusicHandler) comments(trackId string) ([]Comment, error) {
+	values, err := m.redis.HVals(fmt.Sprintf(CommentsFormat, trackId)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch comments: %v", err)
+	}
+	comments := make([]Comment, 0, len(values))
+	for _, v := range values {
+		var c Comment
+		if err := json.Unmarshal([]byte(v), &c); err != nil {
+			log.Printf("Skipping unreadable comment on %s: %v.\n", trackId, err)
+			continue
+		}
+		comments = append(comments, c)
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].Created.Before(comments[j].Created)
+	})
+	return comments, nil
+}
+
+// changeComments adds (with its JSON) or removes (without) a comment, and tells everyone the track changed. Tracks
+// waiting for review aren't in the library yet, so it doesn't change.
+func (m *MusicHandler) changeComments(trackId, commentId, comment string) error {
+	submitted := m.redis.SIsMember(PendingTracksKey, trackId).Val()
+	p := m.redis.TxPipeline()
+	commentScript.Eval(p, []string{trackId, fmt.Sprintf(CommentsFormat, trackId)}, commentId, comment)
+	if !submitted {
+		if err := BumpLibraryVersion(p, trackId); err != nil {
+			return err
+		}
+	}
+	if _, err := p.Exec(); err != nil {
+		return fmt.Errorf("failed to store comment: %v", err)
+	}
+	m.tracks.Invalidate(trackId)
+	track, err := m.tracks.Get(trackId)
+	if err != nil {
+		return err
+	}
+	track["trackId"] = trackId
+	track["trackUrl"] = m.urls.TrackURL(trackId, track)
+	event := "poolTrackUpdated"
+	if submitted {
+		event = "submittedTrackUpdated"
+	}
+	j, err := json.Marshal(map[string]interface{}{
+		"event": event,
+		"track": track,
+	})
+	if err != nil {
+		log.Printf("Failed to encode JSON, somehow: %v.\n", err)
+		return nil
+	}
+	if err := events.Publish(m.redis, m.options.ChannelPrefix+EventsKey, j); err != nil {
+		log.Printf("Failed to publish track updated event: %v.\n", err)
+	}
+	return nil
+}
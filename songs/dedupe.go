@@ -0,0 +1,103 @@
+package songs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// ContentHashesKey is a hash of the SHA-256 of every file uploaded as a new track to the track it became, and
+// ContentHashKey the field in a track hash holding the hash of its file. Replacing a track's audio clears its hash,
+// so uploading the old file again makes a new track.
+const ContentHashesKey = "content-hashes"
+const ContentHashKey = "contentHash"
+
+// uploadLockFormat is held by whoever is turning a file with a given hash into a track, so that anyone uploading the
+// same file at the same time waits for them rather than making a second track.
+const uploadLockFormat = "upload-lock-%s"
+
+// uploadLockTTL is longer than any upload should take to process, in case whoever holds the lock dies.
+const uploadLockTTL = 30 * time.Minute
+const uploadLockPoll = 250 * time.Millisecond
+
+// releaseUploadLockScript deletes the lock in KEYS[1], but only if it's still held by ARGV[1].
+var releaseUploadLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// contentHash hashes a file, leaving it ready to read from the start again.
+func contentHash(f io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashing upload failed: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("hashing upload failed: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploaded is the track a file with this hash became, if it's still around and still has that file.
+func (m *MusicHandler) uploaded(hash string) (string, error) {
+	trackId, err := m.redis.HGet(ContentHashesKey, hash).Result()
+	if err == redis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to look up upload: %v", err)
+	}
+	if m.redis.HGet(trackId, ContentHashKey).Val() != hash {
+		return "", nil
+	}
+	return trackId, nil
+}
+
+// claimUpload makes trackId the track that a file with this hash is becoming, unless it's already become one, in
+// which case it returns that instead. If someone else is already working on it, it waits to see how that goes. If
+// it's ours, call release once we're done, saying whether the track was made.
+func (m *MusicHandler) claimUpload(ctx context.Context, hash, trackId string) (string, func(made bool), error) {
+	lockKey := fmt.Sprintf(uploadLockFormat, hash)
+	for {
+		existing, err := m.uploaded(hash)
+		if err != nil || existing != "" {
+			return existing, nil, err
+		}
+		acquired, err := m.redis.SetNX(lockKey, trackId, uploadLockTTL).Result()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to lock upload: %v", err)
+		}
+		if acquired {
+			// They might have finished just before we locked it.
+			if existing, err := m.uploaded(hash); err != nil || existing != "" {
+				releaseUploadLockScript.Run(m.redis, []string{lockKey}, trackId)
+				return existing, nil, err
+			}
+			return "", func(made bool) {
+				// Record it before unlocking, so whoever's waiting finds it.
+				if made {
+					p := m.redis.TxPipeline()
+					p.HSet(ContentHashesKey, hash, trackId)
+					p.HSet(trackId, ContentHashKey, hash)
+					if _, err := p.Exec(); err != nil {
+						log.Printf("Failed to record the content hash of %s: %v.\n", trackId, err)
+					}
+					m.tracks.Invalidate(trackId)
+				}
+				releaseUploadLockScript.Run(m.redis, []string{lockKey}, trackId)
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(uploadLockPoll):
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package songs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// Content types for the audio we accept. MP4 is the container, not the codec, so it covers AAC and ALAC alike.
+// Opus gets its own, since plenty of players that can do Ogg Vorbis can't do Opus.
+const (
+	contentTypeMP3  = "audio/mpeg"
+	contentTypeMP4  = "audio/mp4"
+	contentTypeFLAC = "audio/flac"
+	contentTypeOgg  = "audio/ogg"
+	contentTypeOpus = "audio/ogg; codecs=opus"
+)
+
+// AcceptedFormat is a kind of file we take uploads of.
+type AcceptedFormat struct {
+	Name        string   `json:"name"`
+	ContentType string   `json:"contentType"`
+	Extensions  []string `json:"extensions"`
+}
+
+// acceptedFormats are what detectAudio knows about.
+var acceptedFormats = []AcceptedFormat{
+	{Name: "MP3", ContentType: contentTypeMP3, Extensions: []string{"mp3"}},
+	{Name: "MP4 (AAC or ALAC)", ContentType: contentTypeMP4, Extensions: []string{"m4a", "mp4"}},
+	{Name: "FLAC", ContentType: contentTypeFLAC, Extensions: []string{"flac"}},
+	{Name: "Ogg Vorbis", ContentType: contentTypeOgg, Extensions: []string{"ogg", "oga"}},
+	{Name: "Ogg Opus", ContentType: contentTypeOpus, Extensions: []string{"opus"}},
+}
+
+// maxOpusTags is as much of an Opus file's comment header as we'll read. They can have cover art in them.
+const maxOpusTags = 16 << 20
+
+// audio is what we need to know about an uploaded file before storing it.
+type audio struct {
+	ContentType string
+	Title       string
+	Artist      string
+	Album       string
+	// TrackNumber is where the track comes on its album, or zero if we don't know.
+	TrackNumber int
+}
+
+// detectAudio works out what an uploaded file is from the file itself (not its name, or what the uploader claimed),
+// and reads its title, artist and album. The file is left somewhere in the middle; seek before reading it again.
+func detectAudio(file io.ReadSeeker) (audio, error) {
+	contentType, start, err := sniffContentType(file)
+	if err != nil {
+		return audio{}, err
+	}
+	// Only MP3s keep their metadata in ID3 tags. Anything else might have one in front of it too, but what's in
+	// there is often stale or empty, so we read each format's own tags from where the audio actually starts.
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return audio{}, fmt.Errorf("seeking to the start of the audio somehow failed: %v", err)
+	}
+	var t tag.Metadata
+	switch contentType {
+	case contentTypeOpus:
+		// The tag package doesn't know about Opus, but its comments are Vorbis comments with a different header.
+		comments, err := readOpusTags(file)
+		if err != nil {
+			return audio{}, fmt.Errorf("couldn't parse file: %v", err)
+		}
+		// Track numbers are sometimes written like 3/12.
+		number, _ := strconv.Atoi(strings.SplitN(comments["tracknumber"], "/", 2)[0])
+		return audio{ContentType: contentType, Title: comments["title"], Artist: comments["artist"], Album: comments["album"], TrackNumber: number}, nil
+	case contentTypeFLAC:
+		t, err = tag.ReadFLACTags(file)
+	case contentTypeOgg:
+		t, err = tag.ReadOGGTags(file)
+	case contentTypeMP4:
+		t, err = tag.ReadAtoms(file)
+	default:
+		// MP3s start at the beginning, ID3 tag and all, since that's the one place the tag is what we want.
+		t, err = tag.ReadFrom(file)
+	}
+	if err != nil {
+		return audio{}, fmt.Errorf("couldn't parse file: %v", err)
+	}
+	number, _ := t.Track()
+	return audio{ContentType: contentType, Title: t.Title(), Artist: t.Artist(), Album: t.Album(), TrackNumber: number}, nil
+}
+
+// sniffContentType looks at the start of a file to see what's in it, skipping past any ID3 tag, since those turn
+// up in front of FLAC files as well as MP3s. It also returns where the audio starts, after any such tag.
+func sniffContentType(file io.ReadSeeker) (string, int64, error) {
+	header := make([]byte, 64)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", 0, fmt.Errorf("couldn't read file: %v", err)
+	}
+	header = header[:n]
+	var start int64
+	if bytes.HasPrefix(header, []byte("ID3")) && len(header) >= 10 {
+		// The size is "syncsafe": seven bits to a byte.
+		start = int64(header[6]&0x7f)<<21 | int64(header[7]&0x7f)<<14 | int64(header[8]&0x7f)<<7 | int64(header[9]&0x7f)
+		start += 10
+		if header[5]&0x10 != 0 {
+			start += 10
+		}
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			return "", 0, fmt.Errorf("couldn't skip the ID3 tag: %v", err)
+		}
+		header = make([]byte, 64)
+		n, err := io.ReadFull(file, header)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return "", 0, fmt.Errorf("couldn't read file: %v", err)
+		}
+		header = header[:n]
+		// Plenty of MP3 encoders pad the tag, so if there's nothing we recognise it's probably one of those.
+		if !bytes.HasPrefix(header, []byte("fLaC")) {
+			return contentTypeMP3, 0, nil
+		}
+	}
+	contentType, err := containerType(header)
+	return contentType, start, err
+}
+
+// containerType says what sort of audio a file holds from its first few bytes.
+func containerType(header []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return contentTypeFLAC, nil
+	case bytes.HasPrefix(header, []byte("OggS")):
+		// The first packet of an Ogg stream says what codec it is, and follows the page's segment table.
+		if len(header) < 27 || len(header) < 27+int(header[26]) {
+			return "", errors.New("ogg file is too short")
+		}
+		packet := header[27+int(header[26]):]
+		switch {
+		case bytes.HasPrefix(packet, []byte("OpusHead")):
+			return contentTypeOpus, nil
+		case bytes.HasPrefix(packet, []byte("\x01vorbis")):
+			if err := checkVorbisHeader(packet); err != nil {
+				return "", err
+			}
+			return contentTypeOgg, nil
+		}
+		return "", errors.New("ogg file isn't Vorbis or Opus")
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		if string(header[8:12]) == "M4P " {
+			return "", errors.New("copy protected files can't be played")
+		}
+		return contentTypeMP4, nil
+	case len(header) >= 2 && header[0] == 0xff && header[1]&0xe0 == 0xe0:
+		return contentTypeMP3, nil
+	}
+	return "", errors.New("not a media type we know about")
+}
+
+// checkVorbisHeader makes sure a Vorbis identification header describes something a player could actually play,
+// since a broken one only shows up when a player chokes on it mid-stream.
+func checkVorbisHeader(packet []byte) error {
+	if len(packet) < 30 {
+		return errors.New("vorbis identification header is too short")
+	}
+	version := binary.LittleEndian.Uint32(packet[7:11])
+	channels := packet[11]
+	rate := binary.LittleEndian.Uint32(packet[12:16])
+	switch {
+	case version != 0:
+		return fmt.Errorf("unsupported vorbis version %d", version)
+	case channels == 0:
+		return errors.New("vorbis stream has no channels")
+	case rate == 0:
+		return errors.New("vorbis stream has no sample rate")
+	case packet[29]&1 == 0:
+		return errors.New("vorbis identification header isn't framed properly")
+	}
+	return nil
+}
+
+// readOpusTags reads the comments out of an Ogg Opus file, with their names in lower case. The comment header is
+// the second packet, so we read pages until we've got it.
+func readOpusTags(file io.Reader) (map[string]string, error) {
+	var packets [][]byte
+	var current []byte
+	for len(packets) < 2 {
+		header := make([]byte, 27)
+		if _, err := io.ReadFull(file, header); err != nil {
+			return nil, fmt.Errorf("couldn't read ogg page: %v", err)
+		}
+		if string(header[0:4]) != "OggS" {
+			return nil, errors.New("lost track of the ogg pages")
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(file, segments); err != nil {
+			return nil, fmt.Errorf("couldn't read ogg page: %v", err)
+		}
+		for _, size := range segments {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(file, data); err != nil {
+				return nil, fmt.Errorf("couldn't read ogg page: %v", err)
+			}
+			current = append(current, data...)
+			if len(current) > maxOpusTags {
+				return nil, errors.New("opus comments are too big")
+			}
+			// A segment shorter than 255 bytes ends a packet.
+			if size < 255 {
+				packets = append(packets, current)
+				current = nil
+			}
+		}
+	}
+	tags := packets[1]
+	if !bytes.HasPrefix(tags, []byte("OpusTags")) {
+		return nil, errors.New("missing opus comment header")
+	}
+	r := bytes.NewReader(tags[8:])
+	readString := func() (string, error) {
+		var length uint32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return "", err
+		}
+		if int64(length) > int64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		s := make([]byte, length)
+		_, err := io.ReadFull(r, s)
+		return string(s), err
+	}
+	if _, err := readString(); err != nil {
+		return nil, fmt.Errorf("bad opus vendor string: %v", err)
+	}
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("bad opus comment count: %v", err)
+	}
+	comments := map[string]string{}
+	for i := uint32(0); i < count; i++ {
+		comment, err := readString()
+		if err != nil {
+			return nil, fmt.Errorf("bad opus comment: %v", err)
+		}
+		parts := strings.SplitN(comment, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.ToLower(parts[0])
+		// Where there's more than one, as there often is with artists, the first one is the one we want.
+		if _, ok := comments[name]; !ok {
+			comments[name] = parts[1]
+		}
+	}
+	return comments, nil
+}
@@ -0,0 +1,59 @@
+package songs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// id3v2 builds an ID3v2.4 tag with just a title in it.
+func id3v2(title string) []byte {
+	frame := append([]byte{3}, title...)
+	var b bytes.Buffer
+	b.WriteString("TIT2")
+	b.Write([]byte{0, 0, 0, byte(len(frame))})
+	b.Write([]byte{0, 0})
+	b.Write(frame)
+	size := b.Len()
+	return append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, byte(size >> 7 & 0x7f), byte(size & 0x7f)}, b.Bytes()...)
+}
+
+// flac builds a FLAC file with nothing in it but Vorbis comments.
+func flac(comments ...string) []byte {
+	var block bytes.Buffer
+	le := func(n int) { _ = binary.Write(&block, binary.LittleEndian, uint32(n)) }
+	le(len("test"))
+	block.WriteString("test")
+	le(len(comments))
+	for _, c := range comments {
+		le(len(c))
+		block.WriteString(c)
+	}
+	n := block.Len()
+	return append([]byte{'f', 'L', 'a', 'C', 0x80 | 4, byte(n >> 16), byte(n >> 8), byte(n)}, block.Bytes()...)
+}
+
+func TestDetectAudio(t *testing.T) {
+	tests := []struct {
+		name            string
+		file            []byte
+		wantContentType string
+		wantTitle       string
+		wantArtist      string
+	}{
+		{"mp3", append(id3v2("Tagged"), 0xff, 0xfb, 0x90, 0x00), contentTypeMP3, "Tagged", ""},
+		{"flac", flac("TITLE=Song", "ARTIST=Someone"), contentTypeFLAC, "Song", "Someone"},
+		{"flac behind id3", append(id3v2("Stale"), flac("TITLE=Song", "ARTIST=Someone")...), contentTypeFLAC, "Song", "Someone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := detectAudio(bytes.NewReader(tt.file))
+			if err != nil {
+				t.Fatalf("detectAudio failed: %v", err)
+			}
+			if a.ContentType != tt.wantContentType || a.Title != tt.wantTitle || a.Artist != tt.wantArtist {
+				t.Errorf("got %q, %q by %q, want %q, %q by %q", a.ContentType, a.Title, a.Artist, tt.wantContentType, tt.wantTitle, tt.wantArtist)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package songs
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+)
+
+// exportColumns are the fields people can usefully curate in a spreadsheet, in the order we put them there.
+var exportColumns = []string{"title", "artist", FeaturesKey, AlbumKey, TrackNumberKey, DurationKey, StartAtKey, GainKey, "explicit", TagsKey, LicenseSourceKey, LicenseTypeKey, AllowedUntilKey}
+
+// handleExport dumps the library's editable metadata, sorted by track ID, as JSON (the same shape that PATCH and
+// import accept) or, with `format=csv`, as a CSV with a header row.
+func (m *MusicHandler) handleExport(w http.ResponseWriter, r *http.Request) {
+	trackIds, err := m.redis.SMembers(TrackPoolKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list track IDs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(trackIds)
+	tracks, err := m.tracks.GetMany(trackIds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Looking up track data failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.FormValue("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="tracks.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write(append([]string{"trackId"}, exportColumns...))
+		for _, trackId := range trackIds {
+			row := []string{trackId}
+			for _, column := range exportColumns {
+				row = append(row, tracks[trackId][column])
+			}
+			_ = cw.Write(row)
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Failed to write CSV export: %v.\n", err)
+		}
+	case "", "json":
+		edits := make([]trackEdit, len(trackIds))
+		for i, trackId := range trackIds {
+			fields := map[string]string{}
+			for _, column := range exportColumns {
+				fields[column] = tracks[trackId][column]
+			}
+			edits[i] = trackEdit{TrackID: trackId, Fields: fields}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(edits); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", r.FormValue("format")), http.StatusBadRequest)
+	}
+}
+
+// handleImport applies an edited export. Unlike PATCH, it's all or nothing: if any row is wrong, nothing changes and
+// we say which rows were the problem. Columns missing from the import are left alone; empty cells clear the field.
+func (m *MusicHandler) handleImport(w http.ResponseWriter, r *http.Request) {
+	var edits []trackEdit
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		edits, err = readCSVEdits(r.Body)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&edits)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't parse import: %v", err), http.StatusBadRequest)
+		return
+	}
+	results, valid, err := m.checkEdits(edits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(valid) != len(edits) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "results": results})
+		return
+	}
+	if err := m.commitEdits(valid); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Imported metadata for %d tracks.\n", len(valid))
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "results": results}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func readCSVEdits(r io.Reader) ([]trackEdit, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read header row: %v", err)
+	}
+	idColumn := -1
+	for i, column := range header {
+		if column == "trackId" {
+			idColumn = i
+		}
+	}
+	if idColumn == -1 {
+		return nil, fmt.Errorf("there's no trackId column")
+	}
+	var edits []trackEdit
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		edit := trackEdit{TrackID: row[idColumn], Fields: map[string]string{}}
+		for i, column := range header {
+			if i != idColumn {
+				edit.Fields[column] = row[i]
+			}
+		}
+		edits = append(edits, edit)
+	}
+	return edits, nil
+}
@@ -0,0 +1,76 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// ContentTypeKey is the field in a track hash holding the MIME type of its audio. Tracks uploaded before we
+// recorded it don't have one.
+const ContentTypeKey = "contentType"
+
+// FormatsKey is the set of every content type we've stored, and FormatFormat is the set of tracks with audio (in any
+// rendition) of each one, so we can work out what a player can't play without looking at every track.
+const FormatsKey = "formats"
+const FormatFormat = "format-%s"
+
+// formatsOf returns the content types a track's audio can be played in.
+func formatsOf(original string, renditions []Rendition) map[string]bool {
+	formats := map[string]bool{}
+	if original != "" {
+		formats[original] = true
+	}
+	for _, r := range renditions {
+		if r.Playable() {
+			formats[r.ContentType] = true
+		}
+	}
+	return formats
+}
+
+// updateFormats queues up moving a track between format sets, when the formats it's available in change.
+func updateFormats(c redis.Cmdable, trackId string, before, after map[string]bool) {
+	for format := range before {
+		if !after[format] {
+			c.SRem(fmt.Sprintf(FormatFormat, format), trackId)
+		}
+	}
+	for format := range after {
+		if !before[format] {
+			c.SAdd(FormatsKey, format)
+			c.SAdd(fmt.Sprintf(FormatFormat, format), trackId)
+		}
+	}
+}
+
+// handleFormats reports what formats we accept uploads in, and how many tracks the library has in each format it
+// actually holds, which includes anything uploaded before we were so careful about content types.
+func (m *MusicHandler) handleFormats(w http.ResponseWriter, r *http.Request) {
+	formats, err := m.redis.SMembers(FormatsKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list formats: %v", err), http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(formats)
+	p := m.redis.Pipeline()
+	counts := make([]*redis.IntCmd, len(formats))
+	for i, format := range formats {
+		counts[i] = p.SCard(fmt.Sprintf(FormatFormat, format))
+	}
+	if _, err := p.Exec(); err != nil && err != redis.Nil {
+		http.Error(w, fmt.Sprintf("failed to count tracks: %v", err), http.StatusInternalServerError)
+		return
+	}
+	stored := make(map[string]int64, len(formats))
+	for i, format := range formats {
+		stored[format] = counts[i].Val()
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "accepted": acceptedFormats, "stored": stored}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,109 @@
+package songs
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HLSFormat is a list of a track's HLS segments, in order, each as "<duration in seconds> <storage key>". Tracks
+// that were never segmented don't have one.
+const HLSFormat = "hls-%s"
+
+// HLSSegmentSeconds is roughly how long each segment is. Streams stitch these together, so they all want to match.
+const HLSSegmentSeconds = 6
+
+// segmentForHLS cuts a track's audio into HLS segments with ffmpeg, uploads them, and records them, replacing any
+// segments it had before. It does nothing if HLS is turned off.
+func (m *MusicHandler) segmentForHLS(trackId, path string) error {
+	if m.options.FFmpeg == "" {
+		return nil
+	}
+	dir, err := m.spoolTempDir("hls")
+	if err != nil {
+		return fmt.Errorf("couldn't create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Everything gets re-encoded the same way, so segments from different tracks can follow one another.
+	cmd := exec.Command(m.options.FFmpeg, "-nostdin", "-loglevel", "error", "-i", path, "-vn",
+		"-c:a", "aac", "-b:a", "128k", "-ar", "44100", "-ac", "2",
+		"-f", "hls", "-hls_time", strconv.Itoa(HLSSegmentSeconds), "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "%05d.ts"), filepath.Join(dir, "index.m3u8"))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, output)
+	}
+	segments, err := readSegments(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		return err
+	}
+
+	version, err := m.redis.HIncrBy(trackId, AudioVersionKey, 1).Result()
+	if err != nil {
+		return fmt.Errorf("couldn't allocate a new audio version: %v", err)
+	}
+	entries := make([]interface{}, len(segments))
+	for i, segment := range segments {
+		f, err := os.Open(filepath.Join(dir, segment.file))
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s-hls-v%d/%s", trackId, version, segment.file)
+		err = m.upload(key, f, "video/mp2t")
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+		entries[i] = fmt.Sprintf("%s %s", segment.duration, key)
+	}
+	key := fmt.Sprintf(HLSFormat, trackId)
+	p := m.redis.TxPipeline()
+	p.Del(key)
+	if len(entries) > 0 {
+		p.RPush(key, entries...)
+	}
+	if _, err := p.Exec(); err != nil {
+		return fmt.Errorf("segments uploaded but storing them failed: %v", err)
+	}
+	log.Printf("Segmented %s into %d HLS segments\n", trackId, len(entries))
+	return nil
+}
+
+type hlsSegment struct {
+	duration string
+	file     string
+}
+
+// readSegments pulls the segments out of the playlist ffmpeg wrote. We only need to understand what ffmpeg writes.
+func readSegments(path string) ([]hlsSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg didn't write a playlist: %v", err)
+	}
+	defer f.Close()
+	var segments []hlsSegment
+	duration := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			duration = strings.TrimSuffix(strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0], ",")
+			if _, err := strconv.ParseFloat(duration, 64); err != nil {
+				return nil, fmt.Errorf("couldn't understand %q", line)
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			if duration == "" {
+				return nil, fmt.Errorf("segment %q has no duration", line)
+			}
+			segments = append(segments, hlsSegment{duration: duration, file: filepath.Base(line)})
+			duration = ""
+		}
+	}
+	return segments, scanner.Err()
+}
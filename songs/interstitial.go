@@ -0,0 +1,34 @@
+package songs
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/PonyFest/music-control/trackurl"
+)
+
+// InterstitialKey marks a track hash as a one-shot interstitial, like an announcement: something to queue, not part
+// of the library.
+const InterstitialKey = "interstitial"
+
+// StoreInterstitial stores some audio as a track that never joins the pool, so is only played where it's queued.
+// The track goes away after ttl, and anything still queued then gets skipped. Its audio stays in storage.
+func (m *MusicHandler) StoreInterstitial(audio []byte, contentType, title string, ttl time.Duration) (string, error) {
+	trackId := uuid.New().String()
+	key := m.objectKey(trackId, contentType)
+	if err := m.upload(key, bytes.NewReader(audio), contentType); err != nil {
+		return "", err
+	}
+	p := m.redis.TxPipeline()
+	p.HSet(trackId, "title", title, "artist", "Announcement", ContentTypeKey, contentType, InterstitialKey, "true", trackurl.KeyField, key)
+	p.Expire(trackId, ttl)
+	if _, err := p.Exec(); err != nil {
+		return "", fmt.Errorf("file uploaded but metadata storage failed: %v", err)
+	}
+	log.Printf("Stored interstitial %s\n", trackId)
+	return trackId, nil
+}
@@ -0,0 +1,182 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/apierror"
+	"github.com/PonyFest/music-control/events"
+)
+
+// Some artists only let us play their music for a while, so tracks can carry licensing details.
+const LicenseSourceKey = "licenseSource"
+const LicenseTypeKey = "licenseType"
+const AllowedUntilKey = "allowedUntil"
+
+// LicenseExpiryKey is a sorted set of every track with an allowedUntil, scored by when it expires (in unix seconds),
+// so we can cheaply exclude expired tracks from selection and find the ones about to expire.
+const LicenseExpiryKey = "license-expiry"
+
+// ParseAllowedUntil accepts either an RFC 3339 timestamp or a plain date, which means the end of that day in UTC.
+func ParseAllowedUntil(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a date nor an RFC 3339 timestamp", s)
+	}
+	return t.Add(24*time.Hour - time.Second), nil
+}
+
+// LicenseExpired reports whether a track's license has run out. Tracks without an expiry never expire.
+func LicenseExpired(c redis.Cmdable, trackId string, now time.Time) bool {
+	expiry, err := c.ZScore(LicenseExpiryKey, trackId).Result()
+	if err != nil {
+		return false
+	}
+	return int64(expiry) < now.Unix()
+}
+
+// licenseFields pulls the license fields out of a form. An empty allowedUntil means the license doesn't expire.
+func licenseFields(form url.Values) (map[string]string, error) {
+	fields := map[string]string{}
+	for _, k := range []string{LicenseSourceKey, LicenseTypeKey, AllowedUntilKey} {
+		if _, ok := form[k]; ok {
+			fields[k] = form.Get(k)
+		}
+	}
+	if until := fields[AllowedUntilKey]; until != "" {
+		t, err := ParseAllowedUntil(until)
+		if err != nil {
+			return nil, err
+		}
+		fields[AllowedUntilKey] = t.UTC().Format(time.RFC3339)
+	}
+	return fields, nil
+}
+
+// setLicense queues up storing the given license fields. Empty values clear the field.
+func setLicense(c redis.Cmdable, trackId string, fields map[string]string) {
+	for k, v := range fields {
+		if v == "" {
+			c.HDel(trackId, k)
+		} else {
+			c.HSet(trackId, k, v)
+		}
+	}
+	if until, ok := fields[AllowedUntilKey]; ok {
+		if until == "" {
+			c.ZRem(LicenseExpiryKey, trackId)
+		} else if t, err := time.Parse(time.RFC3339, until); err == nil {
+			c.ZAdd(LicenseExpiryKey, &redis.Z{Score: float64(t.Unix()), Member: trackId})
+		}
+	}
+}
+
+// handleLicense updates a track's license fields; any it isn't given are left alone.
+func (m *MusicHandler) handleLicense(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	if !m.redis.SIsMember(TrackPoolKey, trackId).Val() {
+		apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("couldn't parse form: %v", err), http.StatusBadRequest)
+		return
+	}
+	fields, err := licenseFields(r.Form)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid allowedUntil: %v", err), http.StatusBadRequest)
+		return
+	}
+	p := m.redis.TxPipeline()
+	setLicense(p, trackId, fields)
+	if err := BumpLibraryVersion(p, trackId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store license: %v", err), http.StatusInternalServerError)
+		return
+	}
+	m.tracks.Invalidate(trackId)
+	track, err := m.tracks.Get(trackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	track["trackId"] = trackId
+	track["trackUrl"] = m.urls.TrackURL(trackId, track)
+	j, err := json.Marshal(map[string]interface{}{
+		"event": "poolTrackUpdated",
+		"track": track,
+	})
+	if err == nil {
+		if err := events.Publish(m.redis, m.options.ChannelPrefix+EventsKey, j); err != nil {
+			log.Printf("Failed to publish track updated event: %v.\n", err)
+		}
+	} else {
+		log.Printf("Failed to encode JSON, somehow: %v.\n", err)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "track": track}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleExpiring lists tracks whose licenses have expired or will within `within` (a Go duration, default 30 days),
+// soonest first.
+func (m *MusicHandler) handleExpiring(w http.ResponseWriter, r *http.Request) {
+	within := 30 * 24 * time.Hour
+	if s := r.FormValue("within"); s != "" {
+		var err error
+		if within, err = time.ParseDuration(s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid duration %q: %v", s, err), http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now()
+	expiring, err := m.redis.ZRangeByScoreWithScores(LicenseExpiryKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Add(within).Unix(), 10),
+	}).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list expiring tracks: %v", err), http.StatusInternalServerError)
+		return
+	}
+	trackIds := make([]string, len(expiring))
+	for i, z := range expiring {
+		trackIds[i] = z.Member.(string)
+	}
+	tracks, err := m.tracks.GetMany(trackIds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Looking up track data failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// ZRANGEBYSCORE has already put them soonest first.
+	result := make([]map[string]interface{}, 0, len(expiring))
+	for _, z := range expiring {
+		trackId := z.Member.(string)
+		entry := map[string]interface{}{
+			"trackId": trackId,
+			"expired": int64(z.Score) < now.Unix(),
+		}
+		for k, v := range tracks[trackId] {
+			entry[k] = v
+		}
+		result = append(result, entry)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "tracks": result}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,158 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/trackurl"
+)
+
+// PendingTracksKey is the set of submitted tracks waiting for an admin to approve or reject them. They aren't in
+// the pool until they're approved, so nothing picks them.
+const PendingTracksKey = "pending-tracks"
+
+// ModerationKey is the field in a track hash saying it's still ModerationPending, and SubmittedByKey who sent it in.
+// Approved tracks lose the former; rejected ones are deleted altogether.
+const ModerationKey = "moderation"
+const ModerationPending = "pending"
+const SubmittedByKey = "submittedBy"
+
+// handlePending lists tracks waiting for moderation.
+func (m *MusicHandler) handlePending(w http.ResponseWriter, r *http.Request) {
+	trackIds, err := m.redis.SMembers(PendingTracksKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list track IDs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	tracks, err := m.tracks.GetMany(trackIds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Looking up track data failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for trackId, track := range tracks {
+		track["trackId"] = trackId
+		track["trackUrl"] = m.urls.TrackURL(trackId, track)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "tracks": tracks}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleApprove moves a pending track into the pool.
+func (m *MusicHandler) handleApprove(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	if !m.redis.SIsMember(PendingTracksKey, trackId).Val() {
+		http.Error(w, fmt.Sprintf("no pending track %q", trackId), http.StatusNotFound)
+		return
+	}
+	p := m.redis.TxPipeline()
+	moved := p.SMove(PendingTracksKey, TrackPoolKey, trackId)
+	p.HDel(trackId, ModerationKey)
+	if err := addedToLibrary(p, trackId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to approve track: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !moved.Val() {
+		http.Error(w, fmt.Sprintf("no pending track %q", trackId), http.StatusNotFound)
+		return
+	}
+	m.tracks.Invalidate(trackId)
+	track, err := m.tracks.Get(trackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	track["trackId"] = trackId
+	track["trackUrl"] = m.urls.TrackURL(trackId, track)
+	j, err := json.Marshal(map[string]interface{}{
+		"event": "poolTrackAdded",
+		"track": track,
+	})
+	if err == nil {
+		if err := events.Publish(m.redis, m.options.ChannelPrefix+EventsKey, j); err != nil {
+			log.Printf("Failed to publish track added event: %v.\n", err)
+		}
+	} else {
+		log.Printf("Failed to encode JSON, somehow: %v.\n", err)
+	}
+	log.Printf("Approved %s, submitted by %s\n", trackId, track[SubmittedByKey])
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "track": track}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleReject deletes a pending track, audio and all.
+func (m *MusicHandler) handleReject(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	if !m.redis.SIsMember(PendingTracksKey, trackId).Val() {
+		http.Error(w, fmt.Sprintf("no pending track %q", trackId), http.StatusNotFound)
+		return
+	}
+	track, err := m.redis.HGetAll(trackId).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch track: %v", err), http.StatusInternalServerError)
+		return
+	}
+	renditions, err := Renditions(m.redis, trackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	segments, err := m.redis.LRange(fmt.Sprintf(HLSFormat, trackId), 0, -1).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch HLS segments: %v", err), http.StatusInternalServerError)
+		return
+	}
+	keys := []string{trackId}
+	if key := track[trackurl.KeyField]; key != "" && key != trackId {
+		keys = append(keys, key)
+	}
+	for _, rendition := range renditions {
+		keys = append(keys, rendition.Key)
+	}
+	for _, segment := range segments {
+		if parts := strings.SplitN(segment, " ", 2); len(parts) == 2 {
+			keys = append(keys, parts[1])
+		}
+	}
+	if err := m.deleteObjects(keys); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p := m.redis.TxPipeline()
+	if err := forgetRelationships(m.redis, p, trackId); err != nil {
+		http.Error(w, fmt.Sprintf("audio deleted but removing the track failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	p.SRem(PendingTracksKey, trackId)
+	p.SRem(ExplicitTracksKey, trackId)
+	p.ZRem(LicenseExpiryKey, trackId)
+	updateFormats(p, trackId, formatsOf(track[ContentTypeKey], renditions), nil)
+	setTags(p, trackId, "")
+	p.Del(trackId, fmt.Sprintf(HLSFormat, trackId), fmt.Sprintf(RenditionsFormat, trackId), fmt.Sprintf(RatingsFormat, trackId), fmt.Sprintf(CommentsFormat, trackId))
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("audio deleted but removing the track failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	m.tracks.Invalidate(trackId)
+	log.Printf("Rejected %s, submitted by %s\n", trackId, track[SubmittedByKey])
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+// deleteObjects deletes objects from storage.
+func (m *MusicHandler) deleteObjects(keys []string) error {
+	return m.storage.Delete(m.ctx, keys)
+}
@@ -0,0 +1,102 @@
+package songs
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// FeaturesKey is the field in a track hash holding the artists a track features, which normalisation moves out of
+// its title and artist.
+const FeaturesKey = "features"
+
+// OriginalTitleKey and OriginalArtistKey are the fields in a track hash holding its title and artist as they were
+// given to us, if normalising them changed anything.
+const OriginalTitleKey = "originalTitle"
+const OriginalArtistKey = "originalArtist"
+
+// artistSeparator is how we join several artists. Commas are left alone, since plenty of single names have them,
+// and slashes and pluses only count with spaces around them, for the likes of AC/DC.
+const artistSeparator = " & "
+
+var artistSeparators = regexp.MustCompile(`\s*[;&]\s*|\s+[/+xX×]\s+`)
+
+// bracketedFeaturing matches a "(feat. someone)" wherever it is, and bareFeaturing a "feat. someone" at the end,
+// apart from anything in brackets after it, like "(Live)".
+var bracketedFeaturing = regexp.MustCompile(`(?i)\s*[(\[]\s*(?:feat\.?|ft\.?|featuring)\s+([^)\]]+)[)\]]`)
+var bareFeaturing = regexp.MustCompile(`(?i)\s+\b(?:feat\.?|ft\.?|featuring)\s+([^(\[]+?)\s*((?:[(\[][^)\]]*[)\]]\s*)*)$`)
+
+// normaliseText composes what it can (NFC), turns every run of whitespace into a single space, and trims the ends.
+func normaliseText(s string) string {
+	return strings.Join(strings.FieldsFunc(norm.NFC.String(s), unicode.IsSpace), " ")
+}
+
+// splitFeatures takes a "feat. someone" out of s, returning what's left and who's featured.
+func splitFeatures(s string) (string, string) {
+	if m := bracketedFeaturing.FindStringSubmatchIndex(s); m != nil && m[0] > 0 {
+		return strings.TrimSpace(s[:m[0]] + " " + strings.TrimSpace(s[m[1]:])), joinArtists(s[m[2]:m[3]])
+	}
+	if m := bareFeaturing.FindStringSubmatchIndex(s); m != nil && m[0] > 0 {
+		return strings.TrimSpace(s[:m[0]] + " " + s[m[4]:m[5]]), joinArtists(s[m[2]:m[3]])
+	}
+	return s, ""
+}
+
+// joinArtists puts every artist separator in s the same way.
+func joinArtists(s string) string {
+	var artists []string
+	for _, artist := range artistSeparators.Split(strings.TrimSpace(s), -1) {
+		if artist != "" {
+			artists = append(artists, artist)
+		}
+	}
+	return strings.Join(artists, artistSeparator)
+}
+
+// normaliseTitle tidies a title, taking off anyone it says is featured.
+func normaliseTitle(title string) (string, string) {
+	return splitFeatures(normaliseText(title))
+}
+
+// normaliseArtist tidies an artist, taking off anyone it says is featured.
+func normaliseArtist(artist string) (string, string) {
+	artist, features := splitFeatures(normaliseText(artist))
+	return joinArtists(artist), features
+}
+
+// normaliseMetadata normalises whichever of the title and artist are in fields, in place. It keeps the originals
+// when that changes them, and records who's featured if they said. Clean values leave any earlier original alone,
+// so that re-importing an export doesn't lose them. An empty title or artist is left alone, since it's removing the
+// field.
+func normaliseMetadata(fields map[string]string) {
+	var features []string
+	for _, f := range []struct {
+		key, original string
+		normalise     func(string) (string, string)
+	}{
+		{"title", OriginalTitleKey, normaliseTitle},
+		{"artist", OriginalArtistKey, normaliseArtist},
+	} {
+		value, ok := fields[f.key]
+		if !ok || value == "" {
+			continue
+		}
+		normalised, featured := f.normalise(value)
+		if normalised == "" {
+			// It was all features, somehow; better the original than nothing.
+			normalised, featured = normaliseText(value), ""
+		}
+		fields[f.key] = normalised
+		if normalised != value {
+			fields[f.original] = value
+		}
+		if featured != "" {
+			features = append(features, featured)
+		}
+	}
+	if len(features) > 0 {
+		fields[FeaturesKey] = strings.Join(features, artistSeparator)
+	}
+}
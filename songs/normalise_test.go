@@ -0,0 +1,29 @@
+package songs
+
+import "testing"
+
+func TestNormaliseTitle(t *testing.T) {
+	tests := []struct {
+		title        string
+		want         string
+		wantFeatures string
+	}{
+		{"  Song   Title ", "Song Title", ""},
+		{"Cafe\u0301 Ko\u0308ln", "Caf\u00e9 K\u00f6ln", ""},
+		{"Song feat. Someone", "Song", "Someone"},
+		{"Song (feat. Someone & Someone Else)", "Song", "Someone & Someone Else"},
+		{"Song (feat. Someone) [Remix]", "Song [Remix]", "Someone"},
+		{"Song [ft. Someone] (Live)", "Song (Live)", "Someone"},
+		{"Song featuring Someone (Live) [2019]", "Song (Live) [2019]", "Someone"},
+		{"Featuring Nobody", "Featuring Nobody", ""},
+		{"Left (Right)", "Left (Right)", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			got, features := normaliseTitle(tt.title)
+			if got != tt.want || features != tt.wantFeatures {
+				t.Errorf("got %q featuring %q, want %q featuring %q", got, features, tt.want, tt.wantFeatures)
+			}
+		})
+	}
+}
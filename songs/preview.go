@@ -0,0 +1,50 @@
+package songs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/PonyFest/music-control/trackurl"
+)
+
+// previewSeconds is roughly how much of a track a preview covers.
+const previewSeconds = 30
+
+// previewTTL is how long preview URLs work for. Listings with previews in them aren't cacheable, so this only needs
+// to outlast someone browsing results.
+const previewTTL = 15 * time.Minute
+
+// previewByteRates are guesses at how many bytes a second each format takes, erring high so previews are at least
+// as long as promised. We don't know most tracks' bitrates, and finding out would mean asking S3 about every one.
+var previewByteRates = map[string]int64{
+	contentTypeFLAC: 150000,
+	"audio/wav":     176400,
+}
+
+const defaultPreviewByteRate = 40000 // 320kbps
+
+// previewRange is the byte range covering about the first previewSeconds of a track.
+func previewRange(track map[string]string) string {
+	rate, ok := previewByteRates[track[ContentTypeKey]]
+	if !ok {
+		rate = defaultPreviewByteRate
+	}
+	return fmt.Sprintf("bytes=0-%d", rate*previewSeconds-1)
+}
+
+// addPreview gives a track a URL for the start of its audio. With S3, the range is part of the URL's signature, so
+// clients have to send exactly the Range header we give them alongside it.
+func (m *MusicHandler) addPreview(trackId string, track map[string]string) error {
+	key := track[trackurl.KeyField]
+	if key == "" {
+		key = trackId
+	}
+	byteRange := previewRange(track)
+	u, err := m.storage.RangeURL(key, byteRange, previewTTL)
+	if err != nil {
+		return fmt.Errorf("presigning preview of %s failed: %v", trackId, err)
+	}
+	track["previewUrl"] = u
+	track["previewRange"] = byteRange
+	return nil
+}
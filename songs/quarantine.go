@@ -0,0 +1,211 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/apierror"
+	"github.com/PonyFest/music-control/events"
+)
+
+// QuarantinedTracksKey is the set of tracks that players kept failing to play. They stay in the pool (and their
+// playlists), but nothing picks them, and they're skipped if they're queued, until an admin releases them.
+const QuarantinedTracksKey = "quarantined-tracks"
+
+// QuarantinedKey is the field in a track hash saying when it was quarantined.
+const QuarantinedKey = "quarantined"
+
+// PlaybackErrorsFormat is a sorted set, per track, of recent playback error reports, scored by when they came in.
+const PlaybackErrorsFormat = "playback-errors-%s"
+
+// playbackErrorWindow is how long a playback error counts towards quarantining a track. Something that fails once
+// a week is more likely a flaky player than a broken file.
+const playbackErrorWindow = 24 * time.Hour
+
+// DefaultQuarantineAfter is how many playback errors in a day quarantine a track, unless Options says otherwise.
+const DefaultQuarantineAfter = 3
+
+// quarantineReporters is how many different players have to have reported errors before a track is quarantined, so
+// one broken player can't take tracks off the air by itself.
+const quarantineReporters = 2
+
+type playbackError struct {
+	ID       string `json:"id"`
+	Stream   string `json:"stream,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+	// Reporter is who we count the report as coming from: the client ID if there is one, or else the address.
+	Reporter string    `json:"reporter"`
+	Error    string    `json:"error,omitempty"`
+	Reported time.Time `json:"reported"`
+}
+
+// reportErrorScript records a playback error, forgets those too old to count, and quarantines the track if there
+// are enough left from enough different reporters, returning 1 if it just did.
+// KEYS: track hash, playback errors, quarantined tracks. ARGV: report, now, window start, threshold, now as text,
+// reporters needed.
+var reportErrorScript = redis.NewScript(`
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[3])
+redis.call("EXPIRE", KEYS[2], 604800)
+local threshold = tonumber(ARGV[4])
+if threshold <= 0 then
+	return 0
+end
+local reports = redis.call("ZRANGE", KEYS[2], 0, -1)
+if #reports < threshold then
+	return 0
+end
+local reporters, distinct = {}, 0
+for _, report in ipairs(reports) do
+	local ok, decoded = pcall(cjson.decode, report)
+	local reporter = ok and decoded.reporter or ""
+	if type(reporter) ~= "string" then
+		reporter = ""
+	end
+	if not reporters[reporter] then
+		reporters[reporter] = true
+		distinct = distinct + 1
+	end
+end
+if distinct >= tonumber(ARGV[6]) and redis.call("SADD", KEYS[3], KEYS[1]) == 1 then
+	redis.call("HSET", KEYS[1], "quarantined", ARGV[5])
+	return 1
+end
+return 0
+`)
+
+// IsQuarantined says whether a track has been quarantined.
+func IsQuarantined(c redis.Cmdable, trackId string) bool {
+	return c.SIsMember(QuarantinedTracksKey, trackId).Val()
+}
+
+// handlePlaybackError is for players to say they couldn't play a track, with the `stream`, their `clientId` and the
+// `error` if they like. Once there have been enough reports in a day, from more than one player, the track is
+// quarantined, and everyone listening for library events hears about it.
+func (m *MusicHandler) handlePlaybackError(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	if !m.redis.SIsMember(TrackPoolKey, trackId).Val() {
+		apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+		return
+	}
+	message := strings.TrimSpace(r.FormValue("error"))
+	if len(message) > 1000 {
+		message = message[:1000]
+	}
+	now := time.Now()
+	report := playbackError{
+		ID:       uuid.New().String(),
+		Stream:   r.FormValue("stream"),
+		ClientID: r.FormValue("clientId"),
+		Error:    message,
+		Reported: now.Truncate(time.Second),
+	}
+	report.Reporter = "client:" + report.ClientID
+	if report.ClientID == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		report.Reporter = "address:" + host
+	}
+	j, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	keys := []string{trackId, fmt.Sprintf(PlaybackErrorsFormat, trackId), QuarantinedTracksKey}
+	quarantined, err := reportErrorScript.Run(m.redis, keys, j, now.Unix(), now.Add(-playbackErrorWindow).Unix(), m.options.QuarantineAfter, now.UTC().Format(time.RFC3339), quarantineReporters).Int()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to record playback error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Playback error for %s on %q: %s\n", trackId, report.Stream, message)
+	if quarantined == 1 {
+		m.quarantineChanged(trackId, "trackQuarantined")
+		log.Printf("Quarantined %s after repeated playback errors.\n", trackId)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "quarantined": IsQuarantined(m.redis, trackId)}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// quarantineChanged tells everyone a track went into or came out of quarantine.
+func (m *MusicHandler) quarantineChanged(trackId, event string) {
+	m.tracks.Invalidate(trackId)
+	p := m.redis.TxPipeline()
+	if err := BumpLibraryVersion(p, trackId); err == nil {
+		_, _ = p.Exec()
+	}
+	j, err := json.Marshal(map[string]interface{}{
+		"event":   event,
+		"trackId": trackId,
+	})
+	if err != nil {
+		log.Printf("Failed to encode JSON, somehow: %v.\n", err)
+		return
+	}
+	if err := events.Publish(m.redis, m.options.ChannelPrefix+EventsKey, j); err != nil {
+		log.Printf("Failed to publish %s event: %v.\n", event, err)
+	}
+}
+
+// handleQuarantined lists quarantined tracks, with the playback errors that got them there.
+func (m *MusicHandler) handleQuarantined(w http.ResponseWriter, r *http.Request) {
+	trackIds, err := m.redis.SMembers(QuarantinedTracksKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list track IDs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	tracks, err := m.tracks.GetMany(trackIds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Looking up track data failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	result := make(map[string]interface{}, len(tracks))
+	for trackId, track := range tracks {
+		track["trackId"] = trackId
+		track["trackUrl"] = m.urls.TrackURL(trackId, track)
+		reports := []playbackError{}
+		for _, entry := range m.redis.ZRange(fmt.Sprintf(PlaybackErrorsFormat, trackId), 0, -1).Val() {
+			var report playbackError
+			if err := json.Unmarshal([]byte(entry), &report); err == nil {
+				reports = append(reports, report)
+			}
+		}
+		result[trackId] = map[string]interface{}{"track": track, "errors": reports}
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "tracks": result}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRelease takes a track out of quarantine, say once its audio has been replaced, and forgets its errors.
+func (m *MusicHandler) handleRelease(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	p := m.redis.TxPipeline()
+	removed := p.SRem(QuarantinedTracksKey, trackId)
+	p.HDel(trackId, QuarantinedKey)
+	p.Del(fmt.Sprintf(PlaybackErrorsFormat, trackId))
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to release track: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if removed.Val() == 0 {
+		http.Error(w, fmt.Sprintf("%q isn't quarantined", trackId), http.StatusNotFound)
+		return
+	}
+	m.quarantineChanged(trackId, "trackReleased")
+	log.Printf("Released %s from quarantine.\n", trackId)
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
@@ -0,0 +1,45 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+func TestReportErrorQuarantines(t *testing.T) {
+	tests := []struct {
+		name      string
+		reporters []string
+		want      bool
+	}{
+		{"too few reports", []string{"a", "b"}, false},
+		{"one reporter", []string{"a", "a", "a", "a"}, false},
+		{"several reporters", []string{"a", "a", "b"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := miniredis.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+			defer c.Close()
+			keys := []string{"track", fmt.Sprintf(PlaybackErrorsFormat, "track"), QuarantinedTracksKey}
+			now := time.Now()
+			for i, reporter := range tt.reporters {
+				j, _ := json.Marshal(playbackError{ID: fmt.Sprint(i), Reporter: reporter})
+				if err := reportErrorScript.Run(c, keys, j, now.Unix(), now.Add(-playbackErrorWindow).Unix(), DefaultQuarantineAfter, "now", quarantineReporters).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := IsQuarantined(c, "track"); got != tt.want {
+				t.Errorf("quarantined is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package songs
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PonyFest/music-control/auth"
+)
+
+const quotaFormat = "upload-quota-%s-%s"
+
+// quotaClient identifies who is uploading for quota purposes. Contributors each have their own password, so they're
+// who their role says; admins share one, so the best we can do for them is the address they're coming from.
+func quotaClient(r *http.Request) string {
+	if role := auth.RoleOf(r); role != auth.RoleAdmin {
+		return "contributor:" + role
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "address:" + host
+}
+
+func quotaKey(r *http.Request) string {
+	return fmt.Sprintf(quotaFormat, quotaClient(r), time.Now().UTC().Format("2006-01-02"))
+}
+
+// limits are the largest upload we'll accept and the daily quota, either of which may be zero for none.
+type limits struct {
+	mu               sync.RWMutex
+	maxUploadBytes   int64
+	dailyUploadQuota int64
+}
+
+// SetUploadLimits changes the largest upload we'll accept and the daily quota, for uploads that start from now on.
+func (m *MusicHandler) SetUploadLimits(maxUploadBytes, dailyUploadQuota int64) {
+	m.limits.mu.Lock()
+	defer m.limits.mu.Unlock()
+	m.limits.maxUploadBytes = maxUploadBytes
+	m.limits.dailyUploadQuota = dailyUploadQuota
+}
+
+// uploadLimits returns the largest upload we'll accept and the daily quota, either of which may be zero for none.
+func (m *MusicHandler) uploadLimits() (int64, int64) {
+	m.limits.mu.RLock()
+	defer m.limits.mu.RUnlock()
+	return m.limits.maxUploadBytes, m.limits.dailyUploadQuota
+}
+
+// quotaAllows checks whether uploading size more bytes would fit in today's quota, without using any of it.
+func (m *MusicHandler) quotaAllows(r *http.Request, size int64) bool {
+	_, quota := m.uploadLimits()
+	if quota <= 0 {
+		return true
+	}
+	used, _ := m.redis.Get(quotaKey(r)).Int64()
+	return used+size <= quota
+}
+
+// consumeQuota uses up size bytes of today's quota, or returns false and uses nothing if that would exceed it.
+func (m *MusicHandler) consumeQuota(r *http.Request, size int64) bool {
+	_, quota := m.uploadLimits()
+	if quota <= 0 {
+		return true
+	}
+	key := quotaKey(r)
+	p := m.redis.TxPipeline()
+	used := p.IncrBy(key, size)
+	// keep it around a bit longer than a day so clock skew between servers doesn't matter.
+	p.Expire(key, 48*time.Hour)
+	if _, err := p.Exec(); err != nil {
+		// Failing open seems better than blocking all uploads because redis had a moment.
+		log.Printf("Failed to update upload quota: %v.\n", err)
+		return true
+	}
+	if used.Val() > quota {
+		m.redis.DecrBy(key, size)
+		return false
+	}
+	return true
+}
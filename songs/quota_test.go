@@ -0,0 +1,28 @@
+package songs
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/PonyFest/music-control/auth"
+)
+
+func TestQuotaClient(t *testing.T) {
+	tests := []struct {
+		name string
+		role string
+		want string
+	}{
+		{"admin", auth.RoleAdmin, "address:192.0.2.1"},
+		{"contributor", "somepony", "contributor:somepony"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/upload", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if got := quotaClient(auth.As(r, tt.role)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/apierror"
+	"github.com/PonyFest/music-control/auth"
+	"github.com/PonyFest/music-control/events"
+)
+
+// RatingsFormat is the key for a hash of everyone's rating of a track, from 1 to 5, by who gave it.
+const RatingsFormat = "ratings-%s"
+
+// RatingKey and RatingCountKey are the fields in a track hash holding its average rating and how many ratings that
+// came from, so listings have them without looking at every rating.
+const RatingKey = "rating"
+const RatingCountKey = "ratingCount"
+
+// FavoriteRating is what marking a track as a favorite rates it.
+const FavoriteRating = 5
+
+// rateScript sets or clears someone's rating of a track, then recomputes the track's average.
+// KEYS: track hash, ratings hash. ARGV: rater, rating (empty to clear it).
+var rateScript = redis.NewScript(`
+if ARGV[2] == "" then
+	redis.call("HDEL", KEYS[2], ARGV[1])
+else
+	redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+end
+local ratings = redis.call("HVALS", KEYS[2])
+if #ratings == 0 then
+	redis.call("HDEL", KEYS[1], "rating", "ratingCount")
+	return true
+end
+local total = 0
+for _, v in ipairs(ratings) do
+	total = total + tonumber(v)
+end
+redis.call("HSET", KEYS[1], "rating", string.format("%.2f", total / #ratings), "ratingCount", #ratings)
+return true
+`)
+
+// rater is who a rating is from. Everyone with the same password is the same person as far as auth is concerned,
+// so operators can say who they are with `rater`; otherwise it's their role.
+func rater(r *http.Request) (string, error) {
+	name := r.FormValue("rater")
+	if name == "" {
+		return auth.RoleOf(r), nil
+	}
+	if len(name) > 100 {
+		return "", fmt.Errorf("rater must be at most 100 characters")
+	}
+	return name, nil
+}
+
+// handleRating rates a track. GET lists its ratings; PUT sets the caller's rating to `rating` (1 to 5), or to
+// FavoriteRating with `favorite=true`; DELETE takes the caller's rating back.
+func (m *MusicHandler) handleRating(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	if !m.redis.SIsMember(TrackPoolKey, trackId).Val() {
+		apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+		return
+	}
+	if r.Method == http.MethodGet {
+		ratings, err := m.redis.HGetAll(fmt.Sprintf(RatingsFormat, trackId)).Result()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to fetch ratings: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "ratings": ratings}); err != nil {
+			http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	who, err := rater(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rating := ""
+	if r.Method == http.MethodPut {
+		if favorite, _ := strconv.ParseBool(r.FormValue("favorite")); favorite {
+			rating = strconv.Itoa(FavoriteRating)
+		} else if n, err := strconv.Atoi(r.FormValue("rating")); err == nil && n >= 1 && n <= 5 {
+			rating = strconv.Itoa(n)
+		} else {
+			http.Error(w, "rating must be an integer between 1 and 5", http.StatusBadRequest)
+			return
+		}
+	}
+	p := m.redis.TxPipeline()
+	rateScript.Eval(p, []string{trackId, fmt.Sprintf(RatingsFormat, trackId)}, who, rating)
+	if err := BumpLibraryVersion(p, trackId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store rating: %v", err), http.StatusInternalServerError)
+		return
+	}
+	m.tracks.Invalidate(trackId)
+	track, err := m.tracks.Get(trackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	track["trackId"] = trackId
+	track["trackUrl"] = m.urls.TrackURL(trackId, track)
+	j, err := json.Marshal(map[string]interface{}{
+		"event": "poolTrackUpdated",
+		"track": track,
+	})
+	if err == nil {
+		if err := events.Publish(m.redis, m.options.ChannelPrefix+EventsKey, j); err != nil {
+			log.Printf("Failed to publish track updated event: %v.\n", err)
+		}
+	} else {
+		log.Printf("Failed to encode JSON, somehow: %v.\n", err)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "track": track}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,177 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/apierror"
+)
+
+// FollowedByKey is a hash of track ID to the track that has to play straight after it, like the next part of a
+// mix split into several files. FollowsKey is the same the other way round.
+const FollowedByKey = "followed-by"
+const FollowsKey = "follows"
+
+// ApartFormat is the key for a set of tracks that should never play right before or after a track. It's kept on
+// both tracks of each pair.
+const ApartFormat = "apart-%s"
+
+// maxFollowChain is the longest chain of tracks that have to follow one another we bother to check for loops.
+const maxFollowChain = 1000
+
+// FollowedBy returns the track that has to play straight after trackId, if there is one.
+func FollowedBy(c redis.Cmdable, trackId string) string {
+	return c.HGet(FollowedByKey, trackId).Val()
+}
+
+// Follows returns the track that trackId has to play straight after, if there is one.
+func Follows(c redis.Cmdable, trackId string) string {
+	return c.HGet(FollowsKey, trackId).Val()
+}
+
+// KeptApart reports whether two tracks should never play one after the other.
+func KeptApart(c redis.Cmdable, a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return c.SIsMember(fmt.Sprintf(ApartFormat, a), b).Val()
+}
+
+// handleFollowedBy says which track has to follow this one (GET), sets it to `track` (PUT), or lets anything
+// follow it again (DELETE).
+func (m *MusicHandler) handleFollowedBy(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	if !m.redis.SIsMember(TrackPoolKey, trackId).Val() {
+		apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		next := r.FormValue("track")
+		if !m.redis.SIsMember(TrackPoolKey, next).Val() {
+			apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", next))
+			return
+		}
+		if previous := Follows(m.redis, next); previous != "" && previous != trackId {
+			http.Error(w, fmt.Sprintf("%s already has to follow %s", next, previous), http.StatusConflict)
+			return
+		}
+		// Following the chain on from next mustn't bring us back here, or it would never end.
+		for t, i := next, 0; t != "" && i < maxFollowChain; t, i = FollowedBy(m.redis, t), i+1 {
+			if t == trackId {
+				http.Error(w, fmt.Sprintf("%s already comes before %s", next, trackId), http.StatusConflict)
+				return
+			}
+		}
+		p := m.redis.TxPipeline()
+		if old := FollowedBy(m.redis, trackId); old != "" {
+			p.HDel(FollowsKey, old)
+		}
+		p.HSet(FollowedByKey, trackId, next)
+		p.HSet(FollowsKey, next, trackId)
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to store relationship: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if err := unfollow(m.redis, trackId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "ok",
+		"followedBy": FollowedBy(m.redis, trackId),
+		"follows":    Follows(m.redis, trackId),
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// forgetRelationships removes every relationship trackId is in, from both ends, as part of p. It's for when the
+// track's going away altogether.
+func forgetRelationships(c redis.Cmdable, p redis.Pipeliner, trackId string) error {
+	apart, err := c.SMembers(fmt.Sprintf(ApartFormat, trackId)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to fetch tracks kept apart from %s: %v", trackId, err)
+	}
+	if next := FollowedBy(c, trackId); next != "" {
+		p.HDel(FollowsKey, next)
+	}
+	if previous := Follows(c, trackId); previous != "" {
+		p.HDel(FollowedByKey, previous)
+	}
+	p.HDel(FollowedByKey, trackId)
+	p.HDel(FollowsKey, trackId)
+	for _, other := range apart {
+		p.SRem(fmt.Sprintf(ApartFormat, other), trackId)
+	}
+	p.Del(fmt.Sprintf(ApartFormat, trackId))
+	return nil
+}
+
+// unfollow lets anything follow trackId again.
+func unfollow(c redis.Cmdable, trackId string) error {
+	next := FollowedBy(c, trackId)
+	if next == "" {
+		return nil
+	}
+	p := c.TxPipeline()
+	p.HDel(FollowedByKey, trackId)
+	p.HDel(FollowsKey, next)
+	if _, err := p.Exec(); err != nil {
+		return fmt.Errorf("failed to remove relationship: %v", err)
+	}
+	return nil
+}
+
+// handleApart lists the tracks that should never play next to this one.
+func (m *MusicHandler) handleApart(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	apart, err := m.redis.SMembers(fmt.Sprintf(ApartFormat, trackId)).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch relationships: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "apart": apart}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleApartPair keeps two tracks from playing next to each other (PUT), or lets them again (DELETE).
+func (m *MusicHandler) handleApartPair(w http.ResponseWriter, r *http.Request) {
+	trackId, other := mux.Vars(r)["track"], mux.Vars(r)["other"]
+	p := m.redis.TxPipeline()
+	if r.Method == http.MethodPut {
+		for _, t := range []string{trackId, other} {
+			if !m.redis.SIsMember(TrackPoolKey, t).Val() {
+				apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", t))
+				return
+			}
+		}
+		if trackId == other {
+			http.Error(w, "a track can't be kept apart from itself", http.StatusBadRequest)
+			return
+		}
+		if FollowedBy(m.redis, trackId) == other || FollowedBy(m.redis, other) == trackId {
+			http.Error(w, "one of those tracks has to follow the other", http.StatusConflict)
+			return
+		}
+		p.SAdd(fmt.Sprintf(ApartFormat, trackId), other)
+		p.SAdd(fmt.Sprintf(ApartFormat, other), trackId)
+	} else {
+		p.SRem(fmt.Sprintf(ApartFormat, trackId), other)
+		p.SRem(fmt.Sprintf(ApartFormat, other), trackId)
+	}
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store relationship: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
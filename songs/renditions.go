@@ -0,0 +1,210 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/apierror"
+	"github.com/PonyFest/music-control/screening"
+)
+
+// RenditionsFormat is a hash of rendition name to JSON-encoded Rendition for each track that has any. The audio
+// that was originally uploaded is always there too, as the "original" rendition, without being listed.
+const RenditionsFormat = "renditions-%s"
+const OriginalRendition = "original"
+
+var renditionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Rendition is another encoding of a track's audio, for players that can't or shouldn't play the original.
+type Rendition struct {
+	Name        string `json:"name"`
+	Key         string `json:"key"`
+	ContentType string `json:"contentType"`
+	// Bitrate is in kbps, if the uploader told us.
+	Bitrate int `json:"bitrate,omitempty"`
+	// Screening is the screener's verdict on the rendition, and ScreeningReason why, as for ScreeningKey. Flagged
+	// renditions are kept for someone to look at, but never played.
+	Screening       string `json:"screening,omitempty"`
+	ScreeningReason string `json:"screeningReason,omitempty"`
+}
+
+// Playable says whether a rendition can be sent to players.
+func (r Rendition) Playable() bool {
+	return r.Screening != screening.Flag
+}
+
+// Renditions returns a track's extra renditions, lowest bitrate first (with unknown bitrates last).
+func Renditions(c redis.Cmdable, trackId string) ([]Rendition, error) {
+	entries, err := c.HGetAll(fmt.Sprintf(RenditionsFormat, trackId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	renditions := make([]Rendition, 0, len(entries))
+	for _, entry := range entries {
+		var r Rendition
+		if err := json.Unmarshal([]byte(entry), &r); err != nil {
+			return nil, fmt.Errorf("corrupt rendition %q: %v", entry, err)
+		}
+		renditions = append(renditions, r)
+	}
+	sort.Slice(renditions, func(i, j int) bool {
+		a, b := renditions[i].Bitrate, renditions[j].Bitrate
+		if a == 0 || b == 0 {
+			return a != 0
+		}
+		return a < b
+	})
+	return renditions, nil
+}
+
+// handleRenditions lists a track's renditions.
+func (m *MusicHandler) handleRenditions(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	if !m.redis.SIsMember(TrackPoolKey, trackId).Val() {
+		apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+		return
+	}
+	renditions, err := Renditions(m.redis, trackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := make([]map[string]interface{}, len(renditions))
+	for i, rendition := range renditions {
+		result[i] = map[string]interface{}{
+			"name":        rendition.Name,
+			"contentType": rendition.ContentType,
+			"bitrate":     rendition.Bitrate,
+			"url":         m.urls.URL(rendition.Key),
+		}
+		if rendition.Screening != "" {
+			result[i]["screening"] = rendition.Screening
+			result[i]["screeningReason"] = rendition.ScreeningReason
+		}
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "renditions": result}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRendition adds or replaces (PUT, with the audio as the body and optionally `bitrate` in kbps) or removes
+// (DELETE) one of a track's renditions. We don't transcode anything ourselves; whoever has the tools does that.
+// Renditions are screened just like uploads, since they're played just like the original.
+func (m *MusicHandler) handleRendition(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	name := mux.Vars(r)["name"]
+	if !m.redis.SIsMember(TrackPoolKey, trackId).Val() {
+		apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+		return
+	}
+	if name == OriginalRendition || !renditionNamePattern.MatchString(name) {
+		http.Error(w, fmt.Sprintf("invalid rendition name %q", name), http.StatusBadRequest)
+		return
+	}
+	key := fmt.Sprintf(RenditionsFormat, trackId)
+	renditions, err := Renditions(m.redis, trackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	original := m.redis.HGet(trackId, ContentTypeKey).Val()
+	// others is every rendition but this one, so we can work out what formats the track ends up in.
+	var others []Rendition
+	for _, rendition := range renditions {
+		if rendition.Name != name {
+			others = append(others, rendition)
+		}
+	}
+
+	p := m.redis.TxPipeline()
+	switch r.Method {
+	case http.MethodDelete:
+		if len(others) == len(renditions) {
+			http.Error(w, fmt.Sprintf("track %q has no rendition %q", trackId, name), http.StatusNotFound)
+			return
+		}
+		p.HDel(key, name)
+		updateFormats(p, trackId, formatsOf(original, renditions), formatsOf(original, others))
+	case http.MethodPut:
+		bitrate := 0
+		if b := r.URL.Query().Get("bitrate"); b != "" {
+			var err error
+			if bitrate, err = strconv.Atoi(b); err != nil || bitrate <= 0 {
+				http.Error(w, fmt.Sprintf("invalid bitrate %q", b), http.StatusBadRequest)
+				return
+			}
+		}
+		f, ok := m.receiveUpload(w, r)
+		if !ok {
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		rendition, err := m.storeRendition(trackId, name, bitrate, f)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Processing music failed: %v", err), uploadStatus(err))
+			return
+		}
+		j, err := json.Marshal(rendition)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		p.HSet(key, name, j)
+		updateFormats(p, trackId, formatsOf(original, renditions), formatsOf(original, append(others, *rendition)))
+	}
+	if err := BumpLibraryVersion(p, trackId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store rendition: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Updated rendition %s of %s\n", name, trackId)
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+// storeRendition screens and uploads a rendition. Rejected renditions aren't stored at all, and flagged ones are
+// stored but not played.
+func (m *MusicHandler) storeRendition(trackId, name string, bitrate int, file io.ReadSeeker) (*Rendition, error) {
+	a, err := detectAudio(file)
+	if err != nil {
+		return nil, err
+	}
+	track := m.redis.HMGet(trackId, "title", "artist").Val()
+	title, _ := track[0].(string)
+	artist, _ := track[1].(string)
+	verdict, err := m.screen(file, screening.Track{ID: trackId, Title: title, Artist: artist, ContentType: a.ContentType})
+	if err != nil {
+		return nil, err
+	}
+	// Versioned like replaced audio, so nothing caching an old URL gets the wrong file.
+	version, err := m.redis.HIncrBy(trackId, AudioVersionKey, 1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't allocate a new audio version: %v", err)
+	}
+	key := m.objectKey(fmt.Sprintf("%s-%s-v%d", trackId, name, version), a.ContentType)
+	if err := m.upload(key, file, a.ContentType); err != nil {
+		return nil, err
+	}
+	return &Rendition{
+		Name:            name,
+		Key:             key,
+		ContentType:     a.ContentType,
+		Bitrate:         bitrate,
+		Screening:       verdict.Result,
+		ScreeningReason: verdict.Reason,
+	}, nil
+}
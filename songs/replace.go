@@ -0,0 +1,133 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/apierror"
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/screening"
+	"github.com/PonyFest/music-control/trackurl"
+)
+
+// AudioVersionKey counts how many times a track's audio has been replaced.
+const AudioVersionKey = "audioVersion"
+
+// replaceAudio swaps out the audio for an existing track, leaving everything else about it alone.
+// The new audio goes under a new key so that nothing caching the old URL gets the wrong file.
+func (m *MusicHandler) replaceAudio(w http.ResponseWriter, r *http.Request) {
+	trackId := mux.Vars(r)["track"]
+	if !m.redis.SIsMember(TrackPoolKey, trackId).Val() {
+		apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+		return
+	}
+	duration := r.URL.Query().Get("duration")
+	if duration != "" {
+		d, err := ParseDuration(duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		duration = strconv.FormatFloat(d, 'f', -1, 64)
+	}
+	f, ok := m.receiveUpload(w, r)
+	if !ok {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	key, contentType, verdict, err := m.storeReplacementAudio(trackId, f)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Processing music failed: %v", err), uploadStatus(err))
+		return
+	}
+	fields := append([]interface{}{trackurl.KeyField, key}, screeningFields(verdict)...)
+	if duration != "" {
+		fields = append(fields, DurationKey, duration)
+	}
+	oldContentType := m.redis.HGet(trackId, ContentTypeKey).Val()
+	renditions, err := Renditions(m.redis, trackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fields = append(fields, ContentTypeKey, contentType)
+	p := m.redis.TxPipeline()
+	p.HSet(trackId, fields...)
+	// It isn't that file any more.
+	p.HDel(trackId, ContentHashKey)
+	if duration == "" {
+		// the old duration is probably wrong now, and no duration is better than a wrong one.
+		p.HDel(trackId, DurationKey)
+	}
+	// Other renditions were made from the old audio, so they're wrong now too. The objects stay in storage.
+	p.Del(fmt.Sprintf(RenditionsFormat, trackId))
+	updateFormats(p, trackId, formatsOf(oldContentType, renditions), formatsOf(contentType, nil))
+	if err := BumpLibraryVersion(p, trackId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("audio uploaded but metadata storage failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	m.tracks.Invalidate(trackId)
+	if err := m.segmentForHLS(trackId, f.Name()); err != nil {
+		// The old segments are still there, which is better than nothing.
+		log.Printf("Failed to segment %s for HLS: %v.\n", trackId, err)
+	}
+
+	track, err := m.tracks.Get(trackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	track["trackId"] = trackId
+	track["trackUrl"] = m.urls.TrackURL(trackId, track)
+	j, err := json.Marshal(map[string]interface{}{
+		"event": "poolTrackUpdated",
+		"track": track,
+	})
+	if err == nil {
+		if err := events.Publish(m.redis, m.options.ChannelPrefix+EventsKey, j); err != nil {
+			log.Printf("Failed to publish track updated event: %v.\n", err)
+		}
+	} else {
+		log.Printf("Failed to encode JSON, somehow: %v.\n", err)
+	}
+	log.Printf("Replaced audio for %s with %s\n", trackId, key)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "track": track}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// storeReplacementAudio screens and uploads new audio for a track, returning its key, content type and the
+// screener's verdict. A flagged replacement is still stored, since the track is already on air either way.
+func (m *MusicHandler) storeReplacementAudio(trackId string, file io.ReadSeeker) (string, string, screening.Verdict, error) {
+	a, err := detectAudio(file)
+	if err != nil {
+		return "", "", screening.Verdict{}, err
+	}
+	verdict, err := m.screen(file, screening.Track{ID: trackId, Title: a.Title, Artist: a.Artist, ContentType: a.ContentType})
+	if err != nil {
+		return "", "", verdict, err
+	}
+	version, err := m.redis.HIncrBy(trackId, AudioVersionKey, 1).Result()
+	if err != nil {
+		return "", "", verdict, fmt.Errorf("couldn't allocate a new audio version: %v", err)
+	}
+	key := m.objectKey(fmt.Sprintf("%s-v%d", trackId, version), a.ContentType)
+	if err := m.upload(key, file, a.ContentType); err != nil {
+		return "", "", verdict, err
+	}
+	return key, a.ContentType, verdict, nil
+}
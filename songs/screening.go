@@ -0,0 +1,68 @@
+package songs
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/PonyFest/music-control/screening"
+)
+
+// ScreeningKey is the field in a track hash holding the screener's verdict on its audio, and ScreeningReasonKey why.
+// Tracks uploaded without a screener don't have one.
+const ScreeningKey = "screening"
+const ScreeningReasonKey = "screeningReason"
+
+// rejectedError is what we fail uploads with when the screener won't have them.
+type rejectedError struct {
+	reason string
+}
+
+func (e rejectedError) Error() string {
+	if e.reason == "" {
+		return "rejected by screening"
+	}
+	return fmt.Sprintf("rejected by screening: %s", e.reason)
+}
+
+// screen runs some audio past the screener, leaving the file back at the start. A screener that's broken flags
+// everything rather than letting it all through. It returns a rejectedError if the audio was rejected, and an empty
+// verdict if there's no screener.
+func (m *MusicHandler) screen(file io.ReadSeeker, track screening.Track) (screening.Verdict, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return screening.Verdict{}, fmt.Errorf("seeking to the start of the file somehow failed: %v", err)
+	}
+	if m.options.Screener == nil {
+		return screening.Verdict{}, nil
+	}
+	verdict, err := m.options.Screener.Screen(file, track)
+	if err != nil {
+		log.Printf("Failed to screen %s: %v.\n", track.ID, err)
+		verdict = screening.Verdict{Result: screening.Flag, Reason: fmt.Sprintf("screening failed: %v", err)}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return screening.Verdict{}, fmt.Errorf("seeking to the start of the file somehow failed: %v", err)
+	}
+	if verdict.Result == screening.Reject {
+		log.Printf("Screening rejected %s: %s\n", track.ID, verdict.Reason)
+		return verdict, rejectedError{reason: verdict.Reason}
+	}
+	return verdict, nil
+}
+
+// screeningFields are the track hash fields recording a verdict, if there is one.
+func screeningFields(verdict screening.Verdict) []interface{} {
+	if verdict.Result == "" {
+		return nil
+	}
+	return []interface{}{ScreeningKey, verdict.Result, ScreeningReasonKey, verdict.Reason}
+}
+
+// uploadStatus is the HTTP status for a failed upload.
+func uploadStatus(err error) int {
+	if _, ok := err.(rejectedError); ok {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,167 @@
+package songs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// uploadJobsKey is a hash of track ID to the JSON-encoded uploadJob for new tracks that have been received but not
+// yet fully processed, so we can pick up where we left off if we die halfway.
+const uploadJobsKey = "upload-jobs"
+
+type uploadJob struct {
+	TrackID  string            `json:"trackId"`
+	Server   string            `json:"server"`
+	Path     string            `json:"path"`
+	Duration string            `json:"duration"`
+	Explicit bool              `json:"explicit"`
+	License  map[string]string `json:"license"`
+	Started  int64             `json:"started"`
+	// SubmittedBy is who uploaded it, if they weren't an admin.
+	SubmittedBy string `json:"submittedBy,omitempty"`
+}
+
+// spoolPrefix starts the name of everything we put in the spool directory, so that servers sharing one only clean
+// up after themselves.
+func spoolPrefix() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return hostname + "-"
+}
+
+func (m *MusicHandler) spoolDir() (string, error) {
+	dir := m.options.SpoolDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("couldn't create spool directory: %v", err)
+	}
+	return dir, nil
+}
+
+// spoolFile creates a file to receive an upload in.
+func (m *MusicHandler) spoolFile() (*os.File, error) {
+	dir, err := m.spoolDir()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, spoolPrefix()+"upload-")
+}
+
+// spoolTempDir creates a scratch directory for working on an upload.
+func (m *MusicHandler) spoolTempDir(purpose string) (string, error) {
+	dir, err := m.spoolDir()
+	if err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(dir, spoolPrefix()+purpose+"-")
+}
+
+func (m *MusicHandler) startJob(job uploadJob) error {
+	j, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return m.redis.HSet(uploadJobsKey, job.TrackID, j).Err()
+}
+
+func (m *MusicHandler) finishJob(job uploadJob) {
+	if err := m.redis.HDel(uploadJobsKey, job.TrackID).Err(); err != nil {
+		log.Printf("Failed to forget upload job for %s: %v.\n", job.TrackID, err)
+	}
+}
+
+// RecoverUploads cleans up whatever this server left in the spool directory when it last stopped, then goes off to
+// finish processing any uploads it had fully received. Call it once at startup, before taking requests, so that it
+// can't mistake new uploads for leftovers.
+func (m *MusicHandler) RecoverUploads() {
+	entries, err := m.redis.HGetAll(uploadJobsKey).Result()
+	if err != nil {
+		log.Printf("Failed to look for interrupted uploads: %v.\n", err)
+		return
+	}
+	hostname := strings.TrimSuffix(spoolPrefix(), "-")
+	var jobs []uploadJob
+	keep := map[string]bool{}
+	for _, entry := range entries {
+		var job uploadJob
+		if err := json.Unmarshal([]byte(entry), &job); err != nil {
+			log.Printf("Ignoring corrupt upload job %q: %v.\n", entry, err)
+			continue
+		}
+		if job.Server == hostname {
+			jobs = append(jobs, job)
+			keep[filepath.Base(job.Path)] = true
+		}
+	}
+	m.cleanSpool(keep)
+	go func() {
+		for _, job := range jobs {
+			m.recoverUpload(job)
+		}
+	}()
+}
+
+func (m *MusicHandler) recoverUpload(job uploadJob) {
+	defer m.finishJob(job)
+	defer os.Remove(job.Path)
+	if m.redis.Exists(job.TrackID).Val() != 0 {
+		// We got as far as storing it, and just didn't get to tidy up.
+		return
+	}
+	f, err := os.Open(job.Path)
+	if err != nil {
+		log.Printf("Lost upload of %s from %s: %v.\n", job.TrackID, time.Unix(job.Started, 0), err)
+		return
+	}
+	defer f.Close()
+	trackID, err := uuid.Parse(job.TrackID)
+	if err != nil {
+		log.Printf("Upload job has an invalid track ID %q.\n", job.TrackID)
+		return
+	}
+	log.Printf("Resuming interrupted upload of %s.\n", job.TrackID)
+	if err := m.processMusicFile(f, trackID, job.Duration, job.Explicit, job.License, job.SubmittedBy); err != nil {
+		log.Printf("Failed to resume upload of %s: %v.\n", job.TrackID, err)
+		return
+	}
+	if err := m.segmentForHLS(job.TrackID, job.Path); err != nil {
+		log.Printf("Failed to segment %s for HLS: %v.\n", job.TrackID, err)
+	}
+}
+
+// cleanSpool removes everything this server left in the spool directory, except for the files named in keep.
+func (m *MusicHandler) cleanSpool(keep map[string]bool) {
+	dir, err := m.spoolDir()
+	if err != nil {
+		log.Printf("Failed to clean spool directory: %v.\n", err)
+		return
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to clean spool directory: %v.\n", err)
+		return
+	}
+	prefix := spoolPrefix()
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) || keep[entry.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("Failed to remove leftover %s: %v.\n", entry.Name(), err)
+			continue
+		}
+		log.Printf("Removed leftover %s from the spool directory.\n", entry.Name())
+	}
+}
@@ -0,0 +1,64 @@
+package songs
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// upload puts something in storage where anyone can fetch it.
+func (m *MusicHandler) upload(key string, body io.Reader, contentType string) error {
+	return m.storage.Put(m.ctx, key, body, contentType)
+}
+
+// extensions are the file extensions for the content types we store.
+var extensions = map[string]string{
+	contentTypeMP3:  "mp3",
+	contentTypeMP4:  "m4a",
+	contentTypeFLAC: "flac",
+	contentTypeOgg:  "ogg",
+	contentTypeOpus: "opus",
+	"audio/wav":     "wav",
+}
+
+// Extension is the file extension for audio of contentType, or "bin" if it isn't something we store.
+func Extension(contentType string) string {
+	if ext, ok := extensions[contentType]; ok {
+		return ext
+	}
+	return "bin"
+}
+
+// ValidateKeyLayout checks a key layout can make a unique key for everything we store.
+func ValidateKeyLayout(layout string) error {
+	if layout != "" && !strings.Contains(layout, "{uuid}") {
+		return fmt.Errorf("key layout %q needs a {uuid} in it somewhere", layout)
+	}
+	if strings.HasPrefix(layout, "/") {
+		return fmt.Errorf("key layout %q can't start with a slash", layout)
+	}
+	return nil
+}
+
+// objectKey is where to store some audio, according to the configured key layout. Keys are recorded with whatever
+// they're for, so changing the layout only affects new uploads.
+func (m *MusicHandler) objectKey(name, contentType string) string {
+	return KeyFor(m.options.KeyLayout, name, contentType)
+}
+
+// KeyFor is where layout puts something, where name is what makes it unique, and also the whole key if there's no
+// layout.
+func KeyFor(layout, name, contentType string) string {
+	if layout == "" {
+		return name
+	}
+	now := time.Now().UTC()
+	return strings.NewReplacer(
+		"{uuid}", name,
+		"{yyyy}", now.Format("2006"),
+		"{mm}", now.Format("01"),
+		"{dd}", now.Format("02"),
+		"{ext}", Extension(contentType),
+	).Replace(layout)
+}
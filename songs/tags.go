@@ -0,0 +1,74 @@
+package songs
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// TagsKey is the field in a track hash holding its tags, comma separated.
+const TagsKey = "tags"
+
+// TagFormat is the key for the set of tracks with a tag, mirroring the tags fields.
+const TagFormat = "tag-%s"
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9 _-]{0,49}$`)
+
+// setTagsScript replaces a track's tags, keeping the tag sets in sync with whatever the track had before.
+// KEYS: track hash. ARGV: tag set key prefix, new tags (comma separated, empty for none).
+var setTagsScript = redis.NewScript(`
+local old = redis.call("HGET", KEYS[1], "tags")
+if old then
+	for tag in string.gmatch(old, "[^,]+") do
+		redis.call("SREM", ARGV[1] .. tag, KEYS[1])
+	end
+end
+if ARGV[2] == "" then
+	redis.call("HDEL", KEYS[1], "tags")
+	return true
+end
+for tag in string.gmatch(ARGV[2], "[^,]+") do
+	redis.call("SADD", ARGV[1] .. tag, KEYS[1])
+end
+redis.call("HSET", KEYS[1], "tags", ARGV[2])
+return true
+`)
+
+// NormaliseTag tidies up a tag and checks it's something we can store.
+func NormaliseTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !tagPattern.MatchString(tag) {
+		return "", fmt.Errorf("invalid tag %q: tags are up to 50 letters, numbers, spaces, dashes and underscores", tag)
+	}
+	return tag, nil
+}
+
+// normaliseTags tidies up a comma separated list of tags, sorting them and dropping duplicates.
+func normaliseTags(value string) (string, error) {
+	seen := map[string]bool{}
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		tag, err := NormaliseTag(tag)
+		if err != nil {
+			return "", err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ","), nil
+}
+
+// setTags queues up replacing a track's tags. It always sends the script itself, since it might be running in a
+// transaction, where we can't fall back to that after finding out the script isn't cached.
+func setTags(c redis.Cmdable, trackId, tags string) {
+	setTagsScript.Eval(c, []string{trackId}, fmt.Sprintf(TagFormat, ""), tags)
+}
@@ -0,0 +1,72 @@
+package songs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// testTrackFormat is the ID of the current test track of each kind, "tone" or "silence", for as long as it lasts.
+const testTrackFormat = "test-track-%s"
+
+// testTrackTTL is how long a test track lasts before we make another. It only needs to outlive a test.
+const testTrackTTL = 24 * time.Hour
+
+// testTrackSeconds is how long a test track plays for: long enough for a player to say it's playing it.
+const testTrackSeconds = 5
+
+// TestTrack is a short track for checking streams work: a quiet 440 Hz tone, or silence if silent is set, so it can
+// be played on a stream people are listening to. It's an interstitial, so it never turns up anywhere it isn't
+// queued.
+func (m *MusicHandler) TestTrack(silent bool) (string, error) {
+	kind := "tone"
+	if silent {
+		kind = "silence"
+	}
+	key := fmt.Sprintf(testTrackFormat, kind)
+	if trackId, err := m.redis.Get(key).Result(); err == nil && m.redis.Exists(trackId).Val() != 0 {
+		return trackId, nil
+	}
+	trackId, err := m.StoreInterstitial(testTone(silent), "audio/wav", "Test "+kind, testTrackTTL)
+	if err != nil {
+		return "", fmt.Errorf("failed to store test track: %v", err)
+	}
+	p := m.redis.TxPipeline()
+	p.HSet(trackId, "artist", "Music Control", DurationKey, testTrackSeconds)
+	// The ID expires a little before the track, so we never hand out one that's about to go.
+	p.Set(key, trackId, testTrackTTL-time.Hour)
+	if _, err := p.Exec(); err != nil {
+		return "", fmt.Errorf("failed to store test track: %v", err)
+	}
+	return trackId, nil
+}
+
+// testTone makes a 16-bit mono WAV file of a tone at -20 dBFS, or silence.
+func testTone(silent bool) []byte {
+	const rate = 22050
+	const samples = rate * testTrackSeconds
+	var b bytes.Buffer
+	write := func(v interface{}) { _ = binary.Write(&b, binary.LittleEndian, v) }
+	b.WriteString("RIFF")
+	write(uint32(36 + samples*2))
+	b.WriteString("WAVEfmt ")
+	write(uint32(16))
+	write(uint16(1)) // PCM
+	write(uint16(1)) // mono
+	write(uint32(rate))
+	write(uint32(rate * 2))
+	write(uint16(2))
+	write(uint16(16))
+	b.WriteString("data")
+	write(uint32(samples * 2))
+	data := make([]int16, samples)
+	if !silent {
+		for i := range data {
+			data[i] = int16(0.1 * math.MaxInt16 * math.Sin(2*math.Pi*440*float64(i)/rate))
+		}
+	}
+	write(data)
+	return b.Bytes()
+}
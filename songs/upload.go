@@ -1,165 +1,447 @@
 package songs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/dhowden/tag"
 	"github.com/go-redis/redis/v7"
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/auth"
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/screening"
+	"github.com/PonyFest/music-control/storage"
+	"github.com/PonyFest/music-control/tracing"
+	"github.com/PonyFest/music-control/trackcache"
+	"github.com/PonyFest/music-control/trackurl"
 )
 
 const TrackPoolKey = "track-pool"
 const EventsKey = "events"
 
+// LibraryVersionKey is bumped every time anything about the library changes, and LibraryModifiedKey records when.
+const LibraryVersionKey = "library-version"
+const LibraryModifiedKey = "library-modified"
+
+// LibraryChangesKey orders tracks by the library version they last changed in, and LibraryAdditionsKey by the
+// version they joined the pool in. LibraryChangesSinceKey is the oldest version they can tell you what changed since.
+const LibraryChangesKey = "library-changes"
+const LibraryAdditionsKey = "library-additions"
+const LibraryChangesSinceKey = "library-changes-since"
+
+// ExplicitTracksKey is a set of tracks that streams can choose not to play.
+const ExplicitTracksKey = "explicit-tracks"
+
+// PlaylistFormat is the key for a set of tracks making up a named playlist.
+const PlaylistFormat = "playlist-%s"
+
+// DurationKey is the field in a track hash holding its length in seconds, if we know it.
+const DurationKey = "duration"
+
+// GainKey is the field in a track hash holding how many dB to adjust its volume by when we mix it ourselves.
+const GainKey = "gain"
+
+// AlbumKey and TrackNumberKey are the fields in a track hash holding the release it's from and where it comes on
+// it, so whole albums can be queued in order.
+const AlbumKey = "album"
+const TrackNumberKey = "trackNumber"
+
+// StartAtKey is the field in a track hash holding how many seconds in players should start it, to skip an awkward
+// opening without editing the file.
+const StartAtKey = "startAt"
+
+// BPMKey is the field in a track hash holding its tempo, in beats per minute, for streams that pick by tempo.
+const BPMKey = "bpm"
+
 type MusicHandler struct {
-	s3     *s3.S3
-	bucket string
-	redis  *redis.Client
-	root   string
+	mux     *mux.Router
+	storage storage.Storage
+	redis   *redis.Client
+	tracks  *trackcache.Cache
+	urls    *trackurl.Builder
+	options Options
+	// limits are the upload limits, which can change while we're running. They're shared by every copy of the
+	// handler.
+	limits *limits
+	// ctx is what storage requests are made with, so they're traced along with the request they're for.
+	ctx context.Context
 }
 
-func New(s3 *s3.S3, bucket string, redis *redis.Client, root string) *MusicHandler {
-	return &MusicHandler{
-		s3:     s3,
-		bucket: bucket,
-		redis:  redis,
-		root:   root,
+// Options holds the less essential knobs for track handling.
+type Options struct {
+	// MaxUploadBytes is the largest file we'll accept an upload of. Zero means no limit.
+	MaxUploadBytes int64
+	// DailyUploadQuota is how many bytes a single client may upload per day. Zero means no limit.
+	DailyUploadQuota int64
+	// ChannelPrefix goes in front of every pub/sub channel we publish to.
+	ChannelPrefix string
+	// FFmpeg is the path to ffmpeg, which we use to segment uploads for HLS. Empty means we don't.
+	FFmpeg string
+	// SpoolDir is where uploads wait while we process them. Empty means the system temporary directory.
+	SpoolDir string
+	// Screener, if set, vets new audio before we store it.
+	Screener screening.Screener
+	// KeyLayout is where new audio goes in the bucket, like "music/{yyyy}/{uuid}.{ext}". Empty means the bucket
+	// root, named by ID alone.
+	KeyLayout string
+	// QuarantineAfter is how many playback errors in a day take a track out of selection. Zero means never.
+	QuarantineAfter int
+}
+
+func New(store storage.Storage, redis *redis.Client, tracks *trackcache.Cache, urls *trackurl.Builder, options Options) *MusicHandler {
+	m := &MusicHandler{
+		mux:     mux.NewRouter(),
+		storage: store,
+		redis:   redis,
+		tracks:  tracks,
+		urls:    urls,
+		options: options,
+		limits:  &limits{maxUploadBytes: options.MaxUploadBytes, dailyUploadQuota: options.DailyUploadQuota},
+		ctx:     context.Background(),
+	}
+	m.handle("/expiring", (*MusicHandler).handleExpiring).Methods(http.MethodGet)
+	m.handle("/export", (*MusicHandler).handleExport).Methods(http.MethodGet)
+	m.handle("/changes", (*MusicHandler).handleChanges).Methods(http.MethodGet)
+	m.handle("/formats", (*MusicHandler).handleFormats).Methods(http.MethodGet)
+	m.handle("/import", (*MusicHandler).handleImport).Methods(http.MethodPost)
+	m.handle("/pending", (*MusicHandler).handlePending).Methods(http.MethodGet)
+	m.handle("/quarantined", (*MusicHandler).handleQuarantined).Methods(http.MethodGet)
+	m.handle("/{track}/approve", (*MusicHandler).handleApprove).Methods(http.MethodPost)
+	m.handle("/{track}/reject", (*MusicHandler).handleReject).Methods(http.MethodPost)
+	m.handle("/{track}/playback-error", (*MusicHandler).handlePlaybackError).Methods(http.MethodPost)
+	m.handle("/{track}/release", (*MusicHandler).handleRelease).Methods(http.MethodPost)
+	m.handle("/{track}/comments", (*MusicHandler).handleComments).Methods(http.MethodGet, http.MethodPost)
+	m.handle("/{track}/comments/{comment}", (*MusicHandler).handleComment).Methods(http.MethodDelete)
+	m.handle("/{track}/followedBy", (*MusicHandler).handleFollowedBy).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	m.handle("/{track}/apart", (*MusicHandler).handleApart).Methods(http.MethodGet)
+	m.handle("/{track}/apart/{other}", (*MusicHandler).handleApartPair).Methods(http.MethodPut, http.MethodDelete)
+	m.handle("/{track}/audio", (*MusicHandler).replaceAudio).Methods(http.MethodPut)
+	m.handle("/{track}/license", (*MusicHandler).handleLicense).Methods(http.MethodPut, http.MethodPatch)
+	m.handle("/{track}/rating", (*MusicHandler).handleRating).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	m.handle("/{track}/renditions", (*MusicHandler).handleRenditions).Methods(http.MethodGet)
+	m.handle("/{track}/renditions/{name}", (*MusicHandler).handleRendition).Methods(http.MethodPut, http.MethodDelete)
+	return m
+}
+
+// handle routes path to f, called on a copy of the handler bound to the request's context.
+func (m *MusicHandler) handle(path string, f func(*MusicHandler, http.ResponseWriter, *http.Request)) *mux.Route {
+	return m.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		f(m.withContext(r.Context()), w, r)
+	})
+}
+
+// withContext returns a copy of the handler whose redis commands and storage requests are traced as part of ctx's
+// span, if it has one.
+func (m *MusicHandler) withContext(ctx context.Context) *MusicHandler {
+	if tracing.FromContext(ctx) == nil {
+		return m
 	}
+	mc := *m
+	mc.redis = m.redis.WithContext(ctx)
+	mc.ctx = ctx
+	return &mc
 }
 
 func (m *MusicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// We're mounted with our prefix stripped, so the collection itself is the empty path.
+	if r.URL.Path != "" && r.URL.Path != "/" {
+		m.mux.ServeHTTP(w, r)
+		return
+	}
+	m = m.withContext(r.Context())
 	switch r.Method {
 	case http.MethodPut:
 		m.addTrack(w, r)
 	case http.MethodGet:
 		m.listTracks(w, r)
+	case http.MethodPatch:
+		m.bulkEdit(w, r)
 	}
 }
 
+// listTracks lists the whole library. With `preview=true`, each track also gets a previewUrl covering about its first
+// 30 seconds, and the previewRange to request it with.
 func (m *MusicHandler) listTracks(w http.ResponseWriter, r *http.Request) {
+	preview, _ := strconv.ParseBool(r.URL.Query().Get("preview"))
+	if preview {
+		// The preview URLs expire, so a listing with them in is never still good later.
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		// We fetch the version before the library, so at worst a concurrent change makes us send a stale version
+		// with a fresher listing, and the client will just fetch it again next time.
+		version, modified := m.libraryVersion()
+		etag := fmt.Sprintf(`"%d"`, version)
+		// Signed track URLs expire, so the listing is also stale once they're due to be signed again.
+		if window, started := m.urls.Window(); window != 0 {
+			etag = fmt.Sprintf(`"%d-%d"`, version, window)
+			if started.After(modified) {
+				modified = started
+			}
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		if notModified(r, etag, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	trackIds, err := m.redis.SMembers(TrackPoolKey).Result()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to list track IDs: %v", err), http.StatusInternalServerError)
 		return
 	}
-	p := m.redis.Pipeline()
-	results := map[string]*redis.StringStringMapCmd{}
-	for _, trackId := range trackIds {
-		results[trackId] = p.HGetAll(trackId)
-	}
-	if _, err := p.Exec(); err != nil {
+	// static typing is for wimps
+	ret, err := m.tracks.GetMany(trackIds)
+	if err != nil {
 		http.Error(w, fmt.Sprintf("Looking up track data failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-
-	// static typing is for wimps
-	ret := map[string]map[string]string{}
-	for trackId, trackResult := range results {
-		track, err := trackResult.Result()
-		if err != nil {
-			log.Printf("Couldn't look up data for track %q: %v\n", trackId, err)
-		}
+	for trackId, track := range ret {
 		track["trackId"] = trackId
-		track["trackUrl"] = m.root + trackId
-		ret[trackId] = track
+		track["trackUrl"] = m.urls.TrackURL(trackId, track)
+		if preview {
+			if err := m.addPreview(trackId, track); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 	}
 	if err := json.NewEncoder(w).Encode(map[string]interface{}{"tracks": ret}); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to encode json", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to encode json: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
 func (m *MusicHandler) addTrack(w http.ResponseWriter, r *http.Request) {
-	f, err := ioutil.TempFile("", "tmpmusic")
+	// We can't easily work out the duration ourselves, so we let the uploader tell us if they know.
+	duration := r.URL.Query().Get("duration")
+	if duration != "" {
+		d, err := ParseDuration(duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		duration = strconv.FormatFloat(d, 'f', -1, 64)
+	}
+	explicit := false
+	if e := r.URL.Query().Get("explicit"); e != "" {
+		var err error
+		if explicit, err = strconv.ParseBool(e); err != nil {
+			http.Error(w, fmt.Sprintf("invalid explicit flag %q: %v", e, err), http.StatusBadRequest)
+			return
+		}
+	}
+	// The body is the audio, so everything else has to come in the query string.
+	license, err := licenseFields(r.URL.Query())
 	if err != nil {
-		http.Error(w, "creating temp file failed", http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("invalid allowedUntil: %v", err), http.StatusBadRequest)
+		return
+	}
+	f, ok := m.receiveUpload(w, r)
+	if !ok {
 		return
 	}
 	defer os.Remove(f.Name())
-	if _, err := io.Copy(f, r.Body); err != nil {
-		http.Error(w, "saving audio failed", http.StatusInternalServerError)
+	defer f.Close()
+	// Two people uploading the same file get the same track, however close together they do it.
+	hash, err := contentHash(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		http.Error(w, "seeking a file failed I guess?", http.StatusInternalServerError)
+	newTrackId := uuid.New().String()
+	existing, release, err := m.claimUpload(r.Context(), hash, newTrackId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	trackID, err := m.processMusicFile(f)
+	if existing != "" {
+		log.Printf("Upload is the same file as %s.\n", existing)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "uuid": existing, "duplicate": true})
+		return
+	}
+	// Deferred so that even a panic lets go of the file, rather than leaving identical uploads waiting on the lock.
+	made := false
+	defer func() { release(made) }()
+	// If we die before we're done, RecoverUploads can finish the job.
+	hostname, _ := os.Hostname()
+	job := uploadJob{
+		TrackID:  newTrackId,
+		Server:   hostname,
+		Path:     f.Name(),
+		Duration: duration,
+		Explicit: explicit,
+		License:  license,
+		Started:  time.Now().Unix(),
+	}
+	// Anyone but an admin is submitting music for review.
+	if role := auth.RoleOf(r); role != auth.RoleAdmin {
+		job.SubmittedBy = role
+	}
+	if err := m.startJob(job); err != nil {
+		log.Printf("Failed to record upload job for %s; it won't survive a restart: %v.\n", job.TrackID, err)
+	}
+	defer m.finishJob(job)
+	trackID := uuid.MustParse(job.TrackID)
+	err = m.processMusicFile(f, trackID, duration, explicit, license, job.SubmittedBy)
+	made = err == nil
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Processing music failed: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Processing music failed: %v", err), uploadStatus(err))
 		return
 	}
+	// The track is perfectly usable without HLS, so this isn't worth failing the upload over.
+	if err := m.segmentForHLS(trackID.String(), f.Name()); err != nil {
+		log.Printf("Failed to segment %s for HLS: %v.\n", trackID, err)
+	}
 	_, _ = w.Write([]byte(fmt.Sprintf(`{"status": "ok", "uuid": "%s"}`, trackID)))
 }
 
-var mimeTypeMapping = map[tag.Format]string{
-	tag.ID3v1:   "audio/mpeg",
-	tag.ID3v2_2: "audio/mpeg",
-	tag.ID3v2_3: "audio/mpeg",
-	tag.ID3v2_4: "audio/mpeg",
-	tag.MP4:     "audio/aac",
-	tag.VORBIS:  "audio/ogg",
+// receiveUpload saves the request body to a temporary file, enforcing size limits and quotas, and returns it ready
+// to read from the start. The caller must clean it up. If it returns false it has already responded with an error.
+func (m *MusicHandler) receiveUpload(w http.ResponseWriter, r *http.Request) (*os.File, bool) {
+	maxUploadBytes, _ := m.uploadLimits()
+	if maxUploadBytes > 0 {
+		if r.ContentLength > maxUploadBytes {
+			http.Error(w, fmt.Sprintf("uploads are limited to %d bytes", maxUploadBytes), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	}
+	if r.ContentLength > 0 && !m.quotaAllows(r, r.ContentLength) {
+		http.Error(w, "daily upload quota exceeded", http.StatusTooManyRequests)
+		return nil, false
+	}
+	f, err := m.spoolFile()
+	if err != nil {
+		http.Error(w, "creating temp file failed", http.StatusInternalServerError)
+		return nil, false
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	size, err := io.Copy(f, r.Body)
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			http.Error(w, fmt.Sprintf("uploads are limited to %d bytes", maxUploadBytes), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, "saving audio failed", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !m.consumeQuota(r, size) {
+		http.Error(w, "daily upload quota exceeded", http.StatusTooManyRequests)
+		return nil, false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "seeking a file failed I guess?", http.StatusInternalServerError)
+		return nil, false
+	}
+	ok = true
+	return f, true
 }
 
-func (m *MusicHandler) processMusicFile(file io.ReadSeeker) (uuid.UUID, error) {
-	t, err := tag.ReadFrom(file)
+// processMusicFile stores an uploaded track. Tracks with a submittedBy, or that screening flags, go into moderation
+// rather than the pool.
+func (m *MusicHandler) processMusicFile(file io.ReadSeeker, trackID uuid.UUID, duration string, explicit bool, license map[string]string, submittedBy string) error {
+	a, err := detectAudio(file)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("couldn't parse file: %v", err)
-	}
-	ft := t.Format()
-	if ft == tag.VORBIS {
-		return uuid.Nil, fmt.Errorf("not a media type: %q", ft)
+		return err
 	}
-	log.Printf("Adding %s - %s (%s)...\n", t.Title(), t.Artist(), t.FileType())
+	log.Printf("Adding %s - %s (%s)...\n", a.Title, a.Artist, a.ContentType)
 
-	trackID := uuid.New()
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		return uuid.Nil, fmt.Errorf("seeking to the start of the file somehow failed: %v", err)
+	verdict, err := m.screen(file, screening.Track{ID: trackID.String(), Title: a.Title, Artist: a.Artist, ContentType: a.ContentType})
+	if err != nil {
+		return err
 	}
-	if _, err = m.s3.PutObject(&s3.PutObjectInput{
-		Bucket:      &m.bucket,
-		Body:        file,
-		Key:         aws.String(trackID.String()),
-		ACL:         aws.String("public-read"),
-		ContentType: aws.String(mimeTypeMapping[ft]),
-	}); err != nil {
-		return uuid.Nil, fmt.Errorf("upload to 'S3' failed: %v", err)
+	// Flagged tracks wait for someone to look at them, just like submissions do.
+	pending := submittedBy != "" || verdict.Result == screening.Flag
+	key := m.objectKey(trackID.String(), a.ContentType)
+	if err := m.upload(key, file, a.ContentType); err != nil {
+		return err
 	}
-	if err := m.redis.Watch(func(tx *redis.Tx) error {
-		if err := tx.HSet(trackID.String(), "title", t.Title(), "artist", t.Artist()).Err(); err != nil {
-			return err
+	metadata := map[string]string{"title": a.Title, "artist": a.Artist, AlbumKey: normaliseText(a.Album)}
+	normaliseMetadata(metadata)
+	if a.TrackNumber > 0 {
+		metadata[TrackNumberKey] = strconv.Itoa(a.TrackNumber)
+	}
+	// Everything goes in at once, so the track is never half there, or there but in neither the pool nor the
+	// moderation queue.
+	trackId := trackID.String()
+	fields := []interface{}{"title", metadata["title"], "artist", metadata["artist"], ContentTypeKey, a.ContentType}
+	for _, k := range []string{OriginalTitleKey, OriginalArtistKey, FeaturesKey, AlbumKey, TrackNumberKey} {
+		if metadata[k] != "" {
+			fields = append(fields, k, metadata[k])
 		}
-		if err := tx.SAdd(TrackPoolKey, trackID.String()).Err(); err != nil {
+	}
+	if duration != "" {
+		fields = append(fields, DurationKey, duration)
+	}
+	if explicit {
+		fields = append(fields, "explicit", "true")
+	}
+	if key != trackId {
+		fields = append(fields, trackurl.KeyField, key)
+	}
+	fields = append(fields, screeningFields(verdict)...)
+	if pending {
+		fields = append(fields, ModerationKey, ModerationPending)
+		if submittedBy != "" {
+			fields = append(fields, SubmittedByKey, submittedBy)
+		}
+	}
+	p := m.redis.TxPipeline()
+	p.HSet(trackId, fields...)
+	if explicit {
+		p.SAdd(ExplicitTracksKey, trackId)
+	}
+	updateFormats(p, trackId, nil, formatsOf(a.ContentType, nil))
+	if len(license) > 0 {
+		setLicense(p, trackId, license)
+	}
+	if pending {
+		p.SAdd(PendingTracksKey, trackId)
+	} else {
+		p.SAdd(TrackPoolKey, trackId)
+		if err := addedToLibrary(p, trackId); err != nil {
 			return err
 		}
-		return nil
-	}); err != nil {
-		return uuid.Nil, fmt.Errorf("file uploaded but metadata storage failed: %v", err)
+	}
+	if _, err := p.Exec(); err != nil {
+		return fmt.Errorf("file uploaded but metadata storage failed: %v", err)
+	}
+	event := "poolTrackAdded"
+	if pending {
+		event = "trackSubmitted"
 	}
 	j, err := json.Marshal(map[string]interface{}{
-		"event": "poolTrackAdded",
+		"event": event,
 		"track": map[string]string{
 			"trackId":  trackID.String(),
-			"trackUrl": m.root + trackID.String(),
-			"title":    t.Title(),
-			"artist":   t.Artist(),
+			"trackUrl": m.urls.URL(key),
+			"title":    metadata["title"],
+			"artist":   metadata["artist"],
 		},
 	})
 	if err == nil {
-		if err := m.redis.Publish(EventsKey, j).Err(); err != nil {
+		if err := events.Publish(m.redis, m.options.ChannelPrefix+EventsKey, j); err != nil {
 			log.Printf("Failed to publish track added event: %v.\n", err)
 		}
 	} else {
 		log.Printf("Failed to encode JSON, somehow: %v.\n", err)
 	}
 	log.Printf("Uploaded %s\n", trackID)
-	return trackID, nil
+	return nil
 }
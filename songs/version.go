@@ -0,0 +1,104 @@
+package songs
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// maxLibraryChanges is about how many tracks library-changes remembers. Past that, the ones that changed longest
+// ago are forgotten, and anyone who last looked before then has to fetch the whole listing again.
+const maxLibraryChanges = 10000
+
+// bumpScript bumps the library version (KEYS[1]) and records when (KEYS[2]) as ARGV[1], and that the tracks in the
+// rest of ARGV changed in the new version (KEYS[3]), and joined the pool then too (KEYS[5]) if ARGV[2] is "1". A
+// change without any tracks means we can't say what changed before now (KEYS[4]), so there's nothing worth keeping.
+// Otherwise, once more than ARGV[3] tracks have changed, the oldest versions' changes are dropped, and KEYS[4]
+// moves up past them.
+var bumpScript = redis.NewScript(`
+local version = redis.call("INCR", KEYS[1])
+redis.call("SET", KEYS[2], ARGV[1])
+if #ARGV == 3 then
+	redis.call("SET", KEYS[4], version)
+	redis.call("DEL", KEYS[3], KEYS[5])
+	return version
+end
+redis.call("SETNX", KEYS[4], version - 1)
+for i = 4, #ARGV do
+	redis.call("ZADD", KEYS[3], version, ARGV[i])
+	if ARGV[2] == "1" then
+		redis.call("ZADD", KEYS[5], version, ARGV[i])
+	end
+end
+local excess = redis.call("ZCARD", KEYS[3]) - tonumber(ARGV[3])
+if excess > 0 then
+	-- Versions are dropped whole, so whatever's left is everything that changed since the new KEYS[4].
+	local oldest = redis.call("ZRANGE", KEYS[3], excess - 1, excess - 1, "WITHSCORES")
+	local trimmed = tonumber(oldest[2])
+	redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", trimmed)
+	redis.call("ZREMRANGEBYSCORE", KEYS[5], "-inf", trimmed)
+	if trimmed > tonumber(redis.call("GET", KEYS[4])) then
+		redis.call("SET", KEYS[4], trimmed)
+	end
+end
+return version
+`)
+
+// BumpLibraryVersion should be called whenever anything changes about the library, so that clients caching the
+// track listing know to fetch it again, with the tracks that changed so they can fetch just those.
+func BumpLibraryVersion(c redis.Cmdable, trackIds ...string) error {
+	return bumpLibraryVersion(c, false, trackIds)
+}
+
+// addedToLibrary is BumpLibraryVersion for tracks that have just joined the pool.
+func addedToLibrary(c redis.Cmdable, trackIds ...string) error {
+	return bumpLibraryVersion(c, true, trackIds)
+}
+
+func bumpLibraryVersion(c redis.Cmdable, added bool, trackIds []string) error {
+	keys := []string{LibraryVersionKey, LibraryModifiedKey, LibraryChangesKey, LibraryChangesSinceKey, LibraryAdditionsKey}
+	args := []interface{}{time.Now().Unix(), "0", maxLibraryChanges}
+	if added {
+		args[1] = "1"
+	}
+	for _, trackId := range trackIds {
+		args = append(args, trackId)
+	}
+	if err := bumpScript.Eval(c, keys, args...).Err(); err != nil {
+		return fmt.Errorf("failed to bump library version: %v", err)
+	}
+	return nil
+}
+
+func (m *MusicHandler) libraryVersion() (int64, time.Time) {
+	p := m.redis.Pipeline()
+	version := p.Get(LibraryVersionKey)
+	modified := p.Get(LibraryModifiedKey)
+	// A library that has never changed doesn't have either of these, which is fine - they're both zero.
+	_, _ = p.Exec()
+	v, _ := version.Int64()
+	t, _ := modified.Int64()
+	return v, time.Unix(t, 0)
+}
+
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		// If-None-Match takes precedence over If-Modified-Since when both are present.
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil && !modified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
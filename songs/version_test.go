@@ -0,0 +1,44 @@
+package songs
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+func TestBumpTrimsChanges(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer c.Close()
+	keys := []string{LibraryVersionKey, LibraryModifiedKey, LibraryChangesKey, LibraryChangesSinceKey, LibraryAdditionsKey}
+	bump := func(added string, trackIds ...interface{}) {
+		t.Helper()
+		if err := bumpScript.Run(c, keys, append([]interface{}{0, added, 3}, trackIds...)...).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bump("1", "a")
+	bump("1", "b", "c")
+	bump("0", "d")
+	if got := c.ZCard(LibraryChangesKey).Val(); got != 3 {
+		t.Errorf("got %d changes, want 3", got)
+	}
+	if got := c.Get(LibraryChangesSinceKey).Val(); got != "1" {
+		t.Errorf("got changes since %s, want 1", got)
+	}
+	if got := c.ZRange(LibraryAdditionsKey, 0, -1).Val(); len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Errorf("got additions %v, want [b c]", got)
+	}
+	bump("0")
+	if got := c.Exists(LibraryChangesKey, LibraryAdditionsKey).Val(); got != 0 {
+		t.Errorf("changes survived a change without tracks")
+	}
+	if got := c.Get(LibraryChangesSinceKey).Val(); got != "4" {
+		t.Errorf("got changes since %s, want 4", got)
+	}
+}
@@ -0,0 +1,79 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/songs"
+	"github.com/PonyFest/music-control/streams"
+)
+
+// gauge is a metric with a value per stream.
+type gauge struct {
+	name, help string
+	value      func(r streams.StreamReserves) float64
+}
+
+var reserveGauges = []gauge{
+	{"music_control_stream_eligible_tracks", "Tracks random picks could choose without repeating anything recently played.",
+		func(r streams.StreamReserves) float64 { return float64(r.EligibleTracks) }},
+	{"music_control_stream_queued_seconds", "Seconds of audio up next, not counting tracks of unknown duration.",
+		func(r streams.StreamReserves) float64 { return r.QueuedSeconds }},
+	{"music_control_stream_queued_tracks", "Tracks up next.",
+		func(r streams.StreamReserves) float64 { return float64(r.QueuedEntries) }},
+	{"music_control_stream_queued_unknown_durations", "Tracks up next whose duration we don't know.",
+		func(r streams.StreamReserves) float64 { return float64(r.QueuedUnknown) }},
+	{"music_control_stream_pending_tracks", "Random picks lined up in advance.",
+		func(r streams.StreamReserves) float64 { return float64(r.Pending) }},
+}
+
+// escapeLabel makes a label value safe for the Prometheus text format.
+var escapeLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+// ServeMetrics reports how close each stream is to running out of music, in the Prometheus text format, so alerts
+// can go off well before a player is told there's nothing to play. Alert on eligible tracks and queued seconds
+// both being low: either one alone is fine.
+func (h *Handler) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	reserves, err := h.streams.Reserves()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	poolSize, err := h.redis.SCard(songs.TrackPoolKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to count tracks: %v", err), http.StatusInternalServerError)
+		return
+	}
+	names := make([]string, 0, len(reserves))
+	for stream := range reserves {
+		names = append(names, stream)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP music_control_library_tracks Tracks in the library.\n")
+	fmt.Fprintf(&b, "# TYPE music_control_library_tracks gauge\n")
+	fmt.Fprintf(&b, "music_control_library_tracks %d\n", poolSize)
+	fmt.Fprintf(&b, "# HELP music_control_event_subscription_restarts_total Times event subscribers resubscribed after losing redis.\n")
+	fmt.Fprintf(&b, "# TYPE music_control_event_subscription_restarts_total counter\n")
+	fmt.Fprintf(&b, "music_control_event_subscription_restarts_total %d\n", events.SubscriptionRestarts())
+	fmt.Fprintf(&b, "# HELP music_control_event_dropped_total Events dropped for subscribers that couldn't keep up.\n")
+	fmt.Fprintf(&b, "# TYPE music_control_event_dropped_total counter\n")
+	fmt.Fprintf(&b, "music_control_event_dropped_total %d\n", events.DroppedEvents())
+	fmt.Fprintf(&b, "# HELP music_control_event_slow_disconnects_total Subscribers disconnected for not keeping up.\n")
+	fmt.Fprintf(&b, "# TYPE music_control_event_slow_disconnects_total counter\n")
+	fmt.Fprintf(&b, "music_control_event_slow_disconnects_total %d\n", events.SlowClientDisconnects())
+	for _, g := range reserveGauges {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, stream := range names {
+			value := g.value(reserves[stream])
+			fmt.Fprintf(&b, "%s{stream=\"%s\"} %s\n", g.name, escapeLabel(stream), strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(b.String()))
+}
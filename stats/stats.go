@@ -0,0 +1,132 @@
+// Package stats summarises the library and streams for dashboards and capacity planning.
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/songs"
+	"github.com/PonyFest/music-control/storage"
+	"github.com/PonyFest/music-control/streams"
+	"github.com/PonyFest/music-control/trackcache"
+)
+
+// storageRefresh is how often we're willing to list the whole bucket to see how big it is.
+const storageRefresh = 10 * time.Minute
+
+type Handler struct {
+	redis   *redis.Client
+	tracks  *trackcache.Cache
+	store   storage.Storage
+	streams *streams.Handler
+
+	mu             sync.Mutex
+	storageBytes   int64
+	storageObjects int64
+	storageChecked time.Time
+}
+
+func New(redis *redis.Client, tracks *trackcache.Cache, store storage.Storage, streams *streams.Handler) *Handler {
+	return &Handler{
+		redis:   redis,
+		tracks:  tracks,
+		store:   store,
+		streams: streams,
+	}
+}
+
+// storage is how much is in storage: everyone's audio, renditions and segments, not just this library's.
+// Listing a big bucket takes a while, so we only do it every so often.
+func (h *Handler) storage() (int64, int64, time.Time, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.storageChecked) < storageRefresh {
+		return h.storageBytes, h.storageObjects, h.storageChecked, nil
+	}
+	bytes, objects, err := h.store.Usage()
+	if err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	h.storageBytes, h.storageObjects, h.storageChecked = bytes, objects, time.Now()
+	return bytes, objects, h.storageChecked, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "stats can only be fetched", http.StatusMethodNotAllowed)
+		return
+	}
+	trackIds, err := h.redis.SMembers(songs.TrackPoolKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list track IDs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	tracks, err := h.tracks.GetMany(trackIds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Looking up track data failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	formats := map[string]int{}
+	tags := map[string]int{}
+	artists := map[string]int{}
+	var duration float64
+	unknownDurations := 0
+	for _, track := range tracks {
+		format := track[songs.ContentTypeKey]
+		if format == "" {
+			format = "unknown"
+		}
+		formats[format]++
+		for _, tag := range strings.Split(track[songs.TagsKey], ",") {
+			if tag != "" {
+				tags[tag]++
+			}
+		}
+		artists[track["artist"]]++
+		if d, err := strconv.ParseFloat(track[songs.DurationKey], 64); err == nil {
+			duration += d
+		} else {
+			unknownDurations++
+		}
+	}
+	streamStats, err := h.streams.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := map[string]interface{}{
+		"status": "ok",
+		"library": map[string]interface{}{
+			"tracks":           len(tracks),
+			"totalDuration":    duration,
+			"unknownDurations": unknownDurations,
+			"formats":          formats,
+			"tags":             tags,
+			"artists":          artists,
+		},
+		"streams": streamStats,
+	}
+	// A dashboard is still useful without this.
+	if bytes, objects, checked, err := h.storage(); err != nil {
+		log.Printf("Failed to measure storage: %v.\n", err)
+	} else {
+		result["storage"] = map[string]interface{}{
+			"bytes":   bytes,
+			"objects": objects,
+			"checked": checked.Unix(),
+		}
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// typesDir is where Dir keeps each object's content type, alongside the objects themselves.
+const typesDir = ".types"
+
+// Dir stores objects as files in a directory, for running without a bucket. It serves them too, since there's
+// nothing else to.
+type Dir struct {
+	root string
+	// url is where the objects are served from, ending in a slash.
+	url string
+}
+
+// NewDir stores objects under root, creating it if need be. url is where the Dir will be served.
+func NewDir(root, url string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create storage directory: %v", err)
+	}
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return &Dir{root: root, url: url}, nil
+}
+
+// path is where the object at key lives. Cleaning it as an absolute path first keeps it inside the root.
+func (d *Dir) path(dir, key string) string {
+	return filepath.Join(d.root, dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (d *Dir) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	p := d.path("", key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("upload to storage directory failed: %v", err)
+	}
+	// Write somewhere else first so nobody fetches half a file.
+	f, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return fmt.Errorf("upload to storage directory failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, body); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("upload to storage directory failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("upload to storage directory failed: %v", err)
+	}
+	t := d.path(typesDir, key)
+	if err := os.MkdirAll(filepath.Dir(t), 0755); err != nil {
+		return fmt.Errorf("upload to storage directory failed: %v", err)
+	}
+	if err := ioutil.WriteFile(t, []byte(contentType), 0644); err != nil {
+		return fmt.Errorf("upload to storage directory failed: %v", err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("upload to storage directory failed: %v", err)
+	}
+	return nil
+}
+
+func (d *Dir) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path("", key))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s from storage directory failed: %v", key, err)
+	}
+	return f, nil
+}
+
+func (d *Dir) Delete(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		for _, p := range []string{d.path("", key), d.path(typesDir, key)} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete %s: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RangeURL is just the object's URL, since we serve ranges to anyone who asks.
+func (d *Dir) RangeURL(key, byteRange string, ttl time.Duration) (string, error) {
+	return d.url + key, nil
+}
+
+func (d *Dir) Usage() (int64, int64, error) {
+	var bytes, objects int64
+	err := filepath.Walk(d.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == typesDir {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".upload-") {
+			bytes += info.Size()
+			objects++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return bytes, objects, nil
+}
+
+// ServeHTTP serves objects, with the content types they were stored with. It expects to have whatever prefix it's
+// mounted at stripped off.
+func (d *Dir) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "" || strings.HasPrefix(key, typesDir+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(d.path("", key))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	if contentType, err := ioutil.ReadFile(d.path(typesDir, key)); err == nil {
+		w.Header().Set("Content-Type", string(contentType))
+	}
+	// Players and the frontend are usually somewhere else during development.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
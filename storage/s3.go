@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Big uploads go up in parts, each retried on its own, so one dropped connection near the end of a 200MB upload
+// costs us a part rather than the whole thing.
+const uploadPartSize = 16 << 20
+const uploadConcurrency = 4
+
+// uploadRetryer retries each request (or part) with exponential backoff from a second or so up to half a minute.
+var uploadRetryer = client.DefaultRetryer{
+	NumMaxRetries:    8,
+	MinRetryDelay:    500 * time.Millisecond,
+	MaxRetryDelay:    30 * time.Second,
+	MinThrottleDelay: time.Second,
+	MaxThrottleDelay: 30 * time.Second,
+}
+
+// S3 stores objects in an S3 bucket.
+type S3 struct {
+	s3       *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func NewS3(s3Client *s3.S3, bucket string) *S3 {
+	return &S3{
+		s3:     s3Client,
+		bucket: bucket,
+		uploader: s3manager.NewUploaderWithClient(s3Client, func(u *s3manager.Uploader) {
+			u.PartSize = uploadPartSize
+			u.Concurrency = uploadConcurrency
+			// If a part fails for good, abort the multipart upload rather than leaving its parts lying around (and
+			// billed for) in the bucket.
+			u.LeavePartsOnError = false
+			u.RequestOptions = append(u.RequestOptions, func(r *request.Request) {
+				r.Retryer = uploadRetryer
+			})
+		}),
+	}
+}
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	if _, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      &s.bucket,
+		Body:        body,
+		Key:         aws.String(key),
+		ACL:         aws.String("public-read"),
+		ContentType: aws.String(contentType),
+	}); err != nil {
+		return fmt.Errorf("upload to 'S3' failed: %v", err)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	result, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s from 'S3' failed: %v", key, err)
+	}
+	return result.Body, nil
+}
+
+// Delete deletes objects a thousand at a time, since that's as many as S3 takes at once.
+func (s *S3) Delete(ctx context.Context, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		objects := make([]*s3.ObjectIdentifier, n)
+		for i, key := range keys[:n] {
+			objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+		}
+		result, err := s.s3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete audio: %v", err)
+		}
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("failed to delete %s: %s", aws.StringValue(result.Errors[0].Key), aws.StringValue(result.Errors[0].Message))
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// RangeURL presigns a request for the range. The range is part of the signature, which is why clients have to
+// send exactly that Range header.
+func (s *S3) RangeURL(key, byteRange string, ttl time.Duration) (string, error) {
+	req, _ := s.s3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    aws.String(key),
+		Range:  aws.String(byteRange),
+	})
+	return req.Presign(ttl)
+}
+
+// Usage lists the whole bucket, which takes a while if it's big.
+func (s *S3) Usage() (int64, int64, error) {
+	var bytes, objects int64
+	err := s.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(s.bucket)}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			bytes += aws.Int64Value(o.Size)
+			objects++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return bytes, objects, nil
+}
@@ -0,0 +1,24 @@
+// Package storage is where the audio lives: an S3 bucket in production, or a directory on disk for development.
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Storage holds objects that anyone can fetch from under the music root. Requests are made with ctx, so they can be
+// traced as part of whatever they're done for.
+type Storage interface {
+	// Put stores an object, replacing anything already at key.
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	// Get fetches an object. The caller has to close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete deletes objects. Objects that aren't there aren't an error.
+	Delete(ctx context.Context, keys []string) error
+	// RangeURL returns a URL for part of an object that works for at least ttl. Clients have to send byteRange as
+	// their Range header along with it.
+	RangeURL(key, byteRange string, ttl time.Duration) (string, error)
+	// Usage is how many bytes everything takes up, and how many objects there are.
+	Usage() (bytes int64, objects int64, err error)
+}
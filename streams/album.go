@@ -0,0 +1,234 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/apierror"
+	"github.com/PonyFest/music-control/songs"
+)
+
+// albumRunFormat is a list of the tracks still to play from the album queued on a stream (or group), in order.
+// Once up next gets as far as the album, nothing else plays until it's empty. albumCurrentFormat is the album
+// track that was taken last, and is only there once the album has started.
+const albumRunFormat = "album-run-%s"
+const albumCurrentFormat = "album-current-%s"
+
+// albumTracks finds the tracks on an album, in order. With an artist, only that artist's tracks count, for albums
+// with common names.
+func (h *Handler) albumTracks(album, artist string) ([]string, error) {
+	trackIds, err := h.redis.SMembers(songs.TrackPoolKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tracks: %v", err)
+	}
+	tracks, err := h.trackService.Tracks(trackIds)
+	if err != nil {
+		return nil, fmt.Errorf("looking up tracks failed: %v", err)
+	}
+	var result []string
+	for trackId, track := range tracks {
+		if strings.EqualFold(track[songs.AlbumKey], album) && (artist == "" || strings.EqualFold(track["artist"], artist)) {
+			result = append(result, trackId)
+		}
+	}
+	number := func(trackId string) int {
+		n, err := strconv.Atoi(tracks[trackId][songs.TrackNumberKey])
+		if err != nil {
+			// Unnumbered tracks go at the end.
+			return int(^uint(0) >> 1)
+		}
+		return n
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := number(result[i]), number(result[j])
+		if a != b {
+			return a < b
+		}
+		return tracks[result[i]]["title"] < tracks[result[j]]["title"]
+	})
+	return result, nil
+}
+
+// chainTracks follows a chain of tracks that have to follow one another, from its start, whichever of them
+// trackId is.
+func (h *Handler) chainTracks(trackId string) []string {
+	start := trackId
+	for i := 0; i < maxChain; i++ {
+		previous := songs.Follows(h.redis, start)
+		if previous == "" || previous == trackId {
+			break
+		}
+		start = previous
+	}
+	result := []string{start}
+	for i := 0; i < maxChain; i++ {
+		next := songs.FollowedBy(h.redis, result[len(result)-1])
+		if next == "" || next == start {
+			break
+		}
+		result = append(result, next)
+	}
+	return result
+}
+
+// maxChain is the longest chain of must-follow tracks we'll queue as a group.
+const maxChain = 1000
+
+// handleQueueAlbum puts every track of an album (`album`, and optionally `artist`) or an explicit group (the chain
+// of must-follow tracks that `track` is part of) at the end of the stream's up next, and plays them straight
+// through once up next gets to them: nothing else plays until they're done, and players are told to join them up
+// without gaps. DELETE
+// stops that, leaving whatever's still queued to play like anything else.
+func (h *Handler) handleQueueAlbum(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	runKey := h.queueKey(albumRunFormat, stream)
+	if r.Method == http.MethodDelete {
+		if err := h.redis.Del(runKey, h.queueKey(albumCurrentFormat, stream)).Err(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to stop album: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+		return
+	}
+
+	var tracks []string
+	if album := r.FormValue("album"); album != "" {
+		var err error
+		if tracks, err = h.albumTracks(album, r.FormValue("artist")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if trackId := r.FormValue("track"); trackId != "" {
+		if !h.redis.SIsMember(songs.TrackPoolKey, trackId).Val() {
+			apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+			return
+		}
+		tracks = h.chainTracks(trackId)
+	} else {
+		http.Error(w, "say which album or track to queue", http.StatusBadRequest)
+		return
+	}
+	if len(tracks) == 0 {
+		http.Error(w, "no tracks on that album", http.StatusNotFound)
+		return
+	}
+	if h.redis.Exists(runKey).Val() != 0 {
+		http.Error(w, fmt.Sprintf("%q is already playing an album", stream), http.StatusConflict)
+		return
+	}
+	p := h.redis.TxPipeline()
+	p.RPush(runKey, stringsToInterfaces(tracks)...)
+	p.SAdd(StreamsKey, stream)
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("queuing album failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := h.queues.Append(stream, tracks...); err != nil {
+		h.redis.Del(runKey)
+		http.Error(w, fmt.Sprintf("queuing album failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.publishUpNextUpdate(stream)
+	for _, member := range h.queueMembers(stream) {
+		h.recordTransition(member, "albumQueued", map[string]interface{}{"tracks": strings.Join(tracks, ",")})
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "tracks": tracks}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// takeAlbumTrack takes the next track of the album the stream's in the middle of, if it's in the middle of one,
+// taking it out of up next too. Album tracks play in order even if someone's rearranged up next, or taken them out
+// of it.
+func (h *Handler) takeAlbumTrack(stream string) (string, bool) {
+	runKey := h.queueKey(albumRunFormat, stream)
+	currentKey := h.queueKey(albumCurrentFormat, stream)
+	if h.redis.Exists(currentKey).Val() == 0 {
+		// Up next hasn't got as far as the album yet.
+		return "", false
+	}
+	for {
+		trackId, err := h.redis.LPop(runKey).Result()
+		if err != nil {
+			h.redis.Del(currentKey)
+			return "", false
+		}
+		if !h.available(trackId) {
+			continue
+		}
+		h.redis.Set(currentKey, trackId, 0)
+		if err := h.queues.Take(stream, trackId); err != nil {
+			log.Printf("Failed to take %s off up next on %q: %v.\n", trackId, stream, err)
+		}
+		h.publishUpNextUpdate(stream)
+		h.countSelection(stream, "album")
+		return trackId, true
+	}
+}
+
+// startAlbumRun starts playing the album queued on the stream straight through, if trackId, which was just taken
+// off up next, is one of its tracks. It's usually the first; if it isn't, the ones before it were taken out of up
+// next, so they're skipped.
+func (h *Handler) startAlbumRun(stream, trackId string) bool {
+	runKey := h.queueKey(albumRunFormat, stream)
+	run, err := h.redis.LRange(runKey, 0, -1).Result()
+	if err != nil {
+		return false
+	}
+	for i, t := range run {
+		if t != trackId {
+			continue
+		}
+		p := h.redis.TxPipeline()
+		p.LTrim(runKey, int64(i+1), -1)
+		p.Set(h.queueKey(albumCurrentFormat, stream), trackId, 0)
+		if _, err := p.Exec(); err != nil {
+			log.Printf("Failed to start album on %q: %v.\n", stream, err)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// albumRunIncludes says whether trackId is one of the tracks of the album queued on the stream, so taking it off
+// up next would start the album.
+func (h *Handler) albumRunIncludes(stream, trackId string) bool {
+	run, _ := h.redis.LRange(h.queueKey(albumRunFormat, stream), 0, -1).Result()
+	for _, t := range run {
+		if t == trackId {
+			return true
+		}
+	}
+	return false
+}
+
+// inAlbumRun says whether trackId is the album track the stream took last.
+func (h *Handler) inAlbumRun(stream, trackId string) bool {
+	return trackId != "" && h.redis.Get(h.queueKey(albumCurrentFormat, stream)).Val() == trackId
+}
+
+// addAlbumHints tells players about the next track when it has to follow this one without a gap, so they can
+// have it ready in time.
+func (h *Handler) addAlbumHints(stream string, track map[string]string) {
+	if !h.inAlbumRun(stream, track["trackId"]) {
+		return
+	}
+	next, err := h.redis.LIndex(h.queueKey(albumRunFormat, stream), 0).Result()
+	if err != nil {
+		return
+	}
+	track["gapless"] = "true"
+	track["gaplessNext"] = next
+	if nextTrack, err := h.trackService.Track(next); err == nil && nextTrack != nil {
+		track["gaplessNextUrl"] = h.urls.TrackURL(next, nextTrack)
+	}
+}
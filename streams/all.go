@@ -0,0 +1,58 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// handleAllStates returns the state of every stream we know about, so dashboards don't need to poll each one.
+func (h *Handler) handleAllStates(w http.ResponseWriter, r *http.Request) {
+	streams, err := h.redis.SMembers(StreamsKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list streams: %v", err), http.StatusInternalServerError)
+		return
+	}
+	states := make(map[string]map[string]string, len(streams))
+	for _, stream := range streams {
+		if states[stream], err = h.states.State(stream); err != nil {
+			http.Error(w, fmt.Sprintf("failed to fetch states: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	var trackIds []string
+	for _, state := range states {
+		if trackId, ok := state["currentTrack"]; ok {
+			trackIds = append(trackIds, trackId)
+		}
+	}
+	tracks, err := h.tracks.GetMany(trackIds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch current tracks: %v", err), http.StatusInternalServerError)
+		return
+	}
+	metadata, err := h.metadata(streams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := make(map[string]interface{}, len(states))
+	for stream, state := range states {
+		var track map[string]string
+		if t, ok := tracks[state["currentTrack"]]; ok {
+			// the same track can be playing on several streams, and renderState scribbles on it.
+			track = map[string]string{}
+			for k, v := range t {
+				track[k] = v
+			}
+		}
+		rendered := h.renderState(state, track)
+		rendered["metadata"] = metadata[stream]
+		result[stream] = rendered
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "streams": result}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
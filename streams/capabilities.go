@@ -0,0 +1,147 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+const capabilitiesFormat = "capabilities-%s"
+
+// unplayableFormat is the set of tracks in formats the stream's player has said it can't decode. Random picks avoid
+// them; anything an operator queues is sent regardless.
+const unplayableFormat = "unplayable-%s"
+
+// Capabilities are what a stream's player has told us it can do. Players that never say anything are assumed to
+// be able to do everything.
+type Capabilities struct {
+	// Codecs are the content types the player can decode. Empty means all of them.
+	Codecs []string `json:"codecs"`
+	// Crossfade is whether the player can overlap tracks. Those that can't are told not to fade.
+	Crossfade bool `json:"crossfade"`
+	// MaxBitrate is the highest bitrate, in kbps, the player wants. Zero means no limit.
+	MaxBitrate int `json:"maxBitrate"`
+}
+
+func (h *Handler) capabilities(stream string) (Capabilities, error) {
+	c := Capabilities{Crossfade: true}
+	fields, err := h.redis.HGetAll(fmt.Sprintf(capabilitiesFormat, stream)).Result()
+	if err != nil {
+		return c, fmt.Errorf("failed to fetch capabilities: %v", err)
+	}
+	if codecs := fields["codecs"]; codecs != "" {
+		c.Codecs = strings.Split(codecs, ",")
+	}
+	if crossfade, err := strconv.ParseBool(fields["crossfade"]); err == nil {
+		c.Crossfade = crossfade
+	}
+	c.MaxBitrate, _ = strconv.Atoi(fields["maxBitrate"])
+	return c, nil
+}
+
+// refreshUnplayable works out which tracks the stream's player can't decode. New formats can turn up at any time,
+// so we redo this before every pick rather than just when the capabilities change.
+func (h *Handler) refreshUnplayable(stream string) error {
+	key := fmt.Sprintf(unplayableFormat, stream)
+	codecs := h.redis.HGet(fmt.Sprintf(capabilitiesFormat, stream), "codecs").Val()
+	if codecs == "" {
+		return h.redis.Del(key).Err()
+	}
+	supported := map[string]bool{}
+	for _, codec := range strings.Split(codecs, ",") {
+		supported[codec] = true
+	}
+	formats, err := h.redis.SMembers(songs.FormatsKey).Result()
+	if err != nil {
+		return err
+	}
+	var unsupported, playable []string
+	for _, format := range formats {
+		if supported[format] {
+			playable = append(playable, fmt.Sprintf(songs.FormatFormat, format))
+		} else {
+			unsupported = append(unsupported, fmt.Sprintf(songs.FormatFormat, format))
+		}
+	}
+	if len(unsupported) == 0 {
+		return h.redis.Del(key).Err()
+	}
+	// Tracks with any rendition the player can decode are fine, whatever else they're available in.
+	p := h.redis.TxPipeline()
+	p.SUnionStore(key, unsupported...)
+	if len(playable) > 0 {
+		p.SDiffStore(key, append([]string{key}, playable...)...)
+	}
+	_, err = p.Exec()
+	return err
+}
+
+// playable says whether the stream's player can decode a track, as of the last refreshUnplayable.
+func (h *Handler) playable(stream, trackId string) bool {
+	return !h.redis.SIsMember(fmt.Sprintf(unplayableFormat, stream), trackId).Val()
+}
+
+// handleCapabilities lets a player say what it can do (PUT, with `codecs` as a comma separated list of content
+// types, `crossfade` and `maxBitrate`), which we then take into account when choosing what it plays next.
+func (h *Handler) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	switch r.Method {
+	case http.MethodPut:
+		fields := map[string]interface{}{}
+		var codecs []string
+		for _, codec := range strings.Split(r.FormValue("codecs"), ",") {
+			if codec = strings.TrimSpace(codec); codec != "" {
+				codecs = append(codecs, codec)
+			}
+		}
+		fields["codecs"] = strings.Join(codecs, ",")
+		crossfade := true
+		if c := r.FormValue("crossfade"); c != "" {
+			var err error
+			if crossfade, err = strconv.ParseBool(c); err != nil {
+				http.Error(w, fmt.Sprintf("invalid crossfade flag %q", c), http.StatusBadRequest)
+				return
+			}
+		}
+		fields["crossfade"] = crossfade
+		maxBitrate := 0
+		if b := r.FormValue("maxBitrate"); b != "" {
+			var err error
+			if maxBitrate, err = strconv.Atoi(b); err != nil || maxBitrate < 0 {
+				http.Error(w, fmt.Sprintf("invalid maxBitrate %q", b), http.StatusBadRequest)
+				return
+			}
+		}
+		fields["maxBitrate"] = maxBitrate
+		// Capabilities are replaced wholesale, since a different player might have taken over the stream.
+		key := fmt.Sprintf(capabilitiesFormat, stream)
+		p := h.redis.TxPipeline()
+		p.Del(key)
+		p.HSet(key, fields)
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to store capabilities: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := h.refreshUnplayable(stream); err != nil {
+			log.Printf("Failed to work out unplayable tracks for %q: %v.\n", stream, err)
+		}
+		fallthrough
+	case http.MethodGet:
+		c, err := h.capabilities(stream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "capabilities": c}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package streams
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// credit is a track (or, when deduplicating by artist, an artist) in the credits.
+type credit struct {
+	TrackID     string     `json:"trackId,omitempty"`
+	Title       string     `json:"title,omitempty"`
+	Artist      string     `json:"artist"`
+	Features    string     `json:"features,omitempty"`
+	Album       string     `json:"album,omitempty"`
+	Tracks      []string   `json:"tracks,omitempty"`
+	Plays       int        `json:"plays"`
+	FirstPlayed *time.Time `json:"firstPlayed,omitempty"`
+	LastPlayed  *time.Time `json:"lastPlayed,omitempty"`
+}
+
+// line is how the credit reads in the plain text credits.
+func (c credit) line() string {
+	if c.Tracks != nil {
+		return c.Artist + ": " + strings.Join(c.Tracks, ", ")
+	}
+	line := c.Title
+	if c.Artist != "" {
+		line = c.Artist + " - " + c.Title
+	}
+	if c.Features != "" {
+		line += " (feat. " + c.Features + ")"
+	}
+	return line
+}
+
+// play is a track starting on a stream, from its timeline. Library credits have plays that never happened.
+type play struct {
+	trackId string
+	at      *time.Time
+}
+
+// plays is every track the streams started playing between since and until, which are millisecond timestamps (or
+// timeline IDs) like the timeline takes, oldest first.
+func (h *Handler) plays(streams []string, since, until string) ([]play, error) {
+	var plays []play
+	for _, stream := range streams {
+		key := fmt.Sprintf(timelineFormat, stream)
+		start := since
+		for {
+			messages, err := h.redis.XRangeN(key, start, until, 1000).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch timeline for %q: %v", stream, err)
+			}
+			for _, message := range messages {
+				if message.ID == start || message.Values["event"] != "update" || message.Values["key"] != "currentTrack" {
+					continue
+				}
+				trackId, _ := message.Values["value"].(string)
+				ms, _ := strconv.ParseInt(strings.SplitN(message.ID, "-", 2)[0], 10, 64)
+				at := time.Unix(0, ms*int64(time.Millisecond)).UTC()
+				plays = append(plays, play{trackId: trackId, at: &at})
+			}
+			if len(messages) < 1000 {
+				break
+			}
+			start = messages[len(messages)-1].ID
+		}
+	}
+	sort.SliceStable(plays, func(i, j int) bool {
+		return plays[i].at.Before(*plays[j].at)
+	})
+	return plays, nil
+}
+
+// handleCredits puts together the credits for the end of the event: everything the streams played (`source=played`,
+// the default), or everything in the library (`source=library`).
+//
+// Played credits can be limited to `streams` (comma separated, otherwise all of them), and to between `since` and
+// `until`, in milliseconds. `dedupe` is `track` (the default) for one credit per track, `artist` for one per artist
+// listing their tracks, or `none` for every play. `sort` is `artist` (the default), `title`, `played` (first played
+// first) or `plays` (most played first). `format` is `json` (the default), `csv` or `txt`, one credit per line.
+// Announcements and tracks that have since been deleted are left out.
+func (h *Handler) handleCredits(w http.ResponseWriter, r *http.Request) {
+	dedupe := r.FormValue("dedupe")
+	if dedupe == "" {
+		dedupe = "track"
+	}
+	if dedupe != "track" && dedupe != "artist" && dedupe != "none" {
+		http.Error(w, fmt.Sprintf("dedupe must be track, artist or none, not %q", dedupe), http.StatusBadRequest)
+		return
+	}
+	order := r.FormValue("sort")
+	if order == "" {
+		order = "artist"
+	}
+	if order != "artist" && order != "title" && order != "played" && order != "plays" {
+		http.Error(w, fmt.Sprintf("sort must be artist, title, played or plays, not %q", order), http.StatusBadRequest)
+		return
+	}
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "csv" && format != "txt" {
+		http.Error(w, fmt.Sprintf("format must be json, csv or txt, not %q", format), http.StatusBadRequest)
+		return
+	}
+
+	var plays []play
+	switch source := r.FormValue("source"); source {
+	case "", "played":
+		streams, err := h.redis.SMembers(StreamsKey).Result()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list streams: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if s := r.FormValue("streams"); s != "" {
+			streams = strings.Split(s, ",")
+		}
+		since, err := streamIDBound(r, "since", "-")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		until, err := streamIDBound(r, "until", "+")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if plays, err = h.plays(streams, since, until); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "library":
+		trackIds, err := h.redis.SMembers(songs.TrackPoolKey).Result()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list tracks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, trackId := range trackIds {
+			plays = append(plays, play{trackId: trackId})
+		}
+	default:
+		http.Error(w, fmt.Sprintf("source must be played or library, not %q", source), http.StatusBadRequest)
+		return
+	}
+
+	credits, err := h.credits(plays, dedupe)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sortCredits(credits, order)
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="credits.csv"`)
+		cw := csv.NewWriter(w)
+		if dedupe == "artist" {
+			_ = cw.Write([]string{"artist", "tracks", "plays"})
+		} else {
+			_ = cw.Write([]string{"title", "artist", "features", "album", "plays", "firstPlayed"})
+		}
+		for _, c := range credits {
+			if dedupe == "artist" {
+				_ = cw.Write([]string{c.Artist, strings.Join(c.Tracks, "; "), strconv.Itoa(c.Plays)})
+				continue
+			}
+			firstPlayed := ""
+			if c.FirstPlayed != nil {
+				firstPlayed = c.FirstPlayed.Format(time.RFC3339)
+			}
+			_ = cw.Write([]string{c.Title, c.Artist, c.Features, c.Album, strconv.Itoa(c.Plays), firstPlayed})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Failed to write CSV credits: %v.\n", err)
+		}
+	case "txt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var b strings.Builder
+		for _, c := range credits {
+			b.WriteString(c.line())
+			b.WriteByte('\n')
+		}
+		_, _ = w.Write([]byte(b.String()))
+	default:
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "credits": credits}); err != nil {
+			http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// credits turns plays into credits, deduplicated by dedupe.
+func (h *Handler) credits(plays []play, dedupe string) ([]credit, error) {
+	seen := map[string]bool{}
+	var trackIds []string
+	for _, p := range plays {
+		if !seen[p.trackId] {
+			seen[p.trackId] = true
+			trackIds = append(trackIds, p.trackId)
+		}
+	}
+	tracks, err := h.tracks.GetMany(trackIds)
+	if err != nil {
+		return nil, fmt.Errorf("looking up tracks failed: %v", err)
+	}
+
+	credits := []credit{}
+	index := map[string]int{}
+	// With dedupe=artist, which tracks each artist already has.
+	credited := map[string]bool{}
+	for _, p := range plays {
+		track, ok := tracks[p.trackId]
+		if !ok || len(track) == 0 || track[songs.InterstitialKey] != "" {
+			continue
+		}
+		switch dedupe {
+		case "none":
+			credits = append(credits, trackCredit(p, track))
+		case "track":
+			if i, ok := index[p.trackId]; ok {
+				credits[i].played(p)
+				continue
+			}
+			index[p.trackId] = len(credits)
+			credits = append(credits, trackCredit(p, track))
+		case "artist":
+			for _, name := range songs.Credited(track) {
+				id := songs.ArtistID(name)
+				if id == "" {
+					continue
+				}
+				i, ok := index[id]
+				if !ok {
+					i = len(credits)
+					index[id] = i
+					credits = append(credits, credit{Artist: name, Tracks: []string{}})
+				}
+				c := &credits[i]
+				c.played(p)
+				if !credited[id+"\x00"+p.trackId] {
+					credited[id+"\x00"+p.trackId] = true
+					c.Tracks = append(c.Tracks, track["title"])
+				}
+			}
+		}
+	}
+	return credits, nil
+}
+
+func trackCredit(p play, track map[string]string) credit {
+	c := credit{
+		TrackID:  p.trackId,
+		Title:    track["title"],
+		Artist:   track["artist"],
+		Features: track[songs.FeaturesKey],
+		Album:    track[songs.AlbumKey],
+	}
+	c.played(p)
+	return c
+}
+
+// played counts a play towards the credit. Plays come oldest first.
+func (c *credit) played(p play) {
+	if p.at == nil {
+		return
+	}
+	c.Plays++
+	if c.FirstPlayed == nil {
+		c.FirstPlayed = p.at
+	}
+	c.LastPlayed = p.at
+}
+
+// sortCredits sorts credits by order, falling back to artist and then title, ignoring case.
+func sortCredits(credits []credit, order string) {
+	key := func(c credit) string {
+		return strings.ToLower(c.Artist) + "\x00" + strings.ToLower(c.Title)
+	}
+	sort.SliceStable(credits, func(i, j int) bool {
+		a, b := credits[i], credits[j]
+		switch order {
+		case "title":
+			if t1, t2 := strings.ToLower(a.Title), strings.ToLower(b.Title); t1 != t2 {
+				return t1 < t2
+			}
+		case "played":
+			if a.FirstPlayed != nil && b.FirstPlayed != nil && !a.FirstPlayed.Equal(*b.FirstPlayed) {
+				return a.FirstPlayed.Before(*b.FirstPlayed)
+			}
+		case "plays":
+			if a.Plays != b.Plays {
+				return a.Plays > b.Plays
+			}
+		}
+		return key(a) < key(b)
+	})
+}
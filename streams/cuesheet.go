@@ -0,0 +1,195 @@
+package streams
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// Cue is one track in a cue sheet, or coming up on a stream. The printable fields are already formatted, so
+// whatever lays the sheet out for printing doesn't need to know about time zones or durations.
+type Cue struct {
+	Position int    `json:"position"`
+	TrackID  string `json:"trackId"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Note     string `json:"note"`
+	// Duration is how long it plays for, in seconds, or nil if we don't know.
+	Duration *float64  `json:"duration"`
+	Start    time.Time `json:"start"`
+	// Approximate is set once a track before this one has an unknown duration, which makes the start a guess.
+	Approximate bool `json:"approximate"`
+
+	StartClock string `json:"startClock"`
+	Offset     string `json:"offset"`
+	Length     string `json:"length"`
+}
+
+// clock formats seconds as h:mm:ss, or m:ss if it's under an hour.
+func clock(seconds float64) string {
+	s := int(math.Round(seconds))
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// currentRemaining is how many seconds the stream's current track has left, or zero if it isn't playing or we
+// can't tell.
+func (h *Handler) currentRemaining(stream string, now time.Time) float64 {
+	state, err := h.states.State(stream)
+	if err != nil || state["playing"] != "true" {
+		return 0
+	}
+	duration, err := strconv.ParseFloat(state["duration"], 64)
+	if err != nil {
+		return 0
+	}
+	position, _ := strconv.ParseFloat(state["position"], 64)
+	if updated, err := strconv.ParseInt(state[positionUpdatedKey], 10, 64); err == nil {
+		position += now.Sub(time.Unix(updated, 0)).Seconds()
+	}
+	return math.Max(duration-position, 0)
+}
+
+// handleCueSheet is the running order of a stream's up next, for stage managers to print. The block starts at
+// `start` (an RFC 3339 timestamp, or a time of day like "21:00"), or when the current track ends if not given.
+// Times are in the stream's time zone, and allow for where tracks start and how long they crossfade for. `format`
+// is `json` (the default) or `csv`.
+func (h *Handler) handleCueSheet(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("format must be json or csv, not %q", format), http.StatusBadRequest)
+		return
+	}
+	settings, err := h.settings(stream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	location, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	now := time.Now().In(location)
+	start := now.Add(time.Duration(h.currentRemaining(stream, now) * float64(time.Second)))
+	if s := r.FormValue("start"); s != "" {
+		if start, err = parseAt(s, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		start = start.In(location)
+	}
+
+	cues, length, approximate, err := h.cues(stream, settings, start)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	end := start.Add(time.Duration(length * float64(time.Second)))
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cuesheet-%s.csv"`, stream))
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"position", "start", "offset", "length", "title", "artist", "album", "note", "approximate"})
+		for _, c := range cues {
+			_ = cw.Write([]string{strconv.Itoa(c.Position), c.StartClock, c.Offset, c.Length, c.Title, c.Artist, c.Album, c.Note, strconv.FormatBool(c.Approximate)})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Failed to write CSV cue sheet: %v.\n", err)
+		}
+	default:
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":      "ok",
+			"stream":      stream,
+			"timezone":    location.String(),
+			"start":       start,
+			"startClock":  start.Format("15:04:05"),
+			"end":         end,
+			"endClock":    end.Format("15:04:05"),
+			"length":      clock(length),
+			"approximate": approximate,
+			"cues":        cues,
+		}); err != nil {
+			http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// cues works out when everything in a stream's up next will play, if it starts at start. It also says how long that
+// all takes, in seconds, and whether that's only approximate because we don't know how long some tracks are.
+func (h *Handler) cues(stream string, settings Settings, start time.Time) ([]Cue, float64, bool, error) {
+	raw, err := h.queues.UpNext(stream)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	entries := parseEntries(raw)
+	var trackIds []string
+	for _, entry := range entries {
+		if entry != nil {
+			trackIds = append(trackIds, entry.TrackID)
+		}
+	}
+	tracks, err := h.trackService.Tracks(trackIds)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("looking up tracks failed: %v", err)
+	}
+
+	cues := []Cue{}
+	offset, approximate := 0.0, false
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		track := tracks[entry.TrackID]
+		c := Cue{
+			Position:    len(cues) + 1,
+			TrackID:     entry.TrackID,
+			Title:       track["title"],
+			Artist:      track["artist"],
+			Album:       track[songs.AlbumKey],
+			Note:        entry.Note,
+			Approximate: approximate,
+		}
+		fade := settings.Crossfade
+		if entry.Fade != nil {
+			fade = *entry.Fade
+		}
+		// The first track doesn't overlap anything we're counting.
+		if len(cues) > 0 {
+			offset = math.Max(offset-fade, 0)
+		}
+		c.Start = start.Add(time.Duration(offset * float64(time.Second)))
+		c.StartClock = c.Start.Format("15:04:05")
+		c.Offset = clock(offset)
+		if duration, err := strconv.ParseFloat(track[songs.DurationKey], 64); err == nil {
+			startAt, _ := strconv.ParseFloat(track[songs.StartAtKey], 64)
+			if entry.StartAt != nil {
+				startAt = *entry.StartAt
+			}
+			duration = math.Max(duration-startAt, 0)
+			c.Duration = &duration
+			c.Length = clock(duration)
+			offset += duration
+		} else {
+			approximate = true
+		}
+		cues = append(cues, c)
+	}
+	return cues, offset, approximate, nil
+}
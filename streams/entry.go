@@ -0,0 +1,155 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// takenEntryFormat is where a stream keeps the up next entry it took last, if it had any overrides, until it's sent
+// to the player.
+const takenEntryFormat = "taken-entry-%s"
+
+// maxNoteLength keeps notes to something that fits on a screen.
+const maxNoteLength = 500
+
+// Entry is something queued in up next: a track, and how to play it this once. Entries without any overrides are
+// stored as the bare track ID, which is all entries used to be, so anything reading the queue the old way still
+// works until it needs the overrides. Tombstones are "".
+type Entry struct {
+	TrackID string `json:"trackId"`
+	// Gain is how many dB to play the track at, instead of the stream's override for it or its own gain.
+	Gain *float64 `json:"gain,omitempty"`
+	// Fade is how many seconds to crossfade into the track, instead of the stream's crossfade.
+	Fade *float64 `json:"fade,omitempty"`
+	// StartAt is how many seconds into the track to start, instead of the track's own startAt.
+	StartAt *float64 `json:"startAt,omitempty"`
+	// Note is something to show while it's playing, like who it's dedicated to.
+	Note string `json:"note,omitempty"`
+}
+
+// parseEntry reads an entry from the queue, in either form. Anything that isn't JSON is a bare track ID.
+func parseEntry(raw string) Entry {
+	if strings.HasPrefix(raw, "{") {
+		var e Entry
+		if err := json.Unmarshal([]byte(raw), &e); err == nil {
+			return e
+		}
+	}
+	return Entry{TrackID: raw}
+}
+
+// String is how the entry goes in the queue.
+func (e Entry) String() string {
+	if e.Gain == nil && e.Fade == nil && e.StartAt == nil && e.Note == "" {
+		return e.TrackID
+	}
+	j, err := json.Marshal(e)
+	if err != nil {
+		return e.TrackID
+	}
+	return string(j)
+}
+
+// entryFromForm builds an entry from `trackId` and any of `gain`, `fade`, `startAt` and `note`.
+func entryFromForm(r *http.Request) (Entry, error) {
+	e := Entry{TrackID: r.FormValue("trackId")}
+	if v := r.FormValue("gain"); v != "" {
+		gain, err := parseGain(v)
+		if err != nil {
+			return e, err
+		}
+		e.Gain = &gain
+	}
+	if v := r.FormValue("fade"); v != "" {
+		fade, err := strconv.ParseFloat(v, 64)
+		if err != nil || fade < 0 || fade > 30 {
+			return e, fmt.Errorf("fade must be a number of seconds between 0 and 30")
+		}
+		e.Fade = &fade
+	}
+	if v := r.FormValue("startAt"); v != "" {
+		startAt, err := songs.ParseStartAt(v)
+		if err != nil {
+			return e, err
+		}
+		e.StartAt = &startAt
+	}
+	e.Note = strings.TrimSpace(r.FormValue("note"))
+	if len(e.Note) > maxNoteLength {
+		return e, fmt.Errorf("note can be at most %d bytes", maxNoteLength)
+	}
+	return e, nil
+}
+
+// parseEntries reads a whole queue. Tombstones come out as nil.
+func parseEntries(raw []string) []*Entry {
+	entries := make([]*Entry, len(raw))
+	for i, r := range raw {
+		if r != "" {
+			e := parseEntry(r)
+			entries[i] = &e
+		}
+	}
+	return entries
+}
+
+// entryTrackIds is the track ID of each entry in a queue, keeping tombstones as "".
+func entryTrackIds(raw []string) []string {
+	trackIds := make([]string, len(raw))
+	for i, r := range raw {
+		if r != "" {
+			trackIds[i] = parseEntry(r).TrackID
+		}
+	}
+	return trackIds
+}
+
+// keepTakenEntry remembers the entry a stream just took from up next, so its overrides go out with the track.
+// Tracks taken from anywhere else get nothing overridden.
+func (h *Handler) keepTakenEntry(stream string, e Entry) {
+	key := fmt.Sprintf(takenEntryFormat, stream)
+	raw := e.String()
+	if raw == e.TrackID {
+		h.redis.Del(key)
+		return
+	}
+	// If the player never asks for it, it shouldn't turn up on a later play of the same track.
+	h.redis.Set(key, raw, time.Hour)
+}
+
+// takenEntry is the entry the stream took trackId from, if it had overrides.
+func (h *Handler) takenEntry(stream, trackId string) *Entry {
+	raw, err := h.redis.Get(fmt.Sprintf(takenEntryFormat, stream)).Result()
+	if err != nil {
+		return nil
+	}
+	e := parseEntry(raw)
+	if e.TrackID != trackId {
+		return nil
+	}
+	return &e
+}
+
+// applyEntry sets the fade, startAt and note on a track we're sending a player to those it was queued with. Gain
+// is up to applyGain.
+func (h *Handler) applyEntry(stream string, track map[string]string) {
+	e := h.takenEntry(stream, track["trackId"])
+	if e == nil {
+		return
+	}
+	if e.Fade != nil {
+		track["fade"] = strconv.FormatFloat(*e.Fade, 'f', -1, 64)
+	}
+	if e.StartAt != nil {
+		track[songs.StartAtKey] = strconv.FormatFloat(*e.StartAt, 'f', -1, 64)
+	}
+	if e.Note != "" {
+		track["note"] = e.Note
+	}
+}
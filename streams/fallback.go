@@ -0,0 +1,158 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxFallbackTracks is the longest a fallback loop can be. It's meant to hold the fort, not be a playlist.
+const maxFallbackTracks = 20
+
+// fallbackRefresh is how often we reload each stream's fallback tracks while things are working, so they're ready
+// when things aren't.
+const fallbackRefresh = time.Minute
+
+// fallbackLoop is a stream's fallback tracks, ready to hand out without touching redis.
+type fallbackLoop struct {
+	tracks []map[string]string
+	next   int
+	loaded time.Time
+}
+
+// fallbackCache keeps every stream's fallback loop in memory, since the point is to have it when redis is gone.
+// It's shared by every copy of the handler.
+type fallbackCache struct {
+	mu    sync.Mutex
+	loops map[string]*fallbackLoop
+}
+
+func newFallbackCache() *fallbackCache {
+	return &fallbackCache{loops: map[string]*fallbackLoop{}}
+}
+
+func splitFallback(value string) []string {
+	tracks := []string{}
+	for _, trackId := range strings.Split(value, ",") {
+		if trackId = strings.TrimSpace(trackId); trackId != "" {
+			tracks = append(tracks, trackId)
+		}
+	}
+	return tracks
+}
+
+// parseFallback validates a comma separated list of fallback tracks.
+func (h *Handler) parseFallback(value string) ([]string, error) {
+	tracks := splitFallback(value)
+	if len(tracks) > maxFallbackTracks {
+		return nil, fmt.Errorf("fallback can have at most %d tracks", maxFallbackTracks)
+	}
+	for _, trackId := range tracks {
+		track, err := h.trackService.Track(trackId)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't look up fallback track %q: %v", trackId, err)
+		}
+		if track == nil {
+			return nil, fmt.Errorf("no such track %q", trackId)
+		}
+	}
+	return tracks, nil
+}
+
+// load replaces a stream's fallback loop with trackIds, keeping its place in the loop. If any track can't be looked
+// up, we keep whatever we had before.
+func (c *fallbackCache) load(h *Handler, stream string, trackIds []string) {
+	tracks := make([]map[string]string, 0, len(trackIds))
+	for _, trackId := range trackIds {
+		track, err := h.trackIdToTrack(trackId)
+		if err != nil {
+			log.Printf("Failed to load fallback track %s for %q: %v.\n", trackId, stream, err)
+			return
+		}
+		tracks = append(tracks, track)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(tracks) == 0 {
+		delete(c.loops, stream)
+		return
+	}
+	loop := &fallbackLoop{tracks: tracks, loaded: time.Now()}
+	if previous, ok := c.loops[stream]; ok {
+		loop.next = previous.next % len(tracks)
+	}
+	c.loops[stream] = loop
+}
+
+// refresh reloads a stream's fallback loop if it hasn't been loaded in a while.
+func (c *fallbackCache) refresh(h *Handler, stream string) {
+	c.mu.Lock()
+	loop, ok := c.loops[stream]
+	fresh := ok && time.Since(loop.loaded) < fallbackRefresh
+	c.mu.Unlock()
+	if fresh {
+		return
+	}
+	settings, err := h.settings(stream)
+	if err != nil {
+		return
+	}
+	c.load(h, stream, settings.Fallback)
+}
+
+// LoadFallbacks loads every stream's fallback loop, so a stream that can't pick anything from the moment we start
+// still has something to play. Otherwise a loop is only loaded once /next has worked for its stream.
+func (h *Handler) LoadFallbacks() {
+	// This is a scan of the whole database, but we only do it once.
+	prefix := fmt.Sprintf(settingsFormat, "")
+	iter := h.redis.Scan(0, prefix+"*", 100).Iterator()
+	for iter.Next() {
+		h.fallbacks.refresh(h, strings.TrimPrefix(iter.Val(), prefix))
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Failed to list streams to load fallbacks for: %v.\n", err)
+	}
+}
+
+// take returns a copy of the next track in a stream's fallback loop, if it has one.
+func (c *fallbackCache) take(stream string) (map[string]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	loop, ok := c.loops[stream]
+	if !ok || len(loop.tracks) == 0 {
+		return nil, false
+	}
+	next := loop.tracks[loop.next%len(loop.tracks)]
+	track := make(map[string]string, len(next)+1)
+	for k, v := range next {
+		track[k] = v
+	}
+	loop.next = (loop.next + 1) % len(loop.tracks)
+	track["fallback"] = "true"
+	return track, true
+}
+
+// sendFallback answers a next track request from the stream's fallback loop, if it has one, after err stopped us
+// finding anything else. It doesn't touch redis, which might well be why we're here.
+func (h *Handler) sendFallback(w http.ResponseWriter, stream string, err error) bool {
+	track, ok := h.fallbacks.take(stream)
+	if !ok {
+		// If redis is fine and the pool is just empty, we might not have loaded the loop yet.
+		if err != errNoMusic {
+			return false
+		}
+		h.fallbacks.refresh(h, stream)
+		if track, ok = h.fallbacks.take(stream); !ok {
+			return false
+		}
+	}
+	log.Printf("Playing fallback track %s on %q: %v.\n", track["trackId"], stream, err)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "track": track}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+	}
+	return true
+}
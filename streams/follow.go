@@ -0,0 +1,82 @@
+package streams
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// followersFormat is the set of streams following each stream, mirroring its settings' follow fields so we don't
+// have to look at every stream's settings on every update.
+const followersFormat = "followers-%s"
+
+// maxFollowDepth is as long a chain of streams following streams as we'll put up with.
+const maxFollowDepth = 10
+
+// followLoop says whether stream following source would eventually have it following itself.
+func (h *Handler) followLoop(stream, source string) bool {
+	for i := 0; source != "" && i < maxFollowDepth; i++ {
+		if source == stream {
+			return true
+		}
+		source = h.redis.HGet(fmt.Sprintf(settingsFormat, source), "follow").Val()
+	}
+	return source != ""
+}
+
+// mirrorToFollowers copies a change to a stream's current track or playing state to every stream following it, and
+// to theirs in turn, publishing the same updates on their channels as on the source's.
+func (h *Handler) mirrorToFollowers(stream, key, value string) {
+	h.mirrorToFollowersAt(stream, key, value, 0)
+}
+
+func (h *Handler) mirrorToFollowersAt(stream, key, value string, depth int) {
+	if depth >= maxFollowDepth {
+		return
+	}
+	followers, err := h.redis.SMembers(fmt.Sprintf(followersFormat, stream)).Result()
+	if err != nil {
+		log.Printf("Failed to fetch followers of %q: %v.\n", stream, err)
+		return
+	}
+	for _, follower := range followers {
+		fields := map[string]interface{}{key: value}
+		if key == "currentTrack" {
+			fields["position"] = 0
+			fields[positionUpdatedKey] = time.Now().Unix()
+		}
+		if err := h.states.Update(follower, fields); err != nil {
+			log.Printf("Failed to mirror %s to %q: %v.\n", key, follower, err)
+			continue
+		}
+		if key == "currentTrack" {
+			if err := h.recordPlay(follower, value); err != nil {
+				log.Printf("Failed to mirror %s to %q: %v.\n", key, follower, err)
+			}
+		}
+		if err := h.publishUpdate(follower, key, value); err != nil {
+			log.Printf("Failed to publish update: %v.\n", err)
+		}
+		h.mirrorToFollowersAt(follower, key, value, depth+1)
+	}
+}
+
+// takeFollowedNext is what a following stream plays next: whatever its source is playing, if it isn't already, or
+// else whatever its source is going to play next, which we reserve so the source agrees.
+func (h *Handler) takeFollowedNext(stream, source string) (string, error) {
+	current, _ := h.states.Field(source, "currentTrack")
+	if own, _ := h.states.Field(stream, "currentTrack"); current != "" && current != own && h.redis.Exists(current).Val() != 0 {
+		h.countSelection(stream, "follow")
+		return current, nil
+	}
+	track, _, err := h.resolveNext(source, true)
+	if err == errUnpredictable {
+		// The source's group hasn't picked yet, so the best guess is whatever their shared queue has next.
+		track, _, err = h.resolveFromQueue(source, true)
+	}
+	if err != nil {
+		return "", err
+	}
+	h.countSelection(stream, "follow")
+	return track["trackId"], nil
+}
@@ -0,0 +1,92 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/apierror"
+	"github.com/PonyFest/music-control/songs"
+)
+
+// gainOverridesFormat is a hash of track ID to the gain, in dB, a stream plays it at instead of the track's own.
+const gainOverridesFormat = "gain-overrides-%s"
+
+// parseGain checks a gain is a sensible number of dB.
+func parseGain(value string) (float64, error) {
+	gain, err := strconv.ParseFloat(value, 64)
+	if err != nil || gain < -30 || gain > 30 {
+		return 0, fmt.Errorf("gain must be a number of dB between -30 and 30, not %q", value)
+	}
+	return gain, nil
+}
+
+// applyGain works out how loud the stream should play a track: the stream's override for it if it has one, or the
+// track's own gain, plus the stream's gain. That replaces the track's gain field, since it's what players should
+// use; trackGain and streamGain say how we got there.
+func (h *Handler) applyGain(stream string, track map[string]string) {
+	settings, err := h.settings(stream)
+	if err != nil {
+		log.Printf("Failed to fetch settings for %q: %v.\n", stream, err)
+		return
+	}
+	trackGain, _ := strconv.ParseFloat(track[songs.GainKey], 64)
+	if override, err := h.redis.HGet(fmt.Sprintf(gainOverridesFormat, stream), track["trackId"]).Float64(); err == nil {
+		trackGain = override
+	}
+	if e := h.takenEntry(stream, track["trackId"]); e != nil && e.Gain != nil {
+		trackGain = *e.Gain
+	}
+	if trackGain == 0 && settings.Gain == 0 {
+		return
+	}
+	track["trackGain"] = strconv.FormatFloat(trackGain, 'f', -1, 64)
+	track["streamGain"] = strconv.FormatFloat(settings.Gain, 'f', -1, 64)
+	track[songs.GainKey] = strconv.FormatFloat(trackGain+settings.Gain, 'f', -1, 64)
+}
+
+// handleGainOverrides lists the stream's per-track gain overrides.
+func (h *Handler) handleGainOverrides(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	overrides, err := h.redis.HGetAll(fmt.Sprintf(gainOverridesFormat, stream)).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch gain overrides: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "overrides": overrides}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleGainOverride sets (PUT, with `gain` in dB) or removes the gain the stream plays a track at.
+func (h *Handler) handleGainOverride(w http.ResponseWriter, r *http.Request) {
+	stream, trackId := mux.Vars(r)["stream"], mux.Vars(r)["track"]
+	key := fmt.Sprintf(gainOverridesFormat, stream)
+	if r.Method == http.MethodDelete {
+		if err := h.redis.HDel(key, trackId).Err(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to remove gain override: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+		return
+	}
+	gain, err := parseGain(r.FormValue("gain"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.redis.Exists(trackId).Val() == 0 {
+		apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+		return
+	}
+	if err := h.redis.HSet(key, trackId, gain).Err(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store gain override: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
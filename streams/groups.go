@@ -0,0 +1,275 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+)
+
+// A group is several streams that play the same music, like a main stream and its low bandwidth mirror. They share
+// one up next queue, pending list and recently played list, but each keeps its own state and settings; random picks
+// go by the settings of whichever member happens to make them.
+//
+// groupsKey is a hash of stream to the group it's in, and groupMembersFormat the set of streams in each group.
+const groupsKey = "stream-groups"
+const groupMembersFormat = "group-members-%s"
+
+// groupSequenceFormat is a stream of every track the group has taken from its queue, in order, and
+// groupCursorsFormat a hash of how far through it each member has got. Whichever member gets to the end first takes
+// the next track from the queue; the rest follow along behind it.
+const groupSequenceFormat = "group-sequence-%s"
+const groupCursorsFormat = "group-cursors-%s"
+const groupLockFormat = "group-lock-%s"
+
+// groupWait is how long a member waits for whoever's taking a track from the group's queue before giving up.
+const groupWait = 15 * time.Second
+
+var groupNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,50}$`)
+
+// groupOf is the group a stream is in, if any.
+func (h *Handler) groupOf(stream string) string {
+	return h.redis.HGet(groupsKey, stream).Val()
+}
+
+// queueKey is the key for one of a stream's queues, which it shares with the rest of its group if it has one.
+func (h *Handler) queueKey(format, stream string) string {
+	if group := h.groupOf(stream); group != "" {
+		return fmt.Sprintf(format, "group:"+group)
+	}
+	return fmt.Sprintf(format, stream)
+}
+
+// queueMembers are the streams sharing a stream's queues, including itself.
+func (h *Handler) queueMembers(stream string) []string {
+	group := h.groupOf(stream)
+	if group == "" {
+		return []string{stream}
+	}
+	members, err := h.redis.SMembers(fmt.Sprintf(groupMembersFormat, group)).Result()
+	if err != nil || len(members) == 0 {
+		return []string{stream}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// sequenceAfter says whether stream entry ID a comes after b, where an empty b comes before everything.
+func sequenceAfter(a, b string) bool {
+	if b == "" {
+		return true
+	}
+	parse := func(id string) (int64, int64) {
+		parts := strings.SplitN(id, "-", 2)
+		ms, _ := strconv.ParseInt(parts[0], 10, 64)
+		var seq int64
+		if len(parts) == 2 {
+			seq, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+		return ms, seq
+	}
+	ams, aseq := parse(a)
+	bms, bseq := parse(b)
+	return ams > bms || (ams == bms && aseq > bseq)
+}
+
+// takeGroupNext decides what a grouped stream plays next. If another member has already moved on, we catch up to
+// the latest track it took, so members that fall behind skip ahead rather than drifting further apart; otherwise
+// it's our turn to take one from the group's queue.
+func (h *Handler) takeGroupNext(group, stream string) (string, error) {
+	sequenceKey := fmt.Sprintf(groupSequenceFormat, group)
+	cursorsKey := fmt.Sprintf(groupCursorsFormat, group)
+	lockKey := fmt.Sprintf(groupLockFormat, group)
+	latest := func() (redis.XMessage, bool, error) {
+		messages, err := h.redis.XRevRangeN(sequenceKey, "+", "-", 1).Result()
+		if err != nil || len(messages) == 0 {
+			return redis.XMessage{}, false, err
+		}
+		return messages[0], true, nil
+	}
+	deadline := time.Now().Add(groupWait)
+	for time.Now().Before(deadline) {
+		cursor := h.redis.HGet(cursorsKey, stream).Val()
+		message, ok, err := latest()
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch group sequence: %v", err)
+		}
+		if ok && sequenceAfter(message.ID, cursor) {
+			h.redis.HSet(cursorsKey, stream, message.ID)
+			trackId, _ := message.Values["trackId"].(string)
+			if trackId == "" || h.redis.Exists(trackId).Val() == 0 {
+				continue
+			}
+			h.countSelection(stream, "group")
+			return trackId, nil
+		}
+
+		// Only one member gets to take from the queue at a time, or they'd each take something different. Whoever
+		// has it adds what they took to the sequence, so we wait to hear about that. If they fail, nothing gets
+		// added, so we check again every so often in case the queue's free.
+		if !h.redis.SetNX(lockKey, stream, 10*time.Second).Val() {
+			after := "0-0"
+			if ok {
+				after = message.ID
+			}
+			err := h.redis.XRead(&redis.XReadArgs{Streams: []string{sequenceKey, after}, Count: 1, Block: time.Second}).Err()
+			if err != nil && err != redis.Nil {
+				return "", fmt.Errorf("failed to wait for group sequence: %v", err)
+			}
+			continue
+		}
+		if message, ok, err := latest(); err == nil && ok && sequenceAfter(message.ID, cursor) {
+			// Someone else took one while we were waiting.
+			h.redis.Del(lockKey)
+			continue
+		}
+		trackId, err := h.takeFromQueue(stream)
+		if err != nil {
+			h.redis.Del(lockKey)
+			return "", err
+		}
+		id, err := h.redis.XAdd(&redis.XAddArgs{
+			Stream:       sequenceKey,
+			MaxLenApprox: 100,
+			Values:       map[string]interface{}{"trackId": trackId, "stream": stream},
+		}).Result()
+		if err != nil {
+			log.Printf("Failed to record %s in group %q's sequence: %v.\n", trackId, group, err)
+		} else {
+			h.redis.HSet(cursorsKey, stream, id)
+		}
+		h.redis.Del(lockKey)
+		return trackId, nil
+	}
+	return "", fmt.Errorf("timed out waiting for the rest of group %q to pick a track", group)
+}
+
+// groups lists every group and its members.
+func (h *Handler) groups() (map[string][]string, error) {
+	entries, err := h.redis.HGetAll(groupsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch groups: %v", err)
+	}
+	groups := map[string][]string{}
+	for stream, group := range entries {
+		groups[group] = append(groups[group], stream)
+	}
+	for _, members := range groups {
+		sort.Strings(members)
+	}
+	return groups, nil
+}
+
+func (h *Handler) handleGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := h.groups()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "groups": groups}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleGroup fetches, sets (PUT, with `streams` comma separated) or breaks up a group. Streams joining a group
+// leave any other group they were in, and swap their own queues for the group's.
+func (h *Handler) handleGroup(w http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["group"]
+	if !groupNamePattern.MatchString(group) {
+		http.Error(w, fmt.Sprintf("group names are up to 50 letters, numbers, dashes and underscores, not %q", group), http.StatusBadRequest)
+		return
+	}
+	membersKey := fmt.Sprintf(groupMembersFormat, group)
+	previous, err := h.redis.SMembers(membersKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch group: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var members []string
+	switch r.Method {
+	case http.MethodGet:
+		if len(previous) == 0 {
+			http.Error(w, fmt.Sprintf("no such group %q", group), http.StatusNotFound)
+			return
+		}
+		members = previous
+	case http.MethodPut:
+		seen := map[string]bool{}
+		for _, stream := range strings.Split(r.FormValue("streams"), ",") {
+			if stream = strings.TrimSpace(stream); stream != "" && !seen[stream] {
+				seen[stream] = true
+				members = append(members, stream)
+			}
+		}
+		if len(members) < 2 {
+			http.Error(w, "a group needs at least two streams", http.StatusBadRequest)
+			return
+		}
+		p := h.redis.TxPipeline()
+		for _, stream := range previous {
+			if !seen[stream] {
+				p.HDel(groupsKey, stream)
+			}
+		}
+		for _, stream := range members {
+			if other := h.groupOf(stream); other != "" && other != group {
+				p.SRem(fmt.Sprintf(groupMembersFormat, other), stream)
+			}
+			p.HSet(groupsKey, stream, group)
+		}
+		p.Del(membersKey)
+		p.SAdd(membersKey, stringsToInterfaces(members)...)
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to store group: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		p := h.redis.TxPipeline()
+		for _, stream := range previous {
+			p.HDel(groupsKey, stream)
+		}
+		queue := "group:" + group
+		p.Del(membersKey, fmt.Sprintf(groupSequenceFormat, group), fmt.Sprintf(groupCursorsFormat, group),
+			fmt.Sprintf(upNextFormat, queue), fmt.Sprintf(pendingFormat, queue),
+			fmt.Sprintf(recentlyPlayedFormat, queue), fmt.Sprintf(recentlyPlayedSetFormat, queue))
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to delete group: %v", err), http.StatusInternalServerError)
+			return
+		}
+		members = []string{}
+	}
+	if r.Method != http.MethodGet {
+		// Anyone that joined or left is now looking at a different queue.
+		changed := map[string]bool{}
+		for _, stream := range append(previous, members...) {
+			changed[stream] = true
+		}
+		for stream := range changed {
+			h.publishUpNextUpdate(stream)
+			h.publishPendingUpdate(stream)
+		}
+		log.Printf("Group %q is now %v.\n", group, members)
+	}
+	sort.Strings(members)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "group": group, "streams": members}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func stringsToInterfaces(s []string) []interface{} {
+	result := make([]interface{}, len(s))
+	for i, v := range s {
+		result[i] = v
+	}
+	return result
+}
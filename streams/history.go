@@ -0,0 +1,158 @@
+package streams
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// historyLength is how many tracks go in a history feed, and historyScanLimit how far back through the timeline
+// we're willing to look for them.
+const historyLength = 20
+const historyScanLimit = 5000
+
+type historyEntry struct {
+	id     string
+	played time.Time
+	track  map[string]string
+}
+
+func (e historyEntry) title() string {
+	if e.track["artist"] == "" {
+		return e.track["title"]
+	}
+	return e.track["artist"] + " - " + e.track["title"]
+}
+
+// history is what the stream has played recently, newest first, according to its timeline. Tracks that have since
+// gone away, and announcements, are left out.
+func (h *Handler) history(stream string) ([]historyEntry, error) {
+	var entries []historyEntry
+	key := fmt.Sprintf(timelineFormat, stream)
+	until := "+"
+	for scanned := 0; len(entries) < historyLength && scanned < historyScanLimit; {
+		messages, err := h.redis.XRevRangeN(key, until, "-", 500).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch timeline: %v", err)
+		}
+		for _, message := range messages {
+			if message.ID == until {
+				continue
+			}
+			scanned++
+			if message.Values["event"] != "update" || message.Values["key"] != "currentTrack" {
+				continue
+			}
+			trackId, _ := message.Values["value"].(string)
+			track, err := h.tracks.Get(trackId)
+			if err != nil || len(track) == 0 || track[songs.InterstitialKey] != "" {
+				continue
+			}
+			ms, _ := strconv.ParseInt(strings.SplitN(message.ID, "-", 2)[0], 10, 64)
+			entries = append(entries, historyEntry{id: message.ID, played: time.Unix(0, ms*int64(time.Millisecond)), track: track})
+			if len(entries) == historyLength {
+				break
+			}
+		}
+		if len(messages) < 500 {
+			break
+		}
+		until = messages[len(messages)-1].ID
+	}
+	return entries, nil
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title   string  `xml:"title"`
+	PubDate string  `xml:"pubDate"`
+	GUID    rssGUID `xml:"guid"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+// handleHistory serves what the stream has played recently as a feed: RSS for history.rss, JSON Feed for
+// history.json.
+func (h *Handler) handleHistory(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	entries, err := h.history(stream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	self := fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.Path)
+	title := fmt.Sprintf("Recently played on %s", stream)
+	// Feed readers poll; there's no point them doing it more often than tracks change.
+	w.Header().Set("Cache-Control", "max-age=30")
+
+	if mux.Vars(r)["format"] == "json" {
+		items := make([]map[string]interface{}, len(entries))
+		for i, entry := range entries {
+			items[i] = map[string]interface{}{
+				"id":             stream + "-" + entry.id,
+				"title":          entry.title(),
+				"content_text":   entry.title(),
+				"date_published": entry.played.UTC().Format(time.RFC3339),
+			}
+		}
+		w.Header().Set("Content-Type", "application/feed+json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":  "https://jsonfeed.org/version/1.1",
+			"title":    title,
+			"feed_url": self,
+			"items":    items,
+		}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        self,
+			Description: title,
+			Items:       make([]rssItem, len(entries)),
+		},
+	}
+	for i, entry := range entries {
+		feed.Channel.Items[i] = rssItem{
+			Title:   entry.title(),
+			PubDate: entry.played.UTC().Format(time.RFC1123Z),
+			GUID:    rssGUID{Value: stream + "-" + entry.id},
+		}
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal xml: %v", err), http.StatusInternalServerError)
+	}
+}
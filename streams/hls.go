@@ -0,0 +1,240 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// A stream's HLS output is a program of segments with wall clock start times, which we extend from the queue as
+// time passes and serve a window of as a live playlist. Nothing happens unless someone is fetching the playlist, and
+// while they are, the playlist is the stream's player: it consumes up next just like any other player would, so
+// don't point another player at the same stream. It only plays tracks that have been segmented, which needs
+// Options.HLS; anything else is left queued rather than skipped.
+const hlsProgramFormat = "hls-program-%s"
+const hlsMetaFormat = "hls-meta-%s"
+const hlsLockFormat = "hls-lock-%s"
+
+// hlsLookahead is how far past now we keep the program planned, and hlsHistory how long we keep segments around
+// after they've played, for clients that are a little behind.
+const hlsLookahead = 30 * time.Second
+const hlsHistory = 2 * time.Minute
+
+// hlsWindow is how many segments we put in each playlist.
+const hlsWindow = 6
+
+type hlsEntry struct {
+	Seq           int64   `json:"seq"`
+	TrackID       string  `json:"trackId"`
+	Key           string  `json:"key"`
+	Duration      float64 `json:"duration"`
+	Start         float64 `json:"start"`
+	Discontinuity bool    `json:"discontinuity,omitempty"`
+}
+
+func (e hlsEntry) end() float64 {
+	return e.Start + e.Duration
+}
+
+func (h *Handler) hlsProgram(stream string) ([]hlsEntry, error) {
+	raw, err := h.redis.LRange(fmt.Sprintf(hlsProgramFormat, stream), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]hlsEntry, 0, len(raw))
+	for _, r := range raw {
+		var e hlsEntry
+		if err := json.Unmarshal([]byte(r), &e); err != nil {
+			return nil, fmt.Errorf("corrupt HLS program entry %q: %v", r, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// extendHLSProgram drops segments that are long gone and plans more until we're hlsLookahead ahead of now.
+func (h *Handler) extendHLSProgram(stream string, now time.Time) error {
+	lockKey := fmt.Sprintf(hlsLockFormat, stream)
+	if !h.redis.SetNX(lockKey, 1, 5*time.Second).Val() {
+		// someone else is on it.
+		return nil
+	}
+	defer h.redis.Del(lockKey)
+
+	programKey := fmt.Sprintf(hlsProgramFormat, stream)
+	metaKey := fmt.Sprintf(hlsMetaFormat, stream)
+	program, err := h.hlsProgram(stream)
+	if err != nil {
+		return err
+	}
+	nowSeconds := float64(now.UnixNano()) / float64(time.Second)
+	for len(program) > 0 && program[0].end() < nowSeconds-hlsHistory.Seconds() {
+		h.redis.LPop(programKey)
+		if program[0].Discontinuity {
+			h.redis.HIncrBy(metaKey, "discontinuitySeq", 1)
+		}
+		program = program[1:]
+	}
+
+	end := nowSeconds
+	if len(program) > 0 && program[len(program)-1].end() > end {
+		end = program[len(program)-1].end()
+	}
+	for attempts := 0; end < nowSeconds+hlsLookahead.Seconds() && attempts < 10; attempts++ {
+		// Look before we take anything, so whatever we can't play stays where it is for a player that can.
+		candidate, source, err := h.resolveNext(stream, true)
+		if err != nil && err != errUnpredictable {
+			return err
+		}
+		if err == nil && !h.hasHLSSegments(candidate["trackId"]) {
+			if source == "random" || source == "prefetched" {
+				// Nobody chose it, so another random pick will do just as well.
+				if err := h.states.Delete(stream, prefetchedKey); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Printf("Holding %q's HLS output until %s is segmented.\n", stream, candidate["trackId"])
+			return nil
+		}
+		trackId, err := h.takeNext(stream)
+		if err != nil {
+			return err
+		}
+		segments := h.redis.LRange(fmt.Sprintf(songs.HLSFormat, trackId), 0, -1).Val()
+		if len(segments) == 0 {
+			// Something we couldn't see coming, like an album run, got in first. It goes back where it was.
+			h.putBack(stream, trackId)
+			log.Printf("Holding %q's HLS output until %s is segmented.\n", stream, trackId)
+			return nil
+		}
+		if err := h.recordPlay(stream, trackId); err != nil {
+			log.Printf("Failed to record HLS play on %q: %v.\n", stream, err)
+		}
+		for i, segment := range segments {
+			parts := strings.SplitN(segment, " ", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			duration, err := strconv.ParseFloat(parts[0], 64)
+			if err != nil {
+				continue
+			}
+			seq, err := h.redis.HIncrBy(metaKey, "nextSeq", 1).Result()
+			if err != nil {
+				return err
+			}
+			j, err := json.Marshal(hlsEntry{
+				Seq:           seq - 1,
+				TrackID:       trackId,
+				Key:           parts[1],
+				Duration:      duration,
+				Start:         end,
+				Discontinuity: i == 0,
+			})
+			if err != nil {
+				return err
+			}
+			if err := h.redis.RPush(programKey, j).Err(); err != nil {
+				return err
+			}
+			end += duration
+		}
+	}
+	return nil
+}
+
+// hasHLSSegments says whether a track has been segmented for HLS.
+func (h *Handler) hasHLSSegments(trackId string) bool {
+	return trackId != "" && h.redis.Exists(fmt.Sprintf(songs.HLSFormat, trackId)).Val() != 0
+}
+
+// putBack returns a track we took from a stream but can't play to the front of its queue, with whatever it was
+// queued with.
+func (h *Handler) putBack(stream, trackId string) {
+	raw := trackId
+	if entry := h.takenEntry(stream, trackId); entry != nil {
+		raw = entry.String()
+	}
+	if err := h.queues.Prepend(stream, raw); err != nil {
+		log.Printf("Failed to put %s back on %q's up next: %v.\n", trackId, stream, err)
+		return
+	}
+	h.publishUpNextUpdate(stream)
+}
+
+// syncHLSState makes the stream's state say whatever the HLS output is playing now, as a player would.
+func (h *Handler) syncHLSState(stream string, current hlsEntry) {
+	if currentTrack, _ := h.states.Field(stream, "currentTrack"); currentTrack == current.TrackID {
+		return
+	}
+	h.startTrack(stream, current.TrackID, "hls")
+}
+
+// handleHLS serves a stream as a live HLS playlist, so any HLS-capable audio element can play it.
+func (h *Handler) handleHLS(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	now := time.Now()
+	if err := h.extendHLSProgram(stream, now); err != nil && err != errNoMusic {
+		log.Printf("Failed to extend HLS program for %q: %v.\n", stream, err)
+	}
+	program, err := h.hlsProgram(stream)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch HLS program: %v", err), http.StatusInternalServerError)
+		return
+	}
+	nowSeconds := float64(now.UnixNano()) / float64(time.Second)
+	// Everything that has started is fair game; the window is the last few of those.
+	last := -1
+	for i, e := range program {
+		if e.Start <= nowSeconds {
+			last = i
+		}
+	}
+	if last == -1 {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "nothing is playing yet", http.StatusServiceUnavailable)
+		return
+	}
+	h.syncHLSState(stream, program[last])
+	first := last - hlsWindow + 1
+	if first < 0 {
+		first = 0
+	}
+	discontinuitySeq, _ := h.redis.HGet(fmt.Sprintf(hlsMetaFormat, stream), "discontinuitySeq").Int64()
+	for _, e := range program[:first] {
+		if e.Discontinuity {
+			discontinuitySeq++
+		}
+	}
+
+	window := program[first : last+1]
+	target := float64(songs.HLSSegmentSeconds)
+	for _, e := range window {
+		target = math.Max(target, e.Duration)
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", window[0].Seq)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySeq)
+	for _, e := range window {
+		// Every track is encoded separately, so its timestamps start again.
+		if e.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", e.Duration, h.urls.URL(e.Key))
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(b.String()))
+}
@@ -0,0 +1,121 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+)
+
+// Listener counts are kept in one hash per stream per UTC day, keyed by the start of each minute.
+const listenersFormat = "listeners-%s-%s"
+const listenerBucket = time.Minute
+
+// listenerRetention is how long we keep listener counts around; long enough to compare with the last con.
+const listenerRetention = 400 * 24 * time.Hour
+
+func listenersKey(stream string, t time.Time) string {
+	return fmt.Sprintf(listenersFormat, stream, t.UTC().Format("2006-01-02"))
+}
+
+// handleListeners records (POST, with `count`) or returns (GET, with optional `since` and `until` as unix
+// timestamps, defaulting to the last day) a stream's listener counts.
+func (h *Handler) handleListeners(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	switch r.Method {
+	case http.MethodPost:
+		count, err := strconv.ParseInt(r.FormValue("count"), 10, 64)
+		if err != nil || count < 0 {
+			http.Error(w, fmt.Sprintf("invalid count %q", r.FormValue("count")), http.StatusBadRequest)
+			return
+		}
+		now := time.Now().Truncate(listenerBucket)
+		key := listenersKey(stream, now)
+		p := h.redis.TxPipeline()
+		// if we get several samples in a bucket, the latest one wins.
+		p.HSet(key, strconv.FormatInt(now.Unix(), 10), count)
+		p.Expire(key, listenerRetention)
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to record listener count: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+	case http.MethodGet:
+		until := time.Now()
+		since := until.Add(-24 * time.Hour)
+		var err error
+		if s := r.FormValue("until"); s != "" {
+			if until, err = parseUnixTime(s); err != nil {
+				http.Error(w, fmt.Sprintf("invalid until %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.FormValue("since"); s != "" {
+			if since, err = parseUnixTime(s); err != nil {
+				http.Error(w, fmt.Sprintf("invalid since %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		if until.Sub(since) > listenerRetention {
+			http.Error(w, "that's too long a range", http.StatusBadRequest)
+			return
+		}
+		samples, err := h.listenerCounts(stream, since, until)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to fetch listener counts: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "listeners": samples}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type listenerSample struct {
+	Time      int64 `json:"time"`
+	Listeners int64 `json:"listeners"`
+}
+
+// listenerCounts returns the samples between since and until, oldest first.
+func (h *Handler) listenerCounts(stream string, since, until time.Time) ([]listenerSample, error) {
+	p := h.redis.Pipeline()
+	var cmds []*redis.StringStringMapCmd
+	for day := since.UTC().Truncate(24 * time.Hour); !day.After(until); day = day.Add(24 * time.Hour) {
+		cmds = append(cmds, p.HGetAll(listenersKey(stream, day)))
+	}
+	if _, err := p.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	samples := []listenerSample{}
+	for _, cmd := range cmds {
+		for k, v := range cmd.Val() {
+			t, err := strconv.ParseInt(k, 10, 64)
+			if err != nil || t < since.Unix() || t > until.Unix() {
+				continue
+			}
+			count, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			samples = append(samples, listenerSample{Time: t, Listeners: count})
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Time < samples[j].Time })
+	return samples, nil
+}
+
+func parseUnixTime(s string) (time.Time, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(n, 0), nil
+}
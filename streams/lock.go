@@ -0,0 +1,120 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/auth"
+	"github.com/PonyFest/music-control/events"
+)
+
+// lockedKey is the state field saying a stream is locked for a live show.
+const lockedKey = "locked"
+
+// confirmLockedParam is how someone other than an admin says they really mean to skip or add to the queue of a
+// locked stream: by giving the stream's name again.
+const confirmLockedParam = "confirmLocked"
+
+// IsLocked says whether a stream is locked for a live show.
+func (h *Handler) IsLocked(stream string) bool {
+	locked, _ := h.states.Field(stream, lockedKey)
+	return locked == "true"
+}
+
+// confirmable says whether a request is one that can go through on a locked stream with confirmation: skipping, or
+// adding a track to up next. Everything else that changes a locked stream is for admins alone.
+func confirmable(r *http.Request) bool {
+	template, err := mux.CurrentRoute(r).GetPathTemplate()
+	if err != nil {
+		return false
+	}
+	switch {
+	case template == "/{stream}/upnext" && r.Method == http.MethodPut:
+		return true
+	case template == "/{stream}/state" && r.Method == http.MethodPatch:
+		// Only if skipping is all it does to the state. State only comes from the body, so the query string, with
+		// its credentials, doesn't matter here.
+		if err := r.ParseForm(); err != nil {
+			return false
+		}
+		for k := range r.PostForm {
+			if stateKeys[k] && k != "skip" {
+				return false
+			}
+		}
+		skip, _ := strconv.ParseBool(r.PostForm.Get("skip"))
+		return skip
+	}
+	return false
+}
+
+// guardLocked is middleware that stops anyone but admins changing a locked stream, so nobody rearranges the queue in
+// the middle of a live set. Players can still ask for the next track, and skips and additions to up next go
+// through if they're confirmed with confirmLocked=<stream>.
+func (h *Handler) guardLocked(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream, ok := mux.Vars(r)["stream"]
+		if !ok || looking(r) || auth.RoleOf(r) == auth.RoleAdmin || !h.IsLocked(stream) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if template, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil && template == "/{stream}/next" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if confirmable(r) && r.FormValue(confirmLockedParam) == stream {
+			r.Form.Del(confirmLockedParam)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusLocked)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "error",
+			"error":   fmt.Sprintf("%q is locked for a live show", stream),
+			"confirm": confirmable(r),
+		})
+	})
+}
+
+// handleLock locks (PUT) or unlocks (DELETE) a stream for a live show. Only admins can do either.
+func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	if auth.RoleOf(r) != auth.RoleAdmin {
+		http.Error(w, "only admins can lock and unlock streams", http.StatusForbidden)
+		return
+	}
+	locked := r.Method == http.MethodPut
+	var err error
+	if locked {
+		err = h.states.Update(stream, map[string]interface{}{lockedKey: "true"})
+	} else {
+		err = h.states.Delete(stream, lockedKey)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to update lock: %v", err), http.StatusInternalServerError)
+		return
+	}
+	event := "streamUnlocked"
+	if locked {
+		event = "streamLocked"
+	}
+	h.recordTransition(stream, event, nil)
+	j, err := json.Marshal(map[string]string{
+		"event":  event,
+		"stream": stream,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+	} else if err := events.Publish(h.redis, h.channel(stream), j); err != nil {
+		log.Printf("Failed to publish %s event: %v.\n", event, err)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "locked": locked}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,310 @@
+package streams
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+)
+
+// MemoryTracks is a TrackService that keeps everything in memory, for tests and running without redis.
+type MemoryTracks struct {
+	mu     sync.RWMutex
+	tracks map[string]map[string]string
+}
+
+func NewMemoryTracks() *MemoryTracks {
+	return &MemoryTracks{tracks: map[string]map[string]string{}}
+}
+
+// Set adds or replaces a track.
+func (t *MemoryTracks) Set(trackId string, track map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tracks[trackId] = copyFields(track)
+}
+
+// Delete removes a track.
+func (t *MemoryTracks) Delete(trackId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tracks, trackId)
+}
+
+func (t *MemoryTracks) Track(trackId string) (map[string]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	track, ok := t.tracks[trackId]
+	if !ok {
+		return nil, nil
+	}
+	return copyFields(track), nil
+}
+
+func (t *MemoryTracks) Tracks(trackIds []string) (map[string]map[string]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := make(map[string]map[string]string, len(trackIds))
+	for _, trackId := range trackIds {
+		if track, ok := t.tracks[trackId]; ok {
+			result[trackId] = copyFields(track)
+		}
+	}
+	return result, nil
+}
+
+// MemoryQueues is a QueueService that keeps everything in memory. Unlike the redis one, it doesn't know about
+// stream groups, so every stream has its own queue.
+type MemoryQueues struct {
+	mu     sync.Mutex
+	queues map[string][]string
+}
+
+func NewMemoryQueues() *MemoryQueues {
+	return &MemoryQueues{queues: map[string][]string{}}
+}
+
+func (q *MemoryQueues) UpNext(stream string) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.queues[stream]...), nil
+}
+
+func (q *MemoryQueues) Append(stream string, entries ...string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queues[stream] = append(q.queues[stream], entries...)
+	return nil
+}
+
+func (q *MemoryQueues) Prepend(stream string, entries ...string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue := make([]string, 0, len(entries)+len(q.queues[stream]))
+	for i := len(entries) - 1; i >= 0; i-- {
+		queue = append(queue, entries[i])
+	}
+	q.queues[stream] = append(queue, q.queues[stream]...)
+	return nil
+}
+
+func (q *MemoryQueues) Pop(stream string) (string, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue := q.queues[stream]
+	if len(queue) == 0 {
+		return "", false, nil
+	}
+	q.queues[stream] = queue[1:]
+	return queue[0], true, nil
+}
+
+func (q *MemoryQueues) Replace(stream string, index int64, entry string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue := q.queues[stream]
+	// Negative indices count from the end, like redis.
+	if index < 0 {
+		index += int64(len(queue))
+	}
+	if index < 0 || index >= int64(len(queue)) {
+		return fmt.Errorf("failed to replace up next entry at index %d: index out of range", index)
+	}
+	queue[index] = entry
+	return nil
+}
+
+func (q *MemoryQueues) Remove(stream string, index int64) error {
+	if err := q.Replace(stream, index, ""); err != nil {
+		return fmt.Errorf("failed to remove up next entry at index %d: index out of range", index)
+	}
+	return nil
+}
+
+func (q *MemoryQueues) Take(stream string, entry string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue := q.queues[stream]
+	for i, e := range queue {
+		if e == entry {
+			q.queues[stream] = append(queue[:i:i], queue[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (q *MemoryQueues) Reset(stream string, entries ...string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queues[stream] = append([]string(nil), entries...)
+	return nil
+}
+
+func (q *MemoryQueues) Shuffle(stream string, seed int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var queue []string
+	for _, entry := range q.queues[stream] {
+		if entry != "" {
+			queue = append(queue, entry)
+		}
+	}
+	rand.New(rand.NewSource(seed)).Shuffle(len(queue), func(i, j int) {
+		queue[i], queue[j] = queue[j], queue[i]
+	})
+	q.queues[stream] = queue
+	return nil
+}
+
+func (q *MemoryQueues) Clear(stream string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.queues, stream)
+	return nil
+}
+
+// MemoryStates is a StateService that keeps everything in memory.
+type MemoryStates struct {
+	mu     sync.RWMutex
+	states map[string]map[string]string
+}
+
+func NewMemoryStates() *MemoryStates {
+	return &MemoryStates{states: map[string]map[string]string{}}
+}
+
+func (s *MemoryStates) State(stream string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyFields(s.states[stream]), nil
+}
+
+func (s *MemoryStates) Field(stream, key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.states[stream][key], nil
+}
+
+// Update formats values as redis does, at least for the strings and numbers we store.
+func (s *MemoryStates) Update(stream string, fields map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state(stream)
+	for k, v := range fields {
+		state[k] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+func (s *MemoryStates) Delete(stream string, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		delete(s.states[stream], k)
+	}
+	return nil
+}
+
+func (s *MemoryStates) UpdateRevision(stream, expected string, fields map[string]interface{}) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state(stream)
+	current := state[revisionKey]
+	if current == "" {
+		current = "0"
+	}
+	if expected != "" && expected != current {
+		return -1, nil
+	}
+	revision, err := strconv.ParseInt(current, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("updating state revision failed: %v", err)
+	}
+	for k, v := range fields {
+		state[k] = fmt.Sprint(v)
+	}
+	revision++
+	state[revisionKey] = strconv.FormatInt(revision, 10)
+	return revision, nil
+}
+
+func (s *MemoryStates) Panic(streams []string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	silenced := make([]bool, len(streams))
+	for i, stream := range streams {
+		state := s.state(stream)
+		if state[panicKey] == "true" {
+			continue
+		}
+		state[panicPlayingKey] = state["playing"]
+		if state[panicPlayingKey] == "" {
+			state[panicPlayingKey] = "false"
+		}
+		state[panicKey], state["playing"] = "true", "false"
+		s.bump(state)
+		silenced[i] = true
+	}
+	return silenced, nil
+}
+
+func (s *MemoryStates) Resume(streams []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	playing := make([]string, len(streams))
+	for i, stream := range streams {
+		state := s.state(stream)
+		if state[panicKey] != "true" {
+			continue
+		}
+		playing[i] = state[panicPlayingKey]
+		if playing[i] == "" {
+			playing[i] = "false"
+		}
+		state["playing"] = playing[i]
+		delete(state, panicKey)
+		delete(state, panicPlayingKey)
+		s.bump(state)
+	}
+	return playing, nil
+}
+
+func (s *MemoryStates) SetQuiet(stream string, quiet bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state(stream)
+	current := state[quietKey]
+	if current == "" {
+		current = "false"
+	}
+	if current == fmt.Sprint(quiet) {
+		return false, nil
+	}
+	state[quietKey] = fmt.Sprint(quiet)
+	return true, nil
+}
+
+// bump increments a state's revision, as redis's HINCRBY would. s.mu must be held.
+func (s *MemoryStates) bump(state map[string]string) {
+	revision, _ := strconv.ParseInt(state[revisionKey], 10, 64)
+	state[revisionKey] = strconv.FormatInt(revision+1, 10)
+}
+
+// state is the stream's state, which it creates if there isn't one. s.mu must be held.
+func (s *MemoryStates) state(stream string) map[string]string {
+	state, ok := s.states[stream]
+	if !ok {
+		state = map[string]string{}
+		s.states[stream] = state
+	}
+	return state
+}
+
+func copyFields(fields map[string]string) map[string]string {
+	result := make(map[string]string, len(fields))
+	for k, v := range fields {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,120 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/events"
+)
+
+// metadataFormat is a hash of the freeform things operators say about a stream, for dashboards to show.
+const metadataFormat = "metadata-%s"
+
+// metadataFields are the metadata a stream can have, and the longest each can be, in characters.
+var metadataFields = map[string]int{
+	"displayName": 100,
+	"description": 1000,
+	"notes":       10000,
+	"color":       7,
+}
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// metadata fetches the metadata for some streams at once.
+func (h *Handler) metadata(streams []string) (map[string]map[string]string, error) {
+	p := h.redis.Pipeline()
+	cmds := make(map[string]*redis.StringStringMapCmd, len(streams))
+	for _, stream := range streams {
+		cmds[stream] = p.HGetAll(fmt.Sprintf(metadataFormat, stream))
+	}
+	if _, err := p.Exec(); err != nil {
+		return nil, fmt.Errorf("failed to fetch stream metadata: %v", err)
+	}
+	result := make(map[string]map[string]string, len(streams))
+	for stream, cmd := range cmds {
+		result[stream] = cmd.Val()
+	}
+	return result, nil
+}
+
+// handleMetadata fetches (GET) or changes (PATCH) a stream's metadata. Setting a field to nothing removes it.
+func (h *Handler) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	key := fmt.Sprintf(metadataFormat, stream)
+	if r.Method == http.MethodPatch {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("parsing form failed: %v", err), http.StatusBadRequest)
+			return
+		}
+		fieldErrors := map[string]string{}
+		set := map[string]interface{}{}
+		var remove []string
+		for k := range r.Form {
+			v := r.Form.Get(k)
+			limit, ok := metadataFields[k]
+			switch {
+			case !ok:
+				fieldErrors[k] = "unknown metadata field"
+			case v == "":
+				remove = append(remove, k)
+			case utf8.RuneCountInString(v) > limit:
+				fieldErrors[k] = fmt.Sprintf("must be at most %d characters", limit)
+			case k == "color" && !colorPattern.MatchString(v):
+				fieldErrors[k] = "must be a colour like #ff88cc"
+			default:
+				set[k] = v
+			}
+		}
+		if len(fieldErrors) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "errors": fieldErrors})
+			return
+		}
+		p := h.redis.TxPipeline()
+		if len(set) > 0 {
+			p.HSet(key, set)
+		}
+		if len(remove) > 0 {
+			p.HDel(key, remove...)
+		}
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to store stream metadata: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	metadata, err := h.redis.HGetAll(key).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch stream metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		h.publishMetadata(stream, metadata)
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "metadata": metadata}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) publishMetadata(stream string, metadata map[string]string) {
+	j, err := json.Marshal(map[string]interface{}{
+		"event":    "metadataUpdated",
+		"stream":   stream,
+		"metadata": metadata,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	h.recordTransition(stream, "metadataUpdated", nil)
+	if err := events.Publish(h.redis, h.channel(stream), j); err != nil {
+		log.Printf("Failed to publish metadata update: %v.\n", err)
+	}
+}
@@ -0,0 +1,74 @@
+package streams
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// NowPlaying is what a stream is playing and what's coming up, as much as the public needs to know. There are no
+// track URLs, since nobody outside should be fetching the audio.
+type NowPlaying struct {
+	Stream      string `json:"stream"`
+	DisplayName string `json:"displayName"`
+	Playing     bool   `json:"playing"`
+	// Track is nil if nothing's loaded.
+	Track *Cue  `json:"track"`
+	Next  []Cue `json:"upNext"`
+}
+
+// NowPlaying says what a stream is playing now and what's coming up after it. The current track's start is when it
+// started, going by the player's position.
+func (h *Handler) NowPlaying(stream string) (NowPlaying, error) {
+	np := NowPlaying{Stream: stream, Next: []Cue{}}
+	state, err := h.states.State(stream)
+	if err != nil {
+		return np, err
+	}
+	metadata, err := h.metadata([]string{stream})
+	if err != nil {
+		return np, err
+	}
+	settings, err := h.settings(stream)
+	if err != nil {
+		return np, err
+	}
+	location, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	now := time.Now().In(location)
+	np.DisplayName = metadata[stream]["displayName"]
+	np.Playing = state["playing"] == "true"
+	if trackId := state["currentTrack"]; trackId != "" {
+		track, err := h.trackService.Track(trackId)
+		if err != nil {
+			return np, fmt.Errorf("couldn't look up track: %v", err)
+		}
+		if track != nil {
+			position, _ := strconv.ParseFloat(state["position"], 64)
+			if updated, err := strconv.ParseInt(state[positionUpdatedKey], 10, 64); err == nil && np.Playing {
+				position += now.Sub(time.Unix(updated, 0)).Seconds()
+			}
+			c := Cue{
+				TrackID: trackId,
+				Title:   track["title"],
+				Artist:  track["artist"],
+				Album:   track[songs.AlbumKey],
+				Start:   now.Add(-time.Duration(position * float64(time.Second))),
+			}
+			c.StartClock = c.Start.Format("15:04:05")
+			if duration, err := strconv.ParseFloat(track[songs.DurationKey], 64); err == nil {
+				c.Duration = &duration
+				c.Length = clock(duration)
+			}
+			np.Track = &c
+		}
+	}
+	if np.Next, _, _, err = h.cues(stream, settings, now.Add(time.Duration(h.currentRemaining(stream, now)*float64(time.Second)))); err != nil {
+		return np, err
+	}
+	return np, nil
+}
@@ -0,0 +1,81 @@
+package streams
+
+import (
+	"log"
+	"time"
+)
+
+// These are for players that run inside the controller rather than talking to it over HTTP.
+
+// outputKey in a stream's state names the player inside the controller that's playing it, if that's what is. Any
+// other player saying what it's playing takes the stream back.
+const outputKey = "output"
+
+// TakeNext consumes whatever the stream should play next, just as a player asking for the next track would, and
+// returns its metadata, with the gain to play it at.
+func (h *Handler) TakeNext(stream string) (map[string]string, error) {
+	trackId, err := h.takeNext(stream)
+	if err != nil {
+		return nil, err
+	}
+	track, err := h.trackIdToTrack(trackId)
+	if err != nil {
+		return nil, err
+	}
+	h.applyGain(stream, track)
+	h.addAlbumHints(stream, track)
+	h.applyEntry(stream, track)
+	return track, nil
+}
+
+// Started records that a track has started playing on the stream, through the mixer.
+func (h *Handler) Started(stream, trackId string) {
+	if err := h.recordPlay(stream, trackId); err != nil {
+		log.Printf("Failed to record play on %q: %v.\n", stream, err)
+	}
+	h.startTrack(stream, trackId, "mixer")
+}
+
+// Crossfade is how long the stream wants tracks to overlap for.
+func (h *Handler) Crossfade(stream string) time.Duration {
+	settings, err := h.settings(stream)
+	if err != nil {
+		log.Printf("Failed to fetch settings for %q: %v.\n", stream, err)
+		return 0
+	}
+	return time.Duration(settings.Crossfade * float64(time.Second))
+}
+
+// Channel is the pub/sub channel that events about the stream, including skip requests, are published on.
+func (h *Handler) Channel(stream string) string {
+	return h.channel(stream)
+}
+
+// startTrack makes the stream's state say that output has just started playing trackId, as a player would.
+func (h *Handler) startTrack(stream, trackId, output string) {
+	h.redis.SAdd(StreamsKey, stream)
+	now := time.Now().Unix()
+	if err := h.states.Update(stream, map[string]interface{}{"currentTrack": trackId, "position": 0, "playing": "true", outputKey: output, positionUpdatedKey: now, lastSeenKey: now}); err != nil {
+		log.Printf("Failed to update state for %q: %v.\n", stream, err)
+		return
+	}
+	if err := h.publishUpdate(stream, "currentTrack", trackId); err != nil {
+		log.Printf("Failed to publish update: %v.\n", err)
+	}
+	h.mirrorToFollowers(stream, "currentTrack", trackId)
+}
+
+// QueueFirst puts a track at the front of the stream's up next, ahead of anything already queued.
+func (h *Handler) QueueFirst(stream, trackId string) error {
+	if err := h.queues.Prepend(stream, trackId); err != nil {
+		return err
+	}
+	h.redis.SAdd(StreamsKey, stream)
+	h.publishUpNextUpdate(stream)
+	return nil
+}
+
+// RequestSkip asks the stream's player to move on to the next track.
+func (h *Handler) RequestSkip(stream string) error {
+	return h.publishSkip(stream)
+}
@@ -0,0 +1,160 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/songs"
+)
+
+// panicKey is the state field saying a stream was silenced by a panic, and panicPlayingKey whether it was playing
+// at the time, so resuming only starts what was playing before.
+const panicKey = "panic"
+const panicPlayingKey = "panicPlaying"
+
+// panicScript pauses every stream in KEYS (state hashes) at once, returning 1 for each one it silenced and 0 for
+// each one that was already silenced. ARGV is panicKey and panicPlayingKey.
+var panicScript = redis.NewScript(`
+local result = {}
+for i, key in ipairs(KEYS) do
+	if redis.call("HGET", key, ARGV[1]) == "true" then
+		result[i] = 0
+	else
+		redis.call("HSET", key, ARGV[2], redis.call("HGET", key, "playing") or "false", ARGV[1], "true", "playing", "false")
+		redis.call("HINCRBY", key, "revision", 1)
+		result[i] = 1
+	end
+end
+return result
+`)
+
+// resumeScript undoes panicScript for every silenced stream in KEYS, returning each one's playing state afterwards,
+// or "" for any that weren't silenced. ARGV is as for panicScript.
+var resumeScript = redis.NewScript(`
+local result = {}
+for i, key in ipairs(KEYS) do
+	if redis.call("HGET", key, ARGV[1]) == "true" then
+		local playing = redis.call("HGET", key, ARGV[2]) or "false"
+		redis.call("HSET", key, "playing", playing)
+		redis.call("HDEL", key, ARGV[1], ARGV[2])
+		redis.call("HINCRBY", key, "revision", 1)
+		result[i] = playing
+	else
+		result[i] = ""
+	end
+end
+return result
+`)
+
+// PanicHandler is the emergency stop: POST / pauses every stream (or just those in `streams`, comma separated) in
+// one go, and POST /resume starts them again, if they were playing before. It's separate from the rest of the
+// streams API, so it can live somewhere easy to find.
+func (h *Handler) PanicHandler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/", h.handlePanic).Methods(http.MethodPost)
+	r.HandleFunc("/resume", h.handlePanic).Methods(http.MethodPost)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "" {
+			req.URL.Path = "/"
+		}
+		r.ServeHTTP(w, req)
+	})
+}
+
+func (h *Handler) handlePanic(w http.ResponseWriter, r *http.Request) {
+	resume := r.URL.Path == "/resume"
+	var streams []string
+	if s := r.FormValue("streams"); s != "" {
+		streams = strings.Split(s, ",")
+	} else {
+		var err error
+		if streams, err = h.redis.SMembers(StreamsKey).Result(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to list streams: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(streams) == 0 {
+		_, _ = w.Write([]byte(`{"status": "ok", "streams": []}`))
+		return
+	}
+	affected := []string{}
+	event := "panic"
+	if resume {
+		event = "panicEnded"
+		result, err := h.states.Resume(streams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i, playing := range result {
+			if playing != "" {
+				affected = append(affected, streams[i])
+				h.publishStateUpdate(streams[i], map[string]string{"playing": playing})
+			}
+		}
+	} else {
+		result, err := h.states.Panic(streams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i, silenced := range result {
+			if silenced {
+				affected = append(affected, streams[i])
+				h.publishStateUpdate(streams[i], map[string]string{"playing": "false"})
+			}
+		}
+	}
+	if resume {
+		log.Printf("Resumed after a panic: %s.\n", strings.Join(affected, ", "))
+	} else {
+		log.Printf("Panic! Silenced %s.\n", strings.Join(affected, ", "))
+	}
+
+	// Players should act on this before anything else they're doing, so it says so.
+	for _, stream := range affected {
+		h.recordTransition(stream, event, nil)
+		h.publishPanic(h.channel(stream), event, []string{stream})
+	}
+	h.publishPanic(h.options.ChannelPrefix+songs.EventsKey, event, affected)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "streams": affected}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// silenced says whether the stream was stopped by a panic, and hasn't been resumed since. Nothing but an admin or
+// resuming should start it playing again until then.
+func (h *Handler) silenced(stream string) bool {
+	panicked, _ := h.states.Field(stream, panicKey)
+	return panicked == "true"
+}
+
+// startsPlaying says whether value, for the playing state field, would start a stream.
+func startsPlaying(value string) bool {
+	playing, _ := strconv.ParseBool(value)
+	return playing
+}
+
+func (h *Handler) publishPanic(channel, event string, streams []string) {
+	j, err := json.Marshal(map[string]interface{}{
+		"event":    event,
+		"priority": "high",
+		"streams":  streams,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	if err := events.Publish(h.redis, channel, j); err != nil {
+		log.Printf("Failed to publish %s event: %v.\n", event, err)
+	}
+}
@@ -0,0 +1,210 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/events"
+)
+
+// The pending list holds random picks we've made ahead of time, so operators can see what's coming and veto it.
+// It's separate from up next, which is what operators have explicitly asked for and always plays first.
+const pendingFormat = "pending-%s"
+const maxAutoQueueHorizon = 50
+
+// removeAtScript removes the entry at an index, but only if it's the entry the client thinks it is.
+// KEYS: the list. ARGV: index, expected value. Returns 1 if something was removed.
+var removeAtScript = redis.NewScript(`
+if redis.call("LINDEX", KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call("LSET", KEYS[1], ARGV[1], "\0deleted")
+redis.call("LREM", KEYS[1], 1, "\0deleted")
+return 1
+`)
+
+// moveScript moves the entry at one index to another, but only if it's the entry the client thinks it is.
+// KEYS: the list. ARGV: from, to, expected value. Returns 1 if something was moved.
+var moveScript = redis.NewScript(`
+local entries = redis.call("LRANGE", KEYS[1], 0, -1)
+local from = tonumber(ARGV[1]) + 1
+local to = tonumber(ARGV[2]) + 1
+if entries[from] ~= ARGV[3] or to < 1 or to > #entries then
+	return 0
+end
+local entry = table.remove(entries, from)
+table.insert(entries, to, entry)
+redis.call("DEL", KEYS[1])
+redis.call("RPUSH", KEYS[1], unpack(entries))
+return 1
+`)
+
+// popPending takes the next track off the pending list, if there is one, and tops the list back up.
+func (h *Handler) popPending(stream string) (string, bool) {
+	key := h.queueKey(pendingFormat, stream)
+	for {
+		trackId, err := h.redis.LPop(key).Result()
+		if err != nil {
+			return "", false
+		}
+		if !h.available(trackId) || !h.playable(stream, trackId) {
+			continue
+		}
+		// It's about to be the current track, but isn't yet.
+		h.fillPending(stream, trackId)
+		return trackId, true
+	}
+}
+
+// fillPending tops up the pending list to the stream's horizon, or empties it if the stream doesn't want one. It
+// never adds the current track, or any of exclude.
+func (h *Handler) fillPending(stream string, exclude ...string) {
+	settings, err := h.settings(stream)
+	if err != nil {
+		log.Printf("Failed to fill pending list for %q: %v.\n", stream, err)
+		return
+	}
+	key := h.queueKey(pendingFormat, stream)
+	pending := h.redis.LRange(key, 0, -1).Val()
+	if settings.AutoQueueHorizon == 0 {
+		if len(pending) > 0 {
+			h.redis.Del(key)
+			h.publishPendingUpdate(stream)
+		}
+		return
+	}
+	seen := make(map[string]bool, len(pending))
+	for _, trackId := range pending {
+		seen[trackId] = true
+	}
+	// Tracks that are playing or about to be aren't in recently played yet, so the picker might well choose them.
+	playing := map[string]bool{}
+	if current, _ := h.states.Field(stream, "currentTrack"); current != "" {
+		playing[current] = true
+	}
+	for _, trackId := range exclude {
+		playing[trackId] = true
+	}
+	changed, retries := false, len(playing)
+	for length := len(pending); length < settings.AutoQueueHorizon; length++ {
+		trackId, err := h.pickRandomTrack(stream)
+		if err != nil {
+			break
+		}
+		if playing[trackId] && retries > 0 {
+			retries--
+			length--
+			continue
+		}
+		// When we run out of fresh tracks we get the same old one back every time, so give up.
+		if seen[trackId] || playing[trackId] {
+			break
+		}
+		seen[trackId] = true
+		h.redis.RPush(key, trackId)
+		changed = true
+	}
+	// Two servers filling at once might overshoot.
+	h.redis.LTrim(key, 0, int64(settings.AutoQueueHorizon)-1)
+	if changed {
+		h.publishPendingUpdate(stream)
+	}
+}
+
+func (h *Handler) publishPendingUpdate(stream string) {
+	pending := h.redis.LRange(h.queueKey(pendingFormat, stream), 0, -1).Val()
+	if pending == nil {
+		pending = []string{}
+	}
+	// Everyone sharing the list should hear about it.
+	for _, member := range h.queueMembers(stream) {
+		j, err := json.Marshal(map[string]interface{}{
+			"event":   "updatePending",
+			"stream":  member,
+			"pending": pending,
+		})
+		if err != nil {
+			log.Printf("Failed to marshal json: %v.\n", err)
+			return
+		}
+		if err := events.Publish(h.redis, h.channel(member), j); err != nil {
+			log.Printf("Failed to publish pending update: %v.\n", err)
+		}
+	}
+}
+
+func (h *Handler) handlePending(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	key := h.queueKey(pendingFormat, stream)
+	switch r.Method {
+	case http.MethodGet:
+		h.fillPending(stream)
+		pending := h.redis.LRange(key, 0, -1).Val()
+		tracks, err := h.tracks.GetMany(pending)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("looking up pending tracks failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		result := make([]map[string]string, len(pending))
+		for i, trackId := range pending {
+			track := tracks[trackId]
+			track["trackId"] = trackId
+			track["trackUrl"] = h.urls.TrackURL(trackId, track)
+			result[i] = track
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "pending": result}); err != nil {
+			http.Error(w, fmt.Sprintf("encoding json somehow failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		// Vetoing needs the track ID as well as the index, since the list moves every time a track ends.
+		index, err := strconv.ParseInt(r.FormValue("index"), 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid index %q: %v", r.FormValue("index"), err), http.StatusBadRequest)
+			return
+		}
+		removed, err := removeAtScript.Run(h.redis, []string{key}, index, r.FormValue("trackId")).Int()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to veto pending track: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if removed == 0 {
+			http.Error(w, "the pending list has changed; refresh and try again", http.StatusConflict)
+			return
+		}
+		h.publishPendingUpdate(stream)
+		h.fillPending(stream)
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+	}
+}
+
+func (h *Handler) handleMovePending(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	from, err := strconv.ParseInt(r.FormValue("from"), 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid index %q: %v", r.FormValue("from"), err), http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.ParseInt(r.FormValue("to"), 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid index %q: %v", r.FormValue("to"), err), http.StatusBadRequest)
+		return
+	}
+	moved, err := moveScript.Run(h.redis, []string{h.queueKey(pendingFormat, stream)}, from, to, r.FormValue("trackId")).Int()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to move pending track: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if moved == 0 {
+		http.Error(w, "the pending list has changed; refresh and try again", http.StatusConflict)
+		return
+	}
+	h.publishPendingUpdate(stream)
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
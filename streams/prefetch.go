@@ -0,0 +1,145 @@
+package streams
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/songs"
+)
+
+const endingSoonFormat = "endingsoon-%s"
+const prefetchedKey = "prefetched"
+const positionUpdatedKey = "positionUpdated"
+
+// checkEndingSoon publishes a trackEndingSoon event the first time a player reports a position close enough to the
+// end of its current track. We can only do this for tracks whose duration we know.
+func (h *Handler) checkEndingSoon(stream string, position float64) {
+	if h.options.EndingSoonLead <= 0 {
+		return
+	}
+	currentTrack, err := h.states.Field(stream, "currentTrack")
+	if err != nil || currentTrack == "" {
+		return
+	}
+	track, err := h.trackService.Track(currentTrack)
+	if err != nil || track == nil {
+		return
+	}
+	duration, err := strconv.ParseFloat(track[songs.DurationKey], 64)
+	if err != nil {
+		return
+	}
+	remaining := duration - position
+	if remaining > h.options.EndingSoonLead.Seconds() {
+		return
+	}
+	// GETSET makes sure only one of several concurrent position reports actually announces anything.
+	if previous := h.redis.GetSet(fmt.Sprintf(endingSoonFormat, stream), currentTrack).Val(); previous == currentTrack {
+		return
+	}
+
+	event := map[string]interface{}{
+		"event":     "trackEndingSoon",
+		"stream":    stream,
+		"trackId":   currentTrack,
+		"remaining": remaining,
+	}
+	if h.options.PrefetchNext {
+		next, _, err := h.resolveNext(stream, true)
+		// If it's unpredictable, players will just have to wait and see.
+		if err == nil {
+			event["next"] = next
+		} else if err != errUnpredictable {
+			log.Printf("Failed to prefetch next track for %q: %v.\n", stream, err)
+		}
+	}
+	j, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	if err := events.Publish(h.redis, h.channel(stream), j); err != nil {
+		log.Printf("Failed to publish track ending soon event: %v.\n", err)
+	}
+}
+
+// errUnpredictable is from resolveNext when there's no telling what handleNext will return until it does.
+var errUnpredictable = errors.New("the next track can't be known in advance")
+
+// resolveNext works out what handleNext is going to return without consuming anything from up next, and says
+// where it came from. If that would be a random pick and reserve is set, we remember the pick so handleNext agrees
+// with us later; otherwise it's just a sample of what might be picked. Members of a group take turns picking for
+// each other, so for them it's errUnpredictable.
+func (h *Handler) resolveNext(stream string, reserve bool) (map[string]string, string, error) {
+	if source := h.redis.HGet(fmt.Sprintf(settingsFormat, stream), "follow").Val(); source != "" {
+		current, _ := h.states.Field(source, "currentTrack")
+		if own, _ := h.states.Field(stream, "currentTrack"); current != "" && current != own && h.redis.Exists(current).Val() != 0 {
+			track, err := h.trackIdToTrack(current)
+			return track, "follow", err
+		}
+		track, _, err := h.resolveNext(source, reserve)
+		return track, "follow", err
+	}
+	if h.groupOf(stream) != "" {
+		return nil, "", errUnpredictable
+	}
+	return h.resolveFromQueue(stream, reserve)
+}
+
+// resolveFromQueue is resolveNext for what chooseFromQueue would take.
+func (h *Handler) resolveFromQueue(stream string, reserve bool) (map[string]string, string, error) {
+	if h.redis.Exists(h.queueKey(albumCurrentFormat, stream)).Val() != 0 {
+		run, _ := h.redis.LRange(h.queueKey(albumRunFormat, stream), 0, -1).Result()
+		for _, trackId := range run {
+			if h.available(trackId) {
+				track, err := h.trackIdToTrack(trackId)
+				return track, "album", err
+			}
+		}
+	}
+	upNext, _ := h.queues.UpNext(stream)
+	for i, raw := range upNext {
+		trackId := parseEntry(raw).TrackID
+		if raw == "" || !h.available(trackId) {
+			continue
+		}
+		if h.albumRunIncludes(stream, trackId) {
+			track, err := h.trackIdToTrack(trackId)
+			return track, "album", err
+		}
+		current, _ := h.states.Field(stream, "currentTrack")
+		if songs.KeptApart(h.redis, current, trackId) {
+			if _, candidate, ok := h.playInstead(current, trackId, upNext[i+1:]); ok {
+				trackId = candidate.TrackID
+			}
+		}
+		track, err := h.trackIdToTrack(trackId)
+		return track, "upNext", err
+	}
+	pending, _ := h.redis.LRange(h.queueKey(pendingFormat, stream), 0, -1).Result()
+	for _, trackId := range pending {
+		if h.available(trackId) && h.playable(stream, trackId) {
+			track, err := h.trackIdToTrack(trackId)
+			return track, "pending", err
+		}
+	}
+	if prefetched, _ := h.states.Field(stream, prefetchedKey); prefetched != "" && h.available(prefetched) && h.playable(stream, prefetched) {
+		track, err := h.trackIdToTrack(prefetched)
+		return track, "prefetched", err
+	}
+	trackId, err := h.pickRandomTrack(stream)
+	if err != nil {
+		return nil, "", err
+	}
+	if reserve {
+		if err := h.states.Update(stream, map[string]interface{}{prefetchedKey: trackId}); err != nil {
+			return nil, "", fmt.Errorf("failed to store prefetched track: %v", err)
+		}
+	}
+	track, err := h.trackIdToTrack(trackId)
+	return track, "random", err
+}
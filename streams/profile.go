@@ -0,0 +1,118 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/profiles"
+	"github.com/PonyFest/music-control/songs"
+)
+
+// switchingProfile applies a newly chosen profile's crossfade to the stream's settings, unless whoever switched it
+// also set the crossfade themselves.
+func (h *Handler) switchingProfile(s *Settings, crossfadeSet bool) {
+	if s.Profile == "" || crossfadeSet {
+		return
+	}
+	p, err := profiles.Get(h.redis, s.Profile)
+	if err != nil {
+		log.Printf("Failed to fetch profile %q: %v.\n", s.Profile, err)
+		return
+	}
+	if p.Crossfade != nil {
+		s.Crossfade = *p.Crossfade
+	}
+}
+
+// switchedProfile throws away random picks made in the old mood, and tells everyone about the new one.
+func (h *Handler) switchedProfile(stream, profile string) {
+	h.redis.Del(h.queueKey(pendingFormat, stream))
+	if err := h.states.Delete(stream, prefetchedKey); err != nil {
+		log.Printf("Failed to forget the prefetched track on %q: %v.\n", stream, err)
+	}
+	h.publishPendingUpdate(stream)
+	h.recordTransition(stream, "profileChanged", map[string]interface{}{"profile": profile})
+	j, err := json.Marshal(map[string]interface{}{
+		"event":   "profileChanged",
+		"stream":  stream,
+		"profile": profile,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	if err := events.Publish(h.redis, h.channel(stream), j); err != nil {
+		log.Printf("Failed to publish profile change: %v.\n", err)
+	}
+}
+
+// activeProfile is the profile the stream's random picks should be made in, if any. A profile that's been deleted
+// out from under the stream counts as none.
+func (h *Handler) activeProfile(s Settings) (*profiles.Profile, error) {
+	if s.Profile == "" {
+		return nil, nil
+	}
+	p, err := profiles.Get(h.redis, s.Profile)
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return p, err
+}
+
+// profileArgs turns a profile into the extra keys candidatesScript wants, and the weights of the weighted ones.
+func profileArgs(p *profiles.Profile) (keys []string, weights []interface{}) {
+	if p == nil {
+		return nil, nil
+	}
+	for tag, weight := range p.Weights {
+		keys = append(keys, fmt.Sprintf(songs.TagFormat, tag))
+		weights = append(weights, weight)
+	}
+	for _, tag := range p.Exclude {
+		keys = append(keys, fmt.Sprintf(songs.TagFormat, tag))
+	}
+	return keys, weights
+}
+
+// handleProfile switches the stream between profiles (PUT, with `profile` empty to go back to not having one),
+// which takes effect from the next random pick.
+func (h *Handler) handleProfile(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	s, err := h.settings(stream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPut {
+		name := r.FormValue("profile")
+		if name != s.Profile {
+			if err := h.applySetting(&s, "profile", name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			h.switchingProfile(&s, false)
+			if err := h.storeSettings(stream, s); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			h.publishSettings(stream, s)
+			h.switchedProfile(stream, s.Profile)
+			h.fillPending(stream)
+		}
+	}
+	p, err := h.activeProfile(s)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "profile": p}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
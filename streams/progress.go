@@ -0,0 +1,61 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/songs"
+)
+
+const progressThrottleFormat = "progress-throttle-%s"
+
+// publishProgress tells overlays where the player has got to, so they can draw a progress bar, but no more than
+// once per ProgressInterval however often the player reports in.
+func (h *Handler) publishProgress(stream string, position float64) {
+	if h.options.ProgressInterval <= 0 {
+		return
+	}
+	// Only one server gets to publish per interval.
+	if !h.redis.SetNX(fmt.Sprintf(progressThrottleFormat, stream), 1, h.options.ProgressInterval).Val() {
+		return
+	}
+	state, err := h.states.State(stream)
+	if err != nil {
+		log.Printf("Failed to fetch state for progress on %q: %v.\n", stream, err)
+		return
+	}
+	trackId, playing := state["currentTrack"], state["playing"]
+	event := map[string]interface{}{
+		"event":    "progress",
+		"stream":   stream,
+		"trackId":  trackId,
+		"position": position,
+		"playing":  playing == "true",
+		// Overlays can extrapolate from this between events.
+		"at": time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if trackId != "" {
+		if track, err := h.tracks.Get(trackId); err == nil {
+			if duration, err := strconv.ParseFloat(track[songs.DurationKey], 64); err == nil {
+				event["duration"] = duration
+			}
+		}
+	}
+	j, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	// There's another one along in a second, so there's no point logging it for anyone who missed this one.
+	if err := h.redis.Publish(h.channel(stream), j).Err(); err != nil {
+		log.Printf("Failed to publish progress: %v.\n", err)
+		return
+	}
+	if err := events.SetSnapshot(h.redis, h.channel(stream), "progress", j); err != nil {
+		log.Printf("Failed to record progress snapshot: %v.\n", err)
+	}
+}
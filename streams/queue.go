@@ -0,0 +1,94 @@
+package streams
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// shuffleScript shuffles the up next list in place, dropping tombstones while it's at it (the indices are all
+// changing anyway, so there's no point preserving them).
+// Redis seeds the Lua PRNG identically for every script run, so we pass our own seed in.
+var shuffleScript = redis.NewScript(`
+math.randomseed(tonumber(ARGV[1]))
+local entries = {}
+for _, v in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+	if v ~= "" then
+		table.insert(entries, v)
+	end
+end
+for i = #entries, 2, -1 do
+	local j = math.random(i)
+	entries[i], entries[j] = entries[j], entries[i]
+end
+redis.call("DEL", KEYS[1])
+for _, v in ipairs(entries) do
+	redis.call("RPUSH", KEYS[1], v)
+end
+return #entries
+`)
+
+func (h *Handler) handleClearUpNext(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	if err := h.queues.Clear(stream); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.publishUpNextUpdate(stream)
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+func (h *Handler) handleShuffleUpNext(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	if err := h.queues.Shuffle(stream, h.random.Int63()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.publishUpNextUpdate(stream)
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+type queueTiming struct {
+	// length is the number of real (non-tombstone) entries in the queue
+	length int
+	// eta is the number of seconds from the start of the queue until each entry starts playing, or nil for
+	// tombstones. Entries after one with an unknown duration get a best-effort (i.e. too early) estimate.
+	eta []interface{}
+	// total is the sum of all the durations we know about
+	total float64
+	// unknown is the number of entries whose duration we don't know
+	unknown int
+}
+
+func (h *Handler) queueTimings(raw []string) (queueTiming, error) {
+	entries := entryTrackIds(raw)
+	timing := queueTiming{eta: make([]interface{}, len(entries))}
+	var trackIds []string
+	for _, trackId := range entries {
+		if trackId != "" {
+			trackIds = append(trackIds, trackId)
+		}
+	}
+	tracks, err := h.trackService.Tracks(trackIds)
+	if err != nil {
+		return timing, err
+	}
+	for i, trackId := range entries {
+		if trackId == "" {
+			continue
+		}
+		timing.length++
+		timing.eta[i] = timing.total
+		duration, err := strconv.ParseFloat(tracks[trackId][songs.DurationKey], 64)
+		if err != nil {
+			timing.unknown++
+			continue
+		}
+		timing.total += duration
+	}
+	return timing, nil
+}
@@ -0,0 +1,144 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/events"
+)
+
+// quietKey is the state field saying a stream is in its quiet hours, and quietAutoplayKey whether it had autoplay
+// on when they started, so we know whether to turn it back on after.
+const quietKey = "quiet"
+const quietAutoplayKey = "quietAutoplay"
+
+// setQuietScript sets a stream's quiet flag, returning 1 if that changed anything, so only one server acts on each
+// transition. KEYS: state hash. ARGV: "true" or "false".
+var setQuietScript = redis.NewScript(`
+if (redis.call("HGET", KEYS[1], "quiet") or "false") == ARGV[1] then
+	return 0
+end
+redis.call("HSET", KEYS[1], "quiet", ARGV[1])
+return 1
+`)
+
+// parseQuietHours parses quiet hours like "23:00-07:00" into minutes past midnight. The end can be before the
+// start, which means they run overnight.
+func parseQuietHours(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("quietHours must look like 23:00-07:00")
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("quietHours must look like 23:00-07:00")
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return 0, 0, fmt.Errorf("quietHours can't start and end at the same time")
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// quietAt says whether t falls in the stream's quiet hours, in its time zone.
+func (s Settings) quietAt(t time.Time) bool {
+	if s.QuietHours == "" {
+		return false
+	}
+	start, end, err := parseQuietHours(s.QuietHours)
+	if err != nil {
+		return false
+	}
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	t = t.In(location)
+	now := t.Hour()*60 + t.Minute()
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// RunQuietHours turns autoplay off for streams as their quiet hours start, and back on as they end if it was on
+// before. Operators can still turn it on in between; we only act at the transitions. It never returns, so run it in
+// a goroutine. It's safe to run on several servers at once.
+func (h *Handler) RunQuietHours() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		streams, err := h.redis.SMembers(StreamsKey).Result()
+		if err != nil {
+			log.Printf("Failed to list streams for quiet hours: %v.\n", err)
+			continue
+		}
+		for _, stream := range streams {
+			h.checkQuietHours(stream, time.Now())
+		}
+	}
+}
+
+func (h *Handler) checkQuietHours(stream string, now time.Time) {
+	settings, err := h.settings(stream)
+	if err != nil {
+		log.Printf("Failed to check quiet hours for %q: %v.\n", stream, err)
+		return
+	}
+	quiet := settings.quietAt(now)
+	changed, err := h.states.SetQuiet(stream, quiet)
+	if err != nil {
+		log.Printf("Failed to update quiet hours for %q: %v.\n", stream, err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	event := "quietHoursStarted"
+	autoplay := false
+	if quiet {
+		if err := h.states.Update(stream, map[string]interface{}{quietAutoplayKey: fmt.Sprint(settings.Autoplay)}); err != nil {
+			log.Printf("Failed to remember autoplay for %q: %v.\n", stream, err)
+		}
+	} else {
+		event = "quietHoursEnded"
+		previous, _ := h.states.Field(stream, quietAutoplayKey)
+		autoplay = previous == "true"
+		if err := h.states.Delete(stream, quietAutoplayKey); err != nil {
+			log.Printf("Failed to forget autoplay for %q: %v.\n", stream, err)
+		}
+	}
+	log.Printf("Quiet hours %s for %q.\n", strings.TrimPrefix(event, "quietHours"), stream)
+	if settings.Autoplay != autoplay && (quiet || autoplay) {
+		value := fmt.Sprint(autoplay)
+		if _, fieldErrors, err := h.changeSettings(stream, url.Values{"autoplay": {value}}); err != nil || len(fieldErrors) > 0 {
+			log.Printf("Failed to change autoplay for quiet hours on %q: %v %v.\n", stream, err, fieldErrors)
+		} else if err := h.publishUpdate(stream, "autoplay", value); err != nil {
+			log.Printf("Failed to publish update: %v.\n", err)
+		}
+	}
+	h.recordTransition(stream, event, map[string]interface{}{"quietHours": settings.QuietHours, "timezone": settings.Timezone})
+	j, err := json.Marshal(map[string]interface{}{
+		"event":      event,
+		"stream":     stream,
+		"quietHours": settings.QuietHours,
+		"timezone":   settings.Timezone,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	if err := events.Publish(h.redis, h.channel(stream), j); err != nil {
+		log.Printf("Failed to publish quiet hours event: %v.\n", err)
+	}
+}
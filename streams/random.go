@@ -0,0 +1,35 @@
+package streams
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Random is where a Handler gets its randomness, so a run's picks can be reproduced from its seed. *rand.Rand will
+// do if only one goroutine uses it; NewRandom is safe to share.
+type Random interface {
+	Float64() float64
+	Int63() int64
+}
+
+// NewRandom returns a Random seeded with seed that any number of goroutines can use at once.
+func NewRandom(seed int64) Random {
+	return &lockedRandom{r: rand.New(rand.NewSource(seed))}
+}
+
+type lockedRandom struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRandom) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRandom) Int63() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63()
+}
@@ -0,0 +1,347 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/profiles"
+	"github.com/PonyFest/music-control/songs"
+)
+
+// The recently played list is mirrored into a set so that Redis can do the set arithmetic for random selection
+// itself, rather than us shipping the whole library over the wire for every pick.
+const recentlyPlayedSetFormat = "recentset-%s"
+const candidatesFormat = "candidates-%s"
+
+// rebuildRecentSet is shared between the scripts below: it recreates the set from the list if it's missing, which
+// happens for streams that were last played before the set existed.
+const rebuildRecentSet = `
+if redis.call("EXISTS", KEYS[2]) == 0 then
+	for _, v in ipairs(redis.call("LRANGE", KEYS[1], 0, -1)) do
+		redis.call("SADD", KEYS[2], v)
+	end
+end
+`
+
+// recordPlayScript moves a track to the front of the recently played list, keeping the list and set in sync.
+// KEYS: recently played list, recently played set. ARGV: track ID, maximum length.
+var recordPlayScript = redis.NewScript(rebuildRecentSet + `
+-- Remove the current entry in the recently played list, if any
+-- This produces saner behaviour if the list is larger than the track pool.
+redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("LPUSH", KEYS[1], ARGV[1])
+redis.call("SADD", KEYS[2], ARGV[1])
+while redis.call("LLEN", KEYS[1]) > tonumber(ARGV[2]) do
+	redis.call("SREM", KEYS[2], redis.call("RPOP", KEYS[1]))
+end
+return true
+`)
+
+// candidatesScript finds the tracks a stream could randomly pick: those in the candidate set that aren't in the
+// recently played set (or explicit, if we're blocking those, or past their license expiry, or unplayable, or
+// quarantined, or ruled out by the stream's profile). It returns "fresh", how many there are, and a random sample
+// of them, or if there are none, "recent" followed by the least recently played eligible track, or nothing at all
+// if there isn't one of those either. Sampling keeps us from shipping the whole library over the wire for every pick.
+// KEYS: recently played list, recently played set, candidate set, scratch key, explicit track set, a list of tracks
+// that are already lined up and shouldn't be picked again, the license expiry sorted set, a set of tracks the
+// player can't decode, the set of quarantined tracks, then the stream's profile's weighted tag sets followed by its
+// excluded tag sets.
+// ARGV: the stream's explicit policy, the current unix time, the number of weighted tag sets, the sample size.
+var candidatesScript = redis.NewScript(`
+redis.replicate_commands()
+` + rebuildRecentSet + `
+local blockExplicit = ARGV[1] == "block"
+local now = tonumber(ARGV[2])
+local weighted = tonumber(ARGV[3])
+local sample = tonumber(ARGV[4])
+-- allowed is whether the stream's profile lets a track be picked at all: it mustn't have any excluded tags, and
+-- must have a weighted tag if there are any.
+local function allowed(track)
+	for i = 10 + weighted, #KEYS do
+		if redis.call("SISMEMBER", KEYS[i], track) == 1 then
+			return false
+		end
+	end
+	if weighted == 0 then
+		return true
+	end
+	for i = 1, weighted do
+		if redis.call("SISMEMBER", KEYS[9 + i], track) == 1 then
+			return true
+		end
+	end
+	return false
+end
+local candidates = redis.call("SDIFFSTORE", KEYS[4], KEYS[3], KEYS[2])
+if candidates > 0 and blockExplicit then
+	candidates = redis.call("SDIFFSTORE", KEYS[4], KEYS[4], KEYS[5])
+end
+if candidates > 0 then
+	candidates = redis.call("SDIFFSTORE", KEYS[4], KEYS[4], KEYS[8], KEYS[9])
+end
+if candidates > 0 then
+	for _, v in ipairs(redis.call("LRANGE", KEYS[6], 0, -1)) do
+		redis.call("SREM", KEYS[4], v)
+	end
+	for _, v in ipairs(redis.call("ZRANGEBYSCORE", KEYS[7], "-inf", "(" .. now)) do
+		redis.call("SREM", KEYS[4], v)
+	end
+	candidates = redis.call("SCARD", KEYS[4])
+end
+if candidates > 0 and #KEYS > 9 then
+	for _, track in ipairs(redis.call("SMEMBERS", KEYS[4])) do
+		if not allowed(track) then
+			redis.call("SREM", KEYS[4], track)
+		end
+	end
+	candidates = redis.call("SCARD", KEYS[4])
+end
+local result = {}
+if candidates > 0 then
+	-- Everything, if it fits, so the pick only depends on the selector's random number.
+	if candidates <= sample then
+		result = redis.call("SMEMBERS", KEYS[4])
+	else
+		result = redis.call("SRANDMEMBER", KEYS[4], sample)
+	end
+	table.insert(result, 1, tostring(candidates))
+	table.insert(result, 1, "fresh")
+end
+redis.call("DEL", KEYS[4])
+if candidates == 0 then
+	local recent = redis.call("LRANGE", KEYS[1], 0, -1)
+	for i = #recent, 1, -1 do
+		local track = recent[i]
+		local expiry = redis.call("ZSCORE", KEYS[7], track)
+		local expired = expiry and tonumber(expiry) < now
+		local unplayable = redis.call("SISMEMBER", KEYS[8], track) == 1 or redis.call("SISMEMBER", KEYS[9], track) == 1
+		if redis.call("SISMEMBER", KEYS[3], track) == 1 and not (blockExplicit and redis.call("SISMEMBER", KEYS[5], track) == 1) and not expired and not unplayable and allowed(track) then
+			result = {"recent", track}
+			break
+		end
+	end
+end
+return result
+`)
+
+// candidateSample is the most candidates we hand a selector. A uniform sample of this many is plenty to weigh up.
+const candidateSample = 1000
+
+func (h *Handler) recordPlay(stream, trackId string) error {
+	settings, err := h.settings(stream)
+	if err != nil {
+		return err
+	}
+	keys := []string{h.queueKey(recentlyPlayedFormat, stream), h.queueKey(recentlyPlayedSetFormat, stream)}
+	// We always remember at least the current track, so we can fall back to it if there's nothing else to play.
+	window := settings.RecentWindow
+	if window < 1 {
+		window = 1
+	}
+	if err := recordPlayScript.Run(h.redis, keys, trackId, window).Err(); err != nil {
+		return fmt.Errorf("failed to record recently played track: %v", err)
+	}
+	return nil
+}
+
+// pickRandomTrack is what we do if we didn't find anything useful in the up next list, so we need to select
+// some random track that isn't too recently played, from the stream's playlist if it has one, using the stream's
+// selector.
+// If everything has been played recently, we play the least-most-recently played track. If we have no options and
+// we have never played anything, presumably there is no music, and we return errNoMusic.
+func (h *Handler) pickRandomTrack(stream string) (string, error) {
+	settings, err := h.settings(stream)
+	if err != nil {
+		return "", err
+	}
+	selector, err := selectorNamed(settings.Selector)
+	if err != nil {
+		return "", err
+	}
+	kind, _, result, profile, err := h.findCandidates(stream, settings, candidateSample)
+	if err != nil {
+		return "", err
+	}
+	if kind == "" {
+		return "", errNoMusic
+	}
+	if kind == "recent" {
+		return result[0], nil
+	}
+	// Redis hands them over in no particular order; sorting them means a seeded Random makes the same pick.
+	candidates := result
+	sort.Strings(candidates)
+	candidates = h.keepRelationships(candidates, h.previousTrackId(stream))
+	tracks, err := h.trackService.Tracks(candidates)
+	if err != nil {
+		return "", fmt.Errorf("looking up candidate tracks failed: %v", err)
+	}
+	selection := Selection{
+		Stream:     stream,
+		Settings:   settings,
+		Profile:    profile,
+		Candidates: candidates,
+		Tracks:     tracks,
+		Previous:   h.previousTrack(stream),
+		Random:     h.random.Float64(),
+	}
+	trackId, err := selector.Select(selection)
+	if err != nil {
+		return "", fmt.Errorf("selecting a track failed: %v", err)
+	}
+	if trackId == "" {
+		return "", errNoMusic
+	}
+	return trackId, nil
+}
+
+// findCandidates runs candidatesScript for the stream, with up to sample fresh tracks, returning what kind of
+// candidates it found ("fresh", "recent", or "" for none at all), how many fresh ones there are, the candidates,
+// and the profile they fit, if they do.
+func (h *Handler) findCandidates(stream string, settings Settings, sample int) (string, int64, []string, *profiles.Profile, error) {
+	source := songs.TrackPoolKey
+	if settings.Playlist != "" {
+		source = fmt.Sprintf(songs.PlaylistFormat, settings.Playlist)
+	}
+	keys := []string{
+		h.queueKey(recentlyPlayedFormat, stream),
+		h.queueKey(recentlyPlayedSetFormat, stream),
+		source,
+		h.queueKey(candidatesFormat, stream),
+		songs.ExplicitTracksKey,
+		h.queueKey(pendingFormat, stream),
+		songs.LicenseExpiryKey,
+		fmt.Sprintf(unplayableFormat, stream),
+		songs.QuarantinedTracksKey,
+	}
+	if err := h.refreshUnplayable(stream); err != nil {
+		return "", 0, nil, nil, fmt.Errorf("working out what the player can play failed: %v", err)
+	}
+	profile, err := h.activeProfile(settings)
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("fetching the stream's profile failed: %v", err)
+	}
+	profileKeys, weights := profileArgs(profile)
+	kind, count, result, err := h.candidates(append(keys, profileKeys...), settings.ExplicitPolicy, len(weights), sample)
+	if err == nil && kind == "" && profile != nil {
+		// Silence is worse than being off-mood.
+		log.Printf("Nothing on %q fits profile %q; ignoring it for now.\n", stream, profile.Name)
+		profile = nil
+		kind, count, result, err = h.candidates(keys, settings.ExplicitPolicy, 0, sample)
+	}
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("finding candidate tracks failed: %v", err)
+	}
+	return kind, count, result, profile, nil
+}
+
+// candidates runs candidatesScript, splitting what it says into what kind of candidates it found, how many fresh
+// ones there are, and the candidates themselves.
+func (h *Handler) candidates(keys []string, explicitPolicy string, weighted, sample int) (string, int64, []string, error) {
+	reply, err := candidatesScript.Run(h.redis, keys, explicitPolicy, time.Now().Unix(), weighted, sample).Result()
+	if err != nil {
+		return "", 0, nil, err
+	}
+	values, _ := reply.([]interface{})
+	result := make([]string, len(values))
+	for i, v := range values {
+		result[i], _ = v.(string)
+	}
+	switch {
+	case len(result) == 0:
+		return "", 0, nil, nil
+	case result[0] == "fresh" && len(result) >= 2:
+		count, _ := strconv.ParseInt(result[1], 10, 64)
+		return "fresh", count, result[2:], nil
+	default:
+		return result[0], 0, result[1:], nil
+	}
+}
+
+// previousTrack is what will have played just before whatever we pick now: the end of the pending list if we're
+// lining things up in advance, or else whatever played most recently.
+func (h *Handler) previousTrack(stream string) map[string]string {
+	trackId := h.previousTrackId(stream)
+	if trackId == "" {
+		return nil
+	}
+	track, err := h.trackService.Track(trackId)
+	if err != nil {
+		return nil
+	}
+	return track
+}
+
+// previousTrackId is the ID of previousTrack, or empty if there isn't one.
+func (h *Handler) previousTrackId(stream string) string {
+	trackId, err := h.redis.LIndex(h.queueKey(pendingFormat, stream), -1).Result()
+	if err != nil {
+		trackId, err = h.redis.LIndex(h.queueKey(recentlyPlayedFormat, stream), 0).Result()
+	}
+	if err != nil {
+		return ""
+	}
+	return trackId
+}
+
+// clearRecent forgets what a stream (or its whole group, which shares the memory) has played recently, and tells
+// everyone listening to any of them.
+func (h *Handler) clearRecent(stream string) error {
+	if err := h.redis.Del(h.queueKey(recentlyPlayedFormat, stream), h.queueKey(recentlyPlayedSetFormat, stream)).Err(); err != nil {
+		return err
+	}
+	for _, member := range h.queueMembers(stream) {
+		h.recordTransition(member, "recentCleared", nil)
+		j, err := json.Marshal(map[string]string{
+			"event":  "recentCleared",
+			"stream": member,
+		})
+		if err != nil {
+			log.Printf("Failed to marshal json: %v.\n", err)
+			continue
+		}
+		if err := events.Publish(h.redis, h.channel(member), j); err != nil {
+			log.Printf("Failed to publish recently played clear: %v.\n", err)
+		}
+	}
+	return nil
+}
+
+// handleClearRecent makes a stream forget what it has played recently, so it'll happily pick anything again. That's
+// mostly useful after swapping in a new library, when the old history would be avoiding the wrong tracks.
+func (h *Handler) handleClearRecent(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	if err := h.clearRecent(stream); err != nil {
+		http.Error(w, fmt.Sprintf("clearing recently played tracks failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+// handleClearAllRecent is handleClearRecent for every stream we know about.
+func (h *Handler) handleClearAllRecent(w http.ResponseWriter, r *http.Request) {
+	streams, err := h.redis.SMembers(StreamsKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("listing streams failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, stream := range streams {
+		if err := h.clearRecent(stream); err != nil {
+			http.Error(w, fmt.Sprintf("clearing recently played tracks for %q failed: %v", stream, err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "streams": streams}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
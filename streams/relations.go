@@ -0,0 +1,96 @@
+package streams
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// lineUpSuccessor puts whatever has to follow trackId at the front of the stream's queue, unless it's there already.
+func (h *Handler) lineUpSuccessor(stream, trackId string) {
+	next := songs.FollowedBy(h.redis, trackId)
+	if next == "" || h.redis.Exists(next).Val() == 0 {
+		return
+	}
+	if upNext, err := h.queues.UpNext(stream); err == nil && len(upNext) > 0 && parseEntry(upNext[0]).TrackID == next {
+		return
+	}
+	if err := h.queues.Prepend(stream, next); err != nil {
+		log.Printf("Failed to line up %s after %s on %q: %v.\n", next, trackId, stream, err)
+		return
+	}
+	h.publishUpNextUpdate(stream)
+}
+
+// swapWithFollowing is for when the track we just took off the front of the queue mustn't play after the current
+// one. If the track after it is fine, we play that instead and put the first one back at the front, so it plays
+// next time. Otherwise there's nothing for it but to play the first one anyway.
+func (h *Handler) swapWithFollowing(stream, current string, next Entry) Entry {
+	upNext, err := h.queues.UpNext(stream)
+	if err != nil {
+		return next
+	}
+	i, candidate, ok := h.playInstead(current, next.TrackID, upNext)
+	if !ok {
+		return next
+	}
+	if err := h.queues.Replace(stream, int64(i), next.String()); err != nil {
+		log.Printf("Failed to swap %s and %s on %q: %v.\n", next.TrackID, candidate.TrackID, stream, err)
+		return next
+	}
+	log.Printf("Playing %s before %s on %q, since %s mustn't play after %s.\n", candidate.TrackID, next.TrackID, stream, next.TrackID, current)
+	return candidate
+}
+
+// playInstead finds the entry of rest, the queue after next, that swapWithFollowing would play instead, and where
+// it is, if there's one that will do.
+func (h *Handler) playInstead(current, next string, rest []string) (int, Entry, bool) {
+	// Something that has to follow another track stays where it is.
+	if songs.Follows(h.redis, next) != "" {
+		return 0, Entry{}, false
+	}
+	for i, raw := range rest {
+		// Tombstones don't count, so skip over them.
+		if raw == "" {
+			continue
+		}
+		candidate := parseEntry(raw)
+		if songs.KeptApart(h.redis, current, candidate.TrackID) || songs.Follows(h.redis, candidate.TrackID) != "" || !h.available(candidate.TrackID) {
+			return 0, Entry{}, false
+		}
+		return i, candidate, true
+	}
+	return 0, Entry{}, false
+}
+
+// keepRelationships drops the candidates that would break a track relationship if they played after previous:
+// those that have to follow some other track, and those that have to be kept apart from it. If that rules out
+// everything, it leaves the candidates alone, since playing something is better than playing nothing.
+func (h *Handler) keepRelationships(candidates []string, previous string) []string {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	p := h.redis.Pipeline()
+	follows := p.HMGet(songs.FollowsKey, candidates...)
+	apartCmd := p.SMembers(fmt.Sprintf(songs.ApartFormat, previous))
+	if _, err := p.Exec(); err != nil {
+		log.Printf("Failed to check track relationships: %v.\n", err)
+		return candidates
+	}
+	apart := map[string]bool{}
+	for _, trackId := range apartCmd.Val() {
+		apart[trackId] = true
+	}
+	kept := make([]string, 0, len(candidates))
+	for i, trackId := range candidates {
+		if follows.Val()[i] != nil || apart[trackId] {
+			continue
+		}
+		kept = append(kept, trackId)
+	}
+	if len(kept) == 0 {
+		return candidates
+	}
+	return kept
+}
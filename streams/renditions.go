@@ -0,0 +1,104 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// sendNext responds to a next track request, swapping in whichever rendition suits the player.
+func (h *Handler) sendNext(w http.ResponseWriter, r *http.Request, stream string, track map[string]string) {
+	if err := h.chooseRendition(stream, track, r.FormValue("quality")); err != nil {
+		// The original is still better than nothing.
+		log.Printf("Failed to choose a rendition of %s for %q: %v.\n", track["trackId"], stream, err)
+	}
+	h.applyGain(stream, track)
+	h.addAlbumHints(stream, track)
+	h.applyEntry(stream, track)
+	h.applyCrossfade(stream, track)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "track": track}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// applyCrossfade tells players that can't overlap tracks not to fade into this one, whatever it was queued with.
+func (h *Handler) applyCrossfade(stream string, track map[string]string) {
+	capabilities, err := h.capabilities(stream)
+	if err != nil {
+		log.Printf("Failed to fetch capabilities for %q: %v.\n", stream, err)
+		return
+	}
+	if !capabilities.Crossfade {
+		track["fade"] = "0"
+	}
+}
+
+// chooseRendition points a track's URL at the rendition the player asked for by name with quality, or failing that
+// the best one it can decode within its bitrate limit. The original wins whenever it's acceptable and we don't know
+// of anything better, since we don't know its bitrate, and also when nothing is acceptable: operators queue things
+// the player may not handle, and playing them anyway beats dropping them.
+func (h *Handler) chooseRendition(stream string, track map[string]string, quality string) error {
+	track["rendition"] = songs.OriginalRendition
+	if quality == songs.OriginalRendition {
+		return nil
+	}
+	renditions, err := songs.Renditions(h.redis, track["trackId"])
+	if err != nil || len(renditions) == 0 {
+		return err
+	}
+	choose := func(rendition songs.Rendition) {
+		track["rendition"] = rendition.Name
+		track["trackUrl"] = h.urls.URL(rendition.Key)
+		track[songs.ContentTypeKey] = rendition.ContentType
+	}
+	if quality != "" {
+		for _, rendition := range renditions {
+			if rendition.Name == quality && rendition.Playable() {
+				choose(rendition)
+				return nil
+			}
+		}
+	}
+
+	capabilities, err := h.capabilities(stream)
+	if err != nil {
+		return err
+	}
+	decodable := func(contentType string) bool {
+		if len(capabilities.Codecs) == 0 || contentType == "" {
+			return true
+		}
+		for _, codec := range capabilities.Codecs {
+			if codec == contentType {
+				return true
+			}
+		}
+		return false
+	}
+	// Renditions come lowest bitrate first, with unknown bitrates at the end.
+	var best, fallback *songs.Rendition
+	for i, rendition := range renditions {
+		if !rendition.Playable() || !decodable(rendition.ContentType) {
+			continue
+		}
+		if fallback == nil {
+			fallback = &renditions[i]
+		}
+		if capabilities.MaxBitrate > 0 && rendition.Bitrate > 0 && rendition.Bitrate <= capabilities.MaxBitrate {
+			best = &renditions[i]
+		}
+	}
+	switch {
+	case best != nil:
+		choose(*best)
+	case decodable(track[songs.ContentTypeKey]):
+		// the original it is.
+	case fallback != nil:
+		choose(*fallback)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package streams
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const revisionKey = "revision"
+
+// These are reported continuously by players rather than decided by operators, so they don't bump the revision
+// and don't need to match it.
+var unversionedKeys = map[string]bool{
+	"position": true,
+	"duration": true,
+	"skip":     true,
+}
+
+// updateRevisionScript sets the fields in ARGV after the first, as name and value pairs, and increments the state
+// revision, but only if it's still the one the client last saw (ARGV[1]). An empty expected revision always
+// succeeds. Returns -1 on a mismatch, having changed nothing.
+var updateRevisionScript = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], "revision")
+if not current then
+	current = "0"
+end
+if ARGV[1] ~= "" and ARGV[1] ~= current then
+	return -1
+end
+for i = 2, #ARGV, 2 do
+	redis.call("HSET", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+return redis.call("HINCRBY", KEYS[1], "revision", 1)
+`)
+
+// expectedRevision pulls the revision out of an If-Match header, and says whether there was one. "*" matches any
+// revision, for clients like players that really do want the last write to win. We don't bother with weak tags or
+// lists.
+func expectedRevision(r *http.Request) (string, bool) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" {
+		return "", false
+	}
+	if ifMatch == "*" {
+		return "", true
+	}
+	ifMatch = strings.TrimPrefix(ifMatch, "W/")
+	return strings.Trim(ifMatch, `"`), true
+}
+
+// needsRevision says whether a state update changes anything operators decide, rather than just what players report.
+func needsRevision(form url.Values) bool {
+	for k := range form {
+		if stateKeys[k] && !unversionedKeys[k] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/auth"
+	"github.com/PonyFest/music-control/events"
+)
+
+// scheduleKey orders every scheduled action by when it's due (in unix seconds), and scheduledActionsKey holds each
+// one's JSON-encoded definition by ID. They cover every stream, so one sweep finds everything that's due.
+const scheduleKey = "schedule"
+const scheduledActionsKey = "scheduled-actions"
+
+// scheduleRole is who scheduled actions act as. It isn't anyone's real role, and in particular isn't an admin.
+const scheduleRole = "schedule"
+
+// ScheduledAction is a one-off change to a stream at a given time: setting `playing`, requesting a `skip`, or
+// changing one of its settings.
+type ScheduledAction struct {
+	ID     string    `json:"id"`
+	Stream string    `json:"stream"`
+	At     time.Time `json:"at"`
+	Key    string    `json:"key"`
+	Value  string    `json:"value,omitempty"`
+}
+
+// parseAt accepts either an RFC 3339 timestamp or a time of day like "21:00", which means the next time it's that
+// time in the server's time zone.
+func parseAt(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	clock, err := time.ParseInLocation("15:04", s, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a time of day nor an RFC 3339 timestamp", s)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// validateAction checks an action could be carried out right now. That's no promise it still can be when it's due,
+// since whatever it refers to might have gone away by then.
+func (h *Handler) validateAction(a ScheduledAction) error {
+	switch a.Key {
+	case "playing":
+		if _, err := strconv.ParseBool(a.Value); err != nil {
+			return fmt.Errorf("playing must be a boolean")
+		}
+	case "skip":
+	default:
+		s, err := h.settings(a.Stream)
+		if err != nil {
+			return err
+		}
+		return h.applySetting(&s, a.Key, a.Value)
+	}
+	return nil
+}
+
+// runAction carries out an action.
+func (h *Handler) runAction(a ScheduledAction) error {
+	switch a.Key {
+	case "playing":
+		// This goes through exactly what a PATCH would, validation, revision and all. Schedules aren't admins, so
+		// they can't undo a panic, but they do get the last word over whatever changed since they were made.
+		form := url.Values{a.Key: {a.Value}}
+		r, err := http.NewRequest(http.MethodPatch, "/"+url.PathEscape(a.Stream)+"/state", strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("If-Match", "*")
+		r = mux.SetURLVars(auth.As(r, scheduleRole), map[string]string{"stream": a.Stream})
+		w := httptest.NewRecorder()
+		h.handleState(w, r)
+		if w.Code != http.StatusOK {
+			return fmt.Errorf("%s", strings.TrimSpace(w.Body.String()))
+		}
+		return nil
+	case "skip":
+		return h.publishSkip(a.Stream)
+	default:
+		_, fieldErrors, err := h.changeSettings(a.Stream, url.Values{a.Key: {a.Value}})
+		if err != nil {
+			return err
+		}
+		if len(fieldErrors) > 0 {
+			return fmt.Errorf("%s", fieldErrors[a.Key])
+		}
+		return nil
+	}
+}
+
+// RunScheduler carries out scheduled actions as they come due. It never returns, so run it in a goroutine. It's safe
+// to run on several servers at once: whoever takes an action off the schedule first is the one that runs it.
+func (h *Handler) RunScheduler() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		due, err := h.redis.ZRangeByScore(scheduleKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+		if err != nil {
+			log.Printf("Scheduler failed to list due actions: %v.\n", err)
+			continue
+		}
+		for _, id := range due {
+			if h.redis.ZRem(scheduleKey, id).Val() == 0 {
+				continue
+			}
+			entry, err := h.redis.HGet(scheduledActionsKey, id).Result()
+			if err != nil {
+				log.Printf("Scheduler failed to fetch action %s: %v.\n", id, err)
+				continue
+			}
+			h.redis.HDel(scheduledActionsKey, id)
+			var a ScheduledAction
+			if err := json.Unmarshal([]byte(entry), &a); err != nil {
+				log.Printf("Dropping corrupt scheduled action %q: %v.\n", entry, err)
+				continue
+			}
+			h.completeAction(a, h.runAction(a))
+		}
+	}
+}
+
+// completeAction records and announces how a scheduled action went.
+func (h *Handler) completeAction(a ScheduledAction, err error) {
+	result := map[string]interface{}{"id": a.ID, "key": a.Key, "value": a.Value, "ok": err == nil}
+	if err != nil {
+		log.Printf("Scheduled action %s (%s=%q on %q) failed: %v.\n", a.ID, a.Key, a.Value, a.Stream, err)
+		result["error"] = err.Error()
+	} else {
+		log.Printf("Ran scheduled action %s (%s=%q on %q).\n", a.ID, a.Key, a.Value, a.Stream)
+	}
+	h.recordTransition(a.Stream, "scheduledActionRun", result)
+	result["event"] = "scheduledActionRun"
+	result["stream"] = a.Stream
+	j, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	if err := events.Publish(h.redis, h.channel(a.Stream), j); err != nil {
+		log.Printf("Failed to publish scheduled action result: %v.\n", err)
+	}
+}
+
+// scheduledActions lists a stream's pending actions, soonest first.
+func (h *Handler) scheduledActions(stream string) ([]ScheduledAction, error) {
+	entries, err := h.redis.HGetAll(scheduledActionsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch scheduled actions: %v", err)
+	}
+	actions := []ScheduledAction{}
+	for _, entry := range entries {
+		var a ScheduledAction
+		if err := json.Unmarshal([]byte(entry), &a); err != nil {
+			return nil, fmt.Errorf("corrupt scheduled action %q: %v", entry, err)
+		}
+		if a.Stream == stream {
+			actions = append(actions, a)
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].At.Before(actions[j].At)
+	})
+	return actions, nil
+}
+
+// handleSchedule lists a stream's scheduled actions, or schedules a new one (POST) to set `key` to `value` `at` a
+// given time.
+func (h *Handler) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	if r.Method == http.MethodPost {
+		at, err := parseAt(r.FormValue("at"), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if at.Before(time.Now()) {
+			http.Error(w, fmt.Sprintf("%s has already happened", at.Format(time.RFC3339)), http.StatusBadRequest)
+			return
+		}
+		a := ScheduledAction{
+			ID:     uuid.New().String(),
+			Stream: stream,
+			At:     at,
+			Key:    r.FormValue("key"),
+			Value:  r.FormValue("value"),
+		}
+		if err := h.validateAction(a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		j, err := json.Marshal(a)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+		p := h.redis.TxPipeline()
+		p.HSet(scheduledActionsKey, a.ID, j)
+		p.ZAdd(scheduleKey, &redis.Z{Score: float64(at.Unix()), Member: a.ID})
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to schedule action: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "action": a}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	actions, err := h.scheduledActions(stream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "actions": actions}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleCancelAction takes an action off a stream's schedule.
+func (h *Handler) handleCancelAction(w http.ResponseWriter, r *http.Request) {
+	stream, id := mux.Vars(r)["stream"], mux.Vars(r)["id"]
+	entry, err := h.redis.HGet(scheduledActionsKey, id).Result()
+	if err == redis.Nil {
+		http.Error(w, fmt.Sprintf("no such scheduled action %q", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch scheduled action: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var a ScheduledAction
+	if err := json.Unmarshal([]byte(entry), &a); err != nil || a.Stream != stream {
+		http.Error(w, fmt.Sprintf("no such scheduled action %q", id), http.StatusNotFound)
+		return
+	}
+	p := h.redis.TxPipeline()
+	p.ZRem(scheduleKey, id)
+	p.HDel(scheduledActionsKey, id)
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to cancel scheduled action: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
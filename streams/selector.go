@@ -0,0 +1,213 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PonyFest/music-control/profiles"
+	"github.com/PonyFest/music-control/songs"
+)
+
+// DefaultSelector is the selector streams use unless their settings say otherwise.
+const DefaultSelector = "weighted"
+
+// Selection is everything a Selector gets to go on when picking a random track.
+type Selection struct {
+	Stream   string
+	Settings Settings
+	// Profile is the stream's active profile, if it has one.
+	Profile *profiles.Profile
+	// Candidates are the tracks the stream could play: not recently played, not already lined up, and not ruled
+	// out by its explicit policy, licenses, player or profile. There's always at least one. There may be more
+	// tracks than this that qualify; if so, these are a random sample of them.
+	Candidates []string
+	// Tracks is the metadata for each candidate.
+	Tracks map[string]map[string]string
+	// Previous is the metadata of whatever will play just before the pick, if we know.
+	Previous map[string]string
+	// Random is a random number in [0, 1), so that Selectors themselves can be deterministic.
+	Random float64
+}
+
+// A Selector decides which of the candidates a stream plays when there's nothing queued.
+type Selector interface {
+	// Select returns one of the candidates, or an empty string if none of them will do.
+	Select(s Selection) (string, error)
+}
+
+var selectorsMu sync.RWMutex
+var selectors = map[string]Selector{
+	"uniform":  uniformSelector{},
+	"weighted": weightedSelector{},
+	"tags":     tagSelector{},
+	"bpm":      bpmSelector{},
+}
+
+// RegisterSelector makes a selector available to streams under name, replacing any already there.
+func RegisterSelector(name string, s Selector) {
+	selectorsMu.Lock()
+	defer selectorsMu.Unlock()
+	selectors[name] = s
+}
+
+// Selectors lists the names of every selector streams can use.
+func Selectors() []string {
+	selectorsMu.RLock()
+	defer selectorsMu.RUnlock()
+	names := make([]string, 0, len(selectors))
+	for name := range selectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleSelectors lists the selectors streams can choose from with their `selector` setting.
+func (h *Handler) handleSelectors(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "selectors": Selectors(), "default": DefaultSelector}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// selectorNamed returns the selector called name, where empty means the default.
+func selectorNamed(name string) (Selector, error) {
+	if name == "" {
+		name = DefaultSelector
+	}
+	selectorsMu.RLock()
+	defer selectorsMu.RUnlock()
+	s, ok := selectors[name]
+	if !ok {
+		return nil, fmt.Errorf("no such selector %q", name)
+	}
+	return s, nil
+}
+
+// weightedPick picks a candidate with probability proportional to its weight. Candidates weighing nothing are
+// never picked.
+func weightedPick(s Selection, weight func(track map[string]string) float64) string {
+	weights := make([]float64, len(s.Candidates))
+	total := 0.0
+	for i, trackId := range s.Candidates {
+		weights[i] = weight(s.Tracks[trackId])
+		total += weights[i]
+	}
+	target := s.Random * total
+	pick := ""
+	for i, trackId := range s.Candidates {
+		if weights[i] > 0 {
+			pick = trackId
+			target -= weights[i]
+			if target < 0 {
+				break
+			}
+		}
+	}
+	return pick
+}
+
+// tagsOf returns a track's tags.
+func tagsOf(track map[string]string) []string {
+	if track[songs.TagsKey] == "" {
+		return nil
+	}
+	return strings.Split(track[songs.TagsKey], ",")
+}
+
+// profileWeight is how likely the stream's profile makes a track: the heaviest of its weighted tags. Candidates
+// have already been checked against the profile, so they have at least one if it has any.
+func profileWeight(p *profiles.Profile, track map[string]string) float64 {
+	if p == nil || len(p.Weights) == 0 {
+		return 1
+	}
+	w := 0.0
+	for _, tag := range tagsOf(track) {
+		w = math.Max(w, p.Weights[tag])
+	}
+	return w
+}
+
+// ratingWeight is how much the stream's rating bias favours a track. Unrated tracks count as middling.
+func ratingWeight(bias float64, track map[string]string) float64 {
+	if bias == 0 {
+		return 1
+	}
+	rating, err := strconv.ParseFloat(track[songs.RatingKey], 64)
+	if err != nil {
+		rating = 3
+	}
+	return math.Pow(rating, bias)
+}
+
+// uniformSelector gives every candidate the same chance, whatever the profile and ratings say.
+type uniformSelector struct{}
+
+func (uniformSelector) Select(s Selection) (string, error) {
+	i := int(s.Random * float64(len(s.Candidates)))
+	if i >= len(s.Candidates) {
+		i = len(s.Candidates) - 1
+	}
+	return s.Candidates[i], nil
+}
+
+// weightedSelector goes by the stream's profile's tag weights and its rating bias.
+type weightedSelector struct{}
+
+func (weightedSelector) Select(s Selection) (string, error) {
+	return weightedPick(s, func(track map[string]string) float64 {
+		return profileWeight(s.Profile, track) * ratingWeight(s.Settings.RatingBias, track)
+	}), nil
+}
+
+// tagSelector is weightedSelector, but favours tracks sharing tags with the previous one, doubling a track's chance
+// for each tag in common, so runs of similar tracks hang together.
+type tagSelector struct{}
+
+func (tagSelector) Select(s Selection) (string, error) {
+	previous := map[string]bool{}
+	for _, tag := range tagsOf(s.Previous) {
+		previous[tag] = true
+	}
+	return weightedPick(s, func(track map[string]string) float64 {
+		w := profileWeight(s.Profile, track) * ratingWeight(s.Settings.RatingBias, track)
+		for _, tag := range tagsOf(track) {
+			if previous[tag] {
+				w *= 2
+			}
+		}
+		return w
+	}), nil
+}
+
+// bpmTolerance is roughly how far apart two tempos can be, in BPM, before bpmSelector starts to mind.
+const bpmTolerance = 8
+
+// bpmSelector is weightedSelector, but favours tracks with a tempo close to the previous one's, so the energy
+// doesn't lurch about. Tracks whose tempo we don't know have half the chance of a perfect match.
+type bpmSelector struct{}
+
+func (bpmSelector) Select(s Selection) (string, error) {
+	previous, err := strconv.ParseFloat(s.Previous[songs.BPMKey], 64)
+	known := err == nil
+	return weightedPick(s, func(track map[string]string) float64 {
+		w := profileWeight(s.Profile, track) * ratingWeight(s.Settings.RatingBias, track)
+		if !known {
+			return w
+		}
+		bpm, err := strconv.ParseFloat(track[songs.BPMKey], 64)
+		if err != nil {
+			return w / 2
+		}
+		// Half and double time are close enough, since they feel about the same.
+		distance := math.Abs(bpm - previous)
+		distance = math.Min(distance, math.Min(math.Abs(bpm*2-previous), math.Abs(bpm-previous*2)))
+		return w / (1 + math.Pow(distance/bpmTolerance, 2))
+	}), nil
+}
@@ -0,0 +1,115 @@
+package streams
+
+import (
+	"testing"
+
+	"github.com/PonyFest/music-control/profiles"
+	"github.com/PonyFest/music-control/songs"
+)
+
+func TestSelectorNamed(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Selector
+		wantErr bool
+	}{
+		{"", weightedSelector{}, false},
+		{"uniform", uniformSelector{}, false},
+		{"weighted", weightedSelector{}, false},
+		{"tags", tagSelector{}, false},
+		{"bpm", bpmSelector{}, false},
+		{"shuffle", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectorNamed(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorSetting(t *testing.T) {
+	h, _, _ := testHandler(t)
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"bpm", "bpm", false},
+		{"shuffle", DefaultSelector, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			s := defaultSettings()
+			s.Selector = DefaultSelector
+			err := h.applySetting(&s, "selector", tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if s.Selector != tt.want {
+				t.Errorf("got selector %q, want %q", s.Selector, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	tracks := map[string]map[string]string{
+		"calm":    {songs.TagsKey: "calm", songs.RatingKey: "1", songs.BPMKey: "120"},
+		"loud":    {songs.TagsKey: "loud", songs.RatingKey: "3", songs.BPMKey: "60"},
+		"unknown": {},
+	}
+	profile := &profiles.Profile{Weights: map[string]float64{"calm": 1, "loud": 3}}
+	tests := []struct {
+		name       string
+		selector   Selector
+		candidates []string
+		profile    *profiles.Profile
+		ratingBias float64
+		previous   map[string]string
+		random     float64
+		want       string
+	}{
+		{"uniform first", uniformSelector{}, []string{"calm", "loud", "unknown"}, profile, 0, nil, 0, "calm"},
+		{"uniform middle", uniformSelector{}, []string{"calm", "loud", "unknown"}, profile, 0, nil, 0.5, "loud"},
+		{"uniform last", uniformSelector{}, []string{"calm", "loud", "unknown"}, profile, 0, nil, 0.999, "unknown"},
+		{"weighted without anything to go on", weightedSelector{}, []string{"calm", "loud"}, nil, 0, nil, 0.4, "calm"},
+		{"weighted light profile tag", weightedSelector{}, []string{"calm", "loud"}, profile, 0, nil, 0.2, "calm"},
+		{"weighted heavy profile tag", weightedSelector{}, []string{"calm", "loud"}, profile, 0, nil, 0.3, "loud"},
+		{"weighted never picks weightless", weightedSelector{}, []string{"unknown", "calm"}, profile, 0, nil, 0, "calm"},
+		{"weighted low rating", weightedSelector{}, []string{"calm", "loud"}, nil, 1, nil, 0.2, "calm"},
+		{"weighted high rating", weightedSelector{}, []string{"calm", "loud"}, nil, 1, nil, 0.3, "loud"},
+		{"tags without previous", tagSelector{}, []string{"calm", "loud"}, nil, 0, nil, 0.4, "calm"},
+		{"tags unshared", tagSelector{}, []string{"loud", "calm"}, nil, 0, tracks["calm"], 0.3, "loud"},
+		{"tags shared", tagSelector{}, []string{"loud", "calm"}, nil, 0, tracks["calm"], 0.4, "calm"},
+		{"bpm without previous", bpmSelector{}, []string{"unknown", "calm"}, nil, 0, nil, 0.4, "unknown"},
+		{"bpm unknown tempo", bpmSelector{}, []string{"unknown", "calm"}, nil, 0, tracks["calm"], 0.3, "unknown"},
+		{"bpm same tempo", bpmSelector{}, []string{"unknown", "calm"}, nil, 0, tracks["calm"], 0.4, "calm"},
+		{"bpm half time", bpmSelector{}, []string{"unknown", "loud"}, nil, 0, tracks["calm"], 0.4, "loud"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.selector.Select(Selection{
+				Stream:     "s",
+				Settings:   Settings{RatingBias: tt.ratingBias},
+				Profile:    tt.profile,
+				Candidates: tt.candidates,
+				Tracks:     tracks,
+				Previous:   tt.previous,
+				Random:     tt.random,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package streams
+
+import (
+	"fmt"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/trackcache"
+)
+
+// The services are what the handlers need from storage, kept apart so the handlers' logic can be run against the
+// in-memory versions in memory.go rather than a live redis. Up next, streams' state and track metadata all go
+// through them. Things around the edges, like settings, groups and track relationships, still talk to redis
+// themselves.
+
+// TrackService looks up track metadata.
+type TrackService interface {
+	// Track returns a track's metadata, or nil if there's no such track.
+	Track(trackId string) (map[string]string, error)
+	// Tracks is Track for several tracks at once. Tracks that don't exist are left out.
+	Tracks(trackIds []string) (map[string]map[string]string, error)
+}
+
+// QueueService looks after streams' up next lists. Removing an entry leaves an empty tombstone in its place, so
+// the indices of everything after it don't change under anyone.
+type QueueService interface {
+	UpNext(stream string) ([]string, error)
+	// Append puts entries at the end of up next, and Prepend puts them at the front, with the last one first.
+	Append(stream string, entries ...string) error
+	Prepend(stream string, entries ...string) error
+	// Pop takes the entry off the front of up next, tombstones and all. It returns false if up next is empty.
+	Pop(stream string) (string, bool, error)
+	// Replace puts entry in place of whatever's at index.
+	Replace(stream string, index int64, entry string) error
+	Remove(stream string, index int64) error
+	// Take takes the first entry that's exactly entry out of up next altogether, if it's there.
+	Take(stream string, entry string) error
+	// Reset replaces the whole of up next with entries, all at once.
+	Reset(stream string, entries ...string) error
+	// Shuffle shuffles up next in place, using seed for randomness, and drops any tombstones while it's at it.
+	Shuffle(stream string, seed int64) error
+	Clear(stream string) error
+}
+
+// StateService stores streams' raw state, as the hash players PATCH.
+type StateService interface {
+	State(stream string) (map[string]string, error)
+	// Field is one field of a stream's state, or "" if it isn't set.
+	Field(stream, key string) (string, error)
+	// Update sets some fields of a stream's state, and Delete unsets them.
+	Update(stream string, fields map[string]interface{}) error
+	Delete(stream string, keys ...string) error
+	// UpdateRevision sets some fields of a stream's state and increments its revision, all at once, and returns the
+	// new revision, but only if the revision is still expected (or expected is ""). Otherwise it changes nothing and
+	// returns -1.
+	UpdateRevision(stream, expected string, fields map[string]interface{}) (int64, error)
+	// Panic pauses all of streams at once, remembering whether each was playing, and says which of them it
+	// silenced. Streams that were already silenced are left alone.
+	Panic(streams []string) ([]bool, error)
+	// Resume undoes Panic for all of streams at once, and returns each one's playing state afterwards, or "" for
+	// any that weren't silenced.
+	Resume(streams []string) ([]string, error)
+	// SetQuiet sets a stream's quiet flag, and says whether that changed anything, so only one server acts on each
+	// transition.
+	SetQuiet(stream string, quiet bool) (bool, error)
+}
+
+// redisTracks is a TrackService over the track cache.
+type redisTracks struct {
+	cache *trackcache.Cache
+}
+
+func (t redisTracks) Track(trackId string) (map[string]string, error) {
+	tracks, err := t.Tracks([]string{trackId})
+	if err != nil {
+		return nil, err
+	}
+	return tracks[trackId], nil
+}
+
+func (t redisTracks) Tracks(trackIds []string) (map[string]map[string]string, error) {
+	tracks, err := t.cache.GetMany(trackIds)
+	if err != nil {
+		return nil, err
+	}
+	for trackId, track := range tracks {
+		if len(track) == 0 {
+			delete(tracks, trackId)
+		}
+	}
+	return tracks, nil
+}
+
+// redisQueues is a QueueService over redis lists, shared between the members of a stream group.
+type redisQueues struct {
+	h *Handler
+}
+
+func (q redisQueues) UpNext(stream string) ([]string, error) {
+	upNext, err := q.h.redis.LRange(q.h.queueKey(upNextFormat, stream), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("fetching up next failed: %v", err)
+	}
+	return upNext, nil
+}
+
+func (q redisQueues) Append(stream string, entries ...string) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := q.h.redis.RPush(q.h.queueKey(upNextFormat, stream), stringsToInterfaces(entries)...).Err(); err != nil {
+		return fmt.Errorf("pushing track failed: %v", err)
+	}
+	return nil
+}
+
+func (q redisQueues) Prepend(stream string, entries ...string) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := q.h.redis.LPush(q.h.queueKey(upNextFormat, stream), stringsToInterfaces(entries)...).Err(); err != nil {
+		return fmt.Errorf("pushing track failed: %v", err)
+	}
+	return nil
+}
+
+func (q redisQueues) Pop(stream string) (string, bool, error) {
+	entry, err := q.h.redis.LPop(q.h.queueKey(upNextFormat, stream)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to pop up next: %v", err)
+	}
+	return entry, true, nil
+}
+
+func (q redisQueues) Replace(stream string, index int64, entry string) error {
+	if err := q.h.redis.LSet(q.h.queueKey(upNextFormat, stream), index, entry).Err(); err != nil {
+		return fmt.Errorf("failed to replace up next entry at index %d: %v", index, err)
+	}
+	return nil
+}
+
+func (q redisQueues) Remove(stream string, index int64) error {
+	if err := q.h.redis.LSet(q.h.queueKey(upNextFormat, stream), index, "").Err(); err != nil {
+		return fmt.Errorf("failed to remove up next entry at index %d: %v", index, err)
+	}
+	return nil
+}
+
+func (q redisQueues) Take(stream string, entry string) error {
+	if err := q.h.redis.LRem(q.h.queueKey(upNextFormat, stream), 1, entry).Err(); err != nil {
+		return fmt.Errorf("failed to take %s off up next: %v", entry, err)
+	}
+	return nil
+}
+
+func (q redisQueues) Reset(stream string, entries ...string) error {
+	key := q.h.queueKey(upNextFormat, stream)
+	tx := q.h.redis.TxPipeline()
+	tx.Del(key)
+	if len(entries) > 0 {
+		tx.RPush(key, stringsToInterfaces(entries)...)
+	}
+	if _, err := tx.Exec(); err != nil {
+		return fmt.Errorf("replacing up next failed: %v", err)
+	}
+	return nil
+}
+
+func (q redisQueues) Shuffle(stream string, seed int64) error {
+	if err := shuffleScript.Run(q.h.redis, []string{q.h.queueKey(upNextFormat, stream)}, seed).Err(); err != nil {
+		return fmt.Errorf("shuffling up next failed: %v", err)
+	}
+	return nil
+}
+
+func (q redisQueues) Clear(stream string) error {
+	if err := q.h.redis.Del(q.h.queueKey(upNextFormat, stream)).Err(); err != nil {
+		return fmt.Errorf("clearing up next failed: %v", err)
+	}
+	return nil
+}
+
+// redisStates is a StateService over redis hashes.
+type redisStates struct {
+	redis *redis.Client
+}
+
+func (s redisStates) State(stream string) (map[string]string, error) {
+	state, err := s.redis.HGetAll(fmt.Sprintf(stateFormat, stream)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch information: %v", err)
+	}
+	return state, nil
+}
+
+func (s redisStates) Field(stream, key string) (string, error) {
+	value, err := s.redis.HGet(fmt.Sprintf(stateFormat, stream), key).Result()
+	if err == redis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to fetch %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func (s redisStates) Update(stream string, fields map[string]interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	if err := s.redis.HSet(fmt.Sprintf(stateFormat, stream), fields).Err(); err != nil {
+		return fmt.Errorf("failed to update state: %v", err)
+	}
+	return nil
+}
+
+func (s redisStates) Delete(stream string, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := s.redis.HDel(fmt.Sprintf(stateFormat, stream), keys...).Err(); err != nil {
+		return fmt.Errorf("failed to update state: %v", err)
+	}
+	return nil
+}
+
+func (s redisStates) UpdateRevision(stream, expected string, fields map[string]interface{}) (int64, error) {
+	args := []interface{}{expected}
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	revision, err := updateRevisionScript.Run(s.redis, []string{fmt.Sprintf(stateFormat, stream)}, args...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("updating state revision failed: %v", err)
+	}
+	return revision, nil
+}
+
+func (s redisStates) keys(streams []string) []string {
+	keys := make([]string, len(streams))
+	for i, stream := range streams {
+		keys[i] = fmt.Sprintf(stateFormat, stream)
+	}
+	return keys
+}
+
+func (s redisStates) Panic(streams []string) ([]bool, error) {
+	result, err := panicScript.Run(s.redis, s.keys(streams), panicKey, panicPlayingKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to silence streams: %v", err)
+	}
+	silenced := make([]bool, len(streams))
+	for i, v := range result.([]interface{}) {
+		n, _ := v.(int64)
+		silenced[i] = n == 1
+	}
+	return silenced, nil
+}
+
+func (s redisStates) Resume(streams []string) ([]string, error) {
+	result, err := resumeScript.Run(s.redis, s.keys(streams), panicKey, panicPlayingKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resume streams: %v", err)
+	}
+	playing := make([]string, len(streams))
+	for i, v := range result.([]interface{}) {
+		playing[i], _ = v.(string)
+	}
+	return playing, nil
+}
+
+func (s redisStates) SetQuiet(stream string, quiet bool) (bool, error) {
+	changed, err := setQuietScript.Run(s.redis, []string{fmt.Sprintf(stateFormat, stream)}, fmt.Sprint(quiet)).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to update quiet hours: %v", err)
+	}
+	return changed == 1, nil
+}
@@ -0,0 +1,353 @@
+package streams
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/auth"
+	"github.com/PonyFest/music-control/trackcache"
+	"github.com/PonyFest/music-control/trackurl"
+)
+
+// testHandler is a handler whose up next and state are in memory. Everything else is in an embedded redis, which
+// starts out holding the given tracks.
+func testHandler(t *testing.T, trackIds ...string) (*Handler, *MemoryQueues, *MemoryStates) {
+	t.Helper()
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	for _, trackId := range trackIds {
+		if err := client.HSet(trackId, "title", "Title of "+trackId, "artist", "Artist").Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	urls, err := trackurl.New("http://music.example/", trackurl.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queues, states := NewMemoryQueues(), NewMemoryStates()
+	h := New(client, trackcache.New(client, ""), urls, Options{Queues: queues, States: states, Random: NewRandom(1)})
+	return h, queues, states
+}
+
+func TestMemoryQueues(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(q *MemoryQueues) error
+		want []string
+	}{
+		{"append", func(q *MemoryQueues) error { return q.Append("s", "a", "b") }, []string{"a", "b"}},
+		{"prepend", func(q *MemoryQueues) error {
+			_ = q.Append("s", "c")
+			return q.Prepend("s", "b", "a")
+		}, []string{"a", "b", "c"}},
+		{"pop", func(q *MemoryQueues) error {
+			_ = q.Append("s", "a", "b")
+			_, _, err := q.Pop("s")
+			return err
+		}, []string{"b"}},
+		{"remove leaves a tombstone", func(q *MemoryQueues) error {
+			_ = q.Append("s", "a", "b", "c")
+			return q.Remove("s", 1)
+		}, []string{"a", "", "c"}},
+		{"remove counts back from the end", func(q *MemoryQueues) error {
+			_ = q.Append("s", "a", "b", "c")
+			return q.Remove("s", -1)
+		}, []string{"a", "b", ""}},
+		{"take only takes the first", func(q *MemoryQueues) error {
+			_ = q.Append("s", "a", "b", "a")
+			return q.Take("s", "a")
+		}, []string{"b", "a"}},
+		{"reset", func(q *MemoryQueues) error {
+			_ = q.Append("s", "a")
+			return q.Reset("s", "b", "c")
+		}, []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewMemoryQueues()
+			if err := tt.run(q); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := q.UpNext("s")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("up next is %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if err := NewMemoryQueues().Remove("s", 0); err == nil {
+		t.Error("removing from an empty queue succeeded")
+	}
+	if _, ok, _ := NewMemoryQueues().Pop("s"); ok {
+		t.Error("popping an empty queue succeeded")
+	}
+}
+
+func TestMemoryStatesUpdateRevision(t *testing.T) {
+	tests := []struct {
+		name        string
+		expected    string
+		want        int64
+		wantPlaying string
+	}{
+		{"unconditional", "", 3, "true"},
+		{"current", "2", 3, "true"},
+		{"stale", "1", -1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStates()
+			_ = s.Update("s", map[string]interface{}{revisionKey: 2})
+			got, err := s.UpdateRevision("s", tt.expected, map[string]interface{}{"playing": true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got revision %d, want %d", got, tt.want)
+			}
+			if playing, _ := s.Field("s", "playing"); playing != tt.wantPlaying {
+				t.Errorf("playing is %q, want %q", playing, tt.wantPlaying)
+			}
+		})
+	}
+}
+
+func TestMemoryStatesPanic(t *testing.T) {
+	s := NewMemoryStates()
+	_ = s.Update("playing", map[string]interface{}{"playing": "true"})
+	_ = s.Update("paused", map[string]interface{}{"playing": "false"})
+	silenced, err := s.Panic([]string{"playing", "paused"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !silenced[0] || !silenced[1] {
+		t.Errorf("silenced %v, want both", silenced)
+	}
+	if again, _ := s.Panic([]string{"playing"}); again[0] {
+		t.Errorf("silenced a stream twice")
+	}
+	if playing, _ := s.Field("playing", "playing"); playing != "false" {
+		t.Errorf("silenced stream is playing %q", playing)
+	}
+	resumed, err := s.Resume([]string{"playing", "paused", "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"true", "false", ""}; !reflect.DeepEqual(resumed, want) {
+		t.Errorf("resumed %q, want %q", resumed, want)
+	}
+	if revision, _ := s.Field("playing", revisionKey); revision != "2" {
+		t.Errorf("revision is %q, want 2", revision)
+	}
+}
+
+func TestPatchState(t *testing.T) {
+	tests := []struct {
+		name       string
+		role       string
+		form       url.Values
+		ifMatch    string
+		wantStatus int
+		want       map[string]string
+	}{
+		{"playing", "operator", url.Values{"playing": {"true"}}, `"0"`, http.StatusOK, map[string]string{"playing": "true", revisionKey: "1"}},
+		{"last word", "operator", url.Values{"playing": {"true"}}, "*", http.StatusOK, map[string]string{"playing": "true", revisionKey: "1"}},
+		{"new track starts from the top", "operator", url.Values{"currentTrack": {"a"}}, "*", http.StatusOK, map[string]string{"currentTrack": "a", "position": "0", revisionKey: "1"}},
+		{"missing revision", "operator", url.Values{"playing": {"true"}}, "", http.StatusPreconditionRequired, map[string]string{"playing": ""}},
+		{"players needn't say", auth.RoleAdmin, url.Values{"currentTrack": {"a"}}, "", http.StatusOK, map[string]string{"currentTrack": "a", revisionKey: "1"}},
+		{"progress needs no revision", "operator", url.Values{"position": {"12"}}, "", http.StatusOK, map[string]string{"position": "12", revisionKey: ""}},
+		{"stale revision", "operator", url.Values{"playing": {"true"}}, `"7"`, http.StatusConflict, map[string]string{"playing": ""}},
+		{"bad field changes nothing", "operator", url.Values{"playing": {"true"}, "position": {"-1"}}, `"0"`, http.StatusBadRequest, map[string]string{"playing": "", revisionKey: ""}},
+		{"unknown key", "operator", url.Values{"volume": {"11"}}, "", http.StatusBadRequest, map[string]string{"volume": ""}},
+		{"query string isn't state", "operator", url.Values{"position": {"12"}}, "", http.StatusOK, map[string]string{"position": "12", "playing": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, states := testHandler(t, "a")
+			r := httptest.NewRequest(http.MethodPatch, "/main/state?playing=true", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, auth.As(r, tt.role))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			state, _ := states.State("main")
+			for k, want := range tt.want {
+				if state[k] != want {
+					t.Errorf("%s is %q, want %q", k, state[k], want)
+				}
+			}
+		})
+	}
+}
+
+func TestTakeNext(t *testing.T) {
+	tests := []struct {
+		name      string
+		upNext    []string
+		want      string
+		wantAfter []string
+	}{
+		{"first in line", []string{"a", "b"}, "a", []string{"b"}},
+		{"skips tombstones and missing tracks", []string{"", "gone", "b", "a"}, "b", []string{"a"}},
+		{"keeps overrides out of the track ID", []string{`{"trackId":"a","note":"hello"}`, "b"}, "a", []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, queues, _ := testHandler(t, "a", "b")
+			_ = queues.Append("main", tt.upNext...)
+			got, err := h.takeNext("main")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("took %q, want %q", got, tt.want)
+			}
+			after, _ := queues.UpNext("main")
+			if !reflect.DeepEqual(after, tt.wantAfter) {
+				t.Errorf("up next is %q afterwards, want %q", after, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func TestResolveNext(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(h *Handler, queues *MemoryQueues, states *MemoryStates)
+		want       string
+		wantSource string
+		wantErr    error
+	}{
+		{"up next", func(h *Handler, queues *MemoryQueues, states *MemoryStates) {
+			_ = queues.Append("main", "a", "b")
+		}, "a", "upNext", nil},
+		{"following", func(h *Handler, queues *MemoryQueues, states *MemoryStates) {
+			_ = queues.Append("main", "a")
+			h.redis.HSet(fmt.Sprintf(settingsFormat, "main"), "follow", "source")
+			_ = states.Update("source", map[string]interface{}{"currentTrack": "b"})
+		}, "b", "follow", nil},
+		{"grouped", func(h *Handler, queues *MemoryQueues, states *MemoryStates) {
+			_ = queues.Append("main", "a")
+			h.redis.HSet(groupsKey, "main", "g")
+		}, "", "", errUnpredictable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, queues, states := testHandler(t, "a", "b")
+			tt.setup(h, queues, states)
+			got, source, err := h.resolveNext("main", false)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got["trackId"] != tt.want || source != tt.wantSource {
+				t.Errorf("got %q from %q, want %q from %q", got["trackId"], source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestRunActionPlaying(t *testing.T) {
+	tests := []struct {
+		name     string
+		panicked bool
+		value    string
+		wantErr  bool
+		want     map[string]string
+	}{
+		{"plays", false, "true", false, map[string]string{"playing": "true", revisionKey: "1"}},
+		{"panicked", true, "true", true, map[string]string{"playing": ""}},
+		{"stops while panicked", true, "false", false, map[string]string{"playing": "false"}},
+		{"nonsense", false, "maybe", true, map[string]string{"playing": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, states := testHandler(t)
+			if tt.panicked {
+				_ = states.Update("main", map[string]interface{}{panicKey: "true"})
+			}
+			err := h.runAction(ScheduledAction{Stream: "main", Key: "playing", Value: tt.value})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			state, _ := states.State("main")
+			for k, want := range tt.want {
+				if state[k] != want {
+					t.Errorf("%s is %q, want %q", k, state[k], want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetStateHidesBookkeeping(t *testing.T) {
+	h, _, states := testHandler(t)
+	_ = states.Update("main", map[string]interface{}{"playing": "true", positionUpdatedKey: 1, panicKey: "true", lastSeenKey: 1})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/main/state", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"playing":"true"`) {
+		t.Errorf("state is missing playing: %s", body)
+	}
+	for _, k := range []string{positionUpdatedKey, panicKey, lastSeenKey} {
+		if strings.Contains(body, `"`+k+`"`) {
+			t.Errorf("state shows %s: %s", k, body)
+		}
+	}
+}
+
+func TestTakeGroupNextWaitsForTaker(t *testing.T) {
+	h, _, _ := testHandler(t, "a")
+	h.redis.Set(fmt.Sprintf(groupLockFormat, "g"), "other", time.Minute)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		h.redis.XAdd(&redis.XAddArgs{Stream: fmt.Sprintf(groupSequenceFormat, "g"), Values: map[string]interface{}{"trackId": "a", "stream": "other"}})
+	}()
+	start := time.Now()
+	got, err := h.takeGroupNext("g", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "a" {
+		t.Errorf("took %q, want the track the other member took", got)
+	}
+	if waited := time.Since(start); waited > 900*time.Millisecond {
+		t.Errorf("took %v to hear about it", waited)
+	}
+}
+
+func TestLoadFallbacks(t *testing.T) {
+	h, _, _ := testHandler(t, "a", "b")
+	if err := h.redis.HSet(fmt.Sprintf(settingsFormat, "s"), "fallback", "a,b").Err(); err != nil {
+		t.Fatal(err)
+	}
+	h.LoadFallbacks()
+	for _, want := range []string{"a", "b", "a"} {
+		track, ok := h.fallbacks.take("s")
+		if !ok {
+			t.Fatal("fallback wasn't loaded")
+		}
+		if track["trackId"] != want {
+			t.Errorf("got fallback %q, want %q", track["trackId"], want)
+		}
+	}
+}
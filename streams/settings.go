@@ -0,0 +1,316 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/profiles"
+	"github.com/PonyFest/music-control/songs"
+)
+
+const settingsFormat = "settings-%s"
+
+const (
+	ExplicitAllow = "allow"
+	ExplicitBlock = "block"
+)
+
+// Settings is how a stream is configured, as opposed to what it's doing right now (which is its state).
+type Settings struct {
+	Autoplay bool `json:"autoplay"`
+	// ExplicitPolicy is either ExplicitAllow or ExplicitBlock; blocked streams never randomly pick explicit tracks.
+	ExplicitPolicy string `json:"explicitPolicy"`
+	// RecentWindow is how many recently played tracks we try to avoid repeating.
+	RecentWindow int `json:"recentWindow"`
+	// Crossfade is how many seconds players should overlap tracks for. We just pass it along.
+	Crossfade float64 `json:"crossfade"`
+	// Playlist, if set, restricts random selection to that playlist rather than the whole pool.
+	Playlist string `json:"playlist"`
+	// AutoQueueHorizon is how many random picks we line up in advance, so operators can see and veto them.
+	AutoQueueHorizon int `json:"autoQueueHorizon"`
+	// Profile, if set, is the mood random picks are made in.
+	Profile string `json:"profile"`
+	// RatingBias is how much random picks favour higher rated tracks: each track's chance is scaled by its average
+	// rating (out of 5, with unrated tracks counting as 3) to this power. Zero ignores ratings.
+	RatingBias float64 `json:"ratingBias"`
+	// QuietHours, if set, is when autoplay goes off by itself, like "23:00-07:00", in Timezone.
+	QuietHours string `json:"quietHours"`
+	// Timezone is the IANA time zone quiet hours are in. Empty means UTC.
+	Timezone string `json:"timezone"`
+	// Follow, if set, is another stream whose track changes and play/pause this one copies exactly.
+	Follow string `json:"follow"`
+	// Gain is how many dB louder (or quieter) than usual the stream plays everything.
+	Gain float64 `json:"gain"`
+	// Selector is how random picks are made, as the name of a Selector. Empty means DefaultSelector.
+	Selector string `json:"selector"`
+	// Fallback is a track, or a short loop of them, that /next plays in turn when it can't pick anything else,
+	// because the pool is empty or redis is struggling, so the stream keeps going.
+	Fallback []string `json:"fallback"`
+}
+
+func defaultSettings() Settings {
+	return Settings{
+		Autoplay:       false,
+		ExplicitPolicy: ExplicitAllow,
+		RecentWindow:   30,
+		Crossfade:      0,
+		Playlist:       "",
+		Fallback:       []string{},
+	}
+}
+
+// applySetting validates and sets a single setting by its JSON name.
+func (h *Handler) applySetting(s *Settings, key, value string) error {
+	switch key {
+	case "autoplay":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("autoplay must be a boolean")
+		}
+		s.Autoplay = b
+	case "explicitPolicy":
+		if value != ExplicitAllow && value != ExplicitBlock {
+			return fmt.Errorf("explicitPolicy must be %q or %q", ExplicitAllow, ExplicitBlock)
+		}
+		s.ExplicitPolicy = value
+	case "recentWindow":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 1000 {
+			return fmt.Errorf("recentWindow must be an integer between 0 and 1000")
+		}
+		s.RecentWindow = n
+	case "crossfade":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 30 {
+			return fmt.Errorf("crossfade must be a number of seconds between 0 and 30")
+		}
+		s.Crossfade = f
+	case "autoQueueHorizon":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > maxAutoQueueHorizon {
+			return fmt.Errorf("autoQueueHorizon must be an integer between 0 and %d", maxAutoQueueHorizon)
+		}
+		s.AutoQueueHorizon = n
+	case "ratingBias":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 5 {
+			return fmt.Errorf("ratingBias must be a number between 0 and 5")
+		}
+		s.RatingBias = f
+	case "quietHours":
+		if value != "" {
+			if _, _, err := parseQuietHours(value); err != nil {
+				return err
+			}
+		}
+		s.QuietHours = value
+	case "timezone":
+		if _, err := time.LoadLocation(value); err != nil || value == "Local" {
+			return fmt.Errorf("unknown timezone %q", value)
+		}
+		s.Timezone = value
+	case "follow":
+		if value != "" && !h.redis.SIsMember(StreamsKey, value).Val() {
+			return fmt.Errorf("no such stream %q", value)
+		}
+		s.Follow = value
+	case "gain":
+		gain, err := parseGain(value)
+		if err != nil {
+			return err
+		}
+		s.Gain = gain
+	case "selector":
+		if _, err := selectorNamed(value); err != nil {
+			return err
+		}
+		s.Selector = value
+	case "fallback":
+		tracks, err := h.parseFallback(value)
+		if err != nil {
+			return err
+		}
+		s.Fallback = tracks
+	case "playlist":
+		if value != "" && h.redis.Exists(fmt.Sprintf(songs.PlaylistFormat, value)).Val() == 0 {
+			return fmt.Errorf("no such playlist %q", value)
+		}
+		s.Playlist = value
+	case "profile":
+		if value != "" && !h.redis.HExists(profiles.Key, value).Val() {
+			return fmt.Errorf("no such profile %q", value)
+		}
+		s.Profile = value
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+func (s Settings) fields() []interface{} {
+	return []interface{}{
+		"autoplay", strconv.FormatBool(s.Autoplay),
+		"explicitPolicy", s.ExplicitPolicy,
+		"recentWindow", s.RecentWindow,
+		"crossfade", s.Crossfade,
+		"playlist", s.Playlist,
+		"autoQueueHorizon", s.AutoQueueHorizon,
+		"profile", s.Profile,
+		"ratingBias", s.RatingBias,
+		"quietHours", s.QuietHours,
+		"timezone", s.Timezone,
+		"follow", s.Follow,
+		"gain", s.Gain,
+		"selector", s.Selector,
+		"fallback", strings.Join(s.Fallback, ","),
+	}
+}
+
+// settings fetches a stream's settings. Anything missing or somehow invalid gets the default.
+func (h *Handler) settings(stream string) (Settings, error) {
+	s := defaultSettings()
+	stored, err := h.redis.HGetAll(fmt.Sprintf(settingsFormat, stream)).Result()
+	if err != nil {
+		return s, fmt.Errorf("failed to fetch settings: %v", err)
+	}
+	for k, v := range stored {
+		// don't insist the playlist or profile still exists just to read the settings.
+		if k == "playlist" {
+			s.Playlist = v
+			continue
+		}
+		if k == "profile" {
+			s.Profile = v
+			continue
+		}
+		if k == "follow" {
+			s.Follow = v
+			continue
+		}
+		// nor that the fallback tracks haven't been deleted since.
+		if k == "fallback" {
+			s.Fallback = splitFallback(v)
+			continue
+		}
+		_ = h.applySetting(&s, k, v)
+	}
+	return s, nil
+}
+
+func (h *Handler) storeSettings(stream string, s Settings) error {
+	previousFollow := h.redis.HGet(fmt.Sprintf(settingsFormat, stream), "follow").Val()
+	p := h.redis.TxPipeline()
+	if s.Follow != previousFollow {
+		if previousFollow != "" {
+			p.SRem(fmt.Sprintf(followersFormat, previousFollow), stream)
+		}
+		if s.Follow != "" {
+			p.SAdd(fmt.Sprintf(followersFormat, s.Follow), stream)
+		}
+	}
+	p.HSet(fmt.Sprintf(settingsFormat, stream), s.fields()...)
+	if _, err := p.Exec(); err != nil {
+		return fmt.Errorf("failed to store settings: %v", err)
+	}
+	// Players have always read autoplay out of the state, so keep that up to date too.
+	return h.states.Update(stream, map[string]interface{}{"autoplay": strconv.FormatBool(s.Autoplay)})
+}
+
+func (h *Handler) publishSettings(stream string, s Settings) {
+	j, err := json.Marshal(map[string]interface{}{
+		"event":    "settingsUpdated",
+		"stream":   stream,
+		"settings": s,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	settings, _ := json.Marshal(s)
+	h.recordTransition(stream, "settingsUpdated", map[string]interface{}{"settings": string(settings)})
+	if err := events.Publish(h.redis, h.channel(stream), j); err != nil {
+		log.Printf("Failed to publish settings update: %v.\n", err)
+	}
+}
+
+// changeSettings applies the given settings to a stream, leaving the rest alone. If any of them are invalid, nothing
+// changes, and it says what was wrong with each.
+func (h *Handler) changeSettings(stream string, changes url.Values) (Settings, map[string]string, error) {
+	s, err := h.settings(stream)
+	if err != nil {
+		return s, nil, err
+	}
+	previousProfile := s.Profile
+	fieldErrors := map[string]string{}
+	for k, sv := range changes {
+		if len(sv) == 0 {
+			continue
+		}
+		if err := h.applySetting(&s, k, sv[0]); err != nil {
+			fieldErrors[k] = err.Error()
+		}
+	}
+	if s.Profile != previousProfile {
+		h.switchingProfile(&s, changes.Get("crossfade") != "")
+	}
+	if _, ok := fieldErrors["follow"]; !ok && s.Follow != "" && h.followLoop(stream, s.Follow) {
+		fieldErrors["follow"] = fmt.Sprintf("following %q would make a loop", s.Follow)
+	}
+	if len(fieldErrors) > 0 {
+		return s, fieldErrors, nil
+	}
+	if err := h.storeSettings(stream, s); err != nil {
+		return s, nil, err
+	}
+	h.publishSettings(stream, s)
+	h.fallbacks.load(h, stream, s.Fallback)
+	if s.Profile != previousProfile {
+		h.switchedProfile(stream, s.Profile)
+	}
+	h.fillPending(stream)
+	return s, nil, nil
+}
+
+func (h *Handler) handleSettings(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("parsing form failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	stream := mux.Vars(r)["stream"]
+	var s Settings
+	var err error
+	switch r.Method {
+	case http.MethodPatch:
+		var fieldErrors map[string]string
+		s, fieldErrors, err = h.changeSettings(stream, r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(fieldErrors) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "errors": fieldErrors})
+			return
+		}
+	case http.MethodGet:
+		if s, err = h.settings(stream); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "settings": s}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
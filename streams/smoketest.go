@@ -0,0 +1,115 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TestTracks makes short tracks for checking streams work; songs.MusicHandler is one.
+type TestTracks interface {
+	TestTrack(silent bool) (string, error)
+}
+
+const defaultSmokeTestTimeout = 30 * time.Second
+const maxSmokeTestTimeout = 5 * time.Minute
+
+type smokeTestCheck struct {
+	Name   string  `json:"name"`
+	Passed bool    `json:"passed"`
+	After  float64 `json:"after,omitempty"`
+}
+
+// handleSmokeTest checks a stream's player is working before a show, instead of listening for it: it puts a test
+// track at the front of up next and waits up to `timeout` (30s by default) for the player to take it and say it's
+// playing it. The test track is a quiet tone, or silence with `silent=true`. With `interrupt=true` we skip whatever's
+// playing rather than waiting for it to end. The report says how far it got either way; it's only an error if we
+// couldn't run the test.
+func (h *Handler) handleSmokeTest(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	if h.options.TestTracks == nil {
+		http.Error(w, "there's no test track to play", http.StatusNotImplemented)
+		return
+	}
+	timeout := defaultSmokeTestTimeout
+	if t := r.FormValue("timeout"); t != "" {
+		var err error
+		if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 || timeout > maxSmokeTestTimeout {
+			http.Error(w, fmt.Sprintf("timeout must be a duration up to %s, not %q", maxSmokeTestTimeout, t), http.StatusBadRequest)
+			return
+		}
+	}
+	silent, _ := strconv.ParseBool(r.FormValue("silent"))
+	interrupt, _ := strconv.ParseBool(r.FormValue("interrupt"))
+	trackId, err := h.options.TestTracks.TestTrack(silent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	start := time.Now()
+	checks := []smokeTestCheck{{Name: "queued"}, {Name: "taken"}, {Name: "playing"}}
+	if err := h.QueueFirst(stream, trackId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	checks[0].Passed = true
+	if interrupt {
+		if err := h.RequestSkip(stream); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for !checks[2].Passed {
+		select {
+		case <-deadline:
+			break wait
+		case <-r.Context().Done():
+			break wait
+		case <-ticker.C:
+		}
+		if !checks[1].Passed && !h.queued(stream, trackId) {
+			checks[1].Passed = true
+			checks[1].After = time.Since(start).Seconds()
+		}
+		if currentTrack, _ := h.states.Field(stream, "currentTrack"); checks[1].Passed && currentTrack == trackId {
+			checks[2].Passed = true
+			checks[2].After = time.Since(start).Seconds()
+		}
+	}
+	// A test that never started mustn't go off halfway through the show.
+	if !checks[1].Passed {
+		if err := h.queues.Take(stream, trackId); err != nil {
+			log.Printf("Failed to take the smoke test off %q: %v.\n", stream, err)
+		}
+		h.publishUpNextUpdate(stream)
+	}
+
+	passed := checks[2].Passed
+	h.recordTransition(stream, "smokeTest", map[string]interface{}{"passed": passed})
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "passed": passed, "trackId": trackId, "checks": checks}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// queued says whether trackId is anywhere in the stream's up next.
+func (h *Handler) queued(stream, trackId string) bool {
+	upNext, _ := h.queues.UpNext(stream)
+	for _, queued := range entryTrackIds(upNext) {
+		if queued == trackId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package streams
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// selectionsFormat is an hourly hash of where a stream's tracks came from to how many came from there.
+const selectionsFormat = "selections-%s-%s"
+const selectionRetention = 48 * time.Hour
+
+func selectionsKey(stream string, t time.Time) string {
+	return fmt.Sprintf(selectionsFormat, stream, t.UTC().Format("2006010215"))
+}
+
+// countSelection notes that the stream took a track from source, for the stats.
+func (h *Handler) countSelection(stream, source string) {
+	key := selectionsKey(stream, time.Now())
+	p := h.redis.Pipeline()
+	p.HIncrBy(key, source, 1)
+	p.Expire(key, selectionRetention)
+	if _, err := p.Exec(); err != nil {
+		log.Printf("Failed to count selection on %q: %v.\n", stream, err)
+	}
+}
+
+// StreamStats is a summary of what a stream has queued and how it's been choosing tracks.
+type StreamStats struct {
+	UpNext  int64 `json:"upNext"`
+	Pending int64 `json:"pending"`
+	// Selections counts the tracks picked over the last 24 hours by where they came from: upNext, pending,
+	// prefetched, random, group (following another member of its group) or follow (copying the stream it follows).
+	Selections map[string]int64 `json:"selections"`
+}
+
+// Stats summarises every stream we know of.
+func (h *Handler) Stats() (map[string]StreamStats, error) {
+	streams, err := h.redis.SMembers(StreamsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list streams: %v", err)
+	}
+	now := time.Now()
+	p := h.redis.Pipeline()
+	type streamCmds struct {
+		upNext, pending *redis.IntCmd
+		selections      []*redis.StringStringMapCmd
+	}
+	cmds := make([]streamCmds, len(streams))
+	for i, stream := range streams {
+		cmds[i].upNext = p.LLen(h.queueKey(upNextFormat, stream))
+		cmds[i].pending = p.LLen(h.queueKey(pendingFormat, stream))
+		for hour := 0; hour <= 24; hour++ {
+			cmds[i].selections = append(cmds[i].selections, p.HGetAll(selectionsKey(stream, now.Add(-time.Duration(hour)*time.Hour))))
+		}
+	}
+	if _, err := p.Exec(); err != nil {
+		return nil, fmt.Errorf("failed to fetch stream stats: %v", err)
+	}
+	result := make(map[string]StreamStats, len(streams))
+	for i, stream := range streams {
+		stats := StreamStats{
+			UpNext:     cmds[i].upNext.Val(),
+			Pending:    cmds[i].pending.Val(),
+			Selections: map[string]int64{},
+		}
+		// The oldest hour is only partly within the last 24, but it's close enough.
+		for _, hour := range cmds[i].selections {
+			for source, count := range hour.Val() {
+				n, _ := strconv.ParseInt(count, 10, 64)
+				stats.Selections[source] += n
+			}
+		}
+		result[stream] = stats
+	}
+	return result, nil
+}
+
+// StreamReserves is how much music a stream has left before it runs dry, for alerting on before it does.
+type StreamReserves struct {
+	// EligibleTracks is how many tracks random picks could choose from without repeating anything recent.
+	EligibleTracks int64
+	// QueuedEntries is how many tracks are up next, and QueuedSeconds how long they'll play for, not counting
+	// QueuedUnknown of them whose durations we don't know.
+	QueuedEntries int
+	QueuedSeconds float64
+	QueuedUnknown int
+	// Pending is how many random picks are lined up.
+	Pending int64
+}
+
+// Reserves measures every stream's StreamReserves.
+func (h *Handler) Reserves() (map[string]StreamReserves, error) {
+	streams, err := h.redis.SMembers(StreamsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list streams: %v", err)
+	}
+	result := make(map[string]StreamReserves, len(streams))
+	for _, stream := range streams {
+		var r StreamReserves
+		settings, err := h.settings(stream)
+		if err != nil {
+			return nil, err
+		}
+		if _, r.EligibleTracks, _, _, err = h.findCandidates(stream, settings, 0); err != nil {
+			return nil, err
+		}
+		upNext, err := h.queues.UpNext(stream)
+		if err != nil {
+			return nil, err
+		}
+		timings, err := h.queueTimings(upNext)
+		if err != nil {
+			return nil, fmt.Errorf("looking up track durations failed: %v", err)
+		}
+		r.QueuedEntries, r.QueuedSeconds, r.QueuedUnknown = timings.length, timings.total, timings.unknown
+		if r.Pending, err = h.redis.LLen(h.queueKey(pendingFormat, stream)).Result(); err != nil {
+			return nil, fmt.Errorf("failed to count pending tracks: %v", err)
+		}
+		result[stream] = r
+	}
+	return result, nil
+}
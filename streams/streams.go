@@ -1,17 +1,25 @@
 package streams
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/gorilla/mux"
 
+	"github.com/PonyFest/music-control/apierror"
+	"github.com/PonyFest/music-control/auth"
+	"github.com/PonyFest/music-control/events"
 	"github.com/PonyFest/music-control/songs"
+	"github.com/PonyFest/music-control/tracing"
+	"github.com/PonyFest/music-control/trackcache"
+	"github.com/PonyFest/music-control/trackurl"
 )
 
 const upNextFormat = "upnext-%s"
@@ -19,45 +27,214 @@ const recentlyPlayedFormat = "recent-%s"
 const stateFormat = "state-%s"
 const eventsFormat = "events-%s"
 
+// stateKeys are the only things that can be PATCHed into a stream's state. Configuration lives in its settings.
+var stateKeys = map[string]bool{
+	"currentTrack": true,
+	"duration":     true,
+	"position":     true,
+	"playing":      true,
+	"autoplay":     true,
+	"skip":         true,
+}
+
+// StreamsKey is a set of every stream we have ever seen a state update for.
+const StreamsKey = "streams"
+const lastSeenKey = "lastSeen"
+
 type Handler struct {
-	mux   *mux.Router
-	redis *redis.Client
-	root  string
+	mux     *mux.Router
+	redis   *redis.Client
+	tracks  *trackcache.Cache
+	urls    *trackurl.Builder
+	options Options
+
+	trackService TrackService
+	queues       QueueService
+	states       StateService
+	random       Random
+	fallbacks    *fallbackCache
+}
+
+// Options holds the less essential knobs for stream handling.
+type Options struct {
+	// EndingSoonLead is how long before the end of a track we publish a trackEndingSoon event.
+	EndingSoonLead time.Duration
+	// PrefetchNext makes us resolve the next track when publishing trackEndingSoon, so players can preload it.
+	PrefetchNext bool
+	// ChannelPrefix goes in front of every pub/sub channel we publish to. Redis shares channels between databases,
+	// so this keeps events apart when several deployments share a server.
+	ChannelPrefix string
+	// StallGrace is how long past the expected end of a track we wait for a stream to show signs of life before
+	// the watchdog tries to kick it. Zero disables the watchdog.
+	StallGrace time.Duration
+	// ProgressInterval is the most often we publish progress events for a stream. Zero disables them.
+	ProgressInterval time.Duration
+	// HLS serves streams as HLS playlists. It's only worth turning on when uploads are being segmented.
+	HLS bool
+	// Tracks, Queues and States replace the redis-backed services, say with the in-memory ones. Nil means redis.
+	Tracks TrackService
+	Queues QueueService
+	States StateService
+	// Random is where random picks and shuffles get their randomness. Nil means a generator seeded from the clock.
+	Random Random
+	// TestTracks makes the tracks smoke tests play. Nil means there's no smoke test.
+	TestTracks TestTracks
+	// ACL limits which streams operators can control. Nil lets anyone who gets this far control every stream.
+	ACL *auth.StreamACL
 }
 
-func New(redisClient *redis.Client, rootURL string) *Handler {
+func New(redisClient *redis.Client, tracks *trackcache.Cache, urls *trackurl.Builder, options Options) *Handler {
 	h := &Handler{
-		mux:   mux.NewRouter(),
-		redis: redisClient,
-		root:  rootURL,
+		mux:     mux.NewRouter(),
+		redis:   redisClient,
+		tracks:  tracks,
+		urls:    urls,
+		options: options,
+
+		fallbacks: newFallbackCache(),
+	}
+	h.trackService = options.Tracks
+	if h.trackService == nil {
+		h.trackService = redisTracks{cache: tracks}
+	}
+	h.queues = options.Queues
+	if h.queues == nil {
+		h.queues = redisQueues{h: h}
+	}
+	h.states = options.States
+	if h.states == nil {
+		h.states = redisStates{redis: redisClient}
+	}
+	h.random = options.Random
+	if h.random == nil {
+		h.random = NewRandom(time.Now().UnixNano())
 	}
+	h.mux.HandleFunc("/state", h.handleAllStates).Methods(http.MethodGet)
+	h.mux.HandleFunc("/recent", h.handleClearAllRecent).Methods(http.MethodDelete)
+	h.mux.HandleFunc("/selectors", h.handleSelectors).Methods(http.MethodGet)
+	h.mux.HandleFunc("/credits", h.handleCredits).Methods(http.MethodGet)
+	h.mux.HandleFunc("/templates", h.handleTemplates).Methods(http.MethodGet)
+	h.mux.HandleFunc("/templates/{template}", h.handleTemplate).Methods(http.MethodGet, http.MethodDelete)
+	h.mux.HandleFunc("/groups", h.handleGroups).Methods(http.MethodGet)
+	h.mux.HandleFunc("/groups/{group}", h.handleGroup).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
 	h.mux.HandleFunc("/{stream}/next", h.handleNext)
 	h.mux.HandleFunc("/{stream}/upnext", h.handleUpNext)
+	h.mux.HandleFunc("/{stream}/upnext/clear", h.handleClearUpNext).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{stream}/upnext/shuffle", h.handleShuffleUpNext).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{stream}/upnext/save", h.handleSaveTemplate).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{stream}/upnext/apply", h.handleApplyTemplate).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{stream}/upnext/cuesheet", h.handleCueSheet).Methods(http.MethodGet)
+	h.mux.HandleFunc("/{stream}/upnext/album", h.handleQueueAlbum).Methods(http.MethodPost, http.MethodDelete)
+	h.mux.HandleFunc("/{stream}/recent", h.handleClearRecent).Methods(http.MethodDelete)
 	h.mux.HandleFunc("/{stream}/state", h.handleState)
+	h.mux.HandleFunc("/{stream}/lock", h.handleLock).Methods(http.MethodPut, http.MethodDelete)
+	h.mux.HandleFunc("/{stream}/settings", h.handleSettings)
+	h.mux.HandleFunc("/{stream}/metadata", h.handleMetadata).Methods(http.MethodGet, http.MethodPatch)
+	h.mux.HandleFunc("/{stream}/schedule", h.handleSchedule).Methods(http.MethodGet, http.MethodPost)
+	h.mux.HandleFunc("/{stream}/schedule/{id}", h.handleCancelAction).Methods(http.MethodDelete)
+	h.mux.HandleFunc("/{stream}/gain", h.handleGainOverrides).Methods(http.MethodGet)
+	h.mux.HandleFunc("/{stream}/gain/{track}", h.handleGainOverride).Methods(http.MethodPut, http.MethodDelete)
+	h.mux.HandleFunc("/{stream}/profile", h.handleProfile).Methods(http.MethodGet, http.MethodPut)
+	h.mux.HandleFunc("/{stream}/pending", h.handlePending)
+	h.mux.HandleFunc("/{stream}/pending/move", h.handleMovePending).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{stream}/timeline", h.handleTimeline).Methods(http.MethodGet)
+	h.mux.HandleFunc("/{stream}/test", h.handleSmokeTest).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{stream}/listeners", h.handleListeners)
+	h.mux.HandleFunc("/{stream}/capabilities", h.handleCapabilities).Methods(http.MethodGet, http.MethodPut)
+	if options.HLS {
+		h.mux.HandleFunc("/{stream}/hls.m3u8", h.handleHLS).Methods(http.MethodGet)
+	}
+	h.mux.HandleFunc("/{stream}/history.{format:rss|json}", h.handleHistory).Methods(http.MethodGet)
+	h.mux.Use(func(next http.Handler) http.Handler {
+		return options.ACL.Wrap(next, looking)
+	})
+	h.mux.Use(h.guardLocked)
 	return h
 }
 
+// readOnlyRoutes are the routes whose GETs only look at streams. Some GETs change things, like asking for the next
+// track, which takes it, fetching pending, which tops it up, or fetching the HLS playlist, which plays the stream,
+// so a route only goes here once we're sure it doesn't.
+var readOnlyRoutes = map[string]bool{
+	"/state":                              true,
+	"/selectors":                          true,
+	"/credits":                            true,
+	"/templates":                          true,
+	"/templates/{template}":               true,
+	"/groups":                             true,
+	"/groups/{group}":                     true,
+	"/{stream}/upnext":                    true,
+	"/{stream}/upnext/cuesheet":           true,
+	"/{stream}/state":                     true,
+	"/{stream}/settings":                  true,
+	"/{stream}/metadata":                  true,
+	"/{stream}/schedule":                  true,
+	"/{stream}/gain":                      true,
+	"/{stream}/profile":                   true,
+	"/{stream}/timeline":                  true,
+	"/{stream}/listeners":                 true,
+	"/{stream}/capabilities":              true,
+	"/{stream}/history.{format:rss|json}": true,
+}
+
+// looking says whether a request only looks at streams.
+func looking(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	template, err := mux.CurrentRoute(r).GetPathTemplate()
+	return err == nil && readOnlyRoutes[template]
+}
+
 func (h *Handler) handleUpNext(w http.ResponseWriter, r *http.Request) {
 	stream := mux.Vars(r)["stream"]
 	switch r.Method {
 	case http.MethodGet:
-		result := h.redis.LRange(fmt.Sprintf(upNextFormat, stream), 0, -1).Val()
+		result, err := h.queues.UpNext(stream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		// nil results in JSON output are annoying; force an empty list.
 		if result == nil {
 			result = []string{}
 		}
-		if err := json.NewEncoder(w).Encode(map[string]interface{}{"upNext": result, "status": "ok"}); err != nil {
+		timings, err := h.queueTimings(result)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("looking up track durations failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"upNext":           entryTrackIds(result),
+			"entries":          parseEntries(result),
+			"length":           timings.length,
+			"eta":              timings.eta,
+			"totalDuration":    timings.total,
+			"unknownDurations": timings.unknown,
+			"status":           "ok",
+		}); err != nil {
 			http.Error(w, fmt.Sprintf("encoding json somehow failed: %v", err), http.StatusInternalServerError)
 			return
 		}
 	case http.MethodPut:
-		trackId := r.FormValue("trackId")
-		if h.redis.Exists(trackId).Val() == 0 {
-			http.Error(w, fmt.Sprintf("no such track %q", trackId), http.StatusFailedDependency)
+		// Besides the track, entries can say how to play it this once.
+		entry, err := entryFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		trackId := entry.TrackID
+		track, err := h.trackService.Track(trackId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if err := h.redis.RPush(fmt.Sprintf(upNextFormat, stream), trackId).Err(); err != nil {
-			http.Error(w, fmt.Sprintf("pushing track failed: %v", err), http.StatusInternalServerError)
+		if track == nil {
+			apierror.Write(w, apierror.UnknownTrack, fmt.Sprintf("no such track %q", trackId))
+			return
+		}
+		if err := h.queues.Append(stream, entry.String()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		h.publishUpNextUpdate(stream)
@@ -73,8 +250,8 @@ func (h *Handler) handleUpNext(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, fmt.Sprintf("invalid track index %q: %v", indexString, err), http.StatusBadRequest)
 			return
 		}
-		if err := h.redis.LSet(fmt.Sprintf(upNextFormat, stream), index, "").Err(); err != nil {
-			http.Error(w, fmt.Sprintf("failed to remove up next entry at index %d: %v", index, err), http.StatusBadRequest)
+		if err := h.queues.Remove(stream, index); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		h.publishUpNextUpdate(stream)
@@ -84,109 +261,227 @@ func (h *Handler) handleUpNext(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) handleNext(w http.ResponseWriter, r *http.Request) {
 	stream := mux.Vars(r)["stream"]
+	if dryRun, _ := strconv.ParseBool(r.FormValue("dryRun")); dryRun {
+		h.handleNextDryRun(w, stream)
+		return
+	}
+	// Every request takes a different track, so answering from a cache would play the same one over and over.
+	w.Header().Set("Cache-Control", "no-store")
+	ctx, span := tracing.Start(r.Context(), "take next")
+	trackId, err := h.withContext(ctx).takeNext(stream)
+	if err == errNoMusic {
+		// Running out of music isn't a fault as far as tracing's concerned.
+		span.End(nil)
+	} else {
+		span.End(err)
+	}
+	if err != nil && h.sendFallback(w, stream, err) {
+		return
+	}
+	if err == errNoMusic {
+		apierror.Write(w, apierror.NoEligibleTracks, err.Error())
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// look up the track and include that metadata
+	ctx, span = tracing.Start(r.Context(), "look up track")
+	trackData, err := h.withContext(ctx).trackIdToTrack(trackId)
+	span.End(err)
+	if err != nil {
+		if h.sendFallback(w, stream, err) {
+			return
+		}
+		http.Error(w, fmt.Sprintf("found a track but also didn't: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.withContext(r.Context()).sendNext(w, r, stream, trackData)
+	// While things are working, make sure the fallback is ready for when they aren't.
+	h.fallbacks.refresh(h, stream)
+}
+
+// withContext returns a copy of the handler whose redis commands are made in ctx, so they're traced as part of it.
+func (h *Handler) withContext(ctx context.Context) *Handler {
+	if tracing.FromContext(ctx) == nil {
+		return h
+	}
+	hc := *h
+	hc.redis = h.redis.WithContext(ctx)
+	if _, ok := h.queues.(redisQueues); ok {
+		hc.queues = redisQueues{h: &hc}
+	}
+	if _, ok := h.states.(redisStates); ok {
+		hc.states = redisStates{redis: hc.redis}
+	}
+	return &hc
+}
+
+// takeNext decides what a stream plays next, consuming it from wherever it came from.
+func (h *Handler) takeNext(stream string) (string, error) {
+	if source := h.redis.HGet(fmt.Sprintf(settingsFormat, stream), "follow").Val(); source != "" {
+		return h.takeFollowedNext(stream, source)
+	}
+	if group := h.groupOf(stream); group != "" {
+		return h.takeGroupNext(group, stream)
+	}
+	return h.takeFromQueue(stream)
+}
+
+// takeFromQueue takes the next track off the stream's queue, or the queue it shares with its group. If the track
+// has to be followed by another, that goes to the front of the queue, unless it's part of an album.
+func (h *Handler) takeFromQueue(stream string) (string, error) {
+	trackId, err := h.chooseFromQueue(stream)
+	if err != nil {
+		return "", err
+	}
+	// Albums already have their tracks in order, successors and all.
+	if !h.inAlbumRun(stream, trackId) {
+		h.lineUpSuccessor(stream, trackId)
+	}
+	return trackId, nil
+}
+
+// available says whether a track can go out at all: it still exists, we're still allowed to play it, and players
+// haven't kept failing to.
+func (h *Handler) available(trackId string) bool {
+	return h.redis.Exists(trackId).Val() != 0 && !songs.LicenseExpired(h.redis, trackId, time.Now()) && !songs.IsQuarantined(h.redis, trackId)
+}
+
+// chooseFromQueue is takeFromQueue without the successor.
+func (h *Handler) chooseFromQueue(stream string) (string, error) {
+	h.redis.Del(fmt.Sprintf(takenEntryFormat, stream))
+	if trackId, ok := h.takeAlbumTrack(stream); ok {
+		return trackId, nil
+	}
+	current, err := h.states.Field(stream, "currentTrack")
+	if err != nil {
+		return "", err
+	}
 	for {
-		next, err := h.redis.LPop(fmt.Sprintf(upNextFormat, stream)).Result()
-		if err == redis.Nil {
+		raw, ok, err := h.queues.Pop(stream)
+		if err != nil {
+			return "", err
+		} else if !ok {
 			break
 		}
-		if next == "" {
+		if raw == "" {
 			continue
 		}
+		entry := parseEntry(raw)
+		next := entry.TrackID
 		if h.redis.Exists(next).Val() == 0 {
 			continue
 		}
-		trackData, err := h.trackIdToTrack(next)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("looking up extant track failed I guess: %v", err), http.StatusInternalServerError)
-			return
+		if songs.LicenseExpired(h.redis, next, time.Now()) {
+			log.Printf("Skipping %s on %q, since its license has expired.\n", next, stream)
+			continue
 		}
-		h.publishUpNextUpdate(stream)
-		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "track": trackData}); err != nil {
-			http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
-			return
+		if songs.IsQuarantined(h.redis, next) {
+			log.Printf("Skipping %s on %q, since it's quarantined.\n", next, stream)
+			continue
 		}
-		return
+		// Up next has got as far as an album, which plays in its own order from here.
+		if h.startAlbumRun(stream, next) {
+			h.keepTakenEntry(stream, entry)
+			h.publishUpNextUpdate(stream)
+			h.countSelection(stream, "album")
+			return next, nil
+		}
+		if songs.KeptApart(h.redis, current, next) {
+			entry = h.swapWithFollowing(stream, current, entry)
+			next = entry.TrackID
+		}
+		h.keepTakenEntry(stream, entry)
+		h.publishUpNextUpdate(stream)
+		h.countSelection(stream, "upNext")
+		return next, nil
 	}
 
-	// If we get here then it means we didn't find anything useful in the up next list, so we need to select
-	// some random track.
-	// In this case, we should pick a track that isn't too recently played.
-	// since we expect these lists to be fairly small, we just fetch the entire library and the recently played list,
-	// subtract the latter from the former, and then pick a random entry.
-	p := h.redis.Pipeline()
-	recentlyPlayed := p.LRange(fmt.Sprintf(recentlyPlayedFormat, stream), 0, -1)
-	allTracks := p.SMembers(songs.TrackPoolKey)
-	if _, err := p.Exec(); err != nil {
-		http.Error(w, fmt.Sprintf("looking up track collections failed: %v", err), http.StatusInternalServerError)
-		return
-	}
-	availableTracks := map[string]struct{}{}
-	for _, trackId := range allTracks.Val() {
-		availableTracks[trackId] = struct{}{}
-	}
-	for _, trackId := range recentlyPlayed.Val() {
-		delete(availableTracks, trackId)
+	// Random picks that operators have already seen in the pending list come next.
+	if trackId, ok := h.popPending(stream); ok {
+		h.countSelection(stream, "pending")
+		return trackId, nil
 	}
-	// If we are left with no candidates, and we have ever played anything, play the least-most-recently played track
-	// If we have no options and we have never played anything, presumably there is no music - give up.
-	if len(availableTracks) == 0 {
-		if len(recentlyPlayed.Val()) == 0 {
-			http.Error(w, "apparently there is no music to play", http.StatusTeapot)
-			return
-		}
-		oldestTrack := recentlyPlayed.Val()[len(recentlyPlayed.Val())-1]
-		trackData, err := h.trackIdToTrack(oldestTrack)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("found the oldest track but also didn't: %v", err), http.StatusInternalServerError)
-			return
+
+	// If we prefetched a random selection when the last track was ending, honour it so players that preloaded it
+	// aren't surprised.
+	if prefetched, _ := h.states.Field(stream, prefetchedKey); prefetched != "" {
+		if err := h.states.Delete(stream, prefetchedKey); err != nil {
+			log.Printf("Failed to forget the prefetched track on %q: %v.\n", stream, err)
 		}
-		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "track": trackData}); err != nil {
-			http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
-			return
+		if h.available(prefetched) && h.playable(stream, prefetched) {
+			h.countSelection(stream, "prefetched")
+			return prefetched, nil
 		}
-		return
-	}
-	selectionList := make([]string, 0, len(availableTracks))
-	for track := range availableTracks {
-		selectionList = append(selectionList, track)
 	}
-	track := selectionList[rand.Intn(len(selectionList))]
-	// look up the track and include that metadata
-	trackData, err := h.trackIdToTrack(track)
+
+	trackId, err := h.pickRandomTrack(stream)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("found a track but also didn't: %v", err), http.StatusInternalServerError)
+		return "", err
+	}
+	h.countSelection(stream, "random")
+	return trackId, nil
+}
+
+// handleNextDryRun says what handleNext would return right now, without changing anything. Random picks are
+// only a sample: the real thing will probably pick something else. Members of a group get no track at all, since
+// the group only picks when one of them asks.
+func (h *Handler) handleNextDryRun(w http.ResponseWriter, stream string) {
+	trackData, source, err := h.resolveNext(stream, false)
+	if err == errNoMusic {
+		apierror.Write(w, apierror.NoEligibleTracks, err.Error())
+		return
+	} else if err == errUnpredictable {
+		// The group picks when one of its members asks, so there's nothing to show yet.
+		source = "group"
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "track": trackData}); err != nil {
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "dryRun": true, "source": source, "track": trackData}); err != nil {
 		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
+var errNoMusic = errors.New("apparently there is no music to play")
+
 func (h *Handler) trackIdToTrack(trackId string) (map[string]string, error) {
-	track, err := h.redis.HGetAll(trackId).Result()
+	track, err := h.trackService.Track(trackId)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't look up track: %v", err)
 	}
+	if track == nil {
+		track = map[string]string{}
+	}
 	track["trackId"] = trackId
-	track["trackUrl"] = h.trackIdToURL(trackId)
+	track["trackUrl"] = h.urls.TrackURL(trackId, track)
 	return track, nil
 }
 
 func (h *Handler) publishUpNextUpdate(stream string) {
-	upNext := h.redis.LRange(fmt.Sprintf(upNextFormat, stream), 0, -1).Val()
-	j, err := json.Marshal(map[string]interface{}{
-		"event":  "updateUpNext",
-		"stream": stream,
-		"upNext": upNext,
-	})
+	upNext, err := h.queues.UpNext(stream)
 	if err != nil {
-		log.Printf("Failed to marshal json: %v.\n", err)
+		log.Printf("Failed to fetch up next: %v.\n", err)
 		return
 	}
-	if err := h.redis.Publish(fmt.Sprintf(eventsFormat, stream), j).Err(); err != nil {
-		log.Printf("Failed to publish up next update: %v.\n", err)
-		return
+	// Everyone sharing the queue should hear about it.
+	for _, member := range h.queueMembers(stream) {
+		j, err := json.Marshal(map[string]interface{}{
+			"event":   "updateUpNext",
+			"stream":  member,
+			"upNext":  entryTrackIds(upNext),
+			"entries": parseEntries(upNext),
+		})
+		if err != nil {
+			log.Printf("Failed to marshal json: %v.\n", err)
+			return
+		}
+		if err := events.Publish(h.redis, h.channel(member), j); err != nil {
+			log.Printf("Failed to publish up next update: %v.\n", err)
+			return
+		}
 	}
 }
 
@@ -196,83 +491,171 @@ func (h *Handler) handleState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	stream := mux.Vars(r)["stream"]
-	stateKey := fmt.Sprintf(stateFormat, stream)
 	switch r.Method {
 	case http.MethodPatch:
-		for k, sv := range r.Form {
+		// The query string has credentials in it, so state only comes from the body, and all of that has to be state.
+		form := r.PostForm
+		for k := range form {
+			if !stateKeys[k] {
+				http.Error(w, fmt.Sprintf("unknown state key %q", k), http.StatusBadRequest)
+				return
+			}
+		}
+		if fieldErrors := normaliseState(form); len(fieldErrors) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "errors": fieldErrors})
+			return
+		}
+		if startsPlaying(form.Get("playing")) && auth.RoleOf(r) != auth.RoleAdmin && h.silenced(stream) {
+			http.Error(w, fmt.Sprintf("%q was stopped by a panic, so it has to be resumed first", stream), http.StatusConflict)
+			return
+		}
+		// Check everything we can before changing anything, so a bad field doesn't leave the rest half done.
+		var settings Settings
+		if v := form.Get("autoplay"); v != "" {
+			var err error
+			if settings, err = h.settings(stream); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := h.applySetting(&settings, "autoplay", v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		// Any state update counts as a sign of life for the watchdog.
+		if err := h.redis.SAdd(StreamsKey, stream).Err(); err != nil {
+			log.Printf("Failed to record stream activity: %v.\n", err)
+		}
+		if err := h.states.Update(stream, map[string]interface{}{lastSeenKey: time.Now().Unix()}); err != nil {
+			log.Printf("Failed to record stream activity: %v.\n", err)
+		}
+		// What operators decide moves the revision on, all at once with the change itself.
+		versioned := map[string]interface{}{}
+		if v := form.Get("currentTrack"); v != "" {
+			// A new track starts from the beginning, whatever the player last told us.
+			versioned["currentTrack"], versioned["position"], versioned[positionUpdatedKey] = v, 0, time.Now().Unix()
+		}
+		if v := form.Get("playing"); v != "" {
+			versioned["playing"] = v
+		}
+		if needsRevision(form) {
+			// Operators have to say which revision their change is based on, so nobody silently clobbers anyone
+			// else. Admins, including the players, can leave it out, or send "If-Match: *", to have the last word.
+			expected, ok := expectedRevision(r)
+			if !ok && auth.RoleOf(r) != auth.RoleAdmin {
+				http.Error(w, "If-Match is required to change the stream's state; fetch it first", http.StatusPreconditionRequired)
+				return
+			}
+			revision, err := h.states.UpdateRevision(stream, expected, versioned)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to update state: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if revision < 0 {
+				http.Error(w, "stream state has changed since you last fetched it", http.StatusConflict)
+				return
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"%d"`, revision))
+		}
+		// Everything that changes goes out in one event at the end, however many fields that was.
+		changes := map[string]string{}
+		failure := ""
+	fields:
+		for k, sv := range form {
 			if len(sv) == 0 {
 				continue
 			}
 			v := sv[0]
 			switch k {
 			case "currentTrack":
-				p := h.redis.Pipeline()
-				p.HSet(stateKey, "currentTrack", v)
-				// Remove the current entry in the recently played list, if any
-				// This produces saner behaviour if the list is larger than the track pool.
-				p.LRem(fmt.Sprintf(recentlyPlayedFormat, stream), 0, v)
-				// Make this the most recent played
-				p.LPush(fmt.Sprintf(recentlyPlayedFormat, stream), v)
-				// Truncate the list
-				p.LTrim(fmt.Sprintf(recentlyPlayedFormat, stream), 0, 29)
-				results, err := p.Exec()
-				if err != nil {
-					http.Error(w, fmt.Sprintf("failed to execute current track update: %v", err), http.StatusInternalServerError)
-					break
+				if err := h.states.Delete(stream, outputKey); err != nil {
+					log.Printf("Failed to forget the output of %q: %v.\n", stream, err)
 				}
-				for _, result := range results {
-					if result.Err() != nil {
-						http.Error(w, fmt.Sprintf("failed to execute current track update: %v", result.Err()), http.StatusInternalServerError)
-						break
+				if err := h.recordPlay(stream, v); err != nil {
+					failure = fmt.Sprintf("failed to execute current track update: %v", err)
+					break fields
+				}
+				h.recordUpdate(stream, k, v)
+				changes[k] = v
+				h.mirrorToFollowers(stream, k, v)
+			case "duration":
+				// Players can work out durations far more easily than we can, so they tell us when they load a track.
+				trackId := form.Get("currentTrack")
+				if trackId == "" {
+					trackId, _ = h.states.Field(stream, "currentTrack")
+				}
+				if trackId == "" || h.redis.Exists(trackId).Val() == 0 {
+					continue
+				}
+				// Players report it every time they load a track, but it's only news the first time.
+				if h.redis.HGet(trackId, songs.DurationKey).Val() != v {
+					if err := h.redis.HSet(trackId, songs.DurationKey, v).Err(); err != nil {
+						log.Printf("Failed to store duration for %q: %v.\n", trackId, err)
+						continue
+					}
+					h.tracks.Invalidate(trackId)
+					// It's a change to the library like any other, so anyone caching the listing hears about it.
+					if err := songs.BumpLibraryVersion(h.redis, trackId); err != nil {
+						log.Printf("Failed to record duration change for %q: %v.\n", trackId, err)
 					}
 				}
-				if err := h.publishUpdate(stream, k, v); err != nil {
-					log.Printf("Failed to publish update: %v.\n", err)
+				h.recordUpdate(stream, k, v)
+				changes[k] = v
+			case "position":
+				position, _ := strconv.ParseFloat(v, 64)
+				if err := h.states.Update(stream, map[string]interface{}{k: v, positionUpdatedKey: time.Now().Unix()}); err != nil {
+					log.Printf("Failed to update %q state: %v.\n", k, err)
+					continue
 				}
-			case "playing":
-				fallthrough
+				h.checkEndingSoon(stream, position)
+				h.publishProgress(stream, position)
 			case "autoplay":
-				if err := h.redis.HSet(stateKey, k, v).Err(); err != nil {
+				// autoplay is really a setting, but it's always been changeable here. We checked it above.
+				if err := h.storeSettings(stream, settings); err != nil {
 					log.Printf("Failed to update %q state: %v.\n", k, err)
 				}
-				if err := h.publishUpdate(stream, k, v); err != nil {
-					log.Printf("Failed to publish update: %v.\n", err)
-				}
+				h.publishSettings(stream, settings)
+				h.recordUpdate(stream, k, v)
+				changes[k] = v
+			case "playing":
+				h.recordUpdate(stream, k, v)
+				changes[k] = v
+				h.mirrorToFollowers(stream, k, v)
 			case "skip":
-				j, err := json.Marshal(map[string]string{
-					"event":  "requestSkip",
-					"stream": stream,
-				})
-				if err != nil {
-					log.Printf("Failed to marshal json: %v.\n", err)
-					continue
-				}
-				if err := h.redis.Publish(fmt.Sprintf(eventsFormat, stream), j).Err(); err != nil {
+				if err := h.publishSkip(stream); err != nil {
 					log.Printf("Failed to publish skip request: %v.\n", err)
 					continue
 				}
 			}
 		}
+		h.publishStateUpdate(stream, changes)
+		if failure != "" {
+			http.Error(w, failure, http.StatusInternalServerError)
+			return
+		}
+		fallthrough
 	case http.MethodGet:
-		state, err := h.redis.HGetAll(stateKey).Result()
+		state, err := h.states.State(stream)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to fetch information: %v", err), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		result := map[string]interface{}{}
-		for k, v := range state {
-			result[k] = v
-		}
+		var track map[string]string
 		if trackId, ok := state["currentTrack"]; ok {
-			track, err := h.redis.HGetAll(trackId).Result()
-			if err == nil {
-				track["trackId"] = trackId
-				track["trackUrl"] = h.trackIdToURL(trackId)
-				result["currentTrack"] = track
-			} else {
-				delete(result, "currentTrack")
+			// If this fails, renderState will just drop the current track.
+			if t, err := h.trackService.Track(trackId); err == nil {
+				track = t
 			}
 		}
+		result := h.renderState(state, track)
+		metadata, err := h.metadata([]string{stream})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result["metadata"] = metadata[stream]
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, result[revisionKey]))
 		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "state": result}); err != nil {
 			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
 			return
@@ -280,6 +663,42 @@ func (h *Handler) handleState(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// internalStateKeys are the fields we keep in a stream's state for our own bookkeeping, which clients have no use
+// for.
+var internalStateKeys = map[string]bool{
+	positionUpdatedKey: true,
+	prefetchedKey:      true,
+	panicKey:           true,
+	panicPlayingKey:    true,
+	quietAutoplayKey:   true,
+	outputKey:          true,
+	lastSeenKey:        true,
+}
+
+// renderState turns a raw state hash into what we show to clients, leaving out our own bookkeeping and substituting
+// the current track ID for the current track itself if we have it.
+func (h *Handler) renderState(state map[string]string, track map[string]string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for k, v := range state {
+		if !internalStateKeys[k] {
+			result[k] = v
+		}
+	}
+	if _, ok := state[revisionKey]; !ok {
+		result[revisionKey] = "0"
+	}
+	if trackId, ok := state["currentTrack"]; ok {
+		if track != nil {
+			track["trackId"] = trackId
+			track["trackUrl"] = h.urls.TrackURL(trackId, track)
+			result["currentTrack"] = track
+		} else {
+			delete(result, "currentTrack")
+		}
+	}
+	return result
+}
+
 type streamUpdateEvent struct {
 	Event  string `json:"event"`
 	Stream string `json:"stream"`
@@ -287,11 +706,39 @@ type streamUpdateEvent struct {
 	Value  string `json:"value"`
 }
 
-func (h *Handler) trackIdToURL(trackId string) string {
-	return h.root + trackId
+// channel is the pub/sub channel for events about a stream.
+func (h *Handler) channel(stream string) string {
+	return h.options.ChannelPrefix + fmt.Sprintf(eventsFormat, stream)
 }
 
+// recordUpdate notes a change to the stream's state in its timeline.
+func (h *Handler) recordUpdate(stream, key, value string) {
+	h.recordTransition(stream, "update", map[string]interface{}{"key": key, "value": value})
+}
+
+// publishStateUpdate tells everyone about several changes to the stream's state at once, as a stateUpdated event.
+// It does nothing if nothing changed.
+func (h *Handler) publishStateUpdate(stream string, changes map[string]string) {
+	if len(changes) == 0 {
+		return
+	}
+	j, err := json.Marshal(map[string]interface{}{
+		"event":   "stateUpdated",
+		"stream":  stream,
+		"changes": changes,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	if err := events.Publish(h.redis, h.channel(stream), j); err != nil {
+		log.Printf("Failed to publish state update: %v.\n", err)
+	}
+}
+
+// publishUpdate records and publishes a change to a single field of the stream's state, as an update event.
 func (h *Handler) publishUpdate(stream, key, value string) error {
+	h.recordUpdate(stream, key, value)
 	j, err := json.Marshal(streamUpdateEvent{
 		Event:  "update",
 		Stream: stream,
@@ -301,12 +748,27 @@ func (h *Handler) publishUpdate(stream, key, value string) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal json: %v", err)
 	}
-	if err := h.redis.Publish(fmt.Sprintf(eventsFormat, stream), j).Err(); err != nil {
+	if err := events.Publish(h.redis, h.channel(stream), j); err != nil {
 		return fmt.Errorf("failed to publish update: %v", err)
 	}
 	return nil
 }
 
+func (h *Handler) publishSkip(stream string) error {
+	h.recordTransition(stream, "requestSkip", nil)
+	j, err := json.Marshal(map[string]string{
+		"event":  "requestSkip",
+		"stream": stream,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal json: %v", err)
+	}
+	if err := events.Publish(h.redis, h.channel(stream), j); err != nil {
+		return fmt.Errorf("failed to publish skip request: %v", err)
+	}
+	return nil
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.mux.ServeHTTP(w, r)
 }
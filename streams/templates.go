@@ -0,0 +1,194 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+)
+
+// Queue templates are saved up next lists that can be loaded into any stream, so a run of tracks for something
+// like an opening ceremony can be put together in advance. queueTemplatesKey is the set of their names, and each
+// is a list of up next entries in queueTemplateFormat.
+const queueTemplatesKey = "queue-templates"
+const queueTemplateFormat = "queue-template-%s"
+
+// handleTemplates lists the saved queue templates and how long each is.
+func (h *Handler) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	names, err := h.redis.SMembers(queueTemplatesKey).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("listing templates failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(names)
+	p := h.redis.Pipeline()
+	lengths := make([]*redis.IntCmd, len(names))
+	for i, name := range names {
+		lengths[i] = p.LLen(fmt.Sprintf(queueTemplateFormat, name))
+	}
+	if _, err := p.Exec(); err != nil && err != redis.Nil {
+		http.Error(w, fmt.Sprintf("looking up templates failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	templates := make([]map[string]interface{}, len(names))
+	for i, name := range names {
+		templates[i] = map[string]interface{}{"name": name, "length": lengths[i].Val()}
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "templates": templates}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleTemplate shows (GET) or deletes (DELETE) a queue template.
+func (h *Handler) handleTemplate(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["template"]
+	key := fmt.Sprintf(queueTemplateFormat, name)
+	if !h.redis.SIsMember(queueTemplatesKey, name).Val() {
+		http.Error(w, fmt.Sprintf("no such template %q", name), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tracks, err := h.redis.LRange(key, 0, -1).Result()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("fetching template failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		timings, err := h.queueTimings(tracks)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("looking up track durations failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":           "ok",
+			"name":             name,
+			"tracks":           entryTrackIds(tracks),
+			"entries":          parseEntries(tracks),
+			"totalDuration":    timings.total,
+			"unknownDurations": timings.unknown,
+		}); err != nil {
+			http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		p := h.redis.TxPipeline()
+		p.SRem(queueTemplatesKey, name)
+		p.Del(key)
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("deleting template failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+	}
+}
+
+// handleSaveTemplate saves a stream's up next list as the template `name`. Saving over an existing template needs
+// `replace=true`.
+func (h *Handler) handleSaveTemplate(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "templates need a name", http.StatusBadRequest)
+		return
+	}
+	replace, _ := strconv.ParseBool(r.FormValue("replace"))
+	if !replace && h.redis.SIsMember(queueTemplatesKey, name).Val() {
+		http.Error(w, fmt.Sprintf("template %q already exists", name), http.StatusConflict)
+		return
+	}
+	entries, err := h.queues.UpNext(stream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var tracks []string
+	for _, trackId := range entries {
+		if trackId != "" {
+			tracks = append(tracks, trackId)
+		}
+	}
+	if len(tracks) == 0 {
+		http.Error(w, fmt.Sprintf("%q has nothing up next to save", stream), http.StatusUnprocessableEntity)
+		return
+	}
+	key := fmt.Sprintf(queueTemplateFormat, name)
+	p := h.redis.TxPipeline()
+	p.Del(key)
+	p.RPush(key, stringsToInterfaces(tracks)...)
+	p.SAdd(queueTemplatesKey, name)
+	if _, err := p.Exec(); err != nil {
+		http.Error(w, fmt.Sprintf("saving template failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Saved %d tracks from %s as template %q\n", len(tracks), stream, name)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "name": name, "length": len(tracks)}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleApplyTemplate loads the template `template` into a stream's up next list, either after what's already
+// there (`mode=append`, the default) or instead of it (`mode=replace`). Tracks that have been deleted since the
+// template was saved are left out, and listed as `missing`.
+func (h *Handler) handleApplyTemplate(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	name := r.FormValue("template")
+	mode := r.FormValue("mode")
+	switch mode {
+	case "":
+		mode = "append"
+	case "append", "replace":
+	default:
+		http.Error(w, fmt.Sprintf("mode must be append or replace, not %q", mode), http.StatusBadRequest)
+		return
+	}
+	if !h.redis.SIsMember(queueTemplatesKey, name).Val() {
+		http.Error(w, fmt.Sprintf("no such template %q", name), http.StatusNotFound)
+		return
+	}
+	tracks, err := h.redis.LRange(fmt.Sprintf(queueTemplateFormat, name), 0, -1).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("fetching template failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	p := h.redis.Pipeline()
+	exists := make([]*redis.IntCmd, len(tracks))
+	for i, raw := range tracks {
+		exists[i] = p.Exists(parseEntry(raw).TrackID)
+	}
+	if _, err := p.Exec(); err != nil && err != redis.Nil {
+		http.Error(w, fmt.Sprintf("checking tracks failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var present []string
+	missing := []string{}
+	for i, raw := range tracks {
+		// Templates keep the entries' overrides, so they come back the way they were saved.
+		if exists[i].Val() == 0 {
+			missing = append(missing, parseEntry(raw).TrackID)
+		} else {
+			present = append(present, raw)
+		}
+	}
+	if mode == "replace" {
+		err = h.queues.Reset(stream, present...)
+	} else {
+		err = h.queues.Append(stream, present...)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("loading template failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.publishUpNextUpdate(stream)
+	log.Printf("Loaded template %q into %s (%s)\n", name, stream, mode)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "added": len(present), "missing": missing}); err != nil {
+		http.Error(w, fmt.Sprintf("encoding JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
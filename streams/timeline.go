@@ -0,0 +1,96 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+)
+
+const timelineFormat = "timeline-%s"
+
+// timelineLength is roughly how many transitions we keep per stream; a few days of a busy con.
+const timelineLength = 20000
+
+// recordTransition appends something that happened to a stream to its timeline, for postmortems.
+// Failing to do so is logged but otherwise ignored; it's not worth failing the actual change over.
+func (h *Handler) recordTransition(stream, event string, values map[string]interface{}) {
+	fields := map[string]interface{}{"event": event}
+	for k, v := range values {
+		fields[k] = v
+	}
+	if err := h.redis.XAdd(&redis.XAddArgs{
+		Stream:       fmt.Sprintf(timelineFormat, stream),
+		MaxLenApprox: timelineLength,
+		Values:       fields,
+	}).Err(); err != nil {
+		log.Printf("Failed to record %s on the timeline for %q: %v.\n", event, stream, err)
+	}
+}
+
+// streamIDBound checks a `since` or `until` given as a millisecond timestamp or a stream ID, so that nonsense is the
+// client's problem rather than a failure from redis. Empty means unbounded, which is def.
+func streamIDBound(r *http.Request, param, def string) (string, error) {
+	s := r.FormValue(param)
+	if s == "" {
+		return def, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 64); err != nil {
+			return "", fmt.Errorf("%s must be a millisecond timestamp or a stream ID, not %q", param, s)
+		}
+	}
+	return s, nil
+}
+
+// handleTimeline returns a stream's recorded transitions, oldest first. `since` and `until` are millisecond
+// timestamps (or stream IDs), and `count` limits how many we return, counting back from `until`.
+func (h *Handler) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["stream"]
+	since, err := streamIDBound(r, "since", "-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := streamIDBound(r, "until", "+")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	count := int64(1000)
+	if c := r.FormValue("count"); c != "" {
+		n, err := strconv.ParseInt(c, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid count %q", c), http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	messages, err := h.redis.XRevRangeN(fmt.Sprintf(timelineFormat, stream), until, since, count).Result()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch timeline: %v", err), http.StatusInternalServerError)
+		return
+	}
+	entries := make([]map[string]interface{}, len(messages))
+	for i, message := range messages {
+		entry := map[string]interface{}{"id": message.ID}
+		for k, v := range message.Values {
+			entry[k] = v
+		}
+		// stream IDs are <milliseconds>-<sequence>, which saves us storing the time separately.
+		if ms, err := strconv.ParseInt(strings.SplitN(message.ID, "-", 2)[0], 10, 64); err == nil {
+			entry["timestamp"] = ms
+		}
+		entries[len(messages)-1-i] = entry
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "timeline": entries}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,65 @@
+package streams
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/PonyFest/music-control/songs"
+)
+
+// parseFlag reads a boolean the way people actually write them.
+func parseFlag(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+	return strconv.ParseBool(strings.TrimSpace(value))
+}
+
+// normaliseState checks a state PATCH before we apply any of it, rewriting values into the one form we store them
+// in, so players reading the state back never have to guess. It returns what was wrong with each invalid field.
+func normaliseState(form url.Values) map[string]string {
+	fieldErrors := map[string]string{}
+	for k, sv := range form {
+		if len(sv) == 0 {
+			continue
+		}
+		v := sv[0]
+		switch k {
+		case "currentTrack":
+			if strings.TrimSpace(v) == "" {
+				fieldErrors[k] = "currentTrack can't be empty"
+				continue
+			}
+			v = strings.TrimSpace(v)
+		case "playing", "autoplay":
+			b, err := parseFlag(v)
+			if err != nil {
+				fieldErrors[k] = fmt.Sprintf("%s must be a boolean, not %q", k, v)
+				continue
+			}
+			v = strconv.FormatBool(b)
+		case "duration":
+			d, err := songs.ParseDuration(v)
+			if err != nil {
+				fieldErrors[k] = err.Error()
+				continue
+			}
+			v = strconv.FormatFloat(d, 'f', -1, 64)
+		case "position":
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+				fieldErrors[k] = fmt.Sprintf("%s must be a non-negative number of seconds, not %q", k, v)
+				continue
+			}
+			v = strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		form[k] = []string{v}
+	}
+	return fieldErrors
+}
@@ -0,0 +1,96 @@
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/PonyFest/music-control/events"
+	"github.com/PonyFest/music-control/songs"
+)
+
+const watchdogFormat = "watchdog-%s"
+
+// RunWatchdog periodically looks for streams that claim to be playing but have gone quiet for longer than their
+// current track could possibly last, and tries to kick them back into life. Streams playing tracks we don't know
+// the duration of are left alone, as are those played by the mixer or HLS output. It never returns, so run it in a
+// goroutine. It's safe to run on several servers at once.
+func (h *Handler) RunWatchdog() {
+	if h.options.StallGrace <= 0 {
+		return
+	}
+	ticker := time.NewTicker(h.options.StallGrace / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		streams, err := h.redis.SMembers(StreamsKey).Result()
+		if err != nil {
+			log.Printf("Watchdog failed to list streams: %v.\n", err)
+			continue
+		}
+		for _, stream := range streams {
+			h.checkStalled(stream)
+		}
+	}
+}
+
+func (h *Handler) checkStalled(stream string) {
+	state, err := h.states.State(stream)
+	if err != nil {
+		log.Printf("Watchdog failed to fetch state for %q: %v.\n", stream, err)
+		return
+	}
+	// The mixer and HLS outputs play on whatever happens, and never report progress for us to go on.
+	if state["playing"] != "true" || state["currentTrack"] == "" || state[outputKey] != "" {
+		return
+	}
+	lastSeen, err := strconv.ParseInt(state[lastSeenKey], 10, 64)
+	if err != nil {
+		return
+	}
+	// Without the track's duration, we can't tell a long track from a stalled one.
+	track, err := h.trackService.Track(state["currentTrack"])
+	if err != nil || track == nil {
+		return
+	}
+	duration, err := strconv.ParseFloat(track[songs.DurationKey], 64)
+	if err != nil || duration <= 0 {
+		return
+	}
+	position, _ := strconv.ParseFloat(state["position"], 64)
+	positionUpdated, err := strconv.ParseInt(state[positionUpdatedKey], 10, 64)
+	if err != nil {
+		positionUpdated = lastSeen
+	}
+	expectedEnd := time.Unix(positionUpdated, 0).Add(time.Duration((duration - position) * float64(time.Second)))
+	if expectedEnd.Before(time.Unix(lastSeen, 0)) {
+		expectedEnd = time.Unix(lastSeen, 0)
+	}
+	stalledFor := time.Since(expectedEnd)
+	if stalledFor < h.options.StallGrace {
+		return
+	}
+	// Only one server gets to do anything about it, and only once per grace period.
+	if !h.redis.SetNX(fmt.Sprintf(watchdogFormat, stream), time.Now().Unix(), h.options.StallGrace).Val() {
+		return
+	}
+	log.Printf("Stream %q appears to have stalled %s ago; requesting a skip.\n", stream, stalledFor.Round(time.Second))
+	h.recordTransition(stream, "streamStalled", map[string]interface{}{"currentTrack": state["currentTrack"], "stalledFor": stalledFor.Seconds()})
+	if err := h.publishSkip(stream); err != nil {
+		log.Printf("Watchdog failed to publish skip request: %v.\n", err)
+	}
+	j, err := json.Marshal(map[string]interface{}{
+		"event":        "streamStalled",
+		"stream":       stream,
+		"currentTrack": state["currentTrack"],
+		"stalledFor":   stalledFor.Seconds(),
+	})
+	if err != nil {
+		log.Printf("Failed to marshal json: %v.\n", err)
+		return
+	}
+	if err := events.Publish(h.redis, h.options.ChannelPrefix+songs.EventsKey, j); err != nil {
+		log.Printf("Failed to publish stall alert: %v.\n", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// tenant is another event sharing this deployment. It gets its own redis database, and so its own everything.
+type tenant struct {
+	Name     string
+	DB       int
+	Password string
+}
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+type tenantList []tenant
+
+func (t *tenantList) String() string {
+	names := make([]string, len(*t))
+	for i, tenant := range *t {
+		names[i] = tenant.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (t *tenantList) Set(value string) error {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) < 2 {
+		return fmt.Errorf("tenants look like name:redis-db[:password], not %q", value)
+	}
+	if !tenantNamePattern.MatchString(parts[0]) {
+		return fmt.Errorf("tenant names must be lowercase letters, numbers and dashes, not %q", parts[0])
+	}
+	if parts[0] == "channels" {
+		// That's /api/events/channels, the event channel catalog.
+		return fmt.Errorf("tenants can't be called %q", parts[0])
+	}
+	db, err := strconv.Atoi(parts[1])
+	if err != nil || db < 0 {
+		return fmt.Errorf("tenant %q needs a redis database number, not %q", parts[0], parts[1])
+	}
+	for _, existing := range *t {
+		if existing.Name == parts[0] {
+			return fmt.Errorf("there's already a tenant called %q", parts[0])
+		}
+		if existing.DB == db {
+			return fmt.Errorf("tenant %q would share redis database %d with tenant %q", parts[0], db, existing.Name)
+		}
+	}
+	newTenant := tenant{Name: parts[0], DB: db}
+	if len(parts) == 3 {
+		newTenant.Password = parts[2]
+	}
+	*t = append(*t, newTenant)
+	return nil
+}
+
+// checkTenantDBs makes sure no tenant shares the main event's redis database, which is the one in --redis-url (or
+// 0, for --embedded).
+func checkTenantDBs(c config) error {
+	if len(c.Tenants) == 0 {
+		return nil
+	}
+	mainDB := 0
+	if c.RedisURL != "" {
+		redisOptions, err := parseRedisOptions(c)
+		if err != nil {
+			return err
+		}
+		mainDB = redisOptions.DB
+	}
+	for _, t := range c.Tenants {
+		if t.DB == mainDB {
+			return fmt.Errorf("tenant %q would share redis database %d with the main event", t.Name, t.DB)
+		}
+	}
+	return nil
+}
+
+func nonEmpty(values ...string) []string {
+	var result []string
+	for _, v := range values {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,151 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/secrets"
+)
+
+// Wrap traces requests: those that arrive with a sampled traceparent header, carrying on their trace, and a sample
+// of the rest. Handlers find the request's span in its context.
+func (t *Tracer) Wrap(handler http.Handler) http.Handler {
+	if t == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace, parent, sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if !ok {
+			trace, parent, sampled = traceID{}, spanID{}, t.sampled()
+		}
+		if !sampled {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		s := t.newSpan(r.Method+" "+r.URL.Path, kindServer, trace, parent)
+		s.SetAttribute("http.method", r.Method)
+		s.SetAttribute("http.target", secrets.RedactURL(r.URL))
+		w.Header().Set("traceresponse", s.traceparent())
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+		s.SetAttribute("http.status_code", strconv.Itoa(rec.status))
+		var err error
+		if rec.status >= 500 {
+			err = statusError(rec.status)
+		}
+		s.End(err)
+	})
+}
+
+type statusError int
+
+func (e statusError) Error() string {
+	return http.StatusText(int(e))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes on, which the event stream needs.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// RedisHook returns a redis client hook that records a span for each command or pipeline run with a traced
+// context, as from client.WithContext(r.Context()).
+func (t *Tracer) RedisHook() redis.Hook {
+	return redisHook{}
+}
+
+type redisHook struct{}
+
+type redisSpanKey struct{}
+
+func (redisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return startRedis(ctx, "redis "+cmd.Name(), 1), nil
+}
+
+func (redisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	endRedis(ctx, cmd.Err())
+	return nil
+}
+
+func (redisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return startRedis(ctx, "redis pipeline", len(cmds)), nil
+}
+
+func (redisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	endRedis(ctx, err)
+	return nil
+}
+
+// Redis spans live under their own key, so ending one can't end the request's span by mistake when the command
+// wasn't traced.
+func startRedis(ctx context.Context, name string, commands int) context.Context {
+	ctx, s := start(ctx, name, kindClient)
+	if s == nil {
+		return ctx
+	}
+	s.SetAttribute("db.system", "redis")
+	if commands > 1 {
+		s.SetAttribute("db.redis.commands", strconv.Itoa(commands))
+	}
+	return context.WithValue(ctx, redisSpanKey{}, s)
+}
+
+func endRedis(ctx context.Context, err error) {
+	s, _ := ctx.Value(redisSpanKey{}).(*Span)
+	if err == redis.Nil {
+		err = nil
+	}
+	s.End(err)
+}
+
+// InstrumentAWS records a span for each AWS request, under the request's context's span if it has one (as from the
+// SDK's WithContext methods). Requests without one are slow and rare enough to sample as traces of their own.
+func (t *Tracer) InstrumentAWS(handlers *request.Handlers) {
+	if t == nil {
+		return
+	}
+	handlers.Validate.PushFront(func(r *request.Request) {
+		name := r.ClientInfo.ServiceName + " " + r.Operation.Name
+		ctx, s := start(r.Context(), name, kindClient)
+		if s == nil {
+			if !t.sampled() {
+				return
+			}
+			s = t.newSpan(name, kindClient, traceID{}, spanID{})
+			ctx = context.WithValue(ctx, spanKey{}, s)
+		}
+		s.SetAttribute("rpc.system", "aws-api")
+		s.SetAttribute("rpc.service", r.ClientInfo.ServiceName)
+		s.SetAttribute("rpc.method", r.Operation.Name)
+		r.SetContext(context.WithValue(ctx, awsSpanKey{}, s))
+	})
+	handlers.Complete.PushBack(func(r *request.Request) {
+		s, _ := r.Context().Value(awsSpanKey{}).(*Span)
+		s.End(r.Error)
+	})
+}
+
+type awsSpanKey struct{}
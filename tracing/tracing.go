@@ -0,0 +1,189 @@
+// Package tracing records spans for requests and what they wait on, and sends them to an OpenTelemetry collector
+// over OTLP/HTTP. Spans only start under a sampled request span, so everything is free for requests we don't trace.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as OTLP numbers them.
+const (
+	kindInternal = 1
+	kindServer   = 2
+	kindClient   = 3
+)
+
+type traceID [16]byte
+type spanID [8]byte
+
+// Span is one timed operation within a trace. A nil *Span is fine to use and does nothing, which is what Start
+// gives you when the request isn't being traced.
+type Span struct {
+	tracer *Tracer
+	trace  traceID
+	id     spanID
+	parent spanID
+	name   string
+	kind   int
+	start  time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs map[string]string
+	err   string
+}
+
+type spanKey struct{}
+
+// FromContext returns the span ctx is in, if any.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a span under whatever span ctx is in. If there isn't one, it returns a nil span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, kindInternal)
+}
+
+func start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, kind, parent.trace, parent.id)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttribute records something about the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// End finishes the span, marking it failed if err isn't nil.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+	s.tracer.export(s)
+}
+
+// traceparent is the span's W3C traceparent header, for passing the trace on.
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.trace[:]), hex.EncodeToString(s.id[:]))
+}
+
+// parseTraceparent reads a W3C traceparent header. It returns ok if it's valid, and sampled if the caller is
+// recording the trace.
+func parseTraceparent(header string) (trace traceID, parent spanID, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return trace, parent, false, false
+	}
+	t, err := hex.DecodeString(parts[1])
+	if err != nil || len(t) != len(trace) {
+		return trace, parent, false, false
+	}
+	p, err := hex.DecodeString(parts[2])
+	if err != nil || len(p) != len(parent) {
+		return trace, parent, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return trace, parent, false, false
+	}
+	copy(trace[:], t)
+	copy(parent[:], p)
+	if trace == (traceID{}) || parent == (spanID{}) {
+		return trace, parent, false, false
+	}
+	return trace, parent, flags[0]&1 == 1, true
+}
+
+// Tracer makes spans and sends them off to be exported. A nil *Tracer traces nothing.
+type Tracer struct {
+	service  string
+	sampling float64
+	exporter *exporter
+
+	mu     sync.Mutex
+	random *mrand.Rand
+}
+
+// New returns a Tracer that sends spans to the OTLP/HTTP collector at endpoint, like http://collector:4318,
+// recording sampling of the requests that don't say whether they're traced themselves.
+func New(endpoint, service string, sampling float64) (*Tracer, error) {
+	if sampling < 0 || sampling > 1 {
+		return nil, fmt.Errorf("trace sampling must be between 0 and 1, not %v", sampling)
+	}
+	var seed [8]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, fmt.Errorf("couldn't seed trace IDs: %v", err)
+	}
+	var n int64
+	for _, b := range seed {
+		n = n<<8 | int64(b)
+	}
+	return &Tracer{
+		service:  service,
+		sampling: sampling,
+		exporter: newExporter(strings.TrimSuffix(endpoint, "/")+"/v1/traces", service),
+		random:   mrand.New(mrand.NewSource(n)),
+	}, nil
+}
+
+// Run sends spans to the collector as they finish.
+func (t *Tracer) Run() {
+	t.exporter.run()
+}
+
+func (t *Tracer) newSpan(name string, kind int, trace traceID, parent spanID) *Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &Span{
+		tracer: t,
+		trace:  trace,
+		parent: parent,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  map[string]string{},
+	}
+	if s.trace == (traceID{}) {
+		t.random.Read(s.trace[:])
+	}
+	t.random.Read(s.id[:])
+	return s
+}
+
+func (t *Tracer) sampled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.random.Float64() < t.sampling
+}
+
+func (t *Tracer) export(s *Span) {
+	t.exporter.add(s)
+}
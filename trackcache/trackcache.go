@@ -0,0 +1,146 @@
+package trackcache
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// InvalidationChannel carries the IDs of tracks whose metadata has changed. Redis shares channels between
+// databases, so each tenant's cache prefixes it with the tenant's channel prefix.
+const InvalidationChannel = "track-invalidations"
+
+// maxAge is a safety net in case we somehow miss an invalidation.
+const maxAge = 5 * time.Minute
+
+type entry struct {
+	track   map[string]string
+	fetched time.Time
+}
+
+// Cache keeps track metadata in memory, because every dashboard poll otherwise means another round of HGETALLs for
+// the same handful of tracks. Anything that changes a track hash must call Invalidate.
+type Cache struct {
+	redis   *redis.Client
+	channel string
+
+	mu     sync.RWMutex
+	tracks map[string]entry
+	// generation is bumped on every invalidation, so fetches that raced with one don't store stale data.
+	generation uint64
+}
+
+// New creates a cache of the tracks in redisClient's database, hearing about changes on InvalidationChannel with
+// channelPrefix in front.
+func New(redisClient *redis.Client, channelPrefix string) *Cache {
+	return &Cache{
+		redis:   redisClient,
+		channel: channelPrefix + InvalidationChannel,
+		tracks:  map[string]entry{},
+	}
+}
+
+func copyTrack(track map[string]string) map[string]string {
+	c := make(map[string]string, len(track))
+	for k, v := range track {
+		c[k] = v
+	}
+	return c
+}
+
+// Get returns the metadata for a track. Unknown tracks produce an empty map, just like HGETALL would. The result
+// is the caller's to modify.
+func (c *Cache) Get(trackId string) (map[string]string, error) {
+	tracks, err := c.GetMany([]string{trackId})
+	if err != nil {
+		return nil, err
+	}
+	return tracks[trackId], nil
+}
+
+// GetMany is Get for several tracks at once, fetching any we don't have in a single pipeline.
+func (c *Cache) GetMany(trackIds []string) (map[string]map[string]string, error) {
+	result := make(map[string]map[string]string, len(trackIds))
+	var missing []string
+	c.mu.RLock()
+	generation := c.generation
+	for _, trackId := range trackIds {
+		if e, ok := c.tracks[trackId]; ok && time.Since(e.fetched) < maxAge {
+			result[trackId] = copyTrack(e.track)
+		} else {
+			missing = append(missing, trackId)
+		}
+	}
+	c.mu.RUnlock()
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	p := c.redis.Pipeline()
+	cmds := make(map[string]*redis.StringStringMapCmd, len(missing))
+	for _, trackId := range missing {
+		cmds[trackId] = p.HGetAll(trackId)
+	}
+	if _, err := p.Exec(); err != nil {
+		return nil, fmt.Errorf("looking up track data failed: %v", err)
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for trackId, cmd := range cmds {
+		track := cmd.Val()
+		result[trackId] = copyTrack(track)
+		// Don't remember tracks that don't exist; they might shortly.
+		if len(track) > 0 && c.generation == generation {
+			c.tracks[trackId] = entry{track: track, fetched: now}
+		}
+	}
+	return result, nil
+}
+
+// Invalidate drops a track from this cache and tells every other server to do the same.
+func (c *Cache) Invalidate(trackId string) {
+	c.forget(trackId)
+	if err := c.redis.Publish(c.channel, trackId).Err(); err != nil {
+		log.Printf("Failed to publish track invalidation: %v.\n", err)
+	}
+}
+
+func (c *Cache) forget(trackId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	delete(c.tracks, trackId)
+}
+
+func (c *Cache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.tracks = map[string]entry{}
+}
+
+// Run listens for invalidations from other servers. It never returns, so run it in a goroutine.
+func (c *Cache) Run() {
+	pubsub := c.redis.Subscribe(c.channel)
+	defer pubsub.Close()
+	for {
+		msg, err := pubsub.Receive()
+		if err != nil {
+			// We've probably lost the connection, and with it any invalidations sent in the meantime.
+			c.clear()
+			time.Sleep(time.Second)
+			continue
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			// This also happens when we resubscribe after a reconnect, so we might have missed something.
+			c.clear()
+		case *redis.Message:
+			c.forget(msg.Payload)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package trackurl
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+const (
+	// Unsigned URLs are just the root plus the track ID, which needs a public bucket.
+	Unsigned = ""
+	// Bunny signs URLs the way BunnyCDN's token authentication expects.
+	Bunny = "bunny"
+	// CloudFront signs URLs with a canned policy and an RSA key pair.
+	CloudFront = "cloudfront"
+)
+
+// KeyField is the field in a track's metadata holding the storage key of its audio, if it isn't just its ID.
+const KeyField = "key"
+
+type Options struct {
+	// Scheme is one of Unsigned, Bunny or CloudFront.
+	Scheme string
+	// Key is the security key for Bunny, or the path to a PEM private key for CloudFront.
+	Key string
+	// KeyID is the CloudFront key pair ID.
+	KeyID string
+	// TTL is how long signed URLs last for.
+	TTL time.Duration
+}
+
+// Builder turns track IDs into URLs players can fetch them from.
+type Builder struct {
+	root string
+
+	mu         sync.RWMutex
+	options    Options
+	cloudFront *sign.URLSigner
+}
+
+func New(root string, options Options) (*Builder, error) {
+	b := &Builder{root: root}
+	if err := b.Update(options); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Update changes how URLs are signed from now on, say to rotate keys. URLs we've already handed out work for as
+// long as the CDN still accepts whatever signed them. If the new options are no good, nothing changes.
+func (b *Builder) Update(options Options) error {
+	var cloudFront *sign.URLSigner
+	switch options.Scheme {
+	case Unsigned:
+	case Bunny:
+		if options.Key == "" {
+			return fmt.Errorf("bunny URL signing needs a key")
+		}
+	case CloudFront:
+		if options.KeyID == "" {
+			return fmt.Errorf("cloudfront URL signing needs a key pair ID")
+		}
+		privKey, err := sign.LoadPEMPrivKeyFile(options.Key)
+		if err != nil {
+			return fmt.Errorf("couldn't load cloudfront private key: %v", err)
+		}
+		cloudFront = sign.NewURLSigner(options.KeyID, privKey)
+	default:
+		return fmt.Errorf("unknown URL signing scheme %q", options.Scheme)
+	}
+	if options.Scheme != Unsigned && options.TTL <= 0 {
+		return fmt.Errorf("signed URLs need a positive TTL")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.options = options
+	b.cloudFront = cloudFront
+	return nil
+}
+
+// expiry is when a URL signed now should expire. We round it up to the minute so that everyone asking within the
+// same minute gets the same URL, which is kinder to CDN caches.
+func expiry(ttl time.Duration) time.Time {
+	return time.Now().Add(ttl).Truncate(time.Minute).Add(time.Minute)
+}
+
+// Window says which stretch of time URLs signed now belong to, and when it started, so that anything caching them
+// can tell when they're due to be signed again. It moves on every half TTL, so cached URLs always have at least half
+// their life left. Unsigned URLs never expire, so they're always in window 0, which started at the zero time.
+func (b *Builder) Window() (int64, time.Time) {
+	b.mu.RLock()
+	options := b.options
+	b.mu.RUnlock()
+	if options.Scheme == Unsigned {
+		return 0, time.Time{}
+	}
+	half := options.TTL / 2
+	window := time.Now().UnixNano() / int64(half)
+	return window, time.Unix(0, window*int64(half))
+}
+
+// URL returns the URL for a storage key.
+func (b *Builder) URL(key string) string {
+	unsigned := b.root + key
+	b.mu.RLock()
+	options, cloudFront := b.options, b.cloudFront
+	b.mu.RUnlock()
+	switch options.Scheme {
+	case Bunny:
+		u, err := url.Parse(unsigned)
+		if err != nil {
+			log.Printf("Couldn't parse track URL %q: %v.\n", unsigned, err)
+			return unsigned
+		}
+		expires := strconv.FormatInt(expiry(options.TTL).Unix(), 10)
+		hash := sha256.Sum256([]byte(options.Key + u.Path + expires))
+		q := u.Query()
+		q.Set("token", base64.RawURLEncoding.EncodeToString(hash[:]))
+		q.Set("expires", expires)
+		u.RawQuery = q.Encode()
+		return u.String()
+	case CloudFront:
+		signed, err := cloudFront.Sign(unsigned, expiry(options.TTL))
+		if err != nil {
+			log.Printf("Couldn't sign track URL %q: %v.\n", unsigned, err)
+			return unsigned
+		}
+		return signed
+	}
+	return unsigned
+}
+
+// TrackURL returns the URL for a track given its metadata, which may say its audio lives somewhere other than the
+// default of a key matching its ID.
+func (b *Builder) TrackURL(trackId string, track map[string]string) string {
+	if key := track[KeyField]; key != "" {
+		return b.URL(key)
+	}
+	return b.URL(trackId)
+}
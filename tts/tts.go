@@ -0,0 +1,95 @@
+package tts
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// maxAudioBytes is more than any announcement anyone should be making.
+const maxAudioBytes = 50 << 20
+
+// Synthesizer turns text into speech, returning the audio and its content type.
+type Synthesizer interface {
+	Synthesize(text string) ([]byte, string, error)
+}
+
+// New sets up a synthesizer from a spec. "command:<command line>" runs the command with the text on stdin and takes
+// whatever it writes as the audio (e.g. "command:espeak-ng --stdout"); an http(s) URL gets the text POSTed to it as
+// text/plain and the response is the audio.
+func New(spec string) (Synthesizer, error) {
+	switch {
+	case strings.HasPrefix(spec, "command:"):
+		args := strings.Fields(strings.TrimPrefix(spec, "command:"))
+		if len(args) == 0 {
+			return nil, fmt.Errorf("no TTS command given")
+		}
+		return &command{args: args}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpBackend{url: spec, client: &http.Client{Timeout: time.Minute}}, nil
+	default:
+		return nil, fmt.Errorf("unknown TTS backend %q (want command:... or an http(s) URL)", spec)
+	}
+}
+
+type command struct {
+	args []string
+}
+
+func (c *command) Synthesize(text string) ([]byte, string, error) {
+	cmd := exec.Command(c.args[0], c.args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, "", fmt.Errorf("%s failed: %v: %s", c.args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, "", fmt.Errorf("%s didn't produce any audio", c.args[0])
+	}
+	return stdout.Bytes(), contentType(stdout.Bytes(), ""), nil
+}
+
+type httpBackend struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpBackend) Synthesize(text string) ([]byte, string, error) {
+	resp, err := h.client.Post(h.url, "text/plain; charset=utf-8", strings.NewReader(text))
+	if err != nil {
+		return nil, "", fmt.Errorf("TTS request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAudioBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("reading TTS response failed: %v", err)
+	}
+	if len(body) > maxAudioBytes {
+		return nil, "", fmt.Errorf("TTS backend sent over %d bytes of audio", maxAudioBytes)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("TTS backend said %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, contentType(body, resp.Header.Get("Content-Type")), nil
+}
+
+// contentType believes what we were told if it's audio, and otherwise has a look for itself.
+func contentType(audio []byte, claimed string) string {
+	if t, _, err := mime.ParseMediaType(claimed); err == nil && strings.HasPrefix(t, "audio/") {
+		return t
+	}
+	t := http.DetectContentType(audio)
+	if t == "audio/wave" {
+		// what everyone else calls it.
+		return "audio/wav"
+	}
+	return t
+}
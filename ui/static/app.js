@@ -0,0 +1,296 @@
+'use strict';
+
+// The API authenticates with a password query parameter, so we pass along whatever we were loaded with.
+const password = new URLSearchParams(location.search).get('password');
+
+function apiURL(path, params) {
+    const url = new URL(path, location.href);
+    for (const [k, v] of Object.entries(params || {})) {
+        url.searchParams.set(k, v);
+    }
+    if (password) {
+        url.searchParams.set('password', password);
+    }
+    return url;
+}
+
+// logIdBefore says whether event log ID a (like 1700000000000-0) comes before b. Not having one at all comes before
+// everything.
+function logIdBefore(a, b) {
+    if (!a) {
+        return true;
+    }
+    const [aTime, aSeq] = a.split('-').map(Number);
+    const [bTime, bSeq] = b.split('-').map(Number);
+    return aTime < bTime || (aTime === bTime && aSeq < bSeq);
+}
+
+// subscribe listens to event channels, passing each event to onEvent. The server's heartbeats say which event it
+// last sent on each channel, so if we never saw it, something went missing and we resync instead. If the connection
+// drops, we reconnect with our session, so the server can send whatever we missed.
+function subscribe(channels, onEvent, resync) {
+    const subscription = {closed: false};
+    let session = null;
+    let seen = {};
+    const connect = () => {
+        // The channels are for if the session has expired.
+        const source = new EventSource(apiURL('/api/events', session ? {channels, session} : {channels}));
+        subscription.source = source;
+        source.onmessage = e => {
+            const event = JSON.parse(e.data);
+            if (event.event === 'session') {
+                session = event.session;
+                seen = {};
+                return;
+            }
+            if (event.event === 'resync') {
+                resync();
+                return;
+            }
+            if (event.event !== 'heartbeat') {
+                const i = e.lastEventId.lastIndexOf(':');
+                if (i > 0 && event.eventId) {
+                    seen[e.lastEventId.slice(0, i)] = event.eventId;
+                }
+                onEvent(event);
+                return;
+            }
+            const skew = Date.now() - event.serverTime;
+            if (Math.abs(skew) > 5000) {
+                console.warn(`Our clock is ${skew}ms off the server's, or events are arriving late.`);
+            }
+            const missed = Object.entries(event.lastEventIds || {}).some(([channel, id]) => logIdBefore(seen[channel], id));
+            Object.assign(seen, event.lastEventIds);
+            if (missed) {
+                resync();
+            }
+        };
+        // EventSource would reconnect by itself, but without our session.
+        source.onerror = () => {
+            source.close();
+            if (!subscription.closed) {
+                setTimeout(connect, 2000);
+            }
+        };
+    };
+    subscription.close = () => {
+        subscription.closed = true;
+        subscription.source.close();
+    };
+    connect();
+    return subscription;
+}
+
+async function api(method, path, form, params, headers) {
+    const options = {method, headers};
+    if (form) {
+        options.body = new URLSearchParams(form);
+    }
+    const response = await fetch(apiURL(path, params), options);
+    if (!response.ok) {
+        throw new Error(`${method} ${path} failed: ${await response.text()}`);
+    }
+    const text = await response.text();
+    return text ? JSON.parse(text) : {};
+}
+
+let library = {};
+let currentStream = null;
+// revision is the stream state revision we last saw, so our changes don't clobber anyone else's.
+let revision = null;
+let events = null;
+
+function describe(track) {
+    if (!track) {
+        return 'Nothing';
+    }
+    return `${track.title || 'Untitled'} - ${track.artist || 'Unknown artist'}`;
+}
+
+async function loadLibrary() {
+    library = (await api('GET', '/api/tracks')).tracks;
+    renderLibrary();
+}
+
+function renderLibrary() {
+    const filter = document.getElementById('filter').value.toLowerCase();
+    const list = document.getElementById('library');
+    list.innerHTML = '';
+    const tracks = Object.values(library).sort((a, b) => describe(a).localeCompare(describe(b)));
+    for (const track of tracks) {
+        if (filter && !describe(track).toLowerCase().includes(filter)) {
+            continue;
+        }
+        const li = document.createElement('li');
+        li.textContent = describe(track);
+        li.title = 'Add to up next';
+        li.addEventListener('click', () => enqueue(track.trackId));
+        list.appendChild(li);
+    }
+}
+
+async function loadStreams() {
+    const streams = (await api('GET', '/api/streams/state')).streams;
+    const list = document.getElementById('stream-list');
+    list.innerHTML = '';
+    for (const name of Object.keys(streams).sort()) {
+        const li = document.createElement('li');
+        li.textContent = name;
+        li.classList.toggle('selected', name === currentStream);
+        li.addEventListener('click', () => selectStream(name));
+        list.appendChild(li);
+    }
+}
+
+function selectStream(name) {
+    currentStream = name;
+    document.getElementById('stream').hidden = false;
+    document.getElementById('stream-name').textContent = name;
+    if (events) {
+        events.close();
+    }
+    events = subscribe(`events-${name},events`, () => refresh(), refresh);
+    loadStreams();
+    refresh();
+    heartbeat();
+}
+
+async function refresh() {
+    if (!currentStream) {
+        return;
+    }
+    const stream = encodeURIComponent(currentStream);
+    const [state, upNext, settings, listeners] = await Promise.all([
+        api('GET', `/api/streams/${stream}/state`),
+        api('GET', `/api/streams/${stream}/upnext`),
+        api('GET', `/api/streams/${stream}/settings`),
+        api('GET', `/api/streams/${stream}/listeners`),
+    ]);
+    revision = state.state.revision;
+    const playing = state.state.playing === 'true' ? 'Playing' : 'Paused';
+    document.getElementById('now-playing').textContent = `${playing}: ${describe(state.state.currentTrack)}`;
+    const latest = listeners.listeners[listeners.listeners.length - 1];
+    const peak = Math.max(0, ...listeners.listeners.map(s => s.listeners));
+    document.getElementById('listeners').textContent = latest
+        ? `Listeners: ${latest.listeners} (peak ${peak} in the last day)`
+        : 'Listeners: unknown';
+    document.getElementById('autoplay').checked = settings.settings.autoplay;
+
+    const list = document.getElementById('up-next');
+    list.innerHTML = '';
+    upNext.upNext.forEach((trackId, index) => {
+        const li = document.createElement('li');
+        if (!trackId) {
+            li.className = 'tombstone';
+        } else {
+            const note = upNext.entries[index].note;
+            li.textContent = describe(library[trackId]) + (note ? ` (${note}) ` : ' ');
+            const remove = document.createElement('button');
+            remove.textContent = 'Remove';
+            remove.addEventListener('click', () => streamAPI('DELETE', 'upnext', null, {index}));
+            li.appendChild(remove);
+        }
+        list.appendChild(li);
+    });
+}
+
+function streamAPI(method, path, form, params, headers) {
+    return api(method, `/api/streams/${encodeURIComponent(currentStream)}/${path}`, form, params, headers)
+        .then(refresh)
+        .catch(e => alert(e.message));
+}
+
+function enqueue(trackId) {
+    if (currentStream) {
+        streamAPI('PUT', 'upnext', {trackId});
+    }
+}
+
+async function upload(event) {
+    event.preventDefault();
+    const status = document.getElementById('upload-status');
+    const files = document.getElementById('upload-file').files;
+    for (const [i, file] of Array.from(files).entries()) {
+        status.textContent = `Uploading ${i + 1} of ${files.length}...`;
+        const response = await fetch(apiURL('/api/tracks'), {method: 'PUT', body: file});
+        if (!response.ok) {
+            status.textContent = `Uploading ${file.name} failed: ${await response.text()}`;
+            return;
+        }
+    }
+    status.textContent = 'Done.';
+    loadLibrary();
+}
+
+const chatName = document.getElementById('chat-name');
+chatName.value = localStorage.getItem('operatorName') || '';
+
+function renderPresent(present) {
+    const list = document.getElementById('chat-present');
+    list.innerHTML = '';
+    for (const operator of present) {
+        const li = document.createElement('li');
+        li.textContent = operator.status ? `${operator.name}: ${operator.status}` : operator.name;
+        list.appendChild(li);
+    }
+}
+
+function addMessage(message) {
+    const list = document.getElementById('chat-messages');
+    const li = document.createElement('li');
+    li.textContent = `${new Date(message.sent).toLocaleTimeString()} ${message.name}: ${message.text}`;
+    list.appendChild(li);
+    list.scrollTop = list.scrollHeight;
+}
+
+// Operators count as present while they have the page open.
+function heartbeat() {
+    const status = currentStream ? `watching ${currentStream}` : '';
+    api('POST', '/api/ops/chat/presence', {name: chatName.value, status}).catch(() => {});
+}
+
+async function syncChat() {
+    const chat = await api('GET', '/api/ops/chat');
+    document.getElementById('chat-messages').innerHTML = '';
+    chat.messages.forEach(addMessage);
+    renderPresent(chat.present);
+}
+
+async function loadChat() {
+    await syncChat();
+    subscribe('ops', event => {
+        if (event.event === 'chatMessage') {
+            addMessage(event.message);
+        } else if (event.event === 'presence') {
+            renderPresent(event.present);
+        }
+    }, syncChat);
+    heartbeat();
+    setInterval(heartbeat, 30000);
+}
+
+document.getElementById('chat-form').addEventListener('submit', event => {
+    event.preventDefault();
+    const text = document.getElementById('chat-text');
+    api('POST', '/api/ops/chat', {name: chatName.value, text: text.value})
+        .then(() => text.value = '')
+        .catch(e => alert(e.message));
+});
+chatName.addEventListener('change', () => {
+    localStorage.setItem('operatorName', chatName.value);
+    heartbeat();
+});
+function patchState(form) {
+    return streamAPI('PATCH', 'state', form, null, {'If-Match': `"${revision}"`});
+}
+
+document.getElementById('play').addEventListener('click', () => patchState({playing: 'true'}));
+document.getElementById('pause').addEventListener('click', () => patchState({playing: 'false'}));
+document.getElementById('skip').addEventListener('click', () => streamAPI('PATCH', 'state', {skip: 'true'}));
+document.getElementById('autoplay').addEventListener('change', e => streamAPI('PATCH', 'settings', {autoplay: e.target.checked}));
+document.getElementById('shuffle').addEventListener('click', () => streamAPI('POST', 'upnext/shuffle'));
+document.getElementById('clear').addEventListener('click', () => streamAPI('POST', 'upnext/clear'));
+document.getElementById('filter').addEventListener('input', renderLibrary);
+document.getElementById('upload').addEventListener('submit', upload);
+
+loadLibrary().then(loadStreams).then(loadChat).catch(e => alert(e.message));
@@ -0,0 +1,60 @@
+package ui
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the built-in control panel. It's just static files talking to the API, so it doesn't need to be
+// behind auth; the API calls it makes are.
+func Handler() http.Handler {
+	// static is known to exist at compile time, so this can't fail.
+	root, _ := fs.Sub(static, "static")
+	return http.FileServer(http.FS(root))
+}
+
+type spaHandler struct {
+	root  http.FileSystem
+	files http.Handler
+}
+
+// ServeHTTP serves files that exist, and index.html for anything else, so that client-side routes survive a reload.
+func (s *spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f, err := s.root.Open(path.Clean("/" + r.URL.Path)); err == nil {
+		_ = f.Close()
+		s.files.ServeHTTP(w, r)
+		return
+	}
+	// Missing assets should still 404, rather than getting HTML that the browser will fail to make sense of.
+	if path.Ext(r.URL.Path) != "" {
+		http.NotFound(w, r)
+		return
+	}
+	index, err := s.root.Open("/index.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer index.Close()
+	stat, err := index.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't stat index.html: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, "index.html", stat.ModTime(), index)
+}
+
+// Dir serves a separately built frontend from a directory, with history API fallback routing.
+func Dir(dir string) http.Handler {
+	root := http.Dir(dir)
+	return &spaHandler{
+		root:  root,
+		files: http.FileServer(root),
+	}
+}
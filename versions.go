@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiVersion is a version of the API that's served by the handlers newAPI sets up under /api, and so can be
+// reached at /api/<name>/ as well.
+type apiVersion struct {
+	Name string
+	// Deprecated is when we deprecated the version, if we have. Responses carry a Deprecation header from then on.
+	Deprecated time.Time
+	// Sunset is when we plan to stop serving the version, if we know.
+	Sunset time.Time
+	// Successor is the version to move to once this one's deprecated.
+	Successor string
+}
+
+// apiVersions are the versions served by the /api handlers. Versions with handlers of their own are mounted under
+// /api/<name>/ directly, and pass straight through.
+var apiVersions = map[string]apiVersion{
+	"v1": {Name: "v1"},
+}
+
+// unversionedAPI is the version that paths without one get, which is what players from before versioning expect.
+// They're deprecated in favour of naming it.
+const unversionedAPI = "v1"
+
+// versioned serves /api/<version>/... from the /api handlers for the versions in apiVersions, and labels every
+// API response with the version that produced it.
+func versioned(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/api/")
+		if rest == r.URL.Path {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Origin") != "" {
+			w.Header().Set("Access-Control-Expose-Headers", "API-Version, Deprecation, Sunset, Link")
+		}
+		name := strings.SplitN(rest, "/", 2)[0]
+		if v, ok := apiVersions[name]; ok {
+			r.URL.Path = "/api/" + strings.TrimPrefix(strings.TrimPrefix(rest, name), "/")
+			r.URL.RawPath = ""
+			versionHeaders(w, v)
+		} else if !isVersionName(name) {
+			w.Header().Set("API-Version", unversionedAPI)
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", `</api/`+unversionedAPI+`/`+rest+`>; rel="successor-version"`)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func versionHeaders(w http.ResponseWriter, v apiVersion) {
+	w.Header().Set("API-Version", v.Name)
+	if !v.Deprecated.IsZero() {
+		w.Header().Set("Deprecation", v.Deprecated.UTC().Format(http.TimeFormat))
+		if v.Successor != "" {
+			w.Header().Set("Link", `</api/`+v.Successor+`/>; rel="successor-version"`)
+		}
+	}
+	if !v.Sunset.IsZero() {
+		w.Header().Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+	}
+}
+
+// isVersionName says whether a path segment looks like a version, like v2, rather than the start of an endpoint.
+func isVersionName(name string) bool {
+	if len(name) < 2 || name[0] != 'v' {
+		return false
+	}
+	for _, c := range name[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
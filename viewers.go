@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PonyFest/music-control/auth"
+	"github.com/PonyFest/music-control/events"
+)
+
+// viewer is a password that only gets to watch some event channels, for things like signage that shouldn't be able
+// to change anything.
+type viewer struct {
+	Name     string
+	Password string
+	Channels []string
+}
+
+type viewerList []viewer
+
+func (v *viewerList) String() string {
+	names := make([]string, len(*v))
+	for i, viewer := range *v {
+		names[i] = viewer.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (v *viewerList) Set(value string) error {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("viewers look like name:password:channel[,channel...], not %q", redactPassword(value))
+	}
+	if parts[0] == auth.RoleAdmin {
+		return fmt.Errorf("%q can't be used as a viewer name", parts[0])
+	}
+	for _, existing := range *v {
+		if existing.Name == parts[0] {
+			return fmt.Errorf("viewer %q is defined twice", parts[0])
+		}
+	}
+	channels := strings.Split(parts[2], ",")
+	for _, channel := range channels {
+		if !events.ValidChannel(channel) {
+			return fmt.Errorf("viewer %q: %q isn't an event channel", parts[0], channel)
+		}
+	}
+	*v = append(*v, viewer{Name: parts[0], Password: parts[1], Channels: channels})
+	return nil
+}
+
+func (v viewerList) access() map[string][]string {
+	access := make(map[string][]string, len(v))
+	for _, viewer := range v {
+		access[viewer.Name] = viewer.Channels
+	}
+	return access
+}
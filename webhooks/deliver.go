@@ -0,0 +1,141 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/PonyFest/music-control/events"
+)
+
+const claimFormat = "webhook-claim-%s"
+
+// maxAttempts is how many times we try a delivery before giving up, doubling the wait each time from a second.
+const maxAttempts = 8
+
+// workers is how many deliveries can be in flight at once, and backlog how many more can wait for one of them.
+// Beyond that, deliveries are dropped rather than piling up behind a slow receiver.
+const (
+	workers = 16
+	backlog = 1024
+)
+
+type delivery struct {
+	webhook *Webhook
+	event   string
+	body    []byte
+}
+
+// Run delivers events to webhooks forever, so run it in a goroutine. It's safe to run on several servers at once:
+// every server sees every event, but only one of them gets to deliver it.
+func (h *Handler) Run() {
+	deliveries := make(chan delivery, backlog)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for d := range deliveries {
+				h.deliver(d.webhook, d.event, d.body)
+			}
+		}()
+	}
+	pubsub := h.redis.PSubscribe(h.channelPrefix+"events", h.channelPrefix+"events-*")
+	defer pubsub.Close()
+	for message := range pubsub.Channel() {
+		var event struct {
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil || event.Event == "" {
+			continue
+		}
+		webhooks, err := h.webhooks()
+		if err != nil {
+			log.Printf("Failed to list webhooks: %v.\n", err)
+			continue
+		}
+		for _, w := range webhooks {
+			if !w.wants(event.Event) || !h.claim(w, message) {
+				continue
+			}
+			select {
+			case deliveries <- delivery{w, event.Event, []byte(message.Payload)}:
+			default:
+				h.redis.HIncrBy(fmt.Sprintf(statusFormat, w.ID), "dropped", 1)
+				log.Printf("Dropping %s for webhook %s, since too many deliveries are waiting.\n", event.Event, w.ID)
+			}
+		}
+	}
+}
+
+// claim makes sure only one server delivers each event. Logged events have IDs, so each one is delivered once
+// however many times the same thing happens. Events that only get published don't, so for those, identical
+// payloads on the same channel are taken to be the same event if they arrive within a few seconds of each other,
+// which is all it takes for every server to hear about it.
+func (h *Handler) claim(w *Webhook, message *redis.Message) bool {
+	if id := events.TaggedID(message.Payload); id != "" {
+		return h.redis.SetNX(fmt.Sprintf(claimFormat, w.ID+"-"+message.Channel+"-"+id), 1, time.Hour).Val()
+	}
+	sum := sha256.Sum256([]byte(w.ID + "\x00" + message.Channel + "\x00" + message.Payload))
+	return h.redis.SetNX(fmt.Sprintf(claimFormat, hex.EncodeToString(sum[:])), 1, 5*time.Second).Val()
+}
+
+// Sign returns the signature we send in X-Webhook-Signature: a hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the
+// webhook's secret. Including the timestamp (also sent, in X-Webhook-Timestamp) lets receivers reject replays.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Handler) deliver(w *Webhook, event string, body []byte) {
+	statusKey := fmt.Sprintf(statusFormat, w.ID)
+	backoff := time.Second
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err := h.post(w, event, body)
+		now := time.Now().Unix()
+		if err == nil {
+			h.redis.HSet(statusKey, "lastAttempt", now, "lastSuccess", now, "consecutiveFailures", 0)
+			h.redis.HIncrBy(statusKey, "delivered", 1)
+			return
+		}
+		h.redis.HSet(statusKey, "lastAttempt", now, "lastError", err.Error(), "lastErrorAt", now)
+		h.redis.HIncrBy(statusKey, "consecutiveFailures", 1)
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	h.redis.HIncrBy(statusKey, "dropped", 1)
+	log.Printf("Giving up delivering %s to webhook %s after %d attempts.\n", event, w.ID, maxAttempts)
+}
+
+func (h *Handler) post(w *Webhook, event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PonyFest-Music-Control-Webhooks")
+	req.Header.Set("X-Webhook-Id", w.ID)
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", Sign(w.Secret, timestamp, body))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+// Package webhooks lets external systems that can't hold an SSE connection open receive events as HTTP POSTs.
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Key is a hash of webhook ID to its JSON-encoded definition.
+const Key = "webhooks"
+const statusFormat = "webhook-status-%s"
+
+// Webhook is somewhere we POST events to. Events is a list of event types to send, or empty for all of them.
+type Webhook struct {
+	ID      string   `json:"id"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Secret  string   `json:"secret,omitempty"`
+	Created int64    `json:"created"`
+}
+
+func (w *Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type Handler struct {
+	mux           *mux.Router
+	redis         *redis.Client
+	channelPrefix string
+	client        *http.Client
+}
+
+// New creates the webhook management API and its dispatcher. Call Run to actually deliver anything.
+func New(redis *redis.Client, channelPrefix string) *Handler {
+	h := &Handler{
+		mux:           mux.NewRouter(),
+		redis:         redis,
+		channelPrefix: channelPrefix,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+	h.mux.HandleFunc("/", h.handleWebhooks).Methods(http.MethodGet, http.MethodPost)
+	h.mux.HandleFunc("/{id}", h.handleWebhook).Methods(http.MethodGet, http.MethodPatch, http.MethodDelete)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) webhooks() ([]*Webhook, error) {
+	entries, err := h.redis.HGetAll(Key).Result()
+	if err != nil {
+		return nil, err
+	}
+	webhooks := make([]*Webhook, 0, len(entries))
+	for _, entry := range entries {
+		var w Webhook
+		if err := json.Unmarshal([]byte(entry), &w); err != nil {
+			return nil, fmt.Errorf("corrupt webhook %q: %v", entry, err)
+		}
+		webhooks = append(webhooks, &w)
+	}
+	return webhooks, nil
+}
+
+func (h *Handler) webhook(id string) (*Webhook, error) {
+	entry, err := h.redis.HGet(Key, id).Result()
+	if err != nil {
+		return nil, err
+	}
+	var w Webhook
+	if err := json.Unmarshal([]byte(entry), &w); err != nil {
+		return nil, fmt.Errorf("corrupt webhook %q: %v", entry, err)
+	}
+	return &w, nil
+}
+
+func (h *Handler) store(w *Webhook) error {
+	j, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return h.redis.HSet(Key, w.ID, j).Err()
+}
+
+// describe is what we show people about a webhook: everything but the secret, plus how delivery is going.
+func (h *Handler) describe(w *Webhook) map[string]interface{} {
+	status := h.redis.HGetAll(fmt.Sprintf(statusFormat, w.ID)).Val()
+	return map[string]interface{}{
+		"id":      w.ID,
+		"url":     w.URL,
+		"events":  w.Events,
+		"created": w.Created,
+		"status":  status,
+	}
+}
+
+// applyForm updates a webhook from `url` and `events` (comma separated) form values, whichever are present.
+func applyForm(w *Webhook, r *http.Request) error {
+	if _, ok := r.Form["url"]; ok {
+		u, err := url.Parse(r.Form.Get("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL %q", r.Form.Get("url"))
+		}
+		w.URL = u.String()
+	}
+	if _, ok := r.Form["events"]; ok {
+		w.Events = nil
+		for _, e := range strings.Split(r.Form.Get("events"), ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				w.Events = append(w.Events, e)
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		webhooks, err := h.webhooks()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list webhooks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		result := make([]map[string]interface{}, len(webhooks))
+		for i, webhook := range webhooks {
+			result[i] = h.describe(webhook)
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "webhooks": result}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("couldn't parse form: %v", err), http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("url") == "" {
+			http.Error(w, "url is required", http.StatusBadRequest)
+			return
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			http.Error(w, fmt.Sprintf("failed to generate a secret: %v", err), http.StatusInternalServerError)
+			return
+		}
+		webhook := &Webhook{
+			ID:      uuid.New().String(),
+			Secret:  hex.EncodeToString(secret),
+			Created: time.Now().Unix(),
+		}
+		if err := applyForm(webhook, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.store(webhook); err != nil {
+			http.Error(w, fmt.Sprintf("failed to store webhook: %v", err), http.StatusInternalServerError)
+			return
+		}
+		// This is the only time anyone gets to see the secret.
+		result := h.describe(webhook)
+		result["secret"] = webhook.Secret
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "webhook": result}); err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func (h *Handler) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	webhook, err := h.webhook(id)
+	if err == redis.Nil {
+		http.Error(w, fmt.Sprintf("no such webhook %q", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case http.MethodPatch:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("couldn't parse form: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := applyForm(webhook, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.store(webhook); err != nil {
+			http.Error(w, fmt.Sprintf("failed to store webhook: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		p := h.redis.TxPipeline()
+		p.HDel(Key, id)
+		p.Del(fmt.Sprintf(statusFormat, id))
+		if _, err := p.Exec(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to delete webhook: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "webhook": h.describe(webhook)}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal json: %v", err), http.StatusInternalServerError)
+		return
+	}
+}